@@ -0,0 +1,78 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archive defines methods for converting snapshots to and from standard archive formats, such as tar and zip files.
+package archive
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Format is a standard archive format.
+type Format int
+
+const (
+	// Tar is an uncompressed tar file.
+	Tar Format = iota
+
+	// TarGzip is a gzip-compressed tar file.
+	TarGzip
+
+	// Zip is a zip file.
+	Zip
+)
+
+// modTime is the modification time recorded for every entry written to an
+// archive, since snapshots do not record one. Using a fixed time makes the
+// archives of a snapshot reproducible, and this is the earliest time that
+// can be represented in a zip file.
+var modTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// FormatForPath returns the archive format implied by the extension of the
+// given path.
+func FormatForPath(p string) (Format, error) {
+	lower := strings.ToLower(p)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return TarGzip, nil
+	case strings.HasSuffix(lower, ".tar"):
+		return Tar, nil
+	case strings.HasSuffix(lower, ".zip"):
+		return Zip, nil
+	}
+	return 0, fmt.Errorf("unsupported archive format for %q; the supported extensions are .tar, .tar.gz, .tgz, and .zip", p)
+}
+
+// cleanEntryName validates and normalizes the name of an archive entry,
+// which must be a relative path that stays within the archive.
+//
+// Leading "./" elements are ignored, and names that refer to the root of
+// the archive are returned as the empty name.
+func cleanEntryName(name string) (string, error) {
+	trimmed := strings.Trim(name, "/")
+	for strings.HasPrefix(trimmed, "./") {
+		trimmed = strings.TrimLeft(trimmed[2:], "/")
+	}
+	if len(trimmed) == 0 || trimmed == "." {
+		return "", nil
+	}
+	cleaned := path.Clean(trimmed)
+	if strings.HasPrefix(name, "/") || cleaned != trimmed || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid archive entry name %q", name)
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,350 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archive defines methods for converting snapshots to and from standard archive formats, such as tar and zip files.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+// defaultDirPerm is the permissions given to directories that are implied
+// by the entries of an archive but do not have entries of their own.
+const defaultDirPerm = 0755
+
+// node is a file in the tree described by the entries of an archive.
+type node struct {
+	mode os.FileMode
+
+	// contents is the object holding the contents of a regular file or
+	// the target of a symbolic link.
+	contents *snapshot.Hash
+
+	// children holds the contents of a directory.
+	children map[string]*node
+}
+
+func newDirNode(perm os.FileMode) *node {
+	return &node{
+		mode:     fs.ModeDir | perm,
+		children: make(map[string]*node),
+	}
+}
+
+// subdir returns the child directory with the given name, creating it if
+// it does not already exist.
+func (n *node) subdir(name string) (*node, error) {
+	child, ok := n.children[name]
+	if !ok {
+		child = newDirNode(defaultDirPerm)
+		n.children[name] = child
+		return child, nil
+	}
+	if !child.mode.IsDir() {
+		return nil, fmt.Errorf("%q is not a directory", name)
+	}
+	return child, nil
+}
+
+// store stores the snapshot of the node and all of its children.
+//
+// Mirroring how snapshots of local files are taken, the corresponding
+// snapshot in the previous version of the tree, if there is one, is used
+// as the parent of the new snapshot, or reused as-is if it is unchanged.
+func (n *node) store(ctx context.Context, s *storage.LocalFiles, prevHash *snapshot.Hash, prev *snapshot.File) (*snapshot.Hash, error) {
+	contents := n.contents
+	if n.mode.IsDir() {
+		var prevTree snapshot.Tree
+		if prev != nil && prev.IsDir() {
+			var err error
+			prevTree, err = s.ListDirectorySnapshotContents(ctx, prevHash, prev)
+			if err != nil {
+				return nil, fmt.Errorf("failure reading the contents of the directory snapshot %q: %v", prevHash, err)
+			}
+		}
+		tree := make(snapshot.Tree)
+		for name, child := range n.children {
+			childPrevHash := prevTree[snapshot.Path(name)]
+			var childPrev *snapshot.File
+			if childPrevHash != nil {
+				var err error
+				childPrev, err = s.ReadSnapshot(ctx, childPrevHash)
+				if err != nil {
+					return nil, fmt.Errorf("failure reading the snapshot %q: %v", childPrevHash, err)
+				}
+			}
+			childHash, err := child.store(ctx, s, childPrevHash, childPrev)
+			if err != nil {
+				return nil, err
+			}
+			tree[snapshot.Path(name)] = childHash
+		}
+		treeBytes := []byte(tree.String())
+		var err error
+		contents, err = s.StoreObject(ctx, int64(len(treeBytes)), bytes.NewReader(treeBytes))
+		if err != nil {
+			return nil, fmt.Errorf("failure storing the contents of a directory: %v", err)
+		}
+	}
+	modeLine := n.mode.String()
+	if prev != nil && prev.Mode == modeLine && prev.Contents.Equal(contents) {
+		return prevHash, nil
+	}
+	f := &snapshot.File{
+		Contents: contents,
+		Mode:     modeLine,
+	}
+	if prevHash != nil {
+		f.Parents = []*snapshot.Hash{prevHash}
+	}
+	fileBytes := []byte(f.String())
+	h, err := s.StoreObject(ctx, int64(len(fileBytes)), bytes.NewReader(fileBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failure storing the file metadata for %+v: %v", f, err)
+	}
+	return h, nil
+}
+
+// importer builds a tree of nodes from the entries of an archive.
+type importer struct {
+	ctx  context.Context
+	s    *storage.LocalFiles
+	root *node
+}
+
+// parentDir returns the directory holding the entry with the given name,
+// along with the base name of the entry.
+func (im *importer) parentDir(name string) (*node, string, error) {
+	dir, base := path.Split(name)
+	n := im.root
+	if len(dir) == 0 {
+		return n, base, nil
+	}
+	for _, elem := range strings.Split(strings.TrimSuffix(dir, "/"), "/") {
+		var err error
+		if n, err = n.subdir(elem); err != nil {
+			return nil, "", fmt.Errorf("invalid archive entry %q: %v", name, err)
+		}
+	}
+	return n, base, nil
+}
+
+func (im *importer) addDir(name string, perm os.FileMode) error {
+	if len(name) == 0 {
+		im.root.mode = fs.ModeDir | perm.Perm()
+		return nil
+	}
+	parent, base, err := im.parentDir(name)
+	if err != nil {
+		return err
+	}
+	d, err := parent.subdir(base)
+	if err != nil {
+		return fmt.Errorf("invalid archive entry %q: %v", name, err)
+	}
+	d.mode = fs.ModeDir | perm.Perm()
+	return nil
+}
+
+// addObject adds a regular file or symbolic link whose contents, or link
+// target, are read from the given reader.
+func (im *importer) addObject(name string, mode os.FileMode, size int64, r io.Reader) error {
+	if len(name) == 0 {
+		return fmt.Errorf("the root of the archive must be a directory")
+	}
+	parent, base, err := im.parentDir(name)
+	if err != nil {
+		return err
+	}
+	if existing, ok := parent.children[base]; ok && existing.mode.IsDir() {
+		return fmt.Errorf("invalid archive entry %q: it conflicts with an earlier directory entry", name)
+	}
+	h, err := im.s.StoreObject(im.ctx, size, r)
+	if err != nil {
+		return fmt.Errorf("failure storing the contents of the archive entry %q: %v", name, err)
+	}
+	parent.children[base] = &node{mode: mode, contents: h}
+	return nil
+}
+
+// addHardLink adds a file with the same mode and contents as the earlier
+// entry named by the target.
+func (im *importer) addHardLink(name, target string) error {
+	targetName, err := cleanEntryName(target)
+	if err != nil {
+		return err
+	}
+	targetParent, targetBase, err := im.parentDir(targetName)
+	if err != nil {
+		return err
+	}
+	targetNode, ok := targetParent.children[targetBase]
+	if !ok || targetNode.mode.IsDir() {
+		return fmt.Errorf("invalid archive entry %q: the link target %q is not an earlier file entry", name, target)
+	}
+	parent, base, err := im.parentDir(name)
+	if err != nil {
+		return err
+	}
+	if existing, ok := parent.children[base]; ok && existing.mode.IsDir() {
+		return fmt.Errorf("invalid archive entry %q: it conflicts with an earlier directory entry", name)
+	}
+	parent.children[base] = &node{mode: targetNode.mode, contents: targetNode.contents}
+	return nil
+}
+
+func (im *importer) readTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failure reading the tar archive: %v", err)
+		}
+		name, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		perm := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = im.addDir(name, perm)
+		case tar.TypeReg, tar.TypeRegA:
+			err = im.addObject(name, perm, hdr.Size, tr)
+		case tar.TypeSymlink:
+			err = im.addObject(name, fs.ModeSymlink|0777, int64(len(hdr.Linkname)), strings.NewReader(hdr.Linkname))
+		case tar.TypeLink:
+			err = im.addHardLink(name, hdr.Linkname)
+		case tar.TypeXGlobalHeader:
+			// Global headers only hold metadata about the archive.
+		default:
+			err = fmt.Errorf("unsupported type %q for the archive entry %q", hdr.Typeflag, hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (im *importer) readZip(zr *zip.Reader) error {
+	for _, zf := range zr.File {
+		name, err := cleanEntryName(zf.Name)
+		if err != nil {
+			return err
+		}
+		mode := zf.Mode()
+		if mode.IsDir() || strings.HasSuffix(zf.Name, "/") {
+			if err := im.addDir(name, mode.Perm()); err != nil {
+				return err
+			}
+			continue
+		}
+		if mode&fs.ModeSymlink != 0 {
+			mode = fs.ModeSymlink | 0777
+		} else if mode.IsRegular() {
+			mode = mode.Perm()
+		} else {
+			return fmt.Errorf("unsupported mode %v for the archive entry %q", mode, zf.Name)
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("failure opening the archive entry %q: %v", zf.Name, err)
+		}
+		err = im.addObject(name, mode, int64(zf.UncompressedSize64), r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *importer) readFile(f *os.File, format Format) error {
+	switch format {
+	case Zip:
+		info, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("failure reading the size of the archive: %v", err)
+		}
+		zr, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return fmt.Errorf("failure reading the zip archive: %v", err)
+		}
+		return im.readZip(zr)
+	case TarGzip:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("failure reading the gzip stream: %v", err)
+		}
+		return im.readTar(gz)
+	}
+	return im.readTar(f)
+}
+
+// Import builds a snapshot of the files in the archive at the given path,
+// storing their contents directly from the archive entries.
+//
+// The format of the archive is chosen based on the extension of the path,
+// as with `FormatForPath`. The archive is treated as the contents of a
+// directory, and the hash of the snapshot of that directory is returned.
+// If a parent snapshot is given, then it is recorded as the parent of the
+// new snapshot, and each nested file's snapshot uses the snapshot at the
+// same path in the parent as its own parent.
+//
+// File permissions and symbolic links are preserved. Hard links are
+// imported as copies of the files they link to, and other special files
+// are rejected.
+//
+// Neither the local filesystem nor the mappings from local paths to
+// snapshots are modified.
+func Import(ctx context.Context, s *storage.LocalFiles, archivePath string, parent *snapshot.Hash) (*snapshot.Hash, error) {
+	format, err := FormatForPath(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	var prev *snapshot.File
+	if parent != nil {
+		if prev, err = s.ReadSnapshot(ctx, parent); err != nil {
+			return nil, fmt.Errorf("failure reading the parent snapshot %q: %v", parent, err)
+		}
+	}
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failure opening the archive %q: %v", archivePath, err)
+	}
+	defer f.Close()
+	im := &importer{
+		ctx:  ctx,
+		s:    s,
+		root: newDirNode(defaultDirPerm),
+	}
+	if err := im.readFile(f, format); err != nil {
+		return nil, fmt.Errorf("failure importing the archive %q: %v", archivePath, err)
+	}
+	return im.root.store(ctx, s, parent, prev)
+}
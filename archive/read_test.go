@@ -0,0 +1,173 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archive defines methods for converting snapshots to and from standard archive formats, such as tar and zip files.
+package archive
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+func writeTestTar(t *testing.T, archivePath string, headers []*tar.Header, contents map[string]string) {
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatalf("failure creating the test archive: %v", err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, hdr := range headers {
+		hdr.Size = int64(len(contents[hdr.Name]))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("failure writing the header for %q: %v", hdr.Name, err)
+		}
+		if _, err := tw.Write([]byte(contents[hdr.Name])); err != nil {
+			t.Fatalf("failure writing the contents of %q: %v", hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failure finishing the test archive: %v", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	archiveDir := filepath.Join(t.TempDir(), "archive")
+	s := &storage.LocalFiles{ArchiveDir: archiveDir}
+
+	workDir := filepath.Join(t.TempDir(), "workDir")
+	if err := os.MkdirAll(filepath.Join(workDir, "bin"), 0755); err != nil {
+		t.Fatalf("failure creating the work dir: %v", err)
+	}
+	if err := os.Chmod(workDir, defaultDirPerm); err != nil {
+		t.Fatalf("failure setting the permissions of the work dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(workDir, "hello.txt"), []byte("Hello, World!"), 0644); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(workDir, "bin", "run.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("failure creating the example script: %v", err)
+	}
+	if err := os.Symlink("hello.txt", filepath.Join(workDir, "link")); err != nil {
+		t.Fatalf("failure creating the example symlink: %v", err)
+	}
+	h, f, err := snapshot.Current(ctx, s, snapshot.Path(workDir))
+	if err != nil {
+		t.Fatalf("failure snapshotting the work dir: %v", err)
+	}
+
+	// Importing an archive of a snapshot reproduces that snapshot.
+	for _, name := range []string{"out.tar", "out.tar.gz", "out.zip"} {
+		archivePath := filepath.Join(t.TempDir(), name)
+		format, err := FormatForPath(archivePath)
+		if err != nil {
+			t.Fatalf("failure determining the format of %q: %v", name, err)
+		}
+		out, err := os.Create(archivePath)
+		if err != nil {
+			t.Fatalf("failure creating the archive %q: %v", name, err)
+		}
+		if err := Write(ctx, s, h, out, format, ""); err != nil {
+			t.Fatalf("failure writing the archive %q: %v", name, err)
+		}
+		if err := out.Close(); err != nil {
+			t.Fatalf("failure closing the archive %q: %v", name, err)
+		}
+		imported, err := Import(ctx, s, archivePath, nil)
+		if err != nil {
+			t.Fatalf("failure importing the archive %q: %v", name, err)
+		}
+		if !imported.Equal(h) {
+			t.Errorf("unexpected snapshot imported from %q: got %q, want %q", name, imported, h)
+		}
+	}
+
+	// Importing with a parent records the history of each changed file.
+	updated := filepath.Join(t.TempDir(), "updated.tar")
+	writeTestTar(t, updated, []*tar.Header{
+		{Typeflag: tar.TypeReg, Name: "./hello.txt", Mode: 0644},
+		{Typeflag: tar.TypeReg, Name: "./bin/run.sh", Mode: 0755},
+		{Typeflag: tar.TypeSymlink, Name: "./link", Linkname: "hello.txt"},
+		{Typeflag: tar.TypeLink, Name: "./copy.txt", Linkname: "./hello.txt"},
+	}, map[string]string{
+		"./hello.txt":  "Goodbye, World!",
+		"./bin/run.sh": "#!/bin/sh\n",
+	})
+	imported, err := Import(ctx, s, updated, h)
+	if err != nil {
+		t.Fatalf("failure importing the updated archive: %v", err)
+	}
+	root, err := s.ReadSnapshot(ctx, imported)
+	if err != nil {
+		t.Fatalf("failure reading the imported snapshot: %v", err)
+	}
+	if len(root.Parents) != 1 || !root.Parents[0].Equal(h) {
+		t.Errorf("unexpected parents for the imported snapshot: got %v, want [%q]", root.Parents, h)
+	}
+	prevTree, err := s.ListDirectorySnapshotContents(ctx, h, f)
+	if err != nil {
+		t.Fatalf("failure listing the original snapshot: %v", err)
+	}
+	tree, err := s.ListDirectorySnapshotContents(ctx, imported, root)
+	if err != nil {
+		t.Fatalf("failure listing the imported snapshot: %v", err)
+	}
+	if !tree["bin"].Equal(prevTree["bin"]) || !tree["link"].Equal(prevTree["link"]) {
+		t.Errorf("unchanged children were not reused: got %v, want %v", tree, prevTree)
+	}
+	hello, err := s.ReadSnapshot(ctx, tree["hello.txt"])
+	if err != nil {
+		t.Fatalf("failure reading the updated file snapshot: %v", err)
+	}
+	if len(hello.Parents) != 1 || !hello.Parents[0].Equal(prevTree["hello.txt"]) {
+		t.Errorf("unexpected parents for the updated file: got %v, want [%q]", hello.Parents, prevTree["hello.txt"])
+	}
+	copied, err := s.ReadSnapshot(ctx, tree["copy.txt"])
+	if err != nil {
+		t.Fatalf("failure reading the hard linked file snapshot: %v", err)
+	}
+	if !copied.Contents.Equal(hello.Contents) || len(copied.Parents) != 0 {
+		t.Errorf("unexpected snapshot for the hard linked file: %+v", copied)
+	}
+
+	// The local path mappings are left untouched.
+	if current, _, err := s.FindSnapshot(ctx, snapshot.Path(workDir)); err != nil || !current.Equal(h) {
+		t.Errorf("unexpected snapshot for the work dir after importing: got %q, %v, want %q", current, err, h)
+	}
+
+	for name, headers := range map[string][]*tar.Header{
+		"escape.tar": {
+			{Typeflag: tar.TypeReg, Name: "../escape.txt", Mode: 0644},
+		},
+		"through-link.tar": {
+			{Typeflag: tar.TypeSymlink, Name: "dir", Linkname: "/etc"},
+			{Typeflag: tar.TypeReg, Name: "dir/passwd", Mode: 0644},
+		},
+		"fifo.tar": {
+			{Typeflag: tar.TypeFifo, Name: "fifo", Mode: 0644},
+		},
+	} {
+		archivePath := filepath.Join(t.TempDir(), name)
+		writeTestTar(t, archivePath, headers, nil)
+		if _, err := Import(ctx, s, archivePath, nil); err == nil {
+			t.Errorf("unexpected success importing the invalid archive %q", name)
+		}
+	}
+}
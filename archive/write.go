@@ -0,0 +1,275 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archive defines methods for converting snapshots to and from standard archive formats, such as tar and zip files.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+// entryWriter writes the entries of an archive in a specific format.
+type entryWriter interface {
+	writeDir(name string, perm os.FileMode) error
+	writeLink(name, target string) error
+	writeFile(name string, perm os.FileMode, size int64, r io.Reader) error
+	close() error
+}
+
+type tarEntryWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (t *tarEntryWriter) writeDir(name string, perm os.FileMode) error {
+	return t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     int64(perm),
+		ModTime:  modTime,
+	})
+}
+
+func (t *tarEntryWriter) writeLink(name, target string) error {
+	return t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  modTime,
+	})
+}
+
+func (t *tarEntryWriter) writeFile(name string, perm os.FileMode, size int64, r io.Reader) error {
+	if err := t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     int64(perm),
+		ModTime:  modTime,
+	}); err != nil {
+		return err
+	}
+	_, err := io.Copy(t.tw, r)
+	return err
+}
+
+func (t *tarEntryWriter) close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	if t.gz != nil {
+		return t.gz.Close()
+	}
+	return nil
+}
+
+type zipEntryWriter struct {
+	zw *zip.Writer
+}
+
+func (z *zipEntryWriter) create(name string, mode os.FileMode, method uint16) (io.Writer, error) {
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   method,
+		Modified: modTime,
+	}
+	header.SetMode(mode)
+	return z.zw.CreateHeader(header)
+}
+
+func (z *zipEntryWriter) writeDir(name string, perm os.FileMode) error {
+	_, err := z.create(name+"/", fs.ModeDir|perm, zip.Store)
+	return err
+}
+
+func (z *zipEntryWriter) writeLink(name, target string) error {
+	w, err := z.create(name, fs.ModeSymlink|0777, zip.Store)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, target)
+	return err
+}
+
+func (z *zipEntryWriter) writeFile(name string, perm os.FileMode, size int64, r io.Reader) error {
+	w, err := z.create(name, perm, zip.Deflate)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (z *zipEntryWriter) close() error {
+	return z.zw.Close()
+}
+
+func newEntryWriter(w io.Writer, format Format) (entryWriter, error) {
+	switch format {
+	case Tar:
+		return &tarEntryWriter{tw: tar.NewWriter(w)}, nil
+	case TarGzip:
+		gz := gzip.NewWriter(w)
+		return &tarEntryWriter{tw: tar.NewWriter(gz), gz: gz}, nil
+	case Zip:
+		return &zipEntryWriter{zw: zip.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unsupported archive format %d", format)
+}
+
+// readObject opens the given object along with its size.
+//
+// The size of an object is only known ahead of time if it is stored
+// unencrypted, so other objects are read through once to measure them
+// before being opened again. This takes longer than copying them to a
+// temporary file, but does not store their plaintext outside the archive.
+func readObject(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash) (io.ReadCloser, int64, error) {
+	r, err := s.ReadObject(ctx, h)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failure opening the object %q: %v", h, err)
+	}
+	if f, ok := r.(*os.File); ok {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, fmt.Errorf("failure reading the size of the object %q: %v", h, err)
+		}
+		return f, info.Size(), nil
+	}
+	size, err := io.Copy(io.Discard, r)
+	r.Close()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failure reading the object %q: %v", h, err)
+	}
+	if r, err = s.ReadObject(ctx, h); err != nil {
+		return nil, 0, fmt.Errorf("failure opening the object %q: %v", h, err)
+	}
+	return r, size, nil
+}
+
+// Write writes the files in the given snapshot to an archive in the given
+// format, reading them directly from storage.
+//
+// If the snapshot is of a directory, then its contents are written under
+// the directory named by the prefix, or at the top level of the archive if
+// the prefix is empty. Otherwise, the prefix is required and is used as the
+// name of the single file in the archive.
+//
+// The permissions of files and directories, and the targets of symbolic
+// links, are preserved. Since snapshots do not record modification times,
+// every entry is given the same, fixed modification time.
+func Write(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, w io.Writer, format Format, prefix string) error {
+	name, err := cleanEntryName(prefix)
+	if err != nil {
+		return fmt.Errorf("invalid prefix: %v", err)
+	}
+	f, err := s.ReadSnapshot(ctx, h)
+	if err != nil {
+		return fmt.Errorf("failure reading the snapshot %q: %v", h, err)
+	}
+	if !f.IsDir() && len(name) == 0 {
+		return fmt.Errorf("the snapshot %q is not of a directory, so a prefix is required to name it", h)
+	}
+	ew, err := newEntryWriter(w, format)
+	if err != nil {
+		return err
+	}
+	if err := writeEntries(ctx, s, ew, name, h, f); err != nil {
+		ew.close()
+		return err
+	}
+	if err := ew.close(); err != nil {
+		return fmt.Errorf("failure finishing the archive: %v", err)
+	}
+	return nil
+}
+
+// writeEntries writes the entry for the given snapshot, and the entries for
+// its children if it is a directory.
+func writeEntries(ctx context.Context, s *storage.LocalFiles, ew entryWriter, name string, h *snapshot.Hash, f *snapshot.File) error {
+	if f.IsLink() {
+		r, err := s.ReadObject(ctx, f.Contents)
+		if err != nil {
+			return fmt.Errorf("failure opening the target of the link snapshot %q: %v", h, err)
+		}
+		defer r.Close()
+		target, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("failure reading the target of the link snapshot %q: %v", h, err)
+		}
+		if err := ew.writeLink(name, string(target)); err != nil {
+			return fmt.Errorf("failure writing the archive entry for the link %q: %v", name, err)
+		}
+		return nil
+	}
+	if !f.IsDir() {
+		if f.Contents == nil {
+			return ew.writeFile(name, f.Permissions(), 0, eofReader{})
+		}
+		r, size, err := readObject(ctx, s, f.Contents)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if err := ew.writeFile(name, f.Permissions(), size, r); err != nil {
+			return fmt.Errorf("failure writing the archive entry for the file %q: %v", name, err)
+		}
+		return nil
+	}
+	if len(name) > 0 {
+		if err := ew.writeDir(name, f.Permissions()); err != nil {
+			return fmt.Errorf("failure writing the archive entry for the directory %q: %v", name, err)
+		}
+	}
+	tree, err := s.ListDirectorySnapshotContents(ctx, h, f)
+	if err != nil {
+		return fmt.Errorf("failure reading the contents of the directory snapshot %q: %v", h, err)
+	}
+	var children []string
+	for child := range tree {
+		children = append(children, string(child))
+	}
+	sort.Strings(children)
+	for _, child := range children {
+		childHash := tree[snapshot.Path(child)]
+		childFile, err := s.ReadSnapshot(ctx, childHash)
+		if err != nil {
+			return fmt.Errorf("failure reading the snapshot %q: %v", childHash, err)
+		}
+		if err := writeEntries(ctx, s, ew, path.Join(name, child), childHash, childFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eofReader is an empty reader.
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
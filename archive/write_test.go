@@ -0,0 +1,182 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archive defines methods for converting snapshots to and from standard archive formats, such as tar and zip files.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+// testEntry is the parsed form of an archive entry.
+type testEntry struct {
+	mode     fs.FileMode
+	contents string
+}
+
+func readTestArchive(t *testing.T, format Format, data []byte) map[string]testEntry {
+	entries := make(map[string]testEntry)
+	if format == Zip {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("failure reading the zip archive: %v", err)
+		}
+		for _, zf := range zr.File {
+			r, err := zf.Open()
+			if err != nil {
+				t.Fatalf("failure opening the zip entry %q: %v", zf.Name, err)
+			}
+			contents, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("failure reading the zip entry %q: %v", zf.Name, err)
+			}
+			entries[zf.Name] = testEntry{mode: zf.Mode(), contents: string(contents)}
+		}
+		return entries
+	}
+	var r io.Reader = bytes.NewReader(data)
+	if format == TarGzip {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatalf("failure reading the gzip stream: %v", err)
+		}
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failure reading the tar archive: %v", err)
+		}
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("failure reading the tar entry %q: %v", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			contents = []byte(hdr.Linkname)
+		}
+		entries[hdr.Name] = testEntry{mode: hdr.FileInfo().Mode(), contents: string(contents)}
+	}
+	return entries
+}
+
+func TestWrite(t *testing.T) {
+	ctx := context.Background()
+	archiveDir := filepath.Join(t.TempDir(), "archive")
+	s := &storage.LocalFiles{ArchiveDir: archiveDir}
+
+	workDir := filepath.Join(t.TempDir(), "workDir")
+	if err := os.MkdirAll(filepath.Join(workDir, "bin"), 0755); err != nil {
+		t.Fatalf("failure creating the work dir: %v", err)
+	}
+	// Large objects are stored encrypted, so their sizes are not known
+	// ahead of time.
+	large := strings.Repeat("0123456789abcdef", 128*1024)
+	files := map[string]string{
+		"hello.txt":  "Hello, World!",
+		"bin/run.sh": "#!/bin/sh\necho hello\n",
+		"large.txt":  large,
+	}
+	for name, contents := range files {
+		perm := os.FileMode(0644)
+		if strings.HasPrefix(name, "bin/") {
+			perm = 0755
+		}
+		if err := os.WriteFile(filepath.Join(workDir, name), []byte(contents), perm); err != nil {
+			t.Fatalf("failure creating the example file %q: %v", name, err)
+		}
+	}
+	if err := os.Symlink("hello.txt", filepath.Join(workDir, "link")); err != nil {
+		t.Fatalf("failure creating the example symlink: %v", err)
+	}
+	h, _, err := snapshot.Current(ctx, s, snapshot.Path(workDir))
+	if err != nil {
+		t.Fatalf("failure snapshotting the work dir: %v", err)
+	}
+
+	want := map[string]testEntry{
+		"release/":           {mode: fs.ModeDir | 0755},
+		"release/bin/":       {mode: fs.ModeDir | 0755},
+		"release/bin/run.sh": {mode: 0755, contents: files["bin/run.sh"]},
+		"release/hello.txt":  {mode: 0644, contents: files["hello.txt"]},
+		"release/large.txt":  {mode: 0644, contents: large},
+		"release/link":       {mode: fs.ModeSymlink | 0777, contents: "hello.txt"},
+	}
+	for _, format := range []Format{Tar, TarGzip, Zip} {
+		var buf bytes.Buffer
+		if err := Write(ctx, s, h, &buf, format, "release/"); err != nil {
+			t.Fatalf("failure writing the archive in format %d: %v", format, err)
+		}
+		got := readTestArchive(t, format, buf.Bytes())
+		if len(got) != len(want) {
+			t.Errorf("unexpected entries in format %d: got %d entries, want %d", format, len(got), len(want))
+		}
+		for name, wantEntry := range want {
+			gotEntry, ok := got[name]
+			if !ok {
+				t.Errorf("missing entry %q in format %d", name, format)
+				continue
+			}
+			if gotEntry.mode != wantEntry.mode {
+				t.Errorf("unexpected mode for %q in format %d: got %v, want %v", name, format, gotEntry.mode, wantEntry.mode)
+			}
+			if gotEntry.contents != wantEntry.contents {
+				t.Errorf("unexpected contents for %q in format %d", name, format)
+			}
+		}
+
+		var again bytes.Buffer
+		if err := Write(ctx, s, h, &again, format, "release/"); err != nil {
+			t.Fatalf("failure rewriting the archive in format %d: %v", format, err)
+		}
+		if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+			t.Errorf("archive in format %d is not reproducible", format)
+		}
+	}
+
+	fileHash, _, err := snapshot.Current(ctx, s, snapshot.Path(filepath.Join(workDir, "hello.txt")))
+	if err != nil {
+		t.Fatalf("failure snapshotting the example file: %v", err)
+	}
+	if err := Write(ctx, s, fileHash, io.Discard, Tar, ""); err == nil {
+		t.Error("unexpected success archiving a file snapshot without a prefix")
+	}
+	var buf bytes.Buffer
+	if err := Write(ctx, s, fileHash, &buf, Tar, "greeting.txt"); err != nil {
+		t.Fatalf("failure archiving the file snapshot: %v", err)
+	}
+	got := readTestArchive(t, Tar, buf.Bytes())
+	if entry, ok := got["greeting.txt"]; !ok || len(got) != 1 || entry.contents != files["hello.txt"] {
+		t.Errorf("unexpected entries for the file snapshot: %+v", got)
+	}
+	if err := Write(ctx, s, h, io.Discard, Tar, "../escape"); err == nil {
+		t.Error("unexpected success archiving with a prefix outside of the archive")
+	}
+}
@@ -17,14 +17,21 @@ package bundle
 
 import (
 	"archive/zip"
+	"bytes"
+	"compress/flate"
 	"context"
+	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path"
+	"runtime"
 	"strings"
 	"sync"
 
+	"filippo.io/age"
+
 	"github.com/google/recursive-version-control-system/snapshot"
 	"github.com/google/recursive-version-control-system/storage"
 )
@@ -53,129 +60,441 @@ func bundlePathHash(path string) (*snapshot.Hash, error) {
 	return snapshot.ParseHash(fmt.Sprintf("%s:%s", f, c))
 }
 
-type ZipWriter struct {
-	nested         *zip.Writer
-	visited        map[snapshot.Hash]struct{}
+// preparedEntry is a bundle entry whose contents have already been read,
+// and possibly compressed, so that writing it requires no further work.
+type preparedEntry struct {
+	name     string
+	hash     *snapshot.Hash
+	header   *zip.FileHeader
+	contents *spool
+
+	// chunks holds the entries that the contents were split into, if
+	// they were too large to be written as a single entry.
+	chunks []*preparedEntry
+}
+
+// release frees the resources held by the entry without writing it.
+func (e *preparedEntry) release() {
+	e.contents.release()
+	for _, chunk := range e.chunks {
+		chunk.release()
+	}
+}
+
+// entryWriter writes the individual, named entries of a bundle in a
+// specific encoding.
+//
+// The `prepareEntry` method is safe for concurrent use, but the other
+// methods must only be called by one goroutine at a time.
+type entryWriter interface {
+	// prepareEntry reads the contents of an entry so that it can be
+	// written later. The size is -1 if it is not known ahead of time.
+	prepareEntry(name string, size int64, r io.Reader) (*preparedEntry, error)
+
+	// writePrepared writes a previously prepared entry and then
+	// releases its contents.
+	writePrepared(e *preparedEntry) error
+
+	// close finishes writing the bundle after its last entry.
+	close() error
+}
+
+// writeEntry prepares and then writes a single entry.
+func writeEntry(entries entryWriter, name string, size int64, r io.Reader) error {
+	e, err := entries.prepareEntry(name, size, r)
+	if err != nil {
+		return err
+	}
+	return entries.writePrepared(e)
+}
+
+type zipEntryWriter struct {
+	nested *zip.Writer
+}
+
+func (z *zipEntryWriter) prepareEntry(name string, size int64, r io.Reader) (*preparedEntry, error) {
+	contents := &spool{}
+	compressor, err := flate.NewWriter(contents, flate.DefaultCompression)
+	if err != nil {
+		return nil, fmt.Errorf("failure creating a compressor for the zip file entry %q: %v", name, err)
+	}
+	checksum := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(compressor, checksum), r)
+	if err == nil {
+		err = compressor.Close()
+	}
+	if err != nil {
+		contents.release()
+		return nil, fmt.Errorf("failure compressing the zip file entry %q: %v", name, err)
+	}
+	header := &zip.FileHeader{
+		Name:               name,
+		Method:             zip.Deflate,
+		CRC32:              checksum.Sum32(),
+		CompressedSize64:   uint64(contents.size),
+		UncompressedSize64: uint64(n),
+	}
+	return &preparedEntry{name: name, header: header, contents: contents}, nil
+}
+
+func (z *zipEntryWriter) writePrepared(e *preparedEntry) error {
+	defer e.contents.release()
+	fw, err := z.nested.CreateRaw(e.header)
+	if err != nil {
+		return fmt.Errorf("failure creating the zip file entry %q: %v", e.name, err)
+	}
+	r, err := e.contents.reader()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, r); err != nil {
+		return fmt.Errorf("failure writing the zip file entry %q: %v", e.name, err)
+	}
+	return nil
+}
+
+func (z *zipEntryWriter) close() error {
+	return z.nested.Close()
+}
+
+// Writer writes snapshots, and every object they reference, into a bundle.
+//
+// It is safe for concurrent use. Objects are read and compressed by a pool
+// of worker goroutines, while a single goroutine writes them to the bundle,
+// so errors writing an object may only be reported by a later call or by
+// `Close`.
+type Writer struct {
+	entries        entryWriter
 	exclude        map[snapshot.Hash]struct{}
+	excludeList    []*snapshot.Hash
 	recurseParents bool
 
+	signCtx     context.Context
+	signStorage *storage.LocalFiles
+	signAs      *snapshot.Identity
+
+	slots    chan struct{}
+	workers  sync.WaitGroup
+	prepared chan *preparedEntry
+	written  chan struct{}
+
 	mu       sync.Mutex
+	visited  map[snapshot.Hash]struct{}
+	have     map[snapshot.Hash]struct{}
+	haveList []*snapshot.Hash
 	included []*snapshot.Hash
+	roots    []*snapshot.Hash
+	err      error
 }
 
-func NewZipWriter(w io.Writer, exclude []*snapshot.Hash, metadata map[string]io.ReadCloser, recurseParents bool) (*ZipWriter, error) {
+func newWriter(entries entryWriter, exclude []*snapshot.Hash, metadata map[string]io.ReadCloser, recurseParents bool) (*Writer, error) {
 	excludeMap := make(map[snapshot.Hash]struct{})
 	for _, h := range exclude {
 		excludeMap[*h] = struct{}{}
 	}
-	nested := zip.NewWriter(w)
 	for name, r := range metadata {
-		fw, err := nested.Create(path.Join("metadata", name))
-		if err != nil {
-			return nil, fmt.Errorf("failure creating a zip file entry for metadata key %q: %v", name, err)
-		}
-		if _, err := io.Copy(fw, r); err != nil {
-			return nil, fmt.Errorf("failure writing the zip file entry for metadata key %q: %v", name, err)
+		if err := writeEntry(entries, path.Join("metadata", name), -1, r); err != nil {
+			return nil, fmt.Errorf("failure writing the entry for metadata key %q: %v", name, err)
 		}
 		if err := r.Close(); err != nil {
 			return nil, fmt.Errorf("failure closing the metadata reader: %v", err)
 		}
 	}
-	return &ZipWriter{
-		nested:         nested,
-		visited:        make(map[snapshot.Hash]struct{}),
+	parallelism := runtime.NumCPU()
+	w := &Writer{
+		entries:        entries,
 		exclude:        excludeMap,
+		excludeList:    exclude,
 		recurseParents: recurseParents,
-	}, nil
+		slots:          make(chan struct{}, parallelism),
+		prepared:       make(chan *preparedEntry, parallelism),
+		written:        make(chan struct{}),
+		visited:        make(map[snapshot.Hash]struct{}),
+		have:           make(map[snapshot.Hash]struct{}),
+	}
+	go w.writePrepared()
+	return w, nil
 }
 
-func (w *ZipWriter) Close() error {
-	return w.nested.Close()
+// ZipWriter is the previous name of `Writer`, which is kept so that
+// existing code using it continues to compile.
+//
+// Deprecated: Use `Writer` instead.
+type ZipWriter = Writer
+
+// NewZipWriter returns a writer for a bundle encoded as a zip file.
+func NewZipWriter(w io.Writer, exclude []*snapshot.Hash, metadata map[string]io.ReadCloser, recurseParents bool) (*Writer, error) {
+	return newWriter(&zipEntryWriter{nested: zip.NewWriter(w)}, exclude, metadata, recurseParents)
 }
 
-func (w *ZipWriter) AddObject(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash) error {
-	if _, ok := w.exclude[*h]; ok {
-		// We are explicitly excluding this object.
-		return nil
-	}
-	if _, ok := w.visited[*h]; ok {
-		// We already added this to the zip writer.
-		return nil
+// writePrepared writes the entries prepared by the worker goroutines, until
+// the writer is closed.
+func (w *Writer) writePrepared() {
+	defer close(w.written)
+	for e := range w.prepared {
+		if w.failed() != nil {
+			e.release()
+			continue
+		}
+		if err := w.entries.writePrepared(e); err != nil {
+			w.fail(fmt.Errorf("failure writing the bundle entry for %q: %v", e.hash, err))
+			continue
+		}
+		w.mu.Lock()
+		w.included = append(w.included, e.hash)
+		w.mu.Unlock()
 	}
+}
+
+func (w *Writer) failed() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	w.visited[*h] = struct{}{}
-	r, err := s.ReadObject(ctx, h)
+	return w.err
+}
+
+func (w *Writer) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Close waits for every added object to be written, and then writes the
+// manifest of the bundle, signs it if the writer was configured to, and
+// finishes writing it.
+//
+// If the writer has failed, then the manifest and signature are not
+// written, and the error that it failed with is returned.
+func (w *Writer) Close() error {
+	w.workers.Wait()
+	close(w.prepared)
+	<-w.written
+	if err := w.failed(); err != nil {
+		w.entries.close()
+		return err
+	}
+	m := &Manifest{
+		Version:      ManifestVersion,
+		Roots:        w.roots,
+		Exclude:      w.excludeList,
+		Have:         w.haveList,
+		HashFunction: snapshot.DefaultHashFunction(),
+		RVCSVersion:  RVCSVersion,
+		ObjectCount:  len(w.included),
+	}
+	manifestBytes, err := json.MarshalIndent(m, "", "  ")
 	if err != nil {
-		return fmt.Errorf("failure opening the contents of the object %q: %v", h, err)
+		return fmt.Errorf("failure serializing the bundle manifest: %v", err)
 	}
-	defer r.Close()
-	fw, err := w.nested.Create(bundleEntryPath(h))
+	if err := writeEntry(w.entries, manifestPath, int64(len(manifestBytes)), bytes.NewReader(manifestBytes)); err != nil {
+		return fmt.Errorf("failure writing the bundle manifest: %v", err)
+	}
+	if w.signAs != nil {
+		if err := w.writeSignature(manifestBytes); err != nil {
+			w.entries.close()
+			return fmt.Errorf("failure signing the bundle as %q: %v", w.signAs, err)
+		}
+	}
+	return w.entries.close()
+}
+
+// Included returns the objects that have been written to the bundle.
+//
+// This is only complete after the writer has been closed.
+func (w *Writer) Included() []*snapshot.Hash {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*snapshot.Hash{}, w.included...)
+}
+
+// AddRoot adds the given snapshot to the bundle, and records it as one of
+// the roots listed in the bundle's manifest.
+//
+// If the snapshot cannot be added, then the writer fails, so that closing
+// it does not write a manifest that is missing the root.
+func (w *Writer) AddRoot(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash) error {
+	f, err := s.ReadSnapshot(ctx, h)
 	if err != nil {
-		return fmt.Errorf("failure creating the zip file entry for %q: %v", h, err)
+		err = fmt.Errorf("failure reading the snapshot %q: %v", h, err)
+		w.fail(err)
+		return err
 	}
-	if _, err := io.Copy(fw, r); err != nil {
-		return fmt.Errorf("failure writing the zip file entry for %q: %v", h, err)
+	if err := w.AddFile(ctx, s, h, f); err != nil {
+		w.fail(err)
+		return err
 	}
-	w.included = append(w.included, h)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.roots = append(w.roots, h)
 	return nil
 }
 
-func (w *ZipWriter) AddFile(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, f *snapshot.File) (err error) {
-	if err := w.AddObject(ctx, s, h); err != nil {
-		return fmt.Errorf("failure adding the snapshot %q to the bundle: %v", h, err)
+// claim reports whether or not the given object still needs to be added to
+// the bundle, and if so marks it as visited so that it is only added once.
+func (w *Writer) claim(h *snapshot.Hash) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return false, w.err
 	}
-	defer func() {
-		if err != nil {
+	if _, ok := w.have[*h]; ok {
+		// The recipient already has this object.
+		return false, nil
+	}
+	if _, ok := w.visited[*h]; ok {
+		// We already added this to the bundle.
+		return false, nil
+	}
+	w.visited[*h] = struct{}{}
+	return true, nil
+}
+
+// AddObject adds the given object to the bundle unless it was excluded or
+// was already added.
+//
+// The object is read and written asynchronously.
+func (w *Writer) AddObject(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash) error {
+	if _, ok := w.exclude[*h]; ok {
+		// We are explicitly excluding this object.
+		return nil
+	}
+	if claimed, err := w.claim(h); err != nil || !claimed {
+		return err
+	}
+	w.addClaimed(ctx, s, h)
+	return nil
+}
+
+// addClaimed hands the given, previously claimed object off to a worker.
+func (w *Writer) addClaimed(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash) {
+	w.slots <- struct{}{}
+	w.workers.Add(1)
+	go func() {
+		defer func() {
+			<-w.slots
+			w.workers.Done()
+		}()
+		if w.failed() != nil {
 			return
 		}
-		if !w.recurseParents {
+		e, err := w.prepareObject(ctx, s, h)
+		if err != nil {
+			w.fail(err)
 			return
 		}
-		for _, parentHash := range f.Parents {
-			parent, err := s.ReadSnapshot(ctx, parentHash)
-			if err != nil {
-				// The history is incomplete
+		w.prepared <- e
+	}()
+}
+
+func (w *Writer) prepareObject(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash) (*preparedEntry, error) {
+	r, err := s.ReadObject(ctx, h)
+	if err != nil {
+		return nil, fmt.Errorf("failure opening the contents of the object %q: %v", h, err)
+	}
+	defer r.Close()
+	size := int64(-1)
+	if f, ok := r.(*os.File); ok {
+		if info, err := f.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	e, err := w.entries.prepareEntry(bundleEntryPath(h), size, r)
+	if err != nil {
+		return nil, fmt.Errorf("failure preparing the bundle entry for %q: %v", h, err)
+	}
+	e.hash = h
+	return e, nil
+}
+
+// AddFile adds the given snapshot to the bundle, along with its contents,
+// the snapshots of its children if it is a directory, and its history if
+// the writer was created to recurse into parents.
+func (w *Writer) AddFile(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, f *snapshot.File) error {
+	if _, ok := w.exclude[*h]; !ok {
+		claimed, err := w.claim(h)
+		if err != nil {
+			return fmt.Errorf("failure adding the snapshot %q to the bundle: %v", h, err)
+		}
+		if !claimed {
+			// The snapshot, and everything reachable from it, is
+			// already being added or is not needed.
+			return nil
+		}
+		w.addClaimed(ctx, s, h)
+	}
+	if f.Contents != nil {
+		if err := w.AddObject(ctx, s, f.Contents); err != nil {
+			return fmt.Errorf("failure adding the contents of the snapshot %q to the bundle: %v", h, err)
+		}
+	}
+	if f.IsDir() {
+		tree, err := s.ListDirectorySnapshotContents(ctx, h, f)
+		if err != nil {
+			return fmt.Errorf("failure reading the contents of the directory snapshot %q: %v", h, err)
+		}
+		for _, childHash := range tree {
+			if _, ok := w.exclude[*childHash]; ok {
 				continue
 			}
-			err = w.AddFile(ctx, s, parentHash, parent)
+			child, err := s.ReadSnapshot(ctx, childHash)
 			if err != nil {
-				err = fmt.Errorf("failure adding the parent %q to the bundle: %v", parentHash, err)
-				return
+				return fmt.Errorf("failure reading the snapshot %q: %v", childHash, err)
+			}
+			if err := w.AddFile(ctx, s, childHash, child); err != nil {
+				return fmt.Errorf("failure adding the child %q to the bundle: %v", childHash, err)
 			}
 		}
-	}()
-	if f.Contents == nil {
-		return nil
 	}
-	if err := w.AddObject(ctx, s, f.Contents); err != nil {
-		return fmt.Errorf("failure adding the contents of the snapshot %q to the bundle: %v", h, err)
-	}
-	if !f.IsDir() {
+	if !w.recurseParents {
 		return nil
 	}
-	tree, err := s.ListDirectorySnapshotContents(ctx, h, f)
-	if err != nil {
-		return fmt.Errorf("failure reading the contents of the directory snapshot %q: %v", h, err)
-	}
-	for _, childHash := range tree {
-		if _, ok := w.exclude[*childHash]; ok {
-			continue
-		}
-		if _, ok := w.visited[*childHash]; ok {
-			continue
-		}
-		child, err := s.ReadSnapshot(ctx, childHash)
+	for _, parentHash := range f.Parents {
+		parent, err := s.ReadSnapshot(ctx, parentHash)
 		if err != nil {
-			return fmt.Errorf("failure reading the snapshot %q: %v", childHash, err)
+			// The history is incomplete
+			continue
 		}
-		if err := w.AddFile(ctx, s, childHash, child); err != nil {
-			return fmt.Errorf("failure adding the child %q to the bundle: %v", childHash, err)
+		if err := w.AddFile(ctx, s, parentHash, parent); err != nil {
+			return fmt.Errorf("failure adding the parent %q to the bundle: %v", parentHash, err)
 		}
 	}
 	return nil
 }
 
+// ExportOptions holds the optional settings for exporting a bundle.
+type ExportOptions struct {
+	// EncryptTo are the age recipients that the bundle is encrypted
+	// to. The bundle is not encrypted if this is empty.
+	EncryptTo []age.Recipient
+
+	// SignAs is the identity that the bundle is signed as. The bundle
+	// is not signed if this is nil.
+	SignAs *snapshot.Identity
+
+	// MaxSize, if positive, splits the bundle into a numbered series of
+	// volumes that are each at most this many bytes. The volumes are
+	// written to the paths returned by `VolumePath`, and any encryption
+	// is applied to each volume separately, with the size limit
+	// including the space added by the encryption. Only bundle files,
+	// and not streamed bundles, can be split.
+	MaxSize int64
+}
+
+// ImportOptions holds the optional settings for importing a bundle.
+type ImportOptions struct {
+	// RequireSigner, if not nil, rejects the bundle unless it has a
+	// verified signature by this identity.
+	RequireSigner *snapshot.Identity
+}
+
+func (opts *ImportOptions) requiredSigner() *snapshot.Identity {
+	if opts == nil {
+		return nil
+	}
+	return opts.RequireSigner
+}
+
 // Export writes a bundle with the specified snapshots to the given writer.
 //
 // If the returned error is nil, then the written bundle will include the
@@ -187,88 +506,155 @@ func (w *ZipWriter) AddFile(ctx context.Context, s *storage.LocalFiles, h *snaps
 // not be included in the resulting bundle even if they otherwise would
 // have been.
 //
+// The `have` argument specifies a list of snapshots that the recipient
+// already has. Everything reachable from them, including their history, is
+// omitted from the bundle, making it an incremental bundle that can only be
+// imported by a recipient that has those snapshots.
+//
 // The `metadata` argument specifies an additional map of key/value pairs
 // to include in the bundle in a separate subpath from the bundled objects.
-func Export(ctx context.Context, s *storage.LocalFiles, path string, snapshots []*snapshot.Hash, exclude []*snapshot.Hash, metadata map[string]io.ReadCloser, recurseParents bool) (included []*snapshot.Hash, err error) {
-	w, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0700)
-	if err != nil {
-		return nil, fmt.Errorf("failure opening the file %q: %v", path, err)
+//
+// The `opts` argument, which may be nil, specifies whether the bundle is
+// encrypted and/or signed.
+//
+// The bundle also includes a manifest listing the specified snapshots as
+// its roots, along with the excluded objects and the number of objects
+// that were included.
+func Export(ctx context.Context, s *storage.LocalFiles, path string, snapshots []*snapshot.Hash, exclude []*snapshot.Hash, have []*snapshot.Hash, metadata map[string]io.ReadCloser, recurseParents bool, opts *ExportOptions) (included []*snapshot.Hash, err error) {
+	if opts != nil && opts.MaxSize > 0 {
+		var created []string
+		defer func() {
+			if err != nil {
+				// Do not leave behind a partial bundle.
+				for _, p := range created {
+					os.Remove(p)
+				}
+			}
+		}()
+		vw, err := newVolumeEntryWriter(opts.MaxSize, opts.encryptionOverhead(opts.MaxSize), createVolumes(path, opts, &created))
+		if err != nil {
+			return nil, err
+		}
+		w, err := newWriter(vw, exclude, metadata, recurseParents)
+		if err != nil {
+			vw.close()
+			return nil, fmt.Errorf("failure creating the writer for the split bundle: %v", err)
+		}
+		return writeBundle(ctx, s, w, nopWriteCloser{}, snapshots, have, opts)
 	}
-	defer w.Close()
-	zw, err := NewZipWriter(w, exclude, metadata, recurseParents)
+	w, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0700)
 	if err != nil {
-		return nil, fmt.Errorf("failure creating the zip writer for the bundle: %v", err)
+		return nil, fmt.Errorf("failure opening the file %q: %v", path, err)
 	}
 	defer func() {
-		ce := zw.Close()
-		if err == nil {
-			err = ce
+		w.Close()
+		if err != nil {
+			// Do not leave behind a partial bundle.
+			os.Remove(path)
 		}
 	}()
+	out, err := opts.encrypt(w)
+	if err != nil {
+		return nil, err
+	}
+	zw, err := NewZipWriter(out, exclude, metadata, recurseParents)
+	if err != nil {
+		return nil, fmt.Errorf("failure creating the zip writer for the bundle: %v", err)
+	}
+	return writeBundle(ctx, s, zw, out, snapshots, have, opts)
+}
 
+// writeBundle adds the given snapshots to the bundle writer as roots,
+// omitting everything reachable from the `have` snapshots, and then closes
+// the writer followed by the output it writes to.
+func writeBundle(ctx context.Context, s *storage.LocalFiles, w *Writer, out io.Closer, snapshots []*snapshot.Hash, have []*snapshot.Hash, opts *ExportOptions) ([]*snapshot.Hash, error) {
+	if opts != nil && opts.SignAs != nil {
+		w.SignAs(ctx, s, opts.SignAs)
+	}
+	if err := addRoots(ctx, s, w, snapshots, have); err != nil {
+		w.fail(err)
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, fmt.Errorf("failure finishing the encryption of the bundle: %v", err)
+	}
+	return w.Included(), nil
+}
+
+func addRoots(ctx context.Context, s *storage.LocalFiles, w *Writer, snapshots []*snapshot.Hash, have []*snapshot.Hash) error {
+	if err := w.AddHave(ctx, s, have); err != nil {
+		return err
+	}
 	for _, h := range snapshots {
-		f, err := s.ReadSnapshot(ctx, h)
-		if err != nil {
-			return nil, fmt.Errorf("failure reading the snapshot %q: %v", h, err)
-		}
-		if err := zw.AddFile(ctx, s, h, f); err != nil {
-			return nil, fmt.Errorf("failure adding %q to the zip file: %v", h, err)
+		if err := w.AddRoot(ctx, s, h); err != nil {
+			return fmt.Errorf("failure adding %q to the bundle: %v", h, err)
 		}
 	}
-	return zw.included, nil
+	return nil
 }
 
-func validateZipEntry(ctx context.Context, f *zip.File) error {
-	h, err := bundlePathHash(f.Name)
+// validateEntry verifies that the contents of the named bundle entry match
+// the hash in its name, if it is an object entry or one of the objects of
+// the bundle's signature.
+func validateEntry(ctx context.Context, name string, open func() (io.ReadCloser, error)) error {
+	h, err := bundlePathHash(strings.TrimPrefix(name, signatureDir+"/"))
 	if err != nil {
 		// We allow additional/non-object files in bundles
 		return nil
 	}
-	r, err := f.Open()
+	r, err := open()
 	if err != nil {
-		return fmt.Errorf("failure reading entry %q: %v", f.Name, err)
+		return fmt.Errorf("failure reading entry %q: %v", name, err)
 	}
+	defer r.Close()
 	realHash, err := snapshot.NewHash(r)
 	if err != nil {
-		return fmt.Errorf("failure hashing the entry %q: %v", f.Name, err)
+		return fmt.Errorf("failure hashing the entry %q: %v", name, err)
 	}
 	if !realHash.Equal(h) {
-		return fmt.Errorf("mismatched hash for entry %q: got %q, want %q", f.Name, realHash, h)
+		return invalidBundle("mismatched hash for entry %q: got %q, want %q", name, realHash, h)
 	}
 	return nil
 }
 
-func Import(ctx context.Context, s *storage.LocalFiles, path string, exclude []*snapshot.Hash) (included []*snapshot.Hash, err error) {
-	r, err := zip.OpenReader(path)
+// Import reads the bundle at the given path and stores every object in it
+// that is not already present or explicitly excluded.
+//
+// This is the same as calling `ImportVolumes` with just the given path.
+func Import(ctx context.Context, s *storage.LocalFiles, path string, exclude []*snapshot.Hash, opts *ImportOptions) (roots []*snapshot.Hash, included []*snapshot.Hash, signer *snapshot.Identity, err error) {
+	return ImportVolumes(ctx, s, []string{path}, exclude, opts)
+}
+
+// ImportVolumes reads the bundle in the given files and stores every object
+// in it that is not already present or explicitly excluded.
+//
+// The files are either a single bundle or every volume of a split bundle,
+// in any order. Nothing is imported from a split bundle unless all of its
+// volumes are given.
+//
+// The bundle is decrypted using the local identity of the storage if it is
+// encrypted. The bundle's manifest, if it has one, and its signature, if it
+// is signed, are validated before anything is stored. A signed bundle is
+// rejected unless the signature is verified by the verify helper for the
+// identity that signed it, or, if `opts.RequireSigner` is set, unless it
+// is signed by that identity.
+//
+// The objects are staged in the archive and only published once the whole
+// bundle has been validated, so a failed import does not store any of them.
+// An interrupted import is resumed by importing the same bundle again.
+//
+// The roots listed in the manifest are returned along with the hashes of
+// the imported objects and the identity that signed the bundle, which is
+// nil if the bundle is not signed.
+func ImportVolumes(ctx context.Context, s *storage.LocalFiles, paths []string, exclude []*snapshot.Hash, opts *ImportOptions) (roots []*snapshot.Hash, included []*snapshot.Hash, signer *snapshot.Identity, err error) {
+	r, err := OpenVolumes(s, paths)
 	if err != nil {
-		return nil, fmt.Errorf("failure opening the zip file %q: %v", path, err)
+		return nil, nil, nil, err
 	}
 	defer r.Close()
-	// We first validate that the bundle only includes valid object contents...
-	for _, f := range r.File {
-		if err := validateZipEntry(ctx, f); err != nil {
-			return nil, fmt.Errorf("failure validating the zip entry %q: %v", f.Name, err)
-		}
-	}
-	for _, f := range r.File {
-		h, err := bundlePathHash(f.Name)
-		if err != nil {
-			// We allow additional/non-object files in bundles
-			continue
-		}
-		if _, err := s.ReadObject(ctx, h); err == nil {
-			// We already have this object and can skip importing it.
-			continue
-		}
-		r, err := f.Open()
-		if err != nil {
-			return nil, fmt.Errorf("failure reading entry %q: %v", f.Name, err)
-		}
-		if h, err := s.StoreObject(ctx, int64(f.FileInfo().Size()), r); err != nil {
-			return nil, fmt.Errorf("failure importing the zip entry %q: %v", f.Name, err)
-		} else {
-			included = append(included, h)
-		}
-	}
-	return included, nil
+	return r.importObjects(ctx, s, exclude, opts)
 }
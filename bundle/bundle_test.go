@@ -16,11 +16,22 @@
 package bundle
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
+	"filippo.io/age"
+
 	"github.com/google/recursive-version-control-system/snapshot"
 	"github.com/google/recursive-version-control-system/storage"
 )
@@ -53,7 +64,7 @@ func TestRoundtrip(t *testing.T) {
 	}
 
 	bundleFile := filepath.Join(t.TempDir(), "bundle.zip")
-	included, err := Export(context.Background(), s, bundleFile, []*snapshot.Hash{h2}, nil, nil, true)
+	included, err := Export(context.Background(), s, bundleFile, []*snapshot.Hash{h2}, nil, nil, nil, true, nil)
 	if err != nil {
 		t.Fatalf("failure creating the bundle %q: %v", bundleFile, err)
 	}
@@ -71,10 +82,13 @@ func TestRoundtrip(t *testing.T) {
 
 	archive2Dir := filepath.Join(t.TempDir(), "archive2")
 	s2 := &storage.LocalFiles{archive2Dir}
-	imported, err := Import(context.Background(), s2, bundleFile, nil)
+	roots, imported, _, err := Import(context.Background(), s2, bundleFile, nil, nil)
 	if err != nil {
 		t.Fatalf("failure importing the bundle %q: %v", bundleFile, err)
 	}
+	if len(roots) != 1 || !roots[0].Equal(h2) {
+		t.Errorf("unexpected roots for the imported bundle: got %v, want [%q]", roots, h2)
+	}
 	importedMap := make(map[snapshot.Hash]struct{})
 	for _, i := range imported {
 		importedMap[*i] = struct{}{}
@@ -96,3 +110,1048 @@ func TestRoundtrip(t *testing.T) {
 		t.Errorf("unexpected contents for snapshot %q: got %q, want %q", h1, got, want)
 	}
 }
+
+func TestManifest(t *testing.T) {
+	archiveDir := filepath.Join(t.TempDir(), "archive")
+	s := &storage.LocalFiles{ArchiveDir: archiveDir}
+
+	file := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(file, []byte("Hello, World!"), 0700); err != nil {
+		t.Fatalf("failure creating the example file to snapshot: %v", err)
+	}
+	h, f, err := snapshot.Current(context.Background(), s, snapshot.Path(file))
+	if err != nil {
+		t.Fatalf("failure creating the snapshot for the file: %v", err)
+	}
+
+	bundleFile := filepath.Join(t.TempDir(), "bundle.zip")
+	included, err := Export(context.Background(), s, bundleFile, []*snapshot.Hash{h}, []*snapshot.Hash{f.Contents}, nil, nil, false, nil)
+	if err != nil {
+		t.Fatalf("failure creating the bundle %q: %v", bundleFile, err)
+	}
+	r, err := OpenReader(bundleFile)
+	if err != nil {
+		t.Fatalf("failure opening the bundle %q: %v", bundleFile, err)
+	}
+	defer r.Close()
+	m := r.Manifest()
+	if m == nil {
+		t.Fatal("missing manifest in the bundle")
+	}
+	if got, want := m.Version, ManifestVersion; got != want {
+		t.Errorf("unexpected manifest version: got %d, want %d", got, want)
+	}
+	if len(m.Roots) != 1 || !m.Roots[0].Equal(h) {
+		t.Errorf("unexpected manifest roots: got %v, want [%q]", m.Roots, h)
+	}
+	if len(m.Exclude) != 1 || !m.Exclude[0].Equal(f.Contents) {
+		t.Errorf("unexpected manifest exclude list: got %v, want [%q]", m.Exclude, f.Contents)
+	}
+	if got, want := m.HashFunction, h.Function(); got != want {
+		t.Errorf("unexpected manifest hash function: got %q, want %q", got, want)
+	}
+	if got, want := m.ObjectCount, len(included); got != want {
+		t.Errorf("unexpected manifest object count: got %d, want %d", got, want)
+	}
+
+	objects := []*snapshot.Hash{h}
+	if err := m.validate(objects, nil); err != nil {
+		t.Errorf("unexpected error validating the manifest: %v", err)
+	}
+	for _, invalid := range []*Manifest{
+		{Version: ManifestVersion + 1, Roots: m.Roots, HashFunction: m.HashFunction, ObjectCount: 1},
+		{Version: ManifestVersion, Roots: m.Roots, HashFunction: "md5", ObjectCount: 1},
+		{Version: ManifestVersion, Roots: m.Roots, HashFunction: m.HashFunction, ObjectCount: 2},
+		{Version: ManifestVersion, Roots: []*snapshot.Hash{f.Contents}, HashFunction: m.HashFunction, ObjectCount: 1},
+	} {
+		if err := invalid.validate(objects, nil); err == nil {
+			encoded, _ := json.Marshal(invalid)
+			t.Errorf("unexpected success validating the manifest %s", encoded)
+		}
+	}
+
+	// Roots that are reachable from the have snapshots are left out of
+	// the bundle, so they must already be stored instead.
+	incremental := &Manifest{Version: ManifestVersion, Roots: []*snapshot.Hash{h, f.Contents}, Have: []*snapshot.Hash{h}, HashFunction: m.HashFunction, ObjectCount: 1}
+	if err := incremental.validate(objects, func(*snapshot.Hash) bool { return true }); err != nil {
+		t.Errorf("unexpected error validating an incremental manifest with stored roots: %v", err)
+	}
+	if err := incremental.validate(objects, func(*snapshot.Hash) bool { return false }); err == nil {
+		t.Error("unexpected success validating an incremental manifest with a root that is not stored")
+	}
+}
+
+func TestStreamRoundtrip(t *testing.T) {
+	archiveDir := filepath.Join(t.TempDir(), "archive")
+	s := &storage.LocalFiles{ArchiveDir: archiveDir}
+
+	workDir := filepath.Join(t.TempDir(), "workDir")
+	if err := os.MkdirAll(workDir, os.FileMode(0700)); err != nil {
+		t.Fatalf("failure creating the work dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(workDir, "hello.txt"), []byte("Hello, World!"), 0700); err != nil {
+		t.Fatalf("failure creating the example file to snapshot: %v", err)
+	}
+	large := bytes.Repeat([]byte("0123456789abcdef"), 128*1024)
+	if err := os.WriteFile(filepath.Join(workDir, "large.bin"), large, 0700); err != nil {
+		t.Fatalf("failure creating the large example file to snapshot: %v", err)
+	}
+	h, _, err := snapshot.Current(context.Background(), s, snapshot.Path(workDir))
+	if err != nil {
+		t.Fatalf("failure creating the snapshot for the work dir: %v", err)
+	}
+
+	var encoded bytes.Buffer
+	included, err := ExportStream(context.Background(), s, &encoded, []*snapshot.Hash{h}, nil, nil, map[string]io.ReadCloser{"key": io.NopCloser(strings.NewReader("value"))}, false, nil)
+	if err != nil {
+		t.Fatalf("failure streaming the bundle: %v", err)
+	}
+
+	// Import through a pipe to ensure the reader does not need to be seekable.
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := io.Copy(pw, bytes.NewReader(encoded.Bytes()))
+		pw.CloseWithError(err)
+	}()
+	s2 := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive2")}
+	roots, imported, _, err := ImportStream(context.Background(), s2, pr, nil, nil)
+	if err != nil {
+		t.Fatalf("failure importing the streamed bundle: %v", err)
+	}
+	if len(roots) != 1 || !roots[0].Equal(h) {
+		t.Errorf("unexpected roots for the streamed bundle: got %v, want [%q]", roots, h)
+	}
+	if got, want := len(imported), len(included); got != want {
+		t.Errorf("unexpected number of imported objects: got %d, want %d", got, want)
+	}
+	for _, i := range included {
+		r, err := s2.ReadObject(context.Background(), i)
+		if err != nil {
+			t.Errorf("missing imported object %q: %v", i, err)
+			continue
+		}
+		r.Close()
+	}
+
+	// Importing again only verifies the objects that are already present.
+	if _, imported, _, err := ImportStream(context.Background(), s2, bytes.NewReader(encoded.Bytes()), nil, nil); err != nil {
+		t.Errorf("failure re-importing the streamed bundle: %v", err)
+	} else if len(imported) != 0 {
+		t.Errorf("unexpected objects imported a second time: %v", imported)
+	}
+
+	truncated := encoded.Bytes()[:encoded.Len()-1]
+	if _, _, _, err := ImportStream(context.Background(), &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive3")}, bytes.NewReader(truncated), nil, nil); err == nil {
+		t.Error("unexpected success importing a truncated stream")
+	}
+	corrupted := bytes.Replace(encoded.Bytes(), []byte("Hello, World!"), []byte("Hello, Wurld!"), 1)
+	s4 := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive4")}
+	if _, _, _, err := ImportStream(context.Background(), s4, bytes.NewReader(corrupted), nil, nil); err == nil {
+		t.Error("unexpected success importing a corrupted stream")
+	}
+	for _, i := range included {
+		if hasObject(context.Background(), s4, i) {
+			t.Errorf("the object %q of a corrupted stream was published", i)
+		}
+	}
+}
+
+func TestIncrementalBundle(t *testing.T) {
+	archiveDir := filepath.Join(t.TempDir(), "archive")
+	s := &storage.LocalFiles{ArchiveDir: archiveDir}
+
+	workDir := filepath.Join(t.TempDir(), "workDir")
+	if err := os.MkdirAll(workDir, os.FileMode(0700)); err != nil {
+		t.Fatalf("failure creating the work dir: %v", err)
+	}
+	unchangedFile := filepath.Join(workDir, "unchanged.txt")
+	changedFile := filepath.Join(workDir, "changed.txt")
+	for _, file := range []string{unchangedFile, changedFile} {
+		if err := os.WriteFile(file, []byte("Original"), 0700); err != nil {
+			t.Fatalf("failure creating the example file %q: %v", file, err)
+		}
+	}
+	h1, _, err := snapshot.Current(context.Background(), s, snapshot.Path(workDir))
+	if err != nil {
+		t.Fatalf("failure creating the initial snapshot for the work dir: %v", err)
+	}
+	unchanged, _, err := snapshot.Current(context.Background(), s, snapshot.Path(unchangedFile))
+	if err != nil {
+		t.Fatalf("failure looking up the snapshot of the unchanged file: %v", err)
+	}
+	if err := os.WriteFile(changedFile, []byte("Changed"), 0700); err != nil {
+		t.Fatalf("failure updating the example file: %v", err)
+	}
+	h2, _, err := snapshot.Current(context.Background(), s, snapshot.Path(workDir))
+	if err != nil {
+		t.Fatalf("failure creating the updated snapshot for the work dir: %v", err)
+	}
+
+	fullBundle := filepath.Join(t.TempDir(), "full.zip")
+	if _, err := Export(context.Background(), s, fullBundle, []*snapshot.Hash{h1}, nil, nil, nil, true, nil); err != nil {
+		t.Fatalf("failure creating the full bundle: %v", err)
+	}
+	thinBundle := filepath.Join(t.TempDir(), "thin.zip")
+	included, err := Export(context.Background(), s, thinBundle, []*snapshot.Hash{h2}, nil, []*snapshot.Hash{h1}, nil, true, nil)
+	if err != nil {
+		t.Fatalf("failure creating the incremental bundle: %v", err)
+	}
+	includedMap := make(map[snapshot.Hash]struct{})
+	for _, i := range included {
+		includedMap[*i] = struct{}{}
+	}
+	if _, ok := includedMap[*h2]; !ok {
+		t.Errorf("incremental bundle does not include the specified hash %q: got %v", h2, included)
+	}
+	for _, h := range []*snapshot.Hash{h1, unchanged} {
+		if _, ok := includedMap[*h]; ok {
+			t.Errorf("incremental bundle includes %q, which is reachable from the have set", h)
+		}
+	}
+
+	s2 := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive2")}
+	if _, _, _, err := Import(context.Background(), s2, thinBundle, nil, nil); err == nil {
+		t.Error("unexpected success importing an incremental bundle without the snapshots it requires")
+	}
+	if _, _, _, err := Import(context.Background(), s2, fullBundle, nil, nil); err != nil {
+		t.Fatalf("failure importing the full bundle: %v", err)
+	}
+	if roots, _, _, err := Import(context.Background(), s2, thinBundle, nil, nil); err != nil {
+		t.Fatalf("failure importing the incremental bundle: %v", err)
+	} else if len(roots) != 1 || !roots[0].Equal(h2) {
+		t.Errorf("unexpected roots for the incremental bundle: got %v, want [%q]", roots, h2)
+	}
+	if _, err := s2.ReadSnapshot(context.Background(), h2); err != nil {
+		t.Errorf("failure reading the imported snapshot %q: %v", h2, err)
+	}
+
+	// A root that is reachable from the have set is left out of the
+	// bundle, and is accepted because it is already stored.
+	omittedRootBundle := filepath.Join(t.TempDir(), "omitted-root.zip")
+	if _, err := Export(context.Background(), s, omittedRootBundle, []*snapshot.Hash{h2, unchanged}, nil, []*snapshot.Hash{h1}, nil, true, nil); err != nil {
+		t.Fatalf("failure creating the incremental bundle with an omitted root: %v", err)
+	}
+	if roots, _, _, err := Import(context.Background(), s2, omittedRootBundle, nil, nil); err != nil {
+		t.Fatalf("failure importing the incremental bundle with an omitted root: %v", err)
+	} else if len(roots) != 2 {
+		t.Errorf("unexpected roots for the incremental bundle with an omitted root: got %v, want [%q %q]", roots, h2, unchanged)
+	}
+}
+
+func TestReader(t *testing.T) {
+	archiveDir := filepath.Join(t.TempDir(), "archive")
+	s := &storage.LocalFiles{ArchiveDir: archiveDir}
+
+	workDir := filepath.Join(t.TempDir(), "workDir")
+	if err := os.MkdirAll(workDir, os.FileMode(0700)); err != nil {
+		t.Fatalf("failure creating the work dir: %v", err)
+	}
+	unchangedFile := filepath.Join(workDir, "unchanged.txt")
+	changedFile := filepath.Join(workDir, "changed.txt")
+	for _, file := range []string{unchangedFile, changedFile} {
+		if err := os.WriteFile(file, []byte("Original "+file), 0700); err != nil {
+			t.Fatalf("failure creating the example file %q: %v", file, err)
+		}
+	}
+	h1, _, err := snapshot.Current(context.Background(), s, snapshot.Path(workDir))
+	if err != nil {
+		t.Fatalf("failure creating the initial snapshot for the work dir: %v", err)
+	}
+	if err := os.WriteFile(changedFile, []byte("Changed"), 0700); err != nil {
+		t.Fatalf("failure updating the example file: %v", err)
+	}
+	h2, _, err := snapshot.Current(context.Background(), s, snapshot.Path(workDir))
+	if err != nil {
+		t.Fatalf("failure creating the updated snapshot for the work dir: %v", err)
+	}
+
+	zipBundle := filepath.Join(t.TempDir(), "bundle.zip")
+	metadata := map[string]io.ReadCloser{"key": io.NopCloser(strings.NewReader("value"))}
+	if _, err := Export(context.Background(), s, zipBundle, []*snapshot.Hash{h1}, nil, nil, metadata, false, nil); err != nil {
+		t.Fatalf("failure creating the zip bundle: %v", err)
+	}
+	streamBundle := filepath.Join(t.TempDir(), "bundle.stream")
+	streamFile, err := os.Create(streamBundle)
+	if err != nil {
+		t.Fatalf("failure creating the stream bundle file: %v", err)
+	}
+	metadata = map[string]io.ReadCloser{"key": io.NopCloser(strings.NewReader("value"))}
+	if _, err := ExportStream(context.Background(), s, streamFile, []*snapshot.Hash{h1}, nil, nil, metadata, false, nil); err != nil {
+		t.Fatalf("failure creating the stream bundle: %v", err)
+	}
+	streamFile.Close()
+
+	for _, bundleFile := range []string{zipBundle, streamBundle} {
+		r, err := OpenReader(bundleFile)
+		if err != nil {
+			t.Fatalf("failure opening the bundle %q: %v", bundleFile, err)
+		}
+		defer r.Close()
+		l, err := r.List()
+		if err != nil {
+			t.Fatalf("failure listing the bundle %q: %v", bundleFile, err)
+		}
+		if l.Manifest == nil || len(l.Manifest.Roots) != 1 || !l.Manifest.Roots[0].Equal(h1) {
+			t.Errorf("unexpected manifest for the bundle %q: %+v", bundleFile, l.Manifest)
+		}
+		if len(l.Metadata) != 1 || l.Metadata[0] != "key" {
+			t.Errorf("unexpected metadata keys for the bundle %q: %v", bundleFile, l.Metadata)
+		}
+		if got, want := len(l.Snapshots), 3; got != want {
+			t.Errorf("unexpected number of snapshots in the bundle %q: got %d, want %d", bundleFile, got, want)
+		}
+		if got, want := len(l.Trees), 1; got != want {
+			t.Errorf("unexpected number of trees in the bundle %q: got %d, want %d", bundleFile, got, want)
+		}
+		if got, want := len(l.Blobs), 2; got != want {
+			t.Errorf("unexpected number of blobs in the bundle %q: got %d, want %d", bundleFile, got, want)
+		}
+		if missing, err := r.Verify(context.Background(), nil); err != nil {
+			t.Errorf("failure verifying the bundle %q: %v", bundleFile, err)
+		} else if len(missing) != 0 {
+			t.Errorf("unexpected missing objects for the bundle %q: %v", bundleFile, missing)
+		}
+	}
+
+	thinBundle := filepath.Join(t.TempDir(), "thin.zip")
+	if _, err := Export(context.Background(), s, thinBundle, []*snapshot.Hash{h2}, nil, []*snapshot.Hash{h1}, nil, false, nil); err != nil {
+		t.Fatalf("failure creating the incremental bundle: %v", err)
+	}
+	r, err := OpenReader(thinBundle)
+	if err != nil {
+		t.Fatalf("failure opening the incremental bundle: %v", err)
+	}
+	defer r.Close()
+	if missing, err := r.Verify(context.Background(), nil); err != nil {
+		t.Errorf("failure verifying the incremental bundle: %v", err)
+	} else if len(missing) != 1 {
+		t.Errorf("unexpected missing objects for the incremental bundle: got %v, want the unchanged file", missing)
+	}
+	if missing, err := r.Verify(context.Background(), s); err != nil {
+		t.Errorf("failure verifying the incremental bundle against the archive: %v", err)
+	} else if len(missing) != 0 {
+		t.Errorf("unexpected missing objects for the incremental bundle against the archive: %v", missing)
+	}
+}
+
+func TestConcurrentWriter(t *testing.T) {
+	archiveDir := filepath.Join(t.TempDir(), "archive")
+	s := &storage.LocalFiles{ArchiveDir: archiveDir}
+
+	workDir := filepath.Join(t.TempDir(), "workDir")
+	var roots []*snapshot.Hash
+	for i := 0; i < 20; i++ {
+		dir := filepath.Join(workDir, fmt.Sprintf("dir-%d", i))
+		if err := os.MkdirAll(dir, os.FileMode(0700)); err != nil {
+			t.Fatalf("failure creating the directory %q: %v", dir, err)
+		}
+		// Every directory shares one file, so the roots overlap.
+		for name, contents := range map[string]string{"shared.txt": "Shared", "unique.txt": dir} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0700); err != nil {
+				t.Fatalf("failure creating the example file %q: %v", name, err)
+			}
+		}
+		h, _, err := snapshot.Current(context.Background(), s, snapshot.Path(dir))
+		if err != nil {
+			t.Fatalf("failure creating the snapshot for %q: %v", dir, err)
+		}
+		roots = append(roots, h)
+	}
+
+	bundleFile := filepath.Join(t.TempDir(), "bundle.zip")
+	out, err := os.Create(bundleFile)
+	if err != nil {
+		t.Fatalf("failure creating the bundle file: %v", err)
+	}
+	defer out.Close()
+	w, err := NewZipWriter(out, nil, nil, true)
+	if err != nil {
+		t.Fatalf("failure creating the bundle writer: %v", err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(roots))
+	for _, h := range roots {
+		wg.Add(1)
+		go func(h *snapshot.Hash) {
+			defer wg.Done()
+			errs <- w.AddRoot(context.Background(), s, h)
+		}(h)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("failure adding a root to the bundle: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failure closing the bundle writer: %v", err)
+	}
+
+	// Opening the bundle fails if any entry was written more than once.
+	r, err := OpenReader(bundleFile)
+	if err != nil {
+		t.Fatalf("failure opening the bundle: %v", err)
+	}
+	defer r.Close()
+	if got, want := len(r.Manifest().Roots), len(roots); got != want {
+		t.Errorf("unexpected number of roots: got %d, want %d", got, want)
+	}
+	if missing, err := r.Verify(context.Background(), nil); err != nil {
+		t.Errorf("failure verifying the bundle: %v", err)
+	} else if len(missing) > 0 {
+		t.Errorf("unexpected missing objects: %v", missing)
+	}
+}
+
+func TestEncryptedBundle(t *testing.T) {
+	archiveDir := filepath.Join(t.TempDir(), "archive")
+	s := &storage.LocalFiles{ArchiveDir: archiveDir}
+	workDir := filepath.Join(t.TempDir(), "workDir")
+	if err := os.MkdirAll(workDir, 0700); err != nil {
+		t.Fatalf("failure creating the work dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(workDir, "secret.txt"), []byte("Top secret!"), 0700); err != nil {
+		t.Fatalf("failure creating the example file to snapshot: %v", err)
+	}
+	h, _, err := snapshot.Current(context.Background(), s, snapshot.Path(workDir))
+	if err != nil {
+		t.Fatalf("failure creating the snapshot for the work dir: %v", err)
+	}
+
+	recipientStorage := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "recipient")}
+	recipient, err := recipientStorage.Recipient()
+	if err != nil {
+		t.Fatalf("failure reading the recipient: %v", err)
+	}
+	recipients, err := ParseRecipients(recipient.String())
+	if err != nil {
+		t.Fatalf("failure parsing the recipient %q: %v", recipient, err)
+	}
+	opts := &ExportOptions{EncryptTo: recipients}
+
+	zipBundle := filepath.Join(t.TempDir(), "bundle.zip.age")
+	if _, err := Export(context.Background(), s, zipBundle, []*snapshot.Hash{h}, nil, nil, nil, false, opts); err != nil {
+		t.Fatalf("failure creating the encrypted bundle: %v", err)
+	}
+	var encoded bytes.Buffer
+	if _, err := ExportStream(context.Background(), s, &encoded, []*snapshot.Hash{h}, nil, nil, nil, false, opts); err != nil {
+		t.Fatalf("failure streaming the encrypted bundle: %v", err)
+	}
+	if contents, err := os.ReadFile(zipBundle); err != nil {
+		t.Fatalf("failure reading the encrypted bundle: %v", err)
+	} else if bytes.Contains(contents, []byte("secret.txt")) || bytes.Contains(encoded.Bytes(), []byte("secret.txt")) {
+		t.Error("the encrypted bundles include plaintext")
+	}
+
+	if _, err := OpenReader(zipBundle); err == nil {
+		t.Error("unexpected success reading an encrypted bundle without decrypting it")
+	}
+	other := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "other")}
+	if _, _, _, err := Import(context.Background(), other, zipBundle, nil, nil); err == nil {
+		t.Error("unexpected success importing a bundle encrypted for a different recipient")
+	}
+	if roots, _, _, err := Import(context.Background(), recipientStorage, zipBundle, nil, nil); err != nil {
+		t.Errorf("failure importing the encrypted bundle: %v", err)
+	} else if len(roots) != 1 || !roots[0].Equal(h) {
+		t.Errorf("unexpected roots for the encrypted bundle: got %v, want [%q]", roots, h)
+	}
+	streamStorage := &storage.LocalFiles{ArchiveDir: archiveDir + "2"}
+	streamRecipient, err := streamStorage.Recipient()
+	if err != nil {
+		t.Fatalf("failure reading the recipient: %v", err)
+	}
+	encoded.Reset()
+	if _, err := ExportStream(context.Background(), s, &encoded, []*snapshot.Hash{h}, nil, nil, nil, false, &ExportOptions{EncryptTo: []age.Recipient{streamRecipient}}); err != nil {
+		t.Fatalf("failure streaming the encrypted bundle: %v", err)
+	}
+	if _, _, _, err := ImportStream(context.Background(), streamStorage, &encoded, nil, nil); err != nil {
+		t.Errorf("failure importing the encrypted stream: %v", err)
+	}
+	if _, err := streamStorage.ReadSnapshot(context.Background(), h); err != nil {
+		t.Errorf("missing the imported snapshot %q: %v", h, err)
+	}
+}
+
+// installTestHelpers installs sign and verify helpers for the `test`
+// algorithm, which use the signed hash as its own signature.
+func installTestHelpers(t *testing.T) *snapshot.Identity {
+	binDir := t.TempDir()
+	helpers := map[string]string{
+		"rvcs-sign-test":   "#!/bin/sh\necho \"$2\" > \"$4\"\n",
+		"rvcs-verify-test": "#!/bin/sh\necho \"$2\" > \"$3\"\n",
+	}
+	for name, script := range helpers {
+		if err := os.WriteFile(filepath.Join(binDir, name), []byte(script), 0700); err != nil {
+			t.Fatalf("failure writing the helper %q: %v", name, err)
+		}
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	id, err := snapshot.ParseIdentity("test::example")
+	if err != nil {
+		t.Fatalf("failure parsing the test identity: %v", err)
+	}
+	return id
+}
+
+func TestSignedBundle(t *testing.T) {
+	id := installTestHelpers(t)
+	archiveDir := filepath.Join(t.TempDir(), "archive")
+	s := &storage.LocalFiles{ArchiveDir: archiveDir}
+	file := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(file, []byte("Hello, World!"), 0700); err != nil {
+		t.Fatalf("failure creating the example file to snapshot: %v", err)
+	}
+	h, _, err := snapshot.Current(context.Background(), s, snapshot.Path(file))
+	if err != nil {
+		t.Fatalf("failure creating the snapshot for the file: %v", err)
+	}
+	opts := &ExportOptions{SignAs: id}
+
+	zipBundle := filepath.Join(t.TempDir(), "bundle.zip")
+	if _, err := Export(context.Background(), s, zipBundle, []*snapshot.Hash{h}, nil, nil, nil, false, opts); err != nil {
+		t.Fatalf("failure creating the signed bundle: %v", err)
+	}
+	if _, _, signer, err := Import(context.Background(), &storage.LocalFiles{ArchiveDir: archiveDir + "2"}, zipBundle, nil, &ImportOptions{RequireSigner: id}); err != nil {
+		t.Errorf("failure importing the signed bundle: %v", err)
+	} else if !signer.Equal(id) {
+		t.Errorf("unexpected signer for the imported bundle: got %q, want %q", signer, id)
+	}
+	other, err := snapshot.ParseIdentity("test::other")
+	if err != nil {
+		t.Fatalf("failure parsing the other test identity: %v", err)
+	}
+	if _, _, _, err := Import(context.Background(), &storage.LocalFiles{ArchiveDir: archiveDir + "5"}, zipBundle, nil, &ImportOptions{RequireSigner: other}); err == nil {
+		t.Error("unexpected success importing a bundle signed by a different identity than the required one")
+	}
+	unsignedBundle := filepath.Join(t.TempDir(), "unsigned.zip")
+	if _, err := Export(context.Background(), s, unsignedBundle, []*snapshot.Hash{h}, nil, nil, nil, false, nil); err != nil {
+		t.Fatalf("failure creating the unsigned bundle: %v", err)
+	}
+	if _, _, _, err := Import(context.Background(), &storage.LocalFiles{ArchiveDir: archiveDir + "6"}, unsignedBundle, nil, &ImportOptions{RequireSigner: id}); err == nil {
+		t.Error("unexpected success importing an unsigned bundle when a signer is required")
+	}
+
+	var encoded bytes.Buffer
+	if _, err := ExportStream(context.Background(), s, &encoded, []*snapshot.Hash{h}, nil, nil, nil, false, opts); err != nil {
+		t.Fatalf("failure streaming the signed bundle: %v", err)
+	}
+	if _, _, _, err := ImportStream(context.Background(), &storage.LocalFiles{ArchiveDir: archiveDir + "3"}, bytes.NewReader(encoded.Bytes()), nil, nil); err != nil {
+		t.Errorf("failure importing the signed stream: %v", err)
+	}
+
+	// Replace the signature with one for a different snapshot.
+	i := bytes.Index(encoded.Bytes(), []byte(signatureHashPath+" "))
+	if i < 0 {
+		t.Fatalf("missing the signature hash in the stream")
+	}
+	header := bytes.IndexByte(encoded.Bytes()[i:], '\n') + i + 1
+	forged := append([]byte{}, encoded.Bytes()[:header]...)
+	forged = append(forged, h.String()...)
+	forged = append(forged, encoded.Bytes()[header+len(h.String()):]...)
+	if _, _, _, err := ImportStream(context.Background(), &storage.LocalFiles{ArchiveDir: archiveDir + "4"}, bytes.NewReader(forged), nil, nil); err == nil {
+		t.Error("unexpected success importing a bundle with a forged signature")
+	}
+	// Nothing from the rejected bundle, including its signature, is stored.
+	for _, dir := range []string{"objects", "largeObjects"} {
+		filepath.WalkDir(filepath.Join(archiveDir+"4", dir), func(p string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				t.Errorf("unexpected object %q stored from the bundle with a forged signature", p)
+			}
+			return nil
+		})
+	}
+}
+
+func TestResumableImport(t *testing.T) {
+	ctx := context.Background()
+	s := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive")}
+	workDir := filepath.Join(t.TempDir(), "workDir")
+	if err := os.MkdirAll(workDir, 0700); err != nil {
+		t.Fatalf("failure creating the work dir: %v", err)
+	}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := os.WriteFile(filepath.Join(workDir, name), []byte("Contents of "+name), 0700); err != nil {
+			t.Fatalf("failure creating the example file %q: %v", name, err)
+		}
+	}
+	h, _, err := snapshot.Current(ctx, s, snapshot.Path(workDir))
+	if err != nil {
+		t.Fatalf("failure creating the snapshot for the work dir: %v", err)
+	}
+	bundleFile := filepath.Join(t.TempDir(), "bundle.zip")
+	exported, err := Export(ctx, s, bundleFile, []*snapshot.Hash{h}, nil, nil, nil, false, nil)
+	if err != nil {
+		t.Fatalf("failure creating the bundle: %v", err)
+	}
+
+	// Simulate an import that was interrupted after staging one object.
+	s2 := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive2")}
+	r, err := OpenReader(bundleFile)
+	if err != nil {
+		t.Fatalf("failure opening the bundle: %v", err)
+	}
+	stagingName, err := r.stagingName()
+	if err != nil {
+		t.Fatalf("failure naming the staging area: %v", err)
+	}
+	st, err := s2.Staging(stagingName)
+	if err != nil {
+		t.Fatalf("failure creating the staging area: %v", err)
+	}
+	first := r.objects()[0]
+	if err := stageEntry(ctx, st, bundleEntryPath(first), first, r.entries[bundleEntryPath(first)]); err != nil {
+		t.Fatalf("failure staging the object %q: %v", first, err)
+	}
+	r.Close()
+	excludeKey, err := journalExcludeKey(nil)
+	if err != nil {
+		t.Fatalf("failure keying the journal: %v", err)
+	}
+	j, err := openJournal(st.Dir(), excludeKey)
+	if err != nil {
+		t.Fatalf("failure opening the journal: %v", err)
+	}
+	if err := j.record(journalStaged, bundleEntryPath(first)); err != nil {
+		t.Fatalf("failure writing the journal: %v", err)
+	}
+	j.close()
+	if hasObject(ctx, s2, first) {
+		t.Fatalf("the staged object %q was published before the import completed", first)
+	}
+
+	roots, included, _, err := Import(ctx, s2, bundleFile, nil, nil)
+	if err != nil {
+		t.Fatalf("failure resuming the import: %v", err)
+	}
+	if len(roots) != 1 || !roots[0].Equal(h) {
+		t.Errorf("unexpected roots: got %v, want [%q]", roots, h)
+	}
+	if got, want := len(included), len(exported); got != want {
+		t.Errorf("unexpected number of imported objects: got %d, want %d", got, want)
+	}
+	for _, obj := range exported {
+		if !hasObject(ctx, s2, obj) {
+			t.Errorf("missing the imported object %q", obj)
+		}
+	}
+	if _, err := os.Stat(st.Dir()); !os.IsNotExist(err) {
+		t.Errorf("the staging area was not removed after the import: %v", err)
+	}
+
+	// A bundle with an invalid entry must not publish any of its objects.
+	valid := []byte("Valid contents")
+	validHash, err := snapshot.NewHash(bytes.NewReader(valid))
+	if err != nil {
+		t.Fatalf("failure hashing the valid contents: %v", err)
+	}
+	invalidHash, err := snapshot.NewHash(strings.NewReader("Other contents"))
+	if err != nil {
+		t.Fatalf("failure hashing the other contents: %v", err)
+	}
+	corruptFile := filepath.Join(t.TempDir(), "corrupt.zip")
+	f, err := os.Create(corruptFile)
+	if err != nil {
+		t.Fatalf("failure creating the corrupt bundle: %v", err)
+	}
+	zw := zip.NewWriter(f)
+	for _, e := range []struct {
+		h        *snapshot.Hash
+		contents []byte
+	}{{validHash, valid}, {invalidHash, []byte("Tampered contents")}} {
+		w, err := zw.Create(bundleEntryPath(e.h))
+		if err != nil {
+			t.Fatalf("failure creating a zip entry: %v", err)
+		}
+		w.Write(e.contents)
+	}
+	zw.Close()
+	f.Close()
+	s3 := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive3")}
+	if _, _, _, err := Import(ctx, s3, corruptFile, nil, nil); err == nil {
+		t.Fatal("unexpected success importing a corrupt bundle")
+	}
+	if hasObject(ctx, s3, validHash) {
+		t.Errorf("the valid object %q of a corrupt bundle was published", validHash)
+	}
+	// Importing the corrupt bundle again would fail the same way, so its
+	// staging area is not kept.
+	if entries, err := os.ReadDir(filepath.Join(s3.ArchiveDir, "staging")); err != nil && !os.IsNotExist(err) {
+		t.Errorf("failure reading the staging areas: %v", err)
+	} else if len(entries) > 0 {
+		t.Errorf("the staging area of a corrupt bundle was kept: %v", entries)
+	}
+
+	// A failure to publish the objects, on the other hand, keeps the
+	// staging area so the import can be resumed.
+	s4 := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive4")}
+	objectsDir := filepath.Join(s4.ArchiveDir, "objects")
+	if err := os.MkdirAll(s4.ArchiveDir, 0700); err != nil {
+		t.Fatalf("failure creating the archive dir: %v", err)
+	}
+	if err := os.WriteFile(objectsDir, nil, 0600); err != nil {
+		t.Fatalf("failure blocking the objects dir: %v", err)
+	}
+	if _, _, _, err := Import(ctx, s4, bundleFile, nil, nil); err == nil {
+		t.Fatal("unexpected success importing into an archive that cannot be written to")
+	}
+	if _, err := os.Stat(filepath.Join(s4.ArchiveDir, "staging", stagingName)); err != nil {
+		t.Errorf("the staging area of an interrupted import was not kept: %v", err)
+	}
+	if err := os.Remove(objectsDir); err != nil {
+		t.Fatalf("failure unblocking the objects dir: %v", err)
+	}
+	if _, _, _, err := Import(ctx, s4, bundleFile, nil, nil); err != nil {
+		t.Fatalf("failure resuming the import: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s4.ArchiveDir, "staging", stagingName)); !os.IsNotExist(err) {
+		t.Errorf("the staging area was not removed after the import: %v", err)
+	}
+}
+
+func TestResumedImportRechecksJournal(t *testing.T) {
+	ctx := context.Background()
+	s := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive")}
+	workDir := filepath.Join(t.TempDir(), "workDir")
+	if err := os.MkdirAll(workDir, 0700); err != nil {
+		t.Fatalf("failure creating the work dir: %v", err)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(workDir, name), []byte("Contents of "+name), 0700); err != nil {
+			t.Fatalf("failure creating the example file %q: %v", name, err)
+		}
+	}
+	h, _, err := snapshot.Current(ctx, s, snapshot.Path(workDir))
+	if err != nil {
+		t.Fatalf("failure creating the snapshot for the work dir: %v", err)
+	}
+	bundleFile := filepath.Join(t.TempDir(), "bundle.zip")
+	exported, err := Export(ctx, s, bundleFile, []*snapshot.Hash{h}, nil, nil, nil, false, nil)
+	if err != nil {
+		t.Fatalf("failure creating the bundle: %v", err)
+	}
+
+	r, err := OpenReader(bundleFile)
+	if err != nil {
+		t.Fatalf("failure opening the bundle: %v", err)
+	}
+	defer r.Close()
+	stagingName, err := r.stagingName()
+	if err != nil {
+		t.Fatalf("failure naming the staging area: %v", err)
+	}
+	first, second := r.objects()[0], r.objects()[1]
+
+	// interrupted simulates an import, excluding the given objects, that
+	// was interrupted after verifying one object and staging another.
+	// If `lost` is true, then the staged copy is then lost, as it was
+	// never synced to disk.
+	interrupted := func(s *storage.LocalFiles, exclude []*snapshot.Hash, verified, staged *snapshot.Hash, lost bool) {
+		st, err := s.Staging(stagingName)
+		if err != nil {
+			t.Fatalf("failure creating the staging area: %v", err)
+		}
+		if err := stageEntry(ctx, st, bundleEntryPath(staged), staged, r.entries[bundleEntryPath(staged)]); err != nil {
+			t.Fatalf("failure staging the object %q: %v", staged, err)
+		}
+		if lost {
+			filepath.WalkDir(st.Dir(), func(p string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					if err := os.WriteFile(p, nil, 0600); err != nil {
+						t.Fatalf("failure truncating the staged object %q: %v", p, err)
+					}
+				}
+				return nil
+			})
+		}
+		excludeKey, err := journalExcludeKey(exclude)
+		if err != nil {
+			t.Fatalf("failure keying the journal: %v", err)
+		}
+		j, err := openJournal(st.Dir(), excludeKey)
+		if err != nil {
+			t.Fatalf("failure opening the journal: %v", err)
+		}
+		defer j.close()
+		if err := j.record(journalVerified, bundleEntryPath(verified)); err != nil {
+			t.Fatalf("failure writing the journal: %v", err)
+		}
+		if err := j.record(journalStaged, bundleEntryPath(staged)); err != nil {
+			t.Fatalf("failure writing the journal: %v", err)
+		}
+	}
+	checkImported := func(s *storage.LocalFiles) {
+		for _, obj := range exported {
+			rc, err := s.ReadObject(ctx, obj)
+			if err != nil {
+				t.Errorf("missing the imported object %q: %v", obj, err)
+				continue
+			}
+			got, err := snapshot.NewHash(rc)
+			rc.Close()
+			if err != nil {
+				t.Errorf("failure hashing the imported object %q: %v", obj, err)
+			} else if !got.Equal(obj) {
+				t.Errorf("unexpected contents for the imported object %q: got hash %q", obj, got)
+			}
+		}
+	}
+
+	// The lost object is staged again when resuming the same import...
+	s2 := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive2")}
+	interrupted(s2, nil, first, second, true)
+	if _, _, _, err := Import(ctx, s2, bundleFile, nil, nil); err != nil {
+		t.Fatalf("failure resuming the import: %v", err)
+	}
+	checkImported(s2)
+
+	// ... and objects that are no longer excluded are imported when
+	// resuming with a different set of excluded objects.
+	s3 := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive3")}
+	interrupted(s3, []*snapshot.Hash{first}, first, second, false)
+	if _, _, _, err := Import(ctx, s3, bundleFile, nil, nil); err != nil {
+		t.Fatalf("failure resuming the import with different exclusions: %v", err)
+	}
+	checkImported(s3)
+
+	// Objects staged by the interrupted import are not published if
+	// they are excluded when resuming it.
+	s4 := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive4")}
+	interrupted(s4, nil, first, second, false)
+	if _, _, _, err := Import(ctx, s4, bundleFile, []*snapshot.Hash{second}, nil); err != nil {
+		t.Fatalf("failure resuming the import with more exclusions: %v", err)
+	}
+	if hasObject(ctx, s4, second) {
+		t.Errorf("the excluded object %q was imported", second)
+	}
+}
+
+func TestSplitBundle(t *testing.T) {
+	ctx := context.Background()
+	s := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive")}
+	workDir := filepath.Join(t.TempDir(), "workDir")
+	if err := os.MkdirAll(workDir, 0700); err != nil {
+		t.Fatalf("failure creating the work dir: %v", err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i, size := range []int{3 * MinVolumeSize, MinVolumeSize / 2, MinVolumeSize / 2, 100} {
+		contents := make([]byte, size)
+		rng.Read(contents)
+		if err := os.WriteFile(filepath.Join(workDir, fmt.Sprintf("file%d", i)), contents, 0700); err != nil {
+			t.Fatalf("failure creating the example file: %v", err)
+		}
+	}
+	h, _, err := snapshot.Current(ctx, s, snapshot.Path(workDir))
+	if err != nil {
+		t.Fatalf("failure creating the snapshot for the work dir: %v", err)
+	}
+	bundleFile := filepath.Join(t.TempDir(), "bundle.zip")
+	exported, err := Export(ctx, s, bundleFile, []*snapshot.Hash{h}, nil, nil, nil, false, &ExportOptions{MaxSize: MinVolumeSize})
+	if err != nil {
+		t.Fatalf("failure creating the split bundle: %v", err)
+	}
+	var volumes []string
+	for i := 1; ; i++ {
+		info, err := os.Stat(VolumePath(bundleFile, i))
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			t.Fatalf("failure reading volume %d: %v", i, err)
+		}
+		if info.Size() > MinVolumeSize {
+			t.Errorf("volume %d is larger than the maximum size: %d > %d", i, info.Size(), MinVolumeSize)
+		}
+		volumes = append(volumes, VolumePath(bundleFile, i))
+	}
+	if len(volumes) < 4 {
+		t.Fatalf("unexpected number of volumes: %d", len(volumes))
+	}
+
+	s2 := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive2")}
+	if _, _, _, err := ImportVolumes(ctx, s2, volumes[1:], nil, nil); err == nil {
+		t.Error("unexpected success importing a split bundle with a missing volume")
+	}
+	if _, _, _, err := Import(ctx, s2, volumes[len(volumes)-1], nil, nil); err == nil {
+		t.Error("unexpected success importing only the last volume of a split bundle")
+	}
+	for _, obj := range exported {
+		if hasObject(ctx, s2, obj) {
+			t.Errorf("the object %q was published from an incomplete split bundle", obj)
+		}
+	}
+
+	reversed := make([]string, len(volumes))
+	for i, v := range volumes {
+		reversed[len(volumes)-1-i] = v
+	}
+	roots, included, _, err := ImportVolumes(ctx, s2, reversed, nil, nil)
+	if err != nil {
+		t.Fatalf("failure importing the split bundle: %v", err)
+	}
+	if len(roots) != 1 || !roots[0].Equal(h) {
+		t.Errorf("unexpected roots: got %v, want [%q]", roots, h)
+	}
+	if got, want := len(included), len(exported); got != want {
+		t.Errorf("unexpected number of imported objects: got %d, want %d", got, want)
+	}
+	if _, err := s2.ReadSnapshot(ctx, h); err != nil {
+		t.Errorf("failure reading the imported snapshot: %v", err)
+	}
+	for _, obj := range exported {
+		if !hasObject(ctx, s2, obj) {
+			t.Errorf("missing the imported object %q", obj)
+		}
+	}
+}
+
+func TestEncryptedSplitBundle(t *testing.T) {
+	ctx := context.Background()
+	s := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive")}
+	recipientStorage := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive2")}
+	recipient, err := recipientStorage.Recipient()
+	if err != nil {
+		t.Fatalf("failure reading the recipient for the archive: %v", err)
+	}
+	// Encryption adds an authentication tag for every 64KiB, which is
+	// more than the reserved space in each volume for volumes of this
+	// size. The incompressible object is sized to fill a volume if the
+	// encryption is not accounted for.
+	const maxSize = 32 * 1024 * 1024
+	contents := make([]byte, maxSize-8*1024)
+	rand.New(rand.NewSource(1)).Read(contents)
+	file := filepath.Join(t.TempDir(), "large.bin")
+	if err := os.WriteFile(file, contents, 0700); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	h, _, err := snapshot.Current(ctx, s, snapshot.Path(file))
+	if err != nil {
+		t.Fatalf("failure creating the snapshot for the file: %v", err)
+	}
+	bundleFile := filepath.Join(t.TempDir(), "bundle.zip")
+	opts := &ExportOptions{
+		EncryptTo: []age.Recipient{recipient},
+		MaxSize:   maxSize,
+	}
+	if _, err := Export(ctx, s, bundleFile, []*snapshot.Hash{h}, nil, nil, nil, false, opts); err != nil {
+		t.Fatalf("failure creating the encrypted split bundle: %v", err)
+	}
+	var volumes []string
+	for i := 1; ; i++ {
+		info, err := os.Stat(VolumePath(bundleFile, i))
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			t.Fatalf("failure reading volume %d: %v", i, err)
+		}
+		if info.Size() > maxSize {
+			t.Errorf("volume %d is larger than the maximum size: %d > %d", i, info.Size(), maxSize)
+		}
+		volumes = append(volumes, VolumePath(bundleFile, i))
+	}
+	if len(volumes) < 2 {
+		t.Fatalf("unexpected number of volumes: %d", len(volumes))
+	}
+	if roots, _, _, err := ImportVolumes(ctx, recipientStorage, volumes, nil, nil); err != nil {
+		t.Fatalf("failure importing the encrypted split bundle: %v", err)
+	} else if len(roots) != 1 || !roots[0].Equal(h) {
+		t.Errorf("unexpected roots: got %v, want [%q]", roots, h)
+	}
+}
+
+func TestExportUnknownRoot(t *testing.T) {
+	ctx := context.Background()
+	s := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive")}
+	file := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(file, []byte("Hello, World!"), 0700); err != nil {
+		t.Fatalf("failure creating the example file to snapshot: %v", err)
+	}
+	h, _, err := snapshot.Current(ctx, s, snapshot.Path(file))
+	if err != nil {
+		t.Fatalf("failure creating the snapshot for the file: %v", err)
+	}
+	unknown, err := snapshot.NewHash(strings.NewReader("Not a stored snapshot"))
+	if err != nil {
+		t.Fatalf("failure hashing the unknown snapshot: %v", err)
+	}
+	roots := []*snapshot.Hash{h, unknown}
+
+	var encoded bytes.Buffer
+	w, err := NewZipWriter(&encoded, nil, nil, false)
+	if err != nil {
+		t.Fatalf("failure creating the bundle writer: %v", err)
+	}
+	if err := w.AddRoot(ctx, s, unknown); err == nil {
+		t.Error("unexpected success adding an unknown root")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("unexpected success closing a writer that is missing a root")
+	}
+
+	bundleFile := filepath.Join(t.TempDir(), "bundle.zip")
+	if _, err := Export(ctx, s, bundleFile, roots, nil, nil, nil, false, nil); err == nil {
+		t.Error("unexpected success exporting an unknown root")
+	}
+	if _, err := os.Stat(bundleFile); !os.IsNotExist(err) {
+		t.Errorf("the partial bundle %q was left behind: %v", bundleFile, err)
+	}
+	splitFile := filepath.Join(t.TempDir(), "split.zip")
+	if _, err := Export(ctx, s, splitFile, roots, nil, nil, nil, false, &ExportOptions{MaxSize: MinVolumeSize}); err == nil {
+		t.Error("unexpected success exporting an unknown root to a split bundle")
+	}
+	if entries, err := os.ReadDir(filepath.Dir(splitFile)); err != nil {
+		t.Errorf("failure listing the split bundle's directory: %v", err)
+	} else if len(entries) > 0 {
+		t.Errorf("the partial volumes %v were left behind", entries)
+	}
+}
+
+func TestSealedFile(t *testing.T) {
+	plaintext := make([]byte, 3*maxMemorySpool+7)
+	for i := range plaintext {
+		plaintext[i] = byte(i % 251)
+	}
+	sf, err := newSealedFile("rvcs-test-")
+	if err != nil {
+		t.Fatalf("failure creating the sealed file: %v", err)
+	}
+	defer sf.Close()
+	// Write in uneven pieces so that writes start mid-block.
+	for rest := plaintext; len(rest) > 0; {
+		n := 1021
+		if n > len(rest) {
+			n = len(rest)
+		}
+		if _, err := sf.Write(rest[:n]); err != nil {
+			t.Fatalf("failure writing to the sealed file: %v", err)
+		}
+		rest = rest[n:]
+	}
+	stored, err := os.ReadFile(sf.f.Name())
+	if err != nil {
+		t.Fatalf("failure reading the sealed file: %v", err)
+	}
+	if bytes.Contains(stored, plaintext[:64]) {
+		t.Error("the sealed file holds its plaintext")
+	}
+	if got, err := io.ReadAll(sf.reader()); err != nil {
+		t.Fatalf("failure reading back the sealed file: %v", err)
+	} else if !bytes.Equal(got, plaintext) {
+		t.Error("unexpected contents read back from the sealed file")
+	}
+	for _, offset := range []int64{0, 1, 15, 16, 17, 4099, int64(len(plaintext)) - 3} {
+		got := make([]byte, 3)
+		if _, err := sf.ReadAt(got, offset); err != nil {
+			t.Fatalf("failure reading the sealed file at %d: %v", offset, err)
+		}
+		if !bytes.Equal(got, plaintext[offset:offset+3]) {
+			t.Errorf("unexpected contents at offset %d: got %v, want %v", offset, got, plaintext[offset:offset+3])
+		}
+	}
+	name := sf.f.Name()
+	if err := sf.Close(); err != nil {
+		t.Errorf("failure closing the sealed file: %v", err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("the sealed file was not removed: %v", err)
+	}
+}
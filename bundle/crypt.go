@@ -0,0 +1,148 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bundle defines methods for bundling snapshots together so they can be imported and/or exported.
+package bundle
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+const (
+	// ageHeader is the first line of every age-encrypted file.
+	ageHeader = "age-encryption.org/v1"
+
+	// ageHeaderOverhead is an upper bound on the size of an age header,
+	// excluding the recipient stanzas.
+	ageHeaderOverhead = 256
+
+	// ageStanzaOverhead is an upper bound on the size of the header
+	// stanza for each recipient.
+	ageStanzaOverhead = 1024
+
+	// ageChunkSize is the size of the chunks that age encrypts the
+	// payload in, each of which is followed by an authentication tag.
+	ageChunkSize = 64 * 1024
+
+	// ageNonceSize and ageTagSize are the sizes of the payload nonce
+	// and of the authentication tag for each chunk, respectively.
+	ageNonceSize = 16
+	ageTagSize   = 16
+)
+
+// ParseRecipients parses a comma separated list of age recipients, such as
+// the one printed by `rvcs bundle recipient`.
+func ParseRecipients(str string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, part := range strings.Split(str, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		r, err := age.ParseX25519Recipient(part)
+		if err != nil {
+			return nil, fmt.Errorf("failure parsing the age recipient %q: %v", part, err)
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
+
+// isEncrypted reports whether or not the given reader starts with an age
+// header, without consuming any of it.
+func isEncrypted(r *bufio.Reader) bool {
+	prefix, err := r.Peek(len(ageHeader) + 1)
+	return err == nil && string(prefix) == ageHeader+"\n"
+}
+
+// nopWriteCloser adds a no-op Close method to a writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// encrypt returns a writer that encrypts everything written to it for the
+// recipients of the options, if there are any.
+//
+// The returned writer must be closed to finish the encryption, but closing
+// it does not close the underlying writer.
+func (opts *ExportOptions) encrypt(w io.Writer) (io.WriteCloser, error) {
+	if opts == nil || len(opts.EncryptTo) == 0 {
+		return nopWriteCloser{w}, nil
+	}
+	ew, err := age.Encrypt(w, opts.EncryptTo...)
+	if err != nil {
+		return nil, fmt.Errorf("failure creating the encrypted writer for the bundle: %v", err)
+	}
+	return ew, nil
+}
+
+// Open opens the bundle at the given path for reading, decrypting it with
+// the local identity of the given storage if it is encrypted.
+//
+// Encrypted bundles are decrypted into a sealed temporary file, so that
+// their plaintext is never stored on disk, and the file is removed when the
+// returned reader is closed.
+func Open(s *storage.LocalFiles, path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failure opening the bundle %q: %v", path, err)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if !isEncrypted(br) {
+		return OpenReader(path)
+	}
+	plaintext, err := s.Decrypt(br)
+	if err != nil {
+		return nil, fmt.Errorf("failure decrypting the bundle %q: %v", path, err)
+	}
+	tmp, err := newSealedFile("rvcs-bundle-")
+	if err != nil {
+		return nil, fmt.Errorf("failure creating a temp file for the decrypted bundle: %v", err)
+	}
+	if _, err := io.Copy(tmp, plaintext); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failure decrypting the bundle %q: %v", path, err)
+	}
+	r, err := newReader(tmp, path, tmp.Size())
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// encryptionOverhead returns an upper bound on the number of bytes added
+// by encrypting up to the given number of bytes for the recipients of the
+// options, or zero if the options do not encrypt.
+func (opts *ExportOptions) encryptionOverhead(size int64) int64 {
+	if opts == nil || len(opts.EncryptTo) == 0 {
+		return 0
+	}
+	// The last chunk is always tagged, even if it is empty.
+	chunks := size/ageChunkSize + 1
+	return ageHeaderOverhead + int64(len(opts.EncryptTo))*ageStanzaOverhead + ageNonceSize + chunks*ageTagSize
+}
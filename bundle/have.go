@@ -0,0 +1,99 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bundle defines methods for bundling snapshots together so they can be imported and/or exported.
+package bundle
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+// addReachable adds every object reachable from the given snapshot to the
+// given set, including its contents, its children if it is a directory,
+// and, if `followParents` is true, its history.
+//
+// Snapshots that are not available locally are added without being
+// traversed, since the history of a snapshot may be incomplete.
+func addReachable(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, followParents bool, reachable map[snapshot.Hash]struct{}) error {
+	pending := []*snapshot.Hash{h}
+	for len(pending) > 0 {
+		h := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if _, ok := reachable[*h]; ok {
+			continue
+		}
+		reachable[*h] = struct{}{}
+		f, err := s.ReadSnapshot(ctx, h)
+		if err != nil {
+			continue
+		}
+		if followParents {
+			pending = append(pending, f.Parents...)
+		}
+		if f.Contents == nil {
+			continue
+		}
+		reachable[*f.Contents] = struct{}{}
+		if !f.IsDir() {
+			continue
+		}
+		tree, err := s.ListDirectorySnapshotContents(ctx, h, f)
+		if err != nil {
+			return fmt.Errorf("failure reading the contents of the directory snapshot %q: %v", h, err)
+		}
+		for _, childHash := range tree {
+			pending = append(pending, childHash)
+		}
+	}
+	return nil
+}
+
+// AddHave records snapshots that the recipient of the bundle already has.
+//
+// Everything reachable from those snapshots, including their history, is
+// then omitted from the bundle. This must be called before any snapshots
+// are added to the bundle.
+func (w *Writer) AddHave(ctx context.Context, s *storage.LocalFiles, have []*snapshot.Hash) error {
+	reachable := make(map[snapshot.Hash]struct{})
+	for _, h := range have {
+		if err := addReachable(ctx, s, h, true, reachable); err != nil {
+			return fmt.Errorf("failure listing the objects reachable from %q: %v", h, err)
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for h := range reachable {
+		w.have[h] = struct{}{}
+	}
+	w.haveList = append(w.haveList, have...)
+	return nil
+}
+
+// checkHave verifies that every snapshot the bundle was created against is
+// already present, since the bundle omits everything reachable from them.
+func checkHave(ctx context.Context, s *storage.LocalFiles, m *Manifest) error {
+	if m == nil {
+		return nil
+	}
+	for _, h := range m.Have {
+		if _, err := s.ReadSnapshot(ctx, h); err != nil {
+			return fmt.Errorf("the bundle requires the snapshot %q, which is not present: %v", h, err)
+		}
+	}
+	return nil
+}
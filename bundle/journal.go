@@ -0,0 +1,179 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bundle defines methods for bundling snapshots together so they can be imported and/or exported.
+package bundle
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+)
+
+const (
+	// journalFile is the name of the journal within the staging area of
+	// an import.
+	journalFile = "journal"
+
+	// journalStaged marks an object entry that was validated and staged.
+	journalStaged = "staged"
+
+	// journalVerified marks an entry that was validated but did not
+	// need to be staged.
+	journalVerified = "verified"
+
+	// journalValidated marks that every entry of the bundle was
+	// validated, so the staged objects can be published.
+	journalValidated = "validated"
+
+	// journalExclude is the first record of the journal, and identifies
+	// the set of objects excluded from the import.
+	journalExclude = "exclude"
+)
+
+// importJournal records the progress of importing a bundle so that an
+// interrupted import can be resumed rather than restarted.
+//
+// The journal has one line per record, and each record is synced to disk
+// as it is written.
+//
+// Whether an entry needs to be staged depends on the objects excluded from
+// the import, so the journal is discarded when an import is resumed with a
+// different set of excluded objects.
+type importJournal struct {
+	f *os.File
+
+	// exclude identifies the set of objects excluded from the import
+	// that wrote the journal, and is only valid if `keyed` is true.
+	exclude string
+	keyed   bool
+
+	// done maps the names of the entries that were already handled to
+	// the kind of their record.
+	done      map[string]string
+	validated bool
+}
+
+// openJournal opens the journal in the given directory, reading any records
+// written by an earlier import of the same bundle that excluded the same
+// set of objects, as identified by `excludeKey`.
+func openJournal(dir, excludeKey string) (*importJournal, error) {
+	p := filepath.Join(dir, journalFile)
+	j := &importJournal{done: make(map[string]string)}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if f, err := os.Open(p); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			kind, name, _ := strings.Cut(scanner.Text(), " ")
+			j.apply(kind, name)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failure reading the import journal %q: %v", p, err)
+		}
+		if !j.keyed || j.exclude != excludeKey {
+			// The earlier import may have excluded different
+			// objects, so its records cannot be trusted for
+			// this one.
+			j = &importJournal{done: make(map[string]string)}
+			flags |= os.O_TRUNC
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failure opening the import journal %q: %v", p, err)
+	}
+	f, err := os.OpenFile(p, flags, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failure opening the import journal %q for writing: %v", p, err)
+	}
+	j.f = f
+	if !j.keyed {
+		if err := j.record(journalExclude, excludeKey); err != nil {
+			j.close()
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// journalExcludeKey returns the key identifying the given set of objects
+// excluded from an import.
+func journalExcludeKey(exclude []*snapshot.Hash) (string, error) {
+	var lines []string
+	for _, h := range exclude {
+		lines = append(lines, h.String())
+	}
+	sort.Strings(lines)
+	lines = uniqueLines(lines)
+	h, err := snapshot.NewHash(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return "", fmt.Errorf("failure hashing the excluded objects: %v", err)
+	}
+	return h.String(), nil
+}
+
+// uniqueLines removes adjacent duplicates from the given sorted lines.
+func uniqueLines(lines []string) []string {
+	var unique []string
+	for i, line := range lines {
+		if i == 0 || line != lines[i-1] {
+			unique = append(unique, line)
+		}
+	}
+	return unique
+}
+
+// record appends a record for the named entry to the journal.
+func (j *importJournal) record(kind, name string) error {
+	line := kind
+	if len(name) > 0 {
+		line += " " + name
+	}
+	if _, err := j.f.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("failure writing to the import journal: %v", err)
+	}
+	if err := j.f.Sync(); err != nil {
+		return fmt.Errorf("failure syncing the import journal: %v", err)
+	}
+	j.apply(kind, name)
+	return nil
+}
+
+// apply updates the in-memory state of the journal with a single record.
+func (j *importJournal) apply(kind, name string) {
+	switch kind {
+	case journalStaged, journalVerified:
+		j.done[name] = kind
+	case journalValidated:
+		j.validated = true
+	case journalExclude:
+		j.exclude = name
+		j.keyed = true
+	}
+}
+
+// close closes the journal file. It is safe to call more than once.
+func (j *importJournal) close() error {
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
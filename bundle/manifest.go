@@ -0,0 +1,204 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bundle defines methods for bundling snapshots together so they can be imported and/or exported.
+package bundle
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime/debug"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+)
+
+const (
+	// ManifestVersion is the version of the manifest schema written
+	// into new bundles.
+	ManifestVersion = 1
+
+	// manifestPath is the path of the manifest entry within a bundle.
+	manifestPath = "manifest.json"
+)
+
+// RVCSVersion is the version of rvcs recorded in the manifests of new
+// bundles.
+var RVCSVersion = func() string {
+	if info, ok := debug.ReadBuildInfo(); ok && len(info.Main.Version) > 0 {
+		return info.Main.Version
+	}
+	return "(devel)"
+}()
+
+// Manifest describes the contents of a bundle.
+type Manifest struct {
+	// Version is the version of the manifest schema.
+	Version int
+
+	// Roots are the snapshots that were requested when the bundle was
+	// created. Every other object in the bundle is reachable from them.
+	Roots []*snapshot.Hash
+
+	// Exclude are the objects that were left out of the bundle because
+	// the recipient was expected to already have them.
+	Exclude []*snapshot.Hash
+
+	// Have are the snapshots that the recipient was expected to already
+	// have. Everything reachable from them was left out of the bundle.
+	Have []*snapshot.Hash
+
+	// HashFunction is the name of the hash function used for every
+	// object in the bundle.
+	HashFunction string
+
+	// RVCSVersion is the version of rvcs that created the bundle.
+	RVCSVersion string
+
+	// ObjectCount is the number of objects in the bundle.
+	ObjectCount int
+}
+
+type rawManifest struct {
+	Version      int      `json:"version"`
+	Roots        []string `json:"roots"`
+	Exclude      []string `json:"exclude,omitempty"`
+	Have         []string `json:"have,omitempty"`
+	HashFunction string   `json:"hashFunction"`
+	RVCSVersion  string   `json:"rvcsVersion,omitempty"`
+	ObjectCount  int      `json:"objectCount"`
+}
+
+func hashStrings(hashes []*snapshot.Hash) []string {
+	var result []string
+	for _, h := range hashes {
+		result = append(result, h.String())
+	}
+	return result
+}
+
+func parseHashes(strs []string) ([]*snapshot.Hash, error) {
+	var result []*snapshot.Hash
+	for _, str := range strs {
+		h, err := snapshot.ParseHash(str)
+		if err != nil {
+			return nil, fmt.Errorf("failure parsing the hash %q: %v", str, err)
+		}
+		if h == nil {
+			return nil, fmt.Errorf("empty hash in %v", strs)
+		}
+		result = append(result, h)
+	}
+	return result, nil
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (m *Manifest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&rawManifest{
+		Version:      m.Version,
+		Roots:        hashStrings(m.Roots),
+		Exclude:      hashStrings(m.Exclude),
+		Have:         hashStrings(m.Have),
+		HashFunction: m.HashFunction,
+		RVCSVersion:  m.RVCSVersion,
+		ObjectCount:  m.ObjectCount,
+	})
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (m *Manifest) UnmarshalJSON(text []byte) error {
+	var raw rawManifest
+	if err := json.Unmarshal(text, &raw); err != nil {
+		return err
+	}
+	roots, err := parseHashes(raw.Roots)
+	if err != nil {
+		return fmt.Errorf("failure parsing the manifest roots: %v", err)
+	}
+	exclude, err := parseHashes(raw.Exclude)
+	if err != nil {
+		return fmt.Errorf("failure parsing the manifest exclude list: %v", err)
+	}
+	have, err := parseHashes(raw.Have)
+	if err != nil {
+		return fmt.Errorf("failure parsing the manifest have list: %v", err)
+	}
+	m.Version = raw.Version
+	m.Roots = roots
+	m.Exclude = exclude
+	m.Have = have
+	m.HashFunction = raw.HashFunction
+	m.RVCSVersion = raw.RVCSVersion
+	m.ObjectCount = raw.ObjectCount
+	return nil
+}
+
+// decodeManifest parses the manifest from the given bundle entry.
+func decodeManifest(open func() (io.ReadCloser, error)) (*Manifest, error) {
+	r, err := open()
+	if err != nil {
+		return nil, fmt.Errorf("failure opening the manifest: %v", err)
+	}
+	defer r.Close()
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failure parsing the manifest: %v", err)
+	}
+	return &m, nil
+}
+
+// validate checks that the manifest is consistent with the given objects
+// from the bundle it describes.
+//
+// Roots that are reachable from the have snapshots are left out of the
+// bundle too, so if there are any have snapshots then a root that is not
+// in the bundle must instead be reported as already stored by `stored`.
+// If `stored` is nil, then such roots are not checked at all; this is only
+// meant for callers that otherwise report the roots that are missing.
+func (m *Manifest) validate(objects []*snapshot.Hash, stored func(*snapshot.Hash) bool) error {
+	if m.Version < 1 || m.Version > ManifestVersion {
+		return fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	if !snapshot.IsSupportedHashFunction(m.HashFunction) {
+		return fmt.Errorf("unsupported hash function %q", m.HashFunction)
+	}
+	if m.ObjectCount != len(objects) {
+		return fmt.Errorf("the manifest lists %d objects, but the bundle has %d", m.ObjectCount, len(objects))
+	}
+	present := make(map[snapshot.Hash]struct{})
+	for _, h := range objects {
+		if h.Function() != m.HashFunction {
+			return fmt.Errorf("the object %q does not use the hash function %q", h, m.HashFunction)
+		}
+		present[*h] = struct{}{}
+	}
+	for _, h := range m.Exclude {
+		present[*h] = struct{}{}
+	}
+	for _, h := range m.Have {
+		present[*h] = struct{}{}
+	}
+	for _, root := range m.Roots {
+		if _, ok := present[*root]; ok {
+			continue
+		}
+		if len(m.Have) == 0 {
+			return fmt.Errorf("the root %q is neither in the bundle nor excluded from it", root)
+		}
+		if stored != nil && !stored(root) {
+			return fmt.Errorf("the root %q is neither in the bundle nor already stored", root)
+		}
+	}
+	return nil
+}
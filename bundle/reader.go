@@ -0,0 +1,657 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bundle defines methods for bundling snapshots together so they can be imported and/or exported.
+package bundle
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+// maxSnapshotSize limits the size of objects that are parsed to check
+// whether or not they are snapshots.
+const maxSnapshotSize = 64 * 1024
+
+type readerEntry struct {
+	size int64
+	open func() (io.ReadCloser, error)
+}
+
+// bundleFile is the random access file that a bundle is read from.
+type bundleFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// Reader provides access to the entries of a bundle file, in either the zip
+// or the streaming encoding, without importing it.
+type Reader struct {
+	f        bundleFile
+	path     string
+	names    []string
+	entries  map[string]*readerEntry
+	manifest *Manifest
+
+	// volume describes the volume of a split bundle that the file holds,
+	// if it is one.
+	volume *volumeInfo
+
+	// volumes are the readers for the individual volumes, if this is a
+	// reader for a whole split bundle.
+	volumes []*Reader
+}
+
+// OpenReader opens the bundle at the given path for reading.
+//
+// The caller is responsible for closing the returned reader.
+func OpenReader(path string) (r *Reader, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failure opening the bundle %q: %v", path, err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the file info for %q: %v", path, err)
+	}
+	return newReader(f, path, info.Size())
+}
+
+// newReader reads the entries of the bundle in the given file, which has
+// the given size and was read from the given path.
+//
+// The file is not closed if an error is returned.
+func newReader(f bundleFile, path string, size int64) (*Reader, error) {
+	r := &Reader{
+		f:       f,
+		path:    path,
+		entries: make(map[string]*readerEntry),
+	}
+	header := make([]byte, len(streamHeader)+1)
+	_, readErr := io.ReadFull(io.NewSectionReader(f, 0, size), header)
+	var err error
+	if readErr == nil && string(header) == streamHeader+"\n" {
+		err = r.indexStream(int64(len(header)), size)
+	} else if readErr == nil && strings.HasPrefix(string(header), ageHeader) {
+		return nil, fmt.Errorf("the bundle %q is encrypted", path)
+	} else {
+		err = r.indexZip(size)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the entries of the bundle %q: %v", path, err)
+	}
+	if manifest, ok := r.entries[manifestPath]; ok {
+		if r.manifest, err = decodeManifest(manifest.open); err != nil {
+			return nil, err
+		}
+	}
+	if volume, ok := r.entries[volumePath]; ok {
+		if r.volume, err = decodeVolumeInfo(volume.open); err != nil {
+			return nil, fmt.Errorf("failure reading the volume entry of %q: %v", path, err)
+		}
+	}
+	return r, nil
+}
+
+func (r *Reader) addEntry(name string, entry *readerEntry) error {
+	if _, ok := r.entries[name]; ok {
+		return fmt.Errorf("duplicate entry %q", name)
+	}
+	r.names = append(r.names, name)
+	r.entries[name] = entry
+	return nil
+}
+
+func (r *Reader) indexZip(size int64) error {
+	zr, err := zip.NewReader(r.f, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		if err := r.addEntry(zf.Name, &readerEntry{size: int64(zf.UncompressedSize64), open: zf.Open}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Reader) indexStream(offset, size int64) error {
+	br := bufio.NewReader(io.NewSectionReader(r.f, offset, size-offset))
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return errors.New("the stream ended before the end marker")
+		}
+		offset += int64(len(line))
+		name, size, err := readStreamEntryHeader(bufio.NewReader(strings.NewReader(line)))
+		if err != nil {
+			return err
+		}
+		if len(name) == 0 {
+			return nil
+		}
+		if n, err := br.Discard(int(size)); err != nil || int64(n) != size {
+			return fmt.Errorf("the entry %q is truncated", name)
+		}
+		entryOffset := offset
+		if err := r.addEntry(name, &readerEntry{
+			size: size,
+			open: func() (io.ReadCloser, error) {
+				return io.NopCloser(io.NewSectionReader(r.f, entryOffset, size)), nil
+			},
+		}); err != nil {
+			return err
+		}
+		offset += size
+	}
+}
+
+// Close closes the underlying bundle file, which also removes it if it was
+// decrypted into a temporary file.
+//
+// For a split bundle, this closes the file of every volume.
+func (r *Reader) Close() error {
+	if r.f == nil {
+		var err error
+		for _, v := range r.volumes {
+			if closeErr := v.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}
+	return r.f.Close()
+}
+
+// Manifest returns the manifest of the bundle, or nil if the bundle was
+// created before manifests were introduced.
+func (r *Reader) Manifest() *Manifest {
+	return r.manifest
+}
+
+// Names returns the names of all of the entries in the bundle.
+func (r *Reader) Names() []string {
+	return r.names
+}
+
+func (r *Reader) objects() []*snapshot.Hash {
+	var objects []*snapshot.Hash
+	for _, name := range r.names {
+		if h, err := bundlePathHash(name); err == nil {
+			objects = append(objects, h)
+		}
+	}
+	return objects
+}
+
+// readSignature reads the encoded manifest and the signature entries of
+// the bundle.
+func (r *Reader) readSignature() (manifestBytes []byte, entries map[string][]byte, err error) {
+	entries = make(map[string][]byte)
+	for _, name := range r.names {
+		if !isSignatureEntry(name) {
+			continue
+		}
+		rc, err := r.entries[name].open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failure opening the bundle entry %q: %v", name, err)
+		}
+		contents, err := readSignatureEntry(name, rc)
+		rc.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		entries[name] = contents
+	}
+	if manifest, ok := r.entries[manifestPath]; ok && len(entries) > 0 {
+		rc, err := manifest.open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failure opening the manifest: %v", err)
+		}
+		defer rc.Close()
+		if manifestBytes, err = io.ReadAll(rc); err != nil {
+			return nil, nil, fmt.Errorf("failure reading the manifest: %v", err)
+		}
+	}
+	return manifestBytes, entries, nil
+}
+
+// stagingName returns the name of the staging area used for importing the
+// bundle.
+//
+// The name is derived from the names and sizes of the bundle's entries, so
+// that importing the same bundle again resumes an interrupted import.
+func (r *Reader) stagingName() (string, error) {
+	var index strings.Builder
+	for _, name := range r.names {
+		fmt.Fprintf(&index, "%s %d\n", name, r.entries[name].size)
+	}
+	h, err := snapshot.NewHash(strings.NewReader(index.String()))
+	if err != nil {
+		return "", fmt.Errorf("failure hashing the index of the bundle: %v", err)
+	}
+	return "import-" + h.HexContents(), nil
+}
+
+// invalidBundleError reports that the contents of a bundle failed
+// validation, as opposed to a failure reading the bundle or storing its
+// objects.
+//
+// Importing the same bundle again would fail the same way, so the staging
+// area of an import that fails with this error is removed rather than kept
+// for resuming the import.
+type invalidBundleError struct {
+	err error
+}
+
+func (e *invalidBundleError) Error() string {
+	return e.err.Error()
+}
+
+func (e *invalidBundleError) Unwrap() error {
+	return e.err
+}
+
+func invalidBundle(format string, args ...interface{}) error {
+	return &invalidBundleError{err: fmt.Errorf(format, args...)}
+}
+
+// importObjects validates the bundle, including its signature if it has
+// one, and then imports every object in it that is not already present or
+// explicitly excluded.
+//
+// The objects are first stored in a staging area of the archive, and are
+// only published once every entry of the bundle has been validated. The
+// progress is recorded in a journal in the staging area, so if the import
+// is interrupted, then importing the same bundle again resumes it. The
+// staging area is removed once the import completes, or if the bundle
+// fails validation. It is kept if the import fails for any other reason,
+// e.g. an I/O error, until the same bundle is imported again.
+func (r *Reader) importObjects(ctx context.Context, s *storage.LocalFiles, exclude []*snapshot.Hash, opts *ImportOptions) (roots []*snapshot.Hash, included []*snapshot.Hash, signer *snapshot.Identity, err error) {
+	if r.manifest != nil {
+		stored := func(h *snapshot.Hash) bool { return hasObject(ctx, s, h) }
+		if err := r.manifest.validate(r.objects(), stored); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid manifest: %v", err)
+		}
+		if err := checkHave(ctx, s, r.manifest); err != nil {
+			return nil, nil, nil, err
+		}
+		roots = r.manifest.Roots
+	}
+	manifestBytes, signature, err := r.readSignature()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stagingName, err := r.stagingName()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	st, err := s.Staging(stagingName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer func() {
+		var invalid *invalidBundleError
+		if errors.As(err, &invalid) {
+			st.Remove()
+		}
+	}()
+	signer, err = verifySignature(ctx, s, st, manifestBytes, r.manifest, signature, opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	excludeMap := make(map[snapshot.Hash]struct{})
+	for _, h := range exclude {
+		excludeMap[*h] = struct{}{}
+	}
+
+	excludeKey, err := journalExcludeKey(exclude)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	j, err := openJournal(st.Dir(), excludeKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer j.close()
+	for _, name := range r.names {
+		entry := r.entries[name]
+		h, err := bundlePathHash(name)
+		if err != nil {
+			if j.validated {
+				continue
+			}
+			// We allow additional/non-object files in bundles
+			if err := validateEntry(ctx, name, entry.open); err != nil {
+				return nil, nil, nil, fmt.Errorf("failure validating the bundle entry %q: %w", name, err)
+			}
+			continue
+		}
+		_, excluded := excludeMap[*h]
+		switch j.done[name] {
+		case journalVerified:
+			if excluded || hasObject(ctx, s, h) {
+				continue
+			}
+		case journalStaged:
+			// Staged objects are not synced to disk, so they are
+			// checked again rather than trusted because they exist.
+			// Once validated, they may also have been published
+			// before the import was interrupted.
+			if st.VerifyObject(ctx, h) || (j.validated && hasObject(ctx, s, h)) {
+				continue
+			}
+		}
+		if excluded || hasObject(ctx, s, h) {
+			// We only need to verify objects that we do not store.
+			if err := validateEntry(ctx, name, entry.open); err != nil {
+				return nil, nil, nil, fmt.Errorf("failure validating the bundle entry %q: %w", name, err)
+			}
+			// The object may have been staged by an earlier
+			// import that did not exclude it.
+			if err := st.RemoveObject(ctx, h); err != nil {
+				return nil, nil, nil, err
+			}
+			if err := j.record(journalVerified, name); err != nil {
+				return nil, nil, nil, err
+			}
+			continue
+		}
+		if err := stageEntry(ctx, st, name, h, entry); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := j.record(journalStaged, name); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if !j.validated {
+		if err := j.record(journalValidated, ""); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if err := st.Publish(ctx); err != nil {
+		return nil, nil, nil, err
+	}
+	for _, name := range r.names {
+		if j.done[name] != journalStaged {
+			continue
+		}
+		if h, err := bundlePathHash(name); err == nil {
+			included = append(included, h)
+		}
+	}
+	j.close()
+	if err := st.Remove(); err != nil {
+		return nil, nil, nil, fmt.Errorf("failure removing the staging area of the import: %v", err)
+	}
+	return roots, included, signer, nil
+}
+
+// hasObject reports whether or not the given object is already stored.
+func hasObject(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash) bool {
+	rc, err := s.ReadObject(ctx, h)
+	if err != nil {
+		return false
+	}
+	rc.Close()
+	return true
+}
+
+// stageEntry stores the contents of the given bundle entry in the staging
+// area, verifying that they match the hash in the entry's name.
+func stageEntry(ctx context.Context, st *storage.Staging, name string, h *snapshot.Hash, entry *readerEntry) error {
+	rc, err := entry.open()
+	if err != nil {
+		return fmt.Errorf("failure reading entry %q: %v", name, err)
+	}
+	defer rc.Close()
+	got, err := st.StoreObject(ctx, entry.size, rc)
+	if err != nil {
+		return fmt.Errorf("failure staging the bundle entry %q: %v", name, err)
+	}
+	if !got.Equal(h) {
+		st.RemoveObject(ctx, got)
+		return invalidBundle("mismatched hash for entry %q: got %q, want %q", name, got, h)
+	}
+	return nil
+}
+
+func (r *Reader) readObject(h *snapshot.Hash) ([]byte, bool, error) {
+	entry, ok := r.entries[bundleEntryPath(h)]
+	if !ok {
+		return nil, false, nil
+	}
+	rc, err := entry.open()
+	if err != nil {
+		return nil, false, fmt.Errorf("failure opening the bundle entry for %q: %v", h, err)
+	}
+	defer rc.Close()
+	contents, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, false, fmt.Errorf("failure reading the bundle entry for %q: %v", h, err)
+	}
+	return contents, true, nil
+}
+
+// Listing summarizes the contents of a bundle.
+type Listing struct {
+	// Manifest is the manifest of the bundle, if it has one.
+	Manifest *Manifest
+
+	// Metadata are the keys of the metadata entries in the bundle.
+	Metadata []string
+
+	// Signer is the identity that the bundle claims to be signed by, if
+	// it is signed. The signature is only verified when importing.
+	Signer string
+
+	// Snapshots are the file snapshots in the bundle.
+	Snapshots []*snapshot.Hash
+
+	// Trees are the directory contents in the bundle.
+	Trees []*snapshot.Hash
+
+	// Blobs are the contents of all other files in the bundle, along
+	// with any objects that could not be classified.
+	Blobs []*snapshot.Hash
+}
+
+// List summarizes the entries in the bundle.
+//
+// Objects are classified by parsing the ones small enough to be snapshots,
+// and then by how they are referenced from those snapshots.
+func (r *Reader) List() (*Listing, error) {
+	l := &Listing{Manifest: r.manifest}
+	snapshots := make(map[snapshot.Hash]bool)
+	references := make(map[snapshot.Hash]bool)
+	for _, name := range r.names {
+		if strings.HasPrefix(name, "metadata/") {
+			l.Metadata = append(l.Metadata, strings.TrimPrefix(name, "metadata/"))
+			continue
+		}
+		if name == signatureIdentityPath {
+			rc, err := r.entries[name].open()
+			if err != nil {
+				return nil, fmt.Errorf("failure opening the bundle entry %q: %v", name, err)
+			}
+			signer, err := readSignatureEntry(name, rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			l.Signer = strings.TrimSpace(string(signer))
+			continue
+		}
+		h, err := bundlePathHash(name)
+		if err != nil || r.entries[name].size > maxSnapshotSize {
+			continue
+		}
+		contents, _, err := r.readObject(h)
+		if err != nil {
+			return nil, err
+		}
+		if f, err := snapshot.ParseFile(string(contents)); err == nil && f != nil {
+			snapshots[*h] = true
+			references[*f.Contents] = references[*f.Contents] || f.IsDir()
+		}
+	}
+	for _, h := range r.objects() {
+		if isTree, ok := references[*h]; ok {
+			if isTree {
+				l.Trees = append(l.Trees, h)
+			} else {
+				l.Blobs = append(l.Blobs, h)
+			}
+		} else if snapshots[*h] {
+			l.Snapshots = append(l.Snapshots, h)
+		} else {
+			l.Blobs = append(l.Blobs, h)
+		}
+	}
+	return l, nil
+}
+
+// Verify checks that the contents of every object in the bundle match its
+// hash, and that the bundle is consistent with its manifest.
+//
+// It then returns the objects reachable from the roots of the bundle that
+// are neither in the bundle nor already in the given storage, if any. The
+// history of each snapshot is followed as far as it is available, but
+// missing parents are not reported since the history of a snapshot may be
+// deliberately left out of a bundle.
+//
+// The storage is only read from, and may be nil.
+func (r *Reader) Verify(ctx context.Context, s *storage.LocalFiles) (missing []*snapshot.Hash, err error) {
+	for _, name := range r.names {
+		if err := validateEntry(ctx, name, r.entries[name].open); err != nil {
+			return nil, err
+		}
+	}
+	if r.manifest == nil {
+		return nil, nil
+	}
+	// Any roots that are neither in the bundle nor in the storage are
+	// reported as missing below.
+	if err := r.manifest.validate(r.objects(), nil); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+
+	// The `required` flag is false for parents, which may be missing.
+	type pendingObject struct {
+		h        *snapshot.Hash
+		required bool
+	}
+	var pending []pendingObject
+	for _, root := range r.manifest.Roots {
+		pending = append(pending, pendingObject{h: root, required: true})
+	}
+	visited := make(map[snapshot.Hash]struct{})
+	read := func(h *snapshot.Hash) ([]byte, bool, error) {
+		if contents, ok, err := r.readObject(h); ok || err != nil {
+			return contents, ok, err
+		}
+		if s == nil {
+			return nil, false, nil
+		}
+		rc, err := s.ReadObject(ctx, h)
+		if err != nil {
+			return nil, false, nil
+		}
+		defer rc.Close()
+		contents, err := io.ReadAll(rc)
+		if err != nil {
+			return nil, false, fmt.Errorf("failure reading the object %q: %v", h, err)
+		}
+		return contents, true, nil
+	}
+	present := func(h *snapshot.Hash) bool {
+		if _, ok := r.entries[bundleEntryPath(h)]; ok {
+			return true
+		}
+		if s == nil {
+			return false
+		}
+		rc, err := s.ReadObject(ctx, h)
+		if err != nil {
+			return false
+		}
+		rc.Close()
+		return true
+	}
+	for len(pending) > 0 {
+		next := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if _, ok := visited[*next.h]; ok {
+			continue
+		}
+		visited[*next.h] = struct{}{}
+		encoded, ok, err := read(next.h)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if next.required {
+				missing = append(missing, next.h)
+			}
+			continue
+		}
+		f, err := snapshot.ParseFile(string(encoded))
+		if err != nil || f == nil {
+			return nil, fmt.Errorf("the object %q is not a valid snapshot: %v", next.h, err)
+		}
+		for _, parent := range f.Parents {
+			pending = append(pending, pendingObject{h: parent})
+		}
+		if _, ok := visited[*f.Contents]; ok {
+			continue
+		}
+		visited[*f.Contents] = struct{}{}
+		if !f.IsDir() {
+			if !present(f.Contents) {
+				missing = append(missing, f.Contents)
+			}
+			continue
+		}
+		treeContents, ok, err := read(f.Contents)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			missing = append(missing, f.Contents)
+			continue
+		}
+		tree, err := snapshot.ParseTree(string(treeContents))
+		if err != nil {
+			return nil, fmt.Errorf("failure parsing the directory contents of the snapshot %q: %v", next.h, err)
+		}
+		for _, child := range tree {
+			pending = append(pending, pendingObject{h: child, required: true})
+		}
+	}
+	return missing, nil
+}
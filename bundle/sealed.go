@@ -0,0 +1,117 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bundle defines methods for bundling snapshots together so they can be imported and/or exported.
+package bundle
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// sealedFile is a temporary file whose contents are encrypted with a random
+// key that is only ever held in memory.
+//
+// This is used wherever the plaintext of a bundle, or of an entry in one,
+// has to be written to disk, so that the plaintext is never at rest; if the
+// process crashes before the file is removed, then what is left behind can
+// no longer be decrypted.
+//
+// The contents are encrypted with AES in counter mode, so that they can be
+// read back from any offset. They are not authenticated, since the file is
+// only ever read by the same process that wrote it.
+type sealedFile struct {
+	f     *os.File
+	block cipher.Block
+	iv    [aes.BlockSize]byte
+	size  int64
+}
+
+// newSealedFile creates a new sealed file in the default directory for
+// temporary files, with a name starting with the given prefix.
+func newSealedFile(prefix string) (*sealedFile, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failure generating the key for a temp file: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failure creating the cipher for a temp file: %v", err)
+	}
+	sf := &sealedFile{block: block}
+	if _, err := rand.Read(sf.iv[:]); err != nil {
+		return nil, fmt.Errorf("failure generating the IV for a temp file: %v", err)
+	}
+	if sf.f, err = os.CreateTemp("", prefix); err != nil {
+		return nil, fmt.Errorf("failure creating a temp file: %v", err)
+	}
+	return sf, nil
+}
+
+// streamAt returns the key stream starting at the given offset.
+func (sf *sealedFile) streamAt(offset int64) cipher.Stream {
+	var ctr [aes.BlockSize]byte
+	hi := binary.BigEndian.Uint64(sf.iv[:8])
+	lo := binary.BigEndian.Uint64(sf.iv[8:])
+	blocks := uint64(offset / aes.BlockSize)
+	if lo+blocks < lo {
+		hi++
+	}
+	binary.BigEndian.PutUint64(ctr[:8], hi)
+	binary.BigEndian.PutUint64(ctr[8:], lo+blocks)
+	stream := cipher.NewCTR(sf.block, ctr[:])
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream
+}
+
+// Write appends the given data to the end of the file.
+func (sf *sealedFile) Write(p []byte) (int, error) {
+	sealed := make([]byte, len(p))
+	sf.streamAt(sf.size).XORKeyStream(sealed, p)
+	n, err := sf.f.WriteAt(sealed, sf.size)
+	sf.size += int64(n)
+	return n, err
+}
+
+// ReadAt implements the io.ReaderAt interface.
+func (sf *sealedFile) ReadAt(p []byte, offset int64) (int, error) {
+	n, err := sf.f.ReadAt(p, offset)
+	sf.streamAt(offset).XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+// Size returns the number of bytes written to the file.
+func (sf *sealedFile) Size() int64 {
+	return sf.size
+}
+
+// reader returns a reader for everything written to the file.
+func (sf *sealedFile) reader() io.Reader {
+	return io.NewSectionReader(sf, 0, sf.size)
+}
+
+// Close closes and removes the file.
+func (sf *sealedFile) Close() error {
+	err := sf.f.Close()
+	if removeErr := os.Remove(sf.f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
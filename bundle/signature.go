@@ -0,0 +1,233 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bundle defines methods for bundling snapshots together so they can be imported and/or exported.
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/recursive-version-control-system/publish"
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+const (
+	// signatureDir is the directory holding the entries for the
+	// signature of a bundle.
+	//
+	// The signature entries are the identity that signed the bundle,
+	// the hash of the signature, and the objects that make up the
+	// signature, which are stored under `signature/objects/` rather than
+	// `objects/` so that they are not counted as part of the bundle.
+	signatureDir          = "signature"
+	signatureIdentityPath = signatureDir + "/identity"
+	signatureHashPath     = signatureDir + "/hash"
+
+	// signedSnapshotMode is the mode of the snapshot that is signed for
+	// a bundle.
+	signedSnapshotMode = "-r--r--r--"
+)
+
+// signedSnapshot returns the snapshot that is signed for a bundle with the
+// given manifest, along with its hash.
+//
+// The contents of the snapshot are the encoded manifest and its parents are
+// the roots of the bundle, so a signature for it covers the manifest and
+// every object reachable from those roots.
+func signedSnapshot(manifestBytes []byte, roots []*snapshot.Hash) (*snapshot.File, *snapshot.Hash, error) {
+	contents, err := snapshot.NewHash(bytes.NewReader(manifestBytes))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failure hashing the manifest: %v", err)
+	}
+	f := &snapshot.File{
+		Mode:     signedSnapshotMode,
+		Contents: contents,
+		Parents:  roots,
+	}
+	h, err := snapshot.NewHash(strings.NewReader(f.String()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failure hashing the signed snapshot: %v", err)
+	}
+	return f, h, nil
+}
+
+// SignAs configures the writer to sign the bundle as the given identity
+// when it is closed.
+//
+// The signature is created by the `rvcs-sign-<ALGORITHM>` helper for the
+// identity, the same as for publishing snapshots, but it is not recorded as
+// the latest signature for that identity.
+func (w *Writer) SignAs(ctx context.Context, s *storage.LocalFiles, id *snapshot.Identity) {
+	w.signCtx = ctx
+	w.signStorage = s
+	w.signAs = id
+}
+
+// writeSignature signs the bundle with the given encoded manifest, and
+// writes the resulting signature into the bundle.
+func (w *Writer) writeSignature(manifestBytes []byte) error {
+	ctx, s := w.signCtx, w.signStorage
+	f, h, err := signedSnapshot(manifestBytes, w.roots)
+	if err != nil {
+		return err
+	}
+	// The sign helper reads the signed snapshot from the local archive.
+	if _, err := s.StoreObject(ctx, int64(len(manifestBytes)), bytes.NewReader(manifestBytes)); err != nil {
+		return fmt.Errorf("failure storing the manifest: %v", err)
+	}
+	encoded := f.String()
+	if _, err := s.StoreObject(ctx, int64(len(encoded)), strings.NewReader(encoded)); err != nil {
+		return fmt.Errorf("failure storing the signed snapshot: %v", err)
+	}
+	sig, err := publish.SignDetached(ctx, w.signAs, h)
+	if err != nil {
+		return err
+	}
+	// The signature's history leads back to the signed snapshot, which
+	// is recreated from the manifest, so only its contents are needed.
+	reachable := map[snapshot.Hash]struct{}{
+		*h:          struct{}{},
+		*f.Contents: struct{}{},
+	}
+	if err := addReachable(ctx, s, sig, false, reachable); err != nil {
+		return fmt.Errorf("failure listing the objects in the signature %q: %v", sig, err)
+	}
+	var objects []*snapshot.Hash
+	for obj := range reachable {
+		obj := obj
+		objects = append(objects, &obj)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].String() < objects[j].String()
+	})
+	for _, obj := range objects {
+		r, err := s.ReadObject(ctx, obj)
+		if err != nil {
+			return fmt.Errorf("failure opening the signature object %q: %v", obj, err)
+		}
+		err = writeEntry(w.entries, path.Join(signatureDir, bundleEntryPath(obj)), -1, r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failure writing the signature object %q: %v", obj, err)
+		}
+	}
+	id := w.signAs.String()
+	if err := writeEntry(w.entries, signatureIdentityPath, int64(len(id)), strings.NewReader(id)); err != nil {
+		return fmt.Errorf("failure writing the signature identity: %v", err)
+	}
+	if err := writeEntry(w.entries, signatureHashPath, int64(len(sig.String())), strings.NewReader(sig.String())); err != nil {
+		return fmt.Errorf("failure writing the signature hash: %v", err)
+	}
+	return nil
+}
+
+// isSignatureEntry reports whether or not the named bundle entry is part
+// of the bundle's signature.
+func isSignatureEntry(name string) bool {
+	return strings.HasPrefix(name, signatureDir+"/")
+}
+
+// readSignatureEntry reads the contents of a signature entry, which are
+// all expected to be small.
+func readSignatureEntry(name string, r io.Reader) ([]byte, error) {
+	contents, err := io.ReadAll(io.LimitReader(r, maxSnapshotSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the signature entry %q: %v", name, err)
+	}
+	if len(contents) > maxSnapshotSize {
+		return nil, fmt.Errorf("the signature entry %q is too large", name)
+	}
+	return contents, nil
+}
+
+// verifySignature verifies the signature of a bundle, given its encoded
+// manifest and the contents of its signature entries, and returns the
+// identity that signed it.
+//
+// Bundles without a signature are accepted as-is, unless a signer is
+// required. The objects of the signature are added to the given staging
+// area, and are only published while the verify helper reads them.
+func verifySignature(ctx context.Context, s *storage.LocalFiles, st *storage.Staging, manifestBytes []byte, m *Manifest, entries map[string][]byte, opts *ImportOptions) (*snapshot.Identity, error) {
+	required := opts.requiredSigner()
+	if len(entries) == 0 {
+		if required != nil {
+			return nil, invalidBundle("the bundle is not signed, but a signature by %q is required", required)
+		}
+		return nil, nil
+	}
+	idBytes, hasIdentity := entries[signatureIdentityPath]
+	sigBytes, hasHash := entries[signatureHashPath]
+	if !hasIdentity || !hasHash {
+		return nil, invalidBundle("the bundle signature is incomplete")
+	}
+	if m == nil {
+		return nil, invalidBundle("the bundle is signed but has no manifest")
+	}
+	id, err := snapshot.ParseIdentity(strings.TrimSpace(string(idBytes)))
+	if err != nil {
+		return nil, invalidBundle("failure parsing the identity that signed the bundle: %v", err)
+	}
+	if required != nil && !required.Equal(id) {
+		return nil, invalidBundle("the bundle is signed by %q, but a signature by %q is required", id, required)
+	}
+	sig, err := snapshot.ParseHash(strings.TrimSpace(string(sigBytes)))
+	if err != nil || sig == nil {
+		return nil, invalidBundle("failure parsing the hash of the bundle signature %q: %v", sigBytes, err)
+	}
+	var objects []*snapshot.Hash
+	for name, contents := range entries {
+		want, err := bundlePathHash(strings.TrimPrefix(name, signatureDir+"/"))
+		if err != nil {
+			continue
+		}
+		got, err := st.StoreObject(ctx, int64(len(contents)), bytes.NewReader(contents))
+		if err != nil {
+			return nil, fmt.Errorf("failure staging the signature object %q: %v", want, err)
+		}
+		if !got.Equal(want) {
+			st.RemoveObject(ctx, got)
+			return nil, invalidBundle("mismatched hash for the signature entry %q: got %q, want %q", name, got, want)
+		}
+		objects = append(objects, got)
+	}
+	_, h, err := signedSnapshot(manifestBytes, m.Roots)
+	if err != nil {
+		return nil, err
+	}
+	// The verify helper reads the signature from the archive, so the
+	// signature objects are published while it runs. They are withdrawn
+	// afterwards, and published with the rest of the bundle.
+	withdraw, err := st.PublishObjects(ctx, objects)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := publish.Verify(ctx, s, id, sig)
+	if withdrawErr := withdraw(); withdrawErr != nil && err == nil {
+		err = withdrawErr
+	}
+	if err != nil {
+		return nil, invalidBundle("failure verifying the bundle signature by %q: %v", id, err)
+	}
+	if !signed.Equal(h) {
+		return nil, invalidBundle("the signature %q by %q is for %q rather than for this bundle (%q)", sig, id, signed, h)
+	}
+	return id, nil
+}
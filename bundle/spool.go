@@ -0,0 +1,81 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bundle defines methods for bundling snapshots together so they can be imported and/or exported.
+package bundle
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// maxMemorySpool is the largest amount of data a spool keeps in memory
+// before moving it to a temporary file.
+const maxMemorySpool = 1024 * 1024
+
+// spool holds the prepared contents of a bundle entry until it can be
+// written to the bundle.
+//
+// Small contents are kept in memory, while larger ones are written to a
+// sealed temporary file, so that they are never stored unencrypted.
+type spool struct {
+	buf  bytes.Buffer
+	file *sealedFile
+	size int64
+}
+
+// Write implements the io.Writer interface.
+func (sp *spool) Write(p []byte) (int, error) {
+	if sp.file == nil && int64(sp.buf.Len()+len(p)) > maxMemorySpool {
+		tmp, err := newSealedFile("rvcs-bundle-entry-")
+		if err != nil {
+			return 0, fmt.Errorf("failure creating a temp file for a bundle entry: %v", err)
+		}
+		sp.file = tmp
+		if _, err := sp.buf.WriteTo(tmp); err != nil {
+			return 0, fmt.Errorf("failure writing a bundle entry to a temp file: %v", err)
+		}
+	}
+	var n int
+	var err error
+	if sp.file != nil {
+		n, err = sp.file.Write(p)
+	} else {
+		n, err = sp.buf.Write(p)
+	}
+	sp.size += int64(n)
+	return n, err
+}
+
+// reader returns a reader for everything written to the spool.
+func (sp *spool) reader() (io.Reader, error) {
+	if sp.file == nil {
+		return bytes.NewReader(sp.buf.Bytes()), nil
+	}
+	return sp.file.reader(), nil
+}
+
+// release frees the resources held by the spool. It is safe to call more
+// than once, and on a nil spool.
+func (sp *spool) release() {
+	if sp == nil {
+		return
+	}
+	sp.buf = bytes.Buffer{}
+	if sp.file != nil {
+		sp.file.Close()
+		sp.file = nil
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bundle defines methods for bundling snapshots together so they can be imported and/or exported.
+package bundle
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+// streamHeader is the first line of every streamed bundle.
+//
+// The header is followed by a sequence of entries, each of which is a line
+// holding the entry name and its size in bytes, followed by exactly that
+// many bytes of contents. The entry names are the same as the paths used
+// in zip bundles, and the manifest is always the last entry. The end of the
+// stream is marked by an empty line, so that a truncated stream is detected.
+const streamHeader = "rvcs-bundle-stream 1"
+
+type streamEntryWriter struct {
+	w *bufio.Writer
+}
+
+func (sw *streamEntryWriter) prepareEntry(name string, size int64, r io.Reader) (*preparedEntry, error) {
+	if len(name) == 0 || strings.ContainsAny(name, "\n") {
+		return nil, fmt.Errorf("invalid bundle entry name %q", name)
+	}
+	// The size has to be written before the contents, and the writes
+	// are serialized, so the contents are read ahead of time.
+	contents := &spool{}
+	if _, err := io.Copy(contents, r); err != nil {
+		contents.release()
+		return nil, fmt.Errorf("failure reading the entry %q: %v", name, err)
+	}
+	if size >= 0 && contents.size != size {
+		contents.release()
+		return nil, fmt.Errorf("the entry %q changed size while it was being read: got %d bytes, want %d", name, contents.size, size)
+	}
+	return &preparedEntry{name: name, contents: contents}, nil
+}
+
+func (sw *streamEntryWriter) writePrepared(e *preparedEntry) error {
+	defer e.contents.release()
+	if _, err := fmt.Fprintf(sw.w, "%s %d\n", e.name, e.contents.size); err != nil {
+		return fmt.Errorf("failure writing the header for the entry %q: %v", e.name, err)
+	}
+	r, err := e.contents.reader()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(sw.w, r); err != nil {
+		return fmt.Errorf("failure writing the entry %q: %v", e.name, err)
+	}
+	return nil
+}
+
+func (sw *streamEntryWriter) close() error {
+	if _, err := sw.w.WriteString("\n"); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+// NewStreamWriter returns a writer for a bundle encoded as a stream of
+// entries, which does not require the underlying writer to be seekable.
+func NewStreamWriter(w io.Writer, exclude []*snapshot.Hash, metadata map[string]io.ReadCloser, recurseParents bool) (*Writer, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(streamHeader + "\n"); err != nil {
+		return nil, fmt.Errorf("failure writing the stream header: %v", err)
+	}
+	return newWriter(&streamEntryWriter{w: bw}, exclude, metadata, recurseParents)
+}
+
+// ExportStream writes a bundle with the specified snapshots to the given
+// writer using the streaming encoding.
+//
+// The arguments are otherwise the same as for `Export`.
+func ExportStream(ctx context.Context, s *storage.LocalFiles, w io.Writer, snapshots []*snapshot.Hash, exclude []*snapshot.Hash, have []*snapshot.Hash, metadata map[string]io.ReadCloser, recurseParents bool, opts *ExportOptions) (included []*snapshot.Hash, err error) {
+	out, err := opts.encrypt(w)
+	if err != nil {
+		return nil, err
+	}
+	sw, err := NewStreamWriter(out, exclude, metadata, recurseParents)
+	if err != nil {
+		return nil, fmt.Errorf("failure creating the stream writer for the bundle: %v", err)
+	}
+	return writeBundle(ctx, s, sw, out, snapshots, have, opts)
+}
+
+func readStreamEntryHeader(r *bufio.Reader) (name string, size int64, err error) {
+	line, err := r.ReadString('\n')
+	if errors.Is(err, io.EOF) {
+		return "", 0, errors.New("the stream ended before the end marker")
+	} else if err != nil {
+		return "", 0, err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if len(line) == 0 {
+		return "", 0, nil
+	}
+	i := strings.LastIndexByte(line, ' ')
+	if i <= 0 {
+		return "", 0, fmt.Errorf("malformed entry header %q", line)
+	}
+	size, err = strconv.ParseInt(line[i+1:], 10, 64)
+	if err != nil || size < 0 {
+		return "", 0, fmt.Errorf("malformed size in the entry header %q", line)
+	}
+	return line[:i], size, nil
+}
+
+// importStreamObject stages a single object entry from a streamed bundle,
+// verifying its contents against the hash in its name as they are read.
+func importStreamObject(ctx context.Context, st *storage.Staging, h *snapshot.Hash, r *io.LimitedReader, skip bool) (imported bool, err error) {
+	var got *snapshot.Hash
+	if skip {
+		got, err = snapshot.NewHash(r)
+	} else {
+		got, err = st.StoreObject(ctx, r.N, r)
+	}
+	if err != nil {
+		return false, err
+	}
+	if r.N > 0 {
+		return false, io.ErrUnexpectedEOF
+	}
+	if !got.Equal(h) {
+		return false, fmt.Errorf("mismatched hash: got %q, want %q", got, h)
+	}
+	return !skip, nil
+}
+
+// ImportStream reads a bundle encoded using the streaming encoding from the
+// given reader, and stores every object in it that is not already present
+// or explicitly excluded.
+//
+// Each object is verified as it is read rather than in a separate pass, and
+// stored in a staging area of the archive. The staged objects are only
+// published once the whole stream has been validated, and are discarded
+// otherwise. Unlike imports of bundle files, an interrupted import of a
+// stream cannot be resumed, since the stream cannot be read again.
+//
+// The stream is decrypted using the local identity of the storage if it
+// is encrypted.
+//
+// The bundle's manifest, including whether the snapshots it was created
+// against are present, and its signature, if it is signed, are validated
+// once the end of the stream is reached. As with `ImportVolumes`, the
+// roots it lists are returned along with the hashes of the imported
+// objects and the identity that signed it, and the options can require a
+// signature by a specific identity.
+func ImportStream(ctx context.Context, s *storage.LocalFiles, r io.Reader, exclude []*snapshot.Hash, opts *ImportOptions) (roots []*snapshot.Hash, included []*snapshot.Hash, signer *snapshot.Identity, err error) {
+	excludeMap := make(map[snapshot.Hash]struct{})
+	for _, h := range exclude {
+		excludeMap[*h] = struct{}{}
+	}
+	br := bufio.NewReader(r)
+	if isEncrypted(br) {
+		plaintext, err := s.Decrypt(br)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failure decrypting the bundle stream: %v", err)
+		}
+		br = bufio.NewReader(plaintext)
+	}
+	header, err := br.ReadString('\n')
+	if err != nil || strings.TrimSuffix(header, "\n") != streamHeader {
+		return nil, nil, nil, fmt.Errorf("the input is not a streamed bundle: %q", strings.TrimSuffix(header, "\n"))
+	}
+	st, err := s.NewStaging("stream-")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer st.Remove()
+	var objects []*snapshot.Hash
+	var m *Manifest
+	var manifestBytes []byte
+	signature := make(map[string][]byte)
+	for {
+		name, size, err := readStreamEntryHeader(br)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failure reading the bundle stream: %v", err)
+		}
+		if len(name) == 0 {
+			break
+		}
+		entry := &io.LimitedReader{R: br, N: size}
+		if isSignatureEntry(name) {
+			// The signature follows the manifest that it signs.
+			contents, err := readSignatureEntry(name, entry)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if entry.N > 0 {
+				return nil, nil, nil, fmt.Errorf("failure reading entry %q: %v", name, io.ErrUnexpectedEOF)
+			}
+			signature[name] = contents
+			continue
+		}
+		if m != nil {
+			return nil, nil, nil, fmt.Errorf("unexpected entry %q after the manifest", name)
+		}
+		if name == manifestPath {
+			if manifestBytes, err = io.ReadAll(entry); err != nil {
+				return nil, nil, nil, fmt.Errorf("failure reading the manifest: %v", err)
+			}
+			m = &Manifest{}
+			if err := json.Unmarshal(manifestBytes, m); err != nil {
+				return nil, nil, nil, fmt.Errorf("failure parsing the manifest: %v", err)
+			}
+			continue
+		}
+		h, err := bundlePathHash(name)
+		if err != nil {
+			// We allow additional/non-object entries in bundles
+			if _, err := io.Copy(io.Discard, entry); err != nil {
+				return nil, nil, nil, fmt.Errorf("failure reading entry %q: %v", name, err)
+			}
+			continue
+		}
+		objects = append(objects, h)
+		_, skip := excludeMap[*h]
+		if hasObject(ctx, s, h) || st.HasObject(ctx, h) {
+			// We already have this object and only need to verify it.
+			skip = true
+		}
+		if imported, err := importStreamObject(ctx, st, h, entry, skip); err != nil {
+			return nil, nil, nil, fmt.Errorf("failure importing the entry %q: %v", name, err)
+		} else if imported {
+			included = append(included, h)
+		}
+	}
+	if m != nil {
+		stored := func(h *snapshot.Hash) bool { return hasObject(ctx, s, h) }
+		if err := m.validate(objects, stored); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid manifest: %v", err)
+		}
+		if err := checkHave(ctx, s, m); err != nil {
+			return nil, nil, nil, err
+		}
+		roots = m.Roots
+	}
+	signer, err = verifySignature(ctx, s, st, manifestBytes, m, signature, opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := st.Publish(ctx); err != nil {
+		return nil, nil, nil, err
+	}
+	return roots, included, signer, nil
+}
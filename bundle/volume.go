@@ -0,0 +1,506 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bundle defines methods for bundling snapshots together so they can be imported and/or exported.
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+const (
+	// volumePath is the path of the entry describing which volume of a
+	// split bundle a zip file holds.
+	volumePath = "volume.json"
+
+	// chunksDir is the directory holding the chunks of objects that are
+	// too large to fit in a single volume.
+	//
+	// The chunks of an object are named `<OBJECT_PATH>/<INDEX>-of-<COUNT>`
+	// under this directory, where <OBJECT_PATH> is the path the object
+	// would have had if it were not split and <INDEX> starts from 1.
+	chunksDir = "chunks"
+
+	// MinVolumeSize is the smallest supported maximum size for volumes.
+	MinVolumeSize = 64 * 1024
+
+	// volumeReserve is the space reserved in each volume for the end of
+	// the zip file and the volume entry.
+	volumeReserve = 4 * 1024
+
+	// volumeEntryOverhead is an upper bound on the space used by each
+	// zip entry beyond its name and compressed contents.
+	volumeEntryOverhead = 256
+)
+
+// VolumePath returns the path of the volume with the given index in a split
+// bundle written to the given path. Volumes are numbered starting from 1.
+func VolumePath(path string, index int) string {
+	return fmt.Sprintf("%s.%03d", path, index)
+}
+
+// volumeInfo describes one volume of a split bundle.
+type volumeInfo struct {
+	// Series identifies the split bundle that the volume belongs to.
+	Series string `json:"series"`
+
+	// Volume is the index of the volume, starting from 1.
+	Volume int `json:"volume"`
+
+	// Volumes is the total number of volumes, and is only set in the
+	// last volume, which also holds the manifest.
+	Volumes int `json:"volumes,omitempty"`
+}
+
+func decodeVolumeInfo(open func() (io.ReadCloser, error)) (*volumeInfo, error) {
+	rc, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	info := &volumeInfo{}
+	if err := json.NewDecoder(rc).Decode(info); err != nil {
+		return nil, err
+	}
+	if len(info.Series) == 0 || info.Volume < 1 || (info.Volumes != 0 && info.Volumes != info.Volume) {
+		return nil, fmt.Errorf("malformed volume entry %+v", info)
+	}
+	return info, nil
+}
+
+func chunkPath(name string, index, count int) string {
+	return path.Join(chunksDir, name, fmt.Sprintf("%04d-of-%04d", index, count))
+}
+
+// parseChunkPath parses the name of a chunk entry into the name of the
+// object entry it is part of, and the index and count of its chunks.
+func parseChunkPath(name string) (object string, index, count int, err error) {
+	if !strings.HasPrefix(name, chunksDir+"/") {
+		return "", 0, 0, fmt.Errorf("%q is not a chunk path", name)
+	}
+	object, suffix := path.Split(strings.TrimPrefix(name, chunksDir+"/"))
+	indexStr, countStr, ok := strings.Cut(suffix, "-of-")
+	if ok {
+		index, err = strconv.Atoi(indexStr)
+	}
+	if ok && err == nil {
+		count, err = strconv.Atoi(countStr)
+	}
+	if !ok || err != nil || index < 1 || index > count {
+		return "", 0, 0, fmt.Errorf("malformed chunk path %q", name)
+	}
+	return strings.TrimSuffix(object, "/"), index, count, nil
+}
+
+// volumeEntryWriter writes the entries of a bundle into a numbered series
+// of zip files, each of which is no larger than a maximum size.
+//
+// Entries are never split across volumes, except for objects that are too
+// large to fit in a single volume, which are split into chunks.
+type volumeEntryWriter struct {
+	zipEntryWriter
+
+	maxSize  int64
+	overhead int64
+	series   string
+	create   func(index int) (io.WriteCloser, error)
+
+	index int
+	out   io.WriteCloser
+	size  int64
+}
+
+// newVolumeEntryWriter returns a writer for volumes of at most the given
+// size, where the given overhead is the space taken by encrypting each
+// volume, if they are encrypted.
+func newVolumeEntryWriter(maxSize, overhead int64, create func(index int) (io.WriteCloser, error)) (*volumeEntryWriter, error) {
+	if maxSize < MinVolumeSize {
+		return nil, fmt.Errorf("the maximum volume size %d is smaller than the minimum of %d", maxSize, MinVolumeSize)
+	}
+	if maxSize-volumeReserve-overhead < MinVolumeSize/2 {
+		return nil, fmt.Errorf("the maximum volume size %d is too small for the %d bytes of overhead of encrypting each volume", maxSize, overhead)
+	}
+	series := make([]byte, 16)
+	if _, err := rand.Read(series); err != nil {
+		return nil, fmt.Errorf("failure generating the series ID: %v", err)
+	}
+	return &volumeEntryWriter{
+		maxSize:  maxSize,
+		overhead: overhead,
+		series:   hex.EncodeToString(series),
+		create:   create,
+	}, nil
+}
+
+// capacity returns the space in each volume that is available for entries.
+func (v *volumeEntryWriter) capacity() int64 {
+	return v.maxSize - volumeReserve - v.overhead
+}
+
+// chunkSize returns the number of bytes of an object stored in each chunk,
+// leaving room for the worst case expansion of incompressible contents.
+func (v *volumeEntryWriter) chunkSize() int64 {
+	return (v.capacity() - volumeEntryOverhead - 1024) * 99 / 100
+}
+
+func entryCost(e *preparedEntry) int64 {
+	return int64(e.header.CompressedSize64) + int64(2*len(e.name)) + volumeEntryOverhead
+}
+
+func (v *volumeEntryWriter) prepareEntry(name string, size int64, r io.Reader) (*preparedEntry, error) {
+	isObject := strings.HasPrefix(name, "objects/")
+	var raw *spool
+	if isObject && (size < 0 || size > v.chunkSize()) {
+		// The object might not fit in a volume, so we keep the raw
+		// contents in case they have to be split.
+		raw = &spool{}
+		r = io.TeeReader(r, raw)
+	}
+	e, err := v.zipEntryWriter.prepareEntry(name, size, r)
+	if err != nil {
+		raw.release()
+		return nil, err
+	}
+	if entryCost(e) <= v.capacity() {
+		raw.release()
+		return e, nil
+	}
+	if !isObject {
+		e.release()
+		return nil, fmt.Errorf("the entry %q does not fit in a volume of %d bytes", name, v.maxSize)
+	}
+	defer raw.release()
+	e.contents.release()
+	e.contents = &spool{}
+	rr, err := raw.reader()
+	if err != nil {
+		return nil, err
+	}
+	count := int((raw.size + v.chunkSize() - 1) / v.chunkSize())
+	for i := 1; i <= count; i++ {
+		chunk, err := v.zipEntryWriter.prepareEntry(chunkPath(name, i, count), -1, io.LimitReader(rr, v.chunkSize()))
+		if err != nil {
+			e.release()
+			return nil, fmt.Errorf("failure preparing chunk %d of %d for %q: %v", i, count, name, err)
+		}
+		e.chunks = append(e.chunks, chunk)
+	}
+	return e, nil
+}
+
+func (v *volumeEntryWriter) writePrepared(e *preparedEntry) error {
+	if len(e.chunks) == 0 {
+		return v.writeEntry(e)
+	}
+	defer e.release()
+	for _, chunk := range e.chunks {
+		if err := v.writeEntry(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEntry writes a single entry, starting a new volume if the entry
+// does not fit in the current one.
+func (v *volumeEntryWriter) writeEntry(e *preparedEntry) error {
+	cost := entryCost(e)
+	if cost > v.capacity() {
+		e.release()
+		return fmt.Errorf("the entry %q does not fit in a volume of %d bytes", e.name, v.maxSize)
+	}
+	if v.out != nil && v.size+cost > v.capacity() {
+		if err := v.finishVolume(false); err != nil {
+			e.release()
+			return err
+		}
+	}
+	if v.out == nil {
+		if err := v.startVolume(); err != nil {
+			e.release()
+			return err
+		}
+	}
+	v.size += cost
+	return v.zipEntryWriter.writePrepared(e)
+}
+
+func (v *volumeEntryWriter) startVolume() error {
+	v.index++
+	out, err := v.create(v.index)
+	if err != nil {
+		return fmt.Errorf("failure creating volume %d: %v", v.index, err)
+	}
+	v.out = out
+	v.nested = zip.NewWriter(out)
+	v.size = 0
+	return nil
+}
+
+// finishVolume writes the volume entry of the current volume and closes it.
+func (v *volumeEntryWriter) finishVolume(last bool) error {
+	info := &volumeInfo{Series: v.series, Volume: v.index}
+	if last {
+		info.Volumes = v.index
+	}
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failure serializing the volume entry: %v", err)
+	}
+	if err := writeEntry(&v.zipEntryWriter, volumePath, int64(len(encoded)), bytes.NewReader(encoded)); err != nil {
+		return fmt.Errorf("failure writing the volume entry of volume %d: %v", v.index, err)
+	}
+	err = v.nested.Close()
+	if closeErr := v.out.Close(); err == nil {
+		err = closeErr
+	}
+	v.out = nil
+	if err != nil {
+		return fmt.Errorf("failure closing volume %d: %v", v.index, err)
+	}
+	return nil
+}
+
+func (v *volumeEntryWriter) close() error {
+	if v.out == nil {
+		if err := v.startVolume(); err != nil {
+			return err
+		}
+	}
+	return v.finishVolume(true)
+}
+
+// createVolumes returns a function that creates the volumes of a split
+// bundle written to the given path, encrypting them if requested.
+//
+// The path of every volume that is created is appended to `created`.
+func createVolumes(path string, opts *ExportOptions, created *[]string) func(index int) (io.WriteCloser, error) {
+	return func(index int) (io.WriteCloser, error) {
+		p := VolumePath(path, index)
+		f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0700)
+		if err != nil {
+			return nil, fmt.Errorf("failure opening the file %q: %v", p, err)
+		}
+		*created = append(*created, p)
+		out, err := opts.encrypt(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &volumeFile{WriteCloser: out, f: f}, nil
+	}
+}
+
+// volumeFile closes both the writer for a volume and its underlying file.
+type volumeFile struct {
+	io.WriteCloser
+	f *os.File
+}
+
+func (vf *volumeFile) Close() error {
+	err := vf.WriteCloser.Close()
+	if closeErr := vf.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// chunkReader reads the contents of an object that was split into chunks,
+// opening each chunk only when it is reached.
+type chunkReader struct {
+	chunks  []*readerEntry
+	current io.ReadCloser
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.current == nil {
+			if len(cr.chunks) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := cr.chunks[0].open()
+			if err != nil {
+				return 0, err
+			}
+			cr.current = rc
+			cr.chunks = cr.chunks[1:]
+		}
+		n, err := cr.current.Read(p)
+		if errors.Is(err, io.EOF) {
+			cr.current.Close()
+			cr.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (cr *chunkReader) Close() error {
+	if cr.current == nil {
+		return nil
+	}
+	return cr.current.Close()
+}
+
+// OpenVolumes opens the bundle held in the given files for reading, which
+// are either a single bundle or every volume of a split bundle, in any
+// order.
+//
+// Encrypted files are decrypted using the local identity of the storage.
+func OpenVolumes(s *storage.LocalFiles, paths []string) (r *Reader, err error) {
+	var volumes []*Reader
+	defer func() {
+		if err != nil {
+			for _, v := range volumes {
+				v.Close()
+			}
+		}
+	}()
+	for _, p := range paths {
+		v, err := Open(s, p)
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, v)
+	}
+	if len(volumes) == 1 && volumes[0].volume == nil {
+		return volumes[0], nil
+	}
+	return mergeVolumes(volumes)
+}
+
+// mergeVolumes combines the readers for every volume of a split bundle
+// into a single reader for the whole bundle.
+//
+// The volumes may be given in any order, but all of them must be present.
+func mergeVolumes(volumes []*Reader) (*Reader, error) {
+	var series string
+	total := 0
+	byIndex := make(map[int]*Reader)
+	for _, r := range volumes {
+		if r.volume == nil {
+			return nil, fmt.Errorf("%q is not a volume of a split bundle", r.path)
+		}
+		if len(series) == 0 {
+			series = r.volume.Series
+		} else if r.volume.Series != series {
+			return nil, fmt.Errorf("the volume %q belongs to a different bundle", r.path)
+		}
+		if _, ok := byIndex[r.volume.Volume]; ok {
+			return nil, fmt.Errorf("volume %d was given more than once", r.volume.Volume)
+		}
+		byIndex[r.volume.Volume] = r
+		if r.volume.Volumes > 0 {
+			total = r.volume.Volumes
+		}
+	}
+	if total == 0 {
+		return nil, errors.New("the last volume of the bundle is missing")
+	}
+	var missing []string
+	for i := 1; i <= total; i++ {
+		if _, ok := byIndex[i]; !ok {
+			missing = append(missing, strconv.Itoa(i))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing volumes %s of %d", strings.Join(missing, ", "), total)
+	}
+	if len(byIndex) != total {
+		return nil, fmt.Errorf("unexpected volumes beyond the last volume %d", total)
+	}
+
+	merged := &Reader{
+		entries:  make(map[string]*readerEntry),
+		manifest: byIndex[total].manifest,
+		volumes:  volumes,
+	}
+	type chunkedObject struct {
+		count  int
+		chunks map[int]*readerEntry
+	}
+	chunked := make(map[string]*chunkedObject)
+	var chunkedNames []string
+	for i := 1; i <= total; i++ {
+		r := byIndex[i]
+		for _, name := range r.names {
+			if name == volumePath {
+				continue
+			}
+			if i != total && name == manifestPath {
+				return nil, fmt.Errorf("unexpected manifest in volume %d of %d", i, total)
+			}
+			if !strings.HasPrefix(name, chunksDir+"/") {
+				if err := merged.addEntry(name, r.entries[name]); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			object, index, count, err := parseChunkPath(name)
+			if err != nil {
+				return nil, err
+			}
+			c, ok := chunked[object]
+			if !ok {
+				c = &chunkedObject{count: count, chunks: make(map[int]*readerEntry)}
+				chunked[object] = c
+				chunkedNames = append(chunkedNames, object)
+			}
+			if c.count != count {
+				return nil, fmt.Errorf("inconsistent chunk counts for %q", object)
+			}
+			c.chunks[index] = r.entries[name]
+		}
+	}
+	sort.Strings(chunkedNames)
+	for _, object := range chunkedNames {
+		c := chunked[object]
+		var chunks []*readerEntry
+		var size int64
+		for i := 1; i <= c.count; i++ {
+			chunk, ok := c.chunks[i]
+			if !ok {
+				return nil, fmt.Errorf("missing chunk %d of %d for %q", i, c.count, object)
+			}
+			chunks = append(chunks, chunk)
+			size += chunk.size
+		}
+		if err := merged.addEntry(object, &readerEntry{
+			size: size,
+			open: func() (io.ReadCloser, error) {
+				return &chunkReader{chunks: chunks}, nil
+			},
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
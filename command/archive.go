@@ -0,0 +1,103 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package command defines the command line interface for rvcs
+package command
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/recursive-version-control-system/archive"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+const archiveUsage = `Usage: %s archive <SNAPSHOT> -o <OUTPUT> [<FLAGS>]*
+
+Writes the files in the snapshot <SNAPSHOT> to the standard archive <OUTPUT>,
+reading them directly from storage rather than checking them out first.
+
+<SNAPSHOT> is either the hash of a known snapshot, the identity of a
+published snapshot, or a local file path which has previously been
+snapshotted.
+
+The format of <OUTPUT> is chosen based on its extension, which must be
+one of .tar, .tar.gz, .tgz, or .zip. File permissions and symbolic links
+are preserved, and every entry is given the same, fixed modification time
+so that archiving a snapshot is reproducible.
+
+Where <FLAGS> are one of:
+
+`
+
+var (
+	archiveFlags = flag.NewFlagSet("archive", flag.ContinueOnError)
+
+	archiveOutputFlag = archiveFlags.String(
+		"o", "",
+		"the archive file to write")
+	archivePrefixFlag = archiveFlags.String(
+		"prefix", "",
+		"the directory under which to place the files in the archive. If the snapshot is not of a directory, then this is required and is used as the name of the archived file")
+)
+
+func archiveCommand(ctx context.Context, s *storage.LocalFiles, cmd string, args []string) (int, error) {
+	archiveFlags.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), archiveUsage, cmd)
+		archiveFlags.PrintDefaults()
+	}
+	if err := archiveFlags.Parse(args); err != nil {
+		return 1, nil
+	}
+	args = archiveFlags.Args()
+	if len(args) < 1 {
+		archiveFlags.Usage()
+		return 1, nil
+	}
+	name := args[0]
+	// Flags are also accepted after the snapshot.
+	if err := archiveFlags.Parse(args[1:]); err != nil {
+		return 1, nil
+	}
+	if len(archiveFlags.Args()) > 0 || len(*archiveOutputFlag) == 0 {
+		archiveFlags.Usage()
+		return 1, nil
+	}
+	output := *archiveOutputFlag
+	format, err := archive.FormatForPath(output)
+	if err != nil {
+		return 1, err
+	}
+	h, err := resolveSnapshot(ctx, s, name)
+	if err != nil {
+		return 1, fmt.Errorf("failure resolving the snapshot hash for %q: %v", name, err)
+	}
+	out, err := os.Create(output)
+	if err != nil {
+		return 1, fmt.Errorf("failure creating the archive file %q: %v", output, err)
+	}
+	if err := archive.Write(ctx, s, h, out, format, *archivePrefixFlag); err != nil {
+		out.Close()
+		os.Remove(output)
+		return 1, fmt.Errorf("failure archiving the snapshot %q: %v", h, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(output)
+		return 1, fmt.Errorf("failure writing the archive file %q: %v", output, err)
+	}
+	fmt.Printf("%s  %s\n", h, output)
+	return 0, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package command defines the command line interface for rvcs
+package command
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/recursive-version-control-system/bundle"
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+const bundleUsage = `Usage: %s bundle <SUBCOMMAND> <PATH>...
+       %s bundle recipient
+
+Inspects a bundle without importing it, or prints the age recipient that
+bundles can be encrypted to so that only the local archive can decrypt them.
+
+Where <PATH> is a local filesystem path for the bundle, or '-' to read a
+streamed bundle from standard input, and <SUBCOMMAND> is one of the ones
+below. A split bundle is inspected as a whole by passing the path of every
+volume, in any order.
+
+<SUBCOMMAND> is one of:
+
+	list	Print the manifest of the bundle, the identity it claims to
+		be signed by, its metadata keys, and its objects grouped into
+		snapshots, trees, and blobs.
+	verify	Check the contents of every object in the bundle against
+		its hash, check the bundle against its manifest, and report
+		any objects reachable from its roots that are neither in the
+		bundle nor in the local archive.
+`
+
+// openBundle opens the bundle in the given files, or from standard input if
+// the only path is '-', decrypting it if necessary.
+//
+// The returned function must be called once the bundle is no longer needed.
+func openBundle(s *storage.LocalFiles, paths []string) (*bundle.Reader, func(), error) {
+	if len(paths) != 1 || paths[0] != "-" {
+		abs, err := absPaths(paths)
+		if err != nil {
+			return nil, nil, err
+		}
+		r, err := bundle.OpenVolumes(s, abs)
+		if err != nil {
+			return nil, nil, err
+		}
+		return r, func() { r.Close() }, nil
+	}
+	// Reading a bundle requires random access, so copy it to a temp file.
+	tmp, err := os.CreateTemp("", "rvcs-bundle-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failure creating a temp file for the bundle: %v", err)
+	}
+	_, err = io.Copy(tmp, os.Stdin)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, nil, fmt.Errorf("failure reading the bundle from standard input: %v", err)
+	}
+	r, err := bundle.Open(s, tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, nil, err
+	}
+	return r, func() {
+		r.Close()
+		os.Remove(tmp.Name())
+	}, nil
+}
+
+func printHashes(heading string, hashes []*snapshot.Hash) {
+	if len(hashes) == 0 {
+		return
+	}
+	fmt.Printf("%s (%d):\n", heading, len(hashes))
+	for _, h := range hashes {
+		fmt.Printf("\t%s\n", h)
+	}
+}
+
+func bundleCommand(ctx context.Context, s *storage.LocalFiles, cmd string, args []string) (int, error) {
+	usage := func() {
+		fmt.Fprintf(flag.CommandLine.Output(), bundleUsage, cmd, cmd)
+	}
+	if len(args) == 1 && args[0] == "recipient" {
+		recipient, err := s.Recipient()
+		if err != nil {
+			return 1, fmt.Errorf("failure reading the local age recipient: %v", err)
+		}
+		fmt.Println(recipient.String())
+		return 0, nil
+	}
+	if len(args) < 2 || (args[0] != "list" && args[0] != "verify") {
+		usage()
+		return 1, nil
+	}
+	r, closeBundle, err := openBundle(s, args[1:])
+	if err != nil {
+		return 1, fmt.Errorf("failure opening the bundle: %v", err)
+	}
+	defer closeBundle()
+	if args[0] == "verify" {
+		missing, err := r.Verify(ctx, s)
+		if err != nil {
+			return 1, fmt.Errorf("failure verifying the bundle: %v", err)
+		}
+		if len(missing) > 0 {
+			printHashes("missing", missing)
+			return 1, nil
+		}
+		fmt.Println("OK")
+		return 0, nil
+	}
+	l, err := r.List()
+	if err != nil {
+		return 1, fmt.Errorf("failure listing the bundle: %v", err)
+	}
+	if m := l.Manifest; m != nil {
+		fmt.Printf("version: %d\n", m.Version)
+		fmt.Printf("hash function: %s\n", m.HashFunction)
+		if len(m.RVCSVersion) > 0 {
+			fmt.Printf("created by: rvcs %s\n", m.RVCSVersion)
+		}
+		printHashes("roots", m.Roots)
+		printHashes("have", m.Have)
+		printHashes("exclude", m.Exclude)
+	} else {
+		fmt.Println("no manifest")
+	}
+	if len(l.Signer) > 0 {
+		fmt.Printf("signed by: %s (unverified)\n", l.Signer)
+	}
+	if len(l.Metadata) > 0 {
+		fmt.Printf("metadata (%d):\n", len(l.Metadata))
+		for _, key := range l.Metadata {
+			fmt.Printf("\t%s\n", key)
+		}
+	}
+	printHashes("snapshots", l.Snapshots)
+	printHashes("trees", l.Trees)
+	printHashes("blobs", l.Blobs)
+	return 0, nil
+}
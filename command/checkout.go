@@ -0,0 +1,99 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package command defines the command line interface for rvcs
+package command
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/recursive-version-control-system/merge"
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+const checkoutUsage = `Usage: %s checkout [<FLAGS>]* <SNAPSHOT> <PATH>
+
+Replaces the contents of the local file path <PATH> with <SNAPSHOT>.
+
+If <PATH> has been modified since it was last snapshotted or checked out,
+then it is left unchanged unless the '--force' flag is given.
+
+Where <SNAPSHOT> is one of:
+
+	The hash of a known snapshot.
+	A local file path which has previously been snapshotted.
+
+And <FLAGS> are one of:
+
+`
+
+var (
+	checkoutFlags = flag.NewFlagSet("checkout", flag.ContinueOnError)
+
+	checkoutForceFlag = checkoutFlags.Bool(
+		"force", false,
+		"if true, then overwrite any local modifications to <PATH>. The modifications are still snapshotted first, so they are kept in the history of <PATH>")
+)
+
+func checkoutCommand(ctx context.Context, s *storage.LocalFiles, cmd string, args []string) (int, error) {
+	checkoutFlags.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), checkoutUsage, cmd)
+		checkoutFlags.PrintDefaults()
+	}
+	if err := checkoutFlags.Parse(args); err != nil {
+		return 1, nil
+	}
+	args = checkoutFlags.Args()
+	if len(args) != 2 {
+		checkoutFlags.Usage()
+		return 1, nil
+	}
+	h, err := resolveSnapshot(ctx, s, args[0])
+	if err != nil {
+		return 1, fmt.Errorf("failure resolving the snapshot hash for %q: %v", args[0], err)
+	}
+	abs, err := filepath.Abs(args[1])
+	if err != nil {
+		return 1, fmt.Errorf("failure determining the absolute path of %q: %v", args[1], err)
+	}
+	p := snapshot.Path(abs)
+
+	// The path is expected to match the snapshot it was last recorded
+	// as, or to not exist if it was never recorded.
+	expected, _, err := s.FindSnapshot(ctx, p)
+	if err != nil && !os.IsNotExist(err) {
+		return 1, fmt.Errorf("failure looking up the previous snapshot of %q: %v", abs, err)
+	}
+	if *checkoutForceFlag {
+		if expected, _, err = snapshot.Current(ctx, s, p); err != nil {
+			return 1, fmt.Errorf("failure snapshotting the current contents of %q: %v", abs, err)
+		}
+	}
+	progress := newProgressLine()
+	err = merge.SafeCheckout(ctx, s, h, p, expected, progress.checkoutOptions())
+	progress.finish()
+	if err != nil {
+		if !*checkoutForceFlag {
+			return 1, fmt.Errorf("failure checking out %q to %q: %v; re-run with '--force' to overwrite local modifications", h, abs, err)
+		}
+		return 1, fmt.Errorf("failure checking out %q to %q: %v", h, abs, err)
+	}
+	fmt.Printf("%s  %s\n", h, abs)
+	return 0, nil
+}
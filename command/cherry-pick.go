@@ -0,0 +1,99 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package command defines the command line interface for rvcs
+package command
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/google/recursive-version-control-system/config"
+	"github.com/google/recursive-version-control-system/merge"
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+const applyChangeUsage = `Usage: %s %s [<FLAGS>]* <SNAPSHOT> <DESTINATION>
+
+%s
+
+Where <DESTINATION> is a local file path, and <SNAPSHOT> is one of:
+
+	The hash of a known snapshot.
+	A local file path which has previously been snapshotted.
+
+And <FLAGS> are one of:
+
+`
+
+const cherryPickDescription = `Applies the changes made by <SNAPSHOT>, relative to its first parent, to <DESTINATION>.`
+
+type applyChangeFunc func(context.Context, *storage.LocalFiles, *snapshot.Hash, snapshot.Path, *merge.Options) (*merge.Result, error)
+
+func cherryPickCommand(ctx context.Context, s *storage.LocalFiles, cmd string, args []string) (int, error) {
+	return applyChangeCommand(ctx, s, cmd, "cherry-pick", cherryPickDescription, merge.CherryPick, args)
+}
+
+func applyChangeCommand(ctx context.Context, s *storage.LocalFiles, cmd, subcmd, description string, apply applyChangeFunc, args []string) (int, error) {
+	flags := flag.NewFlagSet(subcmd, flag.ContinueOnError)
+	allowConflicts := flags.Bool(
+		"allow-conflicts", false,
+		("if true, then conflicts are left in <DESTINATION> for manual resolution rather than aborting. " +
+			"Once they are resolved, complete the change with the '--continue' flag of the merge command."))
+	flags.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), applyChangeUsage, cmd, subcmd, description)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1, nil
+	}
+	args = flags.Args()
+	if len(args) != 2 {
+		flags.Usage()
+		return 1, nil
+	}
+	h, err := resolveSnapshot(ctx, s, args[0])
+	if err != nil {
+		return 1, fmt.Errorf("failure resolving the snapshot hash for %q: %v", args[0], err)
+	}
+	abs, err := filepath.Abs(args[1])
+	if err != nil {
+		return 1, fmt.Errorf("failure determining the absolute path of %q: %v", args[1], err)
+	}
+	settings, err := config.Read()
+	if err != nil {
+		return 1, fmt.Errorf("failure reading the config settings: %v", err)
+	}
+	progress := newProgressLine()
+	opts := &merge.Options{
+		Drivers:        settings.Merge,
+		AllowConflicts: *allowConflicts,
+		Checkout:       progress.checkoutOptions(),
+	}
+	result, err := apply(ctx, s, h, snapshot.Path(abs), opts)
+	progress.finish()
+	if err != nil {
+		return 1, fmt.Errorf("failure applying %q to %q: %v", h, abs, err)
+	}
+	if len(result.Conflicts) > 0 {
+		printConflicts(result.Conflicts)
+		fmt.Printf("Resolve the conflicts above and then run `%s merge --continue %s`\n", cmd, abs)
+		return 1, nil
+	}
+	fmt.Printf("%s  %s\n", result.Hash, abs)
+	return 0, nil
+}
@@ -33,14 +33,23 @@ type command func(context.Context, *storage.LocalFiles, string, []string) (int,
 
 var (
 	commandMap = map[string]command{
-		"add-mirror":    addMirrorCommand,
-		"export":        exportCommand,
-		"import":        importCommand,
-		"log":           logCommand,
-		"merge":         mergeCommand,
-		"publish":       publishCommand,
-		"remove-mirror": removeMirrorCommand,
-		"snapshot":      snapshotCommand,
+		"add-mirror":      addMirrorCommand,
+		"archive":         archiveCommand,
+		"bundle":          bundleCommand,
+		"checkout":        checkoutCommand,
+		"cherry-pick":     cherryPickCommand,
+		"export":          exportCommand,
+		"import":          importCommand,
+		"import-archive":  importArchiveCommand,
+		"log":             logCommand,
+		"merge":           mergeCommand,
+		"publish":         publishCommand,
+		"remove-mirror":   removeMirrorCommand,
+		"restore":         restoreCommand,
+		"revert":          revertCommand,
+		"snapshot":        snapshotCommand,
+		"sparse-checkout": sparseCheckoutCommand,
+		"stash":           stashCommand,
 	}
 
 	usage = `Usage: %s <SUBCOMMAND>
@@ -48,13 +57,22 @@ var (
 Where <SUBCOMMAND> is one of:
 
 	add-mirror
+	archive
+	bundle
+	checkout
+	cherry-pick
 	export
 	import
+	import-archive
 	log
 	merge
 	publish
 	remove-mirror
+	restore
+	revert
 	snapshot
+	sparse-checkout
+	stash
 `
 )
 
@@ -20,17 +20,21 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/google/recursive-version-control-system/bundle"
+	"github.com/google/recursive-version-control-system/snapshot"
 	"github.com/google/recursive-version-control-system/storage"
 )
 
 const exportUsage = `Usage: %s export [<FLAGS>]* <PATH>
 
-Where <PATH> is a local filesystem path for the newly generated bundle, and <FLAGS> are one of:
+Where <PATH> is a local filesystem path for the newly generated bundle, or '-'
+to stream the bundle to standard output, and <FLAGS> are one of:
 
 `
 
@@ -53,6 +57,14 @@ var (
 		"exclude-from-file", "",
 		"path to a file containing a newline separated list of objects to exclude in the exported bundle")
 
+	exportHaveFlag = exportFlags.String(
+		"have", "",
+		("comma separated list of snapshots that the recipient already has. Everything reachable " +
+			"from them, including their history, is omitted from the exported bundle."))
+	exportHaveFromFileFlag = exportFlags.String(
+		"have-from-file", "",
+		"path to a file containing a newline separated list of snapshots that the recipient already has")
+
 	exportMetadataFlag = exportFlags.String(
 		"metadata", "",
 		"comma separated list of key=value pairs to include in the exported bundle")
@@ -60,6 +72,19 @@ var (
 		"metadata-from-files", "",
 		"comma separated list of key=<PATH> pairs to include in the exported bundle. The <PATH> entries must be local files whose contents will be what is included.")
 
+	exportEncryptToFlag = exportFlags.String(
+		"encrypt-to", "",
+		("comma separated list of age recipients to encrypt the exported bundle to. The recipient " +
+			"for a local archive is printed by the `bundle recipient` command."))
+	exportSignAsFlag = exportFlags.String(
+		"sign-as", "",
+		"identity to sign the exported bundle as, using the sign helper for that identity")
+
+	exportMaxSizeFlag = exportFlags.String(
+		"max-size", "",
+		("maximum size of the exported bundle, such as 650M or 2G. If the bundle would be larger, " +
+			"then it is split into numbered volumes named <PATH>.001, <PATH>.002, etc."))
+
 	exportIncludeParentsFlag = exportFlags.Bool(
 		"include-parents", false,
 		"if true, then the exported bundle will recursively include the parents of selected snapshots")
@@ -97,6 +122,25 @@ func metadataFromFilesAndFlag(ctx context.Context, fromFiles, fromFlag string) (
 	return metadata, nil
 }
 
+// parseSize parses a size in bytes with an optional K, M, G, or T suffix
+// for the corresponding binary multiple.
+func parseSize(str string) (int64, error) {
+	multiplier := int64(1)
+	trimmed := strings.TrimSuffix(strings.ToUpper(str), "B")
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(trimmed, suffix) {
+			multiplier = int64(1) << (10 * (i + 1))
+			trimmed = strings.TrimSuffix(trimmed, suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(trimmed, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("malformed size %q", str)
+	}
+	return n * multiplier, nil
+}
+
 func exportCommand(ctx context.Context, s *storage.LocalFiles, cmd string, args []string) (int, error) {
 	exportFlags.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), exportUsage, cmd)
@@ -120,23 +164,53 @@ func exportCommand(ctx context.Context, s *storage.LocalFiles, cmd string, args
 	if err != nil {
 		return 1, err
 	}
+	have, err := hashesFromFileAndFlag(ctx, *exportHaveFromFileFlag, *exportHaveFlag)
+	if err != nil {
+		return 1, err
+	}
 	metadata, err := metadataFromFilesAndFlag(ctx, *exportMetadataFromFilesFlag, *exportMetadataFlag)
 	if err != nil {
 		return 1, err
 	}
 
-	path, err := filepath.Abs(args[0])
-	if err != nil {
-		return 1, fmt.Errorf("failure resolving the absolute path of %q: %v", args[0], err)
+	opts := &bundle.ExportOptions{}
+	if opts.EncryptTo, err = bundle.ParseRecipients(*exportEncryptToFlag); err != nil {
+		return 1, err
+	}
+	if len(*exportSignAsFlag) > 0 {
+		if opts.SignAs, err = snapshot.ParseIdentity(*exportSignAsFlag); err != nil {
+			return 1, fmt.Errorf("failure parsing the identity %q: %v", *exportSignAsFlag, err)
+		}
+	}
+
+	if len(*exportMaxSizeFlag) > 0 {
+		if opts.MaxSize, err = parseSize(*exportMaxSizeFlag); err != nil {
+			return 1, err
+		}
+		if args[0] == "-" {
+			return 1, fmt.Errorf("streamed bundles cannot be split into volumes")
+		}
 	}
 
-	included, err := bundle.Export(ctx, s, path, snapshots, exclude, metadata, *exportIncludeParentsFlag)
+	var included []*snapshot.Hash
+	verboseOutput := os.Stdout
+	if args[0] == "-" {
+		// Standard output holds the bundle, so report on standard error.
+		verboseOutput = os.Stderr
+		included, err = bundle.ExportStream(ctx, s, os.Stdout, snapshots, exclude, have, metadata, *exportIncludeParentsFlag, opts)
+	} else {
+		path, absErr := filepath.Abs(args[0])
+		if absErr != nil {
+			return 1, fmt.Errorf("failure resolving the absolute path of %q: %v", args[0], absErr)
+		}
+		included, err = bundle.Export(ctx, s, path, snapshots, exclude, have, metadata, *exportIncludeParentsFlag, opts)
+	}
 	if err != nil {
 		return 1, fmt.Errorf("failure creating the bundle: %v\n", err)
 	}
 	if *exportVerboseFlag {
 		for _, h := range included {
-			fmt.Println(h.String())
+			fmt.Fprintln(verboseOutput, h.String())
 		}
 	}
 	return 0, nil
@@ -19,15 +19,32 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"os"
 	"path/filepath"
 
 	"github.com/google/recursive-version-control-system/bundle"
+	"github.com/google/recursive-version-control-system/snapshot"
 	"github.com/google/recursive-version-control-system/storage"
 )
 
-const importUsage = `Usage: %s import [<FLAGS>]* <PATH>
+const importUsage = `Usage: %s import [<FLAGS>]* <PATH>...
 
-Where <PATH> is a local filesystem path for the bundle to import, and <FLAGS> are one of:
+Imports the objects in a bundle and prints the root snapshots listed in its manifest.
+
+Encrypted bundles are decrypted using the identity of the local archive, and
+signed bundles are only imported if their signature can be verified. The
+identity that signed the bundle is printed to standard error, and the
+--require-signer flag rejects bundles that are not signed by a specific
+identity. No objects are stored unless the whole bundle is valid, and an
+interrupted import of a bundle file is resumed by running the same command
+again.
+
+Where <PATH> is a local filesystem path for the bundle to import, or '-' to
+read a streamed bundle from standard input, and <FLAGS> are one of the flags
+below. The volumes of a split bundle are imported together by passing the
+path of every volume, in any order.
+
+<FLAGS> are one of:
 
 `
 
@@ -41,11 +58,30 @@ var (
 		"exclude-from-file", "",
 		"path to a file containing a newline separated list of objects to exclude from the import")
 
+	importRequireSignerFlag = importFlags.String(
+		"require-signer", "",
+		"identity that the bundle must be signed by. Bundles that are unsigned or signed by any other identity are rejected")
+
 	importVerboseFlag = importFlags.Bool(
 		"v", false,
-		"verbose output. Print the hash of every object imported")
+		"verbose output. Print the hash of every object imported instead of the root snapshots")
 )
 
+func absPaths(paths []string) ([]string, error) {
+	var result []string
+	for _, p := range paths {
+		if p == "-" {
+			return nil, fmt.Errorf("standard input cannot be combined with other paths")
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, fmt.Errorf("failure resolving the absolute path of %q: %v", p, err)
+		}
+		result = append(result, abs)
+	}
+	return result, nil
+}
+
 func importCommand(ctx context.Context, s *storage.LocalFiles, cmd string, args []string) (int, error) {
 	importFlags.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), importUsage, cmd)
@@ -65,19 +101,40 @@ func importCommand(ctx context.Context, s *storage.LocalFiles, cmd string, args
 		return 1, err
 	}
 
-	path, err := filepath.Abs(args[0])
-	if err != nil {
-		return 1, fmt.Errorf("failure resolving the absolute path of %q: %v", args[0], err)
+	opts := &bundle.ImportOptions{}
+	if len(*importRequireSignerFlag) > 0 {
+		if opts.RequireSigner, err = snapshot.ParseIdentity(*importRequireSignerFlag); err != nil {
+			return 1, fmt.Errorf("failure parsing the required signer %q: %v", *importRequireSignerFlag, err)
+		}
 	}
 
-	included, err := bundle.Import(ctx, s, path, exclude)
+	var roots, included []*snapshot.Hash
+	var signer *snapshot.Identity
+	if len(args) == 1 && args[0] == "-" {
+		roots, included, signer, err = bundle.ImportStream(ctx, s, os.Stdin, exclude, opts)
+	} else {
+		paths, absErr := absPaths(args)
+		if absErr != nil {
+			return 1, absErr
+		}
+		roots, included, signer, err = bundle.ImportVolumes(ctx, s, paths, exclude, opts)
+	}
 	if err != nil {
 		return 1, fmt.Errorf("failure importing the bundle: %v\n", err)
 	}
+	if signer != nil {
+		fmt.Fprintf(os.Stderr, "verified signature by: %s\n", signer)
+	} else {
+		fmt.Fprintln(os.Stderr, "the bundle is not signed")
+	}
 	if *importVerboseFlag {
 		for _, h := range included {
 			fmt.Println(h.String())
 		}
+		return 0, nil
+	}
+	for _, h := range roots {
+		fmt.Println(h.String())
 	}
 	return 0, nil
 }
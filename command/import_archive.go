@@ -0,0 +1,89 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package command defines the command line interface for rvcs
+package command
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/google/recursive-version-control-system/archive"
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+const importArchiveUsage = `Usage: %s import-archive <FILE> [<FLAGS>]*
+
+Creates a snapshot of the files in the standard archive <FILE>, storing
+them directly from the archive rather than extracting them first, and
+prints the hash of the resulting snapshot.
+
+The format of <FILE> is chosen based on its extension, which must be
+one of .tar, .tar.gz, .tgz, or .zip. The archive is treated as the
+contents of a directory. File permissions and symbolic links are preserved.
+
+Neither the local filesystem nor the snapshots of any local paths are
+modified; the imported snapshot can be checked out or merged as usual.
+
+Where <FLAGS> are one of:
+
+`
+
+var (
+	importArchiveFlags = flag.NewFlagSet("import-archive", flag.ContinueOnError)
+
+	importArchiveParentFlag = importArchiveFlags.String(
+		"parent", "",
+		"the snapshot to record as the parent of the imported snapshot; either the hash of a known snapshot, the identity of a published snapshot, or a local file path which has previously been snapshotted")
+)
+
+func importArchiveCommand(ctx context.Context, s *storage.LocalFiles, cmd string, args []string) (int, error) {
+	importArchiveFlags.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), importArchiveUsage, cmd)
+		importArchiveFlags.PrintDefaults()
+	}
+	if err := importArchiveFlags.Parse(args); err != nil {
+		return 1, nil
+	}
+	args = importArchiveFlags.Args()
+	if len(args) < 1 {
+		importArchiveFlags.Usage()
+		return 1, nil
+	}
+	archivePath := args[0]
+	// Flags are also accepted after the file.
+	if err := importArchiveFlags.Parse(args[1:]); err != nil {
+		return 1, nil
+	}
+	if len(importArchiveFlags.Args()) > 0 {
+		importArchiveFlags.Usage()
+		return 1, nil
+	}
+	var parent *snapshot.Hash
+	if len(*importArchiveParentFlag) > 0 {
+		var err error
+		parent, err = resolveSnapshot(ctx, s, *importArchiveParentFlag)
+		if err != nil {
+			return 1, fmt.Errorf("failure resolving the snapshot hash for %q: %v", *importArchiveParentFlag, err)
+		}
+	}
+	h, err := archive.Import(ctx, s, archivePath, parent)
+	if err != nil {
+		return 1, err
+	}
+	fmt.Println(h)
+	return 0, nil
+}
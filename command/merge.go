@@ -21,34 +21,198 @@ import (
 	"fmt"
 	"path/filepath"
 
+	"github.com/google/recursive-version-control-system/config"
 	"github.com/google/recursive-version-control-system/merge"
+	"github.com/google/recursive-version-control-system/rename"
 	"github.com/google/recursive-version-control-system/snapshot"
 	"github.com/google/recursive-version-control-system/storage"
 )
 
-const mergeUsage = `Usage: %s merge <SOURCE> <DESTINATION>
+const mergeUsage = `Usage: %s merge [<FLAGS>]* <SOURCE> <DESTINATION>
+   or: %s merge --continue <DESTINATION>
+   or: %s merge --into-hash [<FLAGS>]* <SOURCE> <DESTINATION>
 
 Where <DESTINATION> is a local file path, and <SOURCE> is one of:
 
 	The hash of a known snapshot.
 	A local file path which has previously been snapshotted.
+
+With the --into-hash flag, <DESTINATION> can also be the hash of a known
+snapshot, and the merged snapshot is printed without modifying any local
+files.
+
+And <FLAGS> are one of:
+
 `
 
+var (
+	mergeFlags = flag.NewFlagSet("merge", flag.ContinueOnError)
+
+	mergeAllowConflictsFlag = mergeFlags.Bool(
+		"allow-conflicts", false,
+		("if true, then conflicts do not abort the merge. Instead, every path that can be automatically merged is checked out, " +
+			"and conflicting paths are left with conflict markers or with side files for each version. " +
+			"Once the conflicts are resolved, complete the merge with the '--continue' flag."))
+	mergeContinueFlag = mergeFlags.Bool(
+		"continue", false,
+		"complete a merge into <DESTINATION> that was previously left with conflicts to manually resolve")
+	mergePreferDeleteFlag = mergeFlags.Bool(
+		"prefer-delete", false,
+		"if true, then files that were deleted on one side of the merge and modified on the other are deleted")
+	mergePreferKeepFlag = mergeFlags.Bool(
+		"prefer-keep", false,
+		"if true, then files that were deleted on one side of the merge and modified on the other are kept with their modifications")
+	mergeStrategyFlag = mergeFlags.String(
+		"strategy", string(merge.RecursiveStrategy),
+		("how to combine the two snapshots; one of 'recursive' (merge every nested path), " +
+			"'ours' (keep the destination contents unchanged), or 'theirs' (replace the destination contents with the source)"))
+	mergeModeConflictFlag = mergeFlags.String(
+		"mode-conflict", "report",
+		("how to resolve file permissions that were changed differently in the source and destination; " +
+			"one of 'report' (report a conflict), 'source' (take the source permissions), or 'destination' (keep the destination permissions)"))
+	mergeDryRunFlag = mergeFlags.Bool(
+		"dry-run", false,
+		"if true, then report the result of the merge, including any conflicts, without modifying <DESTINATION>")
+	mergeHelperTimeoutFlag = mergeFlags.Duration(
+		"helper-timeout", 0,
+		"if non-zero, then this overrides the configured timeout for each invocation of an external merge helper")
+	mergeNoCheckoutFlag = mergeFlags.Bool(
+		"no-checkout", false,
+		"if true, then store the merged snapshot and print its hash without modifying <DESTINATION>")
+	mergeRenameThresholdFlag = mergeFlags.Int(
+		"rename-threshold", rename.DefaultThreshold,
+		("the minimum percentage of lines that a deleted and an added file must share to be treated as a rename, " +
+			"so that changes from the other side of the merge follow the renamed file. A negative value disables rename detection"))
+	mergeIntoHashFlag = mergeFlags.Bool(
+		"into-hash", false,
+		"if true, then merge the two snapshots entirely within storage and print the merged snapshot, without reading or modifying any local files")
+)
+
+var mergeModeConflictPolicies = map[string]merge.ModeConflictPolicy{
+	"report":      merge.ReportModeConflict,
+	"source":      merge.PreferSourceMode,
+	"destination": merge.PreferDestinationMode,
+}
+
 func mergeCommand(ctx context.Context, s *storage.LocalFiles, cmd string, args []string) (int, error) {
+	mergeFlags.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), mergeUsage, cmd, cmd, cmd)
+		mergeFlags.PrintDefaults()
+	}
+	if err := mergeFlags.Parse(args); err != nil {
+		return 1, nil
+	}
+	args = mergeFlags.Args()
+	if *mergeContinueFlag {
+		return mergeContinue(ctx, s, args)
+	}
 	if len(args) != 2 {
-		fmt.Fprintf(flag.CommandLine.Output(), mergeUsage, cmd)
+		mergeFlags.Usage()
 		return 1, nil
 	}
 	h, err := resolveSnapshot(ctx, s, args[0])
 	if err != nil {
 		return 1, fmt.Errorf("failure resolving the snapshot hash for %q: %v", args[0], err)
 	}
+	opts, err := mergeOptions()
+	if err != nil {
+		return 1, err
+	}
+	if *mergeIntoHashFlag {
+		return mergeIntoHash(ctx, s, h, args[1], opts)
+	}
 	abs, err := filepath.Abs(args[1])
 	if err != nil {
 		return 1, fmt.Errorf("failure determining the absolute path of %q: %v", args[1], err)
 	}
-	if err := merge.Merge(ctx, s, h, snapshot.Path(abs)); err != nil {
+	progress := newProgressLine()
+	opts.Checkout = progress.checkoutOptions()
+	result, err := merge.MergeWithResult(ctx, s, h, snapshot.Path(abs), opts)
+	progress.finish()
+	if err != nil {
 		return 1, fmt.Errorf("failure merging %q into %q: %v", h, abs, err)
 	}
+	if len(result.Conflicts) == 0 {
+		if opts.DryRun || opts.NoCheckout {
+			fmt.Printf("%s  %s\n", result.Hash, abs)
+		}
+		return 0, nil
+	}
+	printConflicts(result.Conflicts)
+	if !opts.DryRun {
+		fmt.Printf("Resolve the conflicts above and then run `%s merge --continue %s`\n", cmd, abs)
+	}
+	return 1, nil
+}
+
+func mergeOptions() (*merge.Options, error) {
+	settings, err := config.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the config settings: %v", err)
+	}
+	modeConflict, ok := mergeModeConflictPolicies[*mergeModeConflictFlag]
+	if !ok {
+		return nil, fmt.Errorf("unknown mode conflict policy %q", *mergeModeConflictFlag)
+	}
+	opts := &merge.Options{
+		Strategy:       merge.Strategy(*mergeStrategyFlag),
+		Drivers:        settings.Merge,
+		ModeConflict:   modeConflict,
+		HelperTimeout:  *mergeHelperTimeoutFlag,
+		AllowConflicts: *mergeAllowConflictsFlag,
+		DryRun:         *mergeDryRunFlag,
+		NoCheckout:     *mergeNoCheckoutFlag,
+
+		RenameThreshold: *mergeRenameThresholdFlag,
+	}
+	if *mergePreferDeleteFlag && *mergePreferKeepFlag {
+		return nil, fmt.Errorf("the `--prefer-delete` and `--prefer-keep` flags are mutually exclusive")
+	} else if *mergePreferDeleteFlag {
+		opts.DeleteModify = merge.PreferDelete
+	} else if *mergePreferKeepFlag {
+		opts.DeleteModify = merge.PreferKeep
+	}
+	return opts, nil
+}
+
+func mergeIntoHash(ctx context.Context, s *storage.LocalFiles, src *snapshot.Hash, destArg string, opts *merge.Options) (int, error) {
+	dest, err := resolveSnapshot(ctx, s, destArg)
+	if err != nil {
+		return 1, fmt.Errorf("failure resolving the snapshot hash for %q: %v", destArg, err)
+	}
+	// Conflicts are reported below rather than as an error.
+	opts.AllowConflicts = true
+	result, err := merge.MergeHashes(ctx, s, src, dest, opts)
+	if err != nil {
+		return 1, fmt.Errorf("failure merging %q into %q: %v", src, dest, err)
+	}
+	if len(result.Conflicts) > 0 {
+		printConflicts(result.Conflicts)
+		return 1, nil
+	}
+	fmt.Println(result.Hash)
+	return 0, nil
+}
+
+func printConflicts(conflicts []*merge.Conflict) {
+	for _, c := range conflicts {
+		fmt.Printf("CONFLICT %s: %s\n", c.Path, c.Reason)
+	}
+}
+
+func mergeContinue(ctx context.Context, s *storage.LocalFiles, args []string) (int, error) {
+	if len(args) != 1 {
+		mergeFlags.Usage()
+		return 1, nil
+	}
+	abs, err := filepath.Abs(args[0])
+	if err != nil {
+		return 1, fmt.Errorf("failure determining the absolute path of %q: %v", args[0], err)
+	}
+	h, err := merge.Continue(ctx, s, snapshot.Path(abs))
+	if err != nil {
+		return 1, fmt.Errorf("failure completing the merge into %q: %v", abs, err)
+	}
+	fmt.Printf("%s  %s\n", h, abs)
 	return 0, nil
 }
@@ -0,0 +1,87 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package command defines the command line interface for rvcs
+package command
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/google/recursive-version-control-system/merge"
+	"github.com/google/recursive-version-control-system/snapshot"
+	"golang.org/x/term"
+)
+
+// progressInterval limits how often the progress line is redrawn.
+const progressInterval = 100 * time.Millisecond
+
+// progressLine renders the progress of a checkout as a single line on the
+// terminal, which is redrawn as files are written.
+type progressLine struct {
+	lastUpdate time.Time
+	drawn      bool
+}
+
+// newProgressLine returns a progress line for a checkout, or nil if the
+// standard error is not a terminal.
+func newProgressLine() *progressLine {
+	if !term.IsTerminal(syscall.Stderr) {
+		return nil
+	}
+	return &progressLine{}
+}
+
+// checkoutOptions returns the checkout options that report progress to
+// this line.
+func (l *progressLine) checkoutOptions() *merge.CheckoutOptions {
+	if l == nil {
+		return nil
+	}
+	return &merge.CheckoutOptions{Progress: l}
+}
+
+// Update implements the `merge.Progress` interface.
+func (l *progressLine) Update(files, bytes int64, current snapshot.Path) {
+	now := time.Now()
+	if now.Sub(l.lastUpdate) < progressInterval {
+		return
+	}
+	l.lastUpdate = now
+	l.drawn = true
+	fmt.Fprintf(os.Stderr, "\r\033[KChecked out %d files (%s): %s", files, formatBytes(bytes), current)
+}
+
+// finish clears the progress line, if it was drawn.
+func (l *progressLine) finish() {
+	if l == nil || !l.drawn {
+		return
+	}
+	fmt.Fprint(os.Stderr, "\r\033[K")
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package command defines the command line interface for rvcs
+package command
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/google/recursive-version-control-system/merge"
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+const restoreUsage = `Usage: %s restore <PATH> [<FLAGS>]* -- <SUBPATH>+
+
+Restores the nested paths <SUBPATH>, relative to the local file path <PATH>,
+from an earlier snapshot of <PATH>, without modifying the rest of <PATH>.
+
+The current contents of <PATH> are snapshotted first, so any local
+modifications to the restored paths are kept in its history.
+
+Where <FLAGS> are one of:
+
+`
+
+var (
+	restoreFlags = flag.NewFlagSet("restore", flag.ContinueOnError)
+
+	restoreFromFlag = restoreFlags.String(
+		"from", "",
+		"the snapshot to restore from; either the hash of a known snapshot or a local file path which has previously been snapshotted. Defaults to the latest snapshot of <PATH>")
+)
+
+func restoreCommand(ctx context.Context, s *storage.LocalFiles, cmd string, args []string) (int, error) {
+	restoreFlags.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), restoreUsage, cmd)
+		restoreFlags.PrintDefaults()
+	}
+	if err := restoreFlags.Parse(args); err != nil {
+		return 1, nil
+	}
+	args = restoreFlags.Args()
+	if len(args) < 1 {
+		restoreFlags.Usage()
+		return 1, nil
+	}
+	path := args[0]
+	// Flags are also accepted after the path.
+	if err := restoreFlags.Parse(args[1:]); err != nil {
+		return 1, nil
+	}
+	args = restoreFlags.Args()
+	if len(args) < 1 {
+		restoreFlags.Usage()
+		return 1, nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return 1, fmt.Errorf("failure determining the absolute path of %q: %v", path, err)
+	}
+	from := *restoreFromFlag
+	if len(from) == 0 {
+		from = abs
+	}
+	h, err := resolveSnapshot(ctx, s, from)
+	if err != nil {
+		return 1, fmt.Errorf("failure resolving the snapshot hash for %q: %v", from, err)
+	}
+	var subpaths []snapshot.Path
+	for _, arg := range args {
+		subpaths = append(subpaths, snapshot.Path(arg))
+	}
+	restored, err := merge.Restore(ctx, s, h, snapshot.Path(abs), subpaths)
+	if err != nil {
+		return 1, fmt.Errorf("failure restoring %v from %q: %v", args, h, err)
+	}
+	fmt.Printf("%s  %s\n", restored, abs)
+	return 0, nil
+}
@@ -0,0 +1,29 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package command defines the command line interface for rvcs
+package command
+
+import (
+	"context"
+
+	"github.com/google/recursive-version-control-system/merge"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+const revertDescription = `Applies the inverse of the changes made by <SNAPSHOT>, relative to its first parent, to <DESTINATION>.`
+
+func revertCommand(ctx context.Context, s *storage.LocalFiles, cmd string, args []string) (int, error) {
+	return applyChangeCommand(ctx, s, cmd, "revert", revertDescription, merge.Revert, args)
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package command defines the command line interface for rvcs
+package command
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/google/recursive-version-control-system/merge"
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+const sparseCheckoutUsage = `Usage: %s sparse-checkout [<FLAGS>]* <PATH> [<PATTERN>]*
+
+Limits which nested paths of <PATH> are materialized in the local filesystem.
+
+Each <PATTERN> is a slash-separated path relative to <PATH>, whose elements
+may use shell-style wildcards. Nested paths that do not match any pattern are
+removed from the local filesystem, but are kept in new snapshots of <PATH>.
+
+If no patterns are given, then the current patterns for <PATH> are printed.
+
+And <FLAGS> are one of:
+
+`
+
+var (
+	sparseCheckoutFlags = flag.NewFlagSet("sparse-checkout", flag.ContinueOnError)
+
+	sparseCheckoutDisableFlag = sparseCheckoutFlags.Bool(
+		"disable", false,
+		"if true, then remove the sparse checkout patterns for <PATH> and materialize all of its nested paths")
+)
+
+func sparseCheckoutCommand(ctx context.Context, s *storage.LocalFiles, cmd string, args []string) (int, error) {
+	sparseCheckoutFlags.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), sparseCheckoutUsage, cmd)
+		sparseCheckoutFlags.PrintDefaults()
+	}
+	if err := sparseCheckoutFlags.Parse(args); err != nil {
+		return 1, nil
+	}
+	args = sparseCheckoutFlags.Args()
+	if len(args) < 1 || (*sparseCheckoutDisableFlag && len(args) > 1) {
+		sparseCheckoutFlags.Usage()
+		return 1, nil
+	}
+	abs, err := filepath.Abs(args[0])
+	if err != nil {
+		return 1, fmt.Errorf("failure determining the absolute path of %q: %v", args[0], err)
+	}
+	p := snapshot.Path(abs)
+	patterns := snapshot.SparsePatterns(args[1:])
+	if len(patterns) == 0 && !*sparseCheckoutDisableFlag {
+		current, err := s.SparsePatterns(ctx, p)
+		if err != nil {
+			return 1, fmt.Errorf("failure reading the sparse checkout patterns for %q: %v", abs, err)
+		}
+		for _, pattern := range current {
+			fmt.Println(pattern)
+		}
+		return 0, nil
+	}
+	h, err := merge.UpdateSparseCheckout(ctx, s, p, patterns)
+	if err != nil {
+		return 1, fmt.Errorf("failure updating the sparse checkout of %q: %v", abs, err)
+	}
+	if h != nil {
+		fmt.Printf("%s  %s\n", h, abs)
+	}
+	return 0, nil
+}
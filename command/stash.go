@@ -0,0 +1,144 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package command defines the command line interface for rvcs
+package command
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"github.com/google/recursive-version-control-system/config"
+	"github.com/google/recursive-version-control-system/merge"
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+const stashUsage = `Usage: %s stash [<FLAGS>]* <SUBCOMMAND> <PATH> [<INDEX>]
+
+Sets aside local changes to <PATH> and later reapplies them.
+
+Where <SUBCOMMAND> is one of:
+
+	push	Snapshot the local changes made to <PATH> since its last
+		recorded snapshot, keep them as a new stash, and check that
+		last recorded snapshot back out.
+	pop	Merge the changes from the stash at <INDEX> back into <PATH>,
+		and then drop that stash.
+	list	Print the stashes for <PATH>, starting with the most recent.
+	drop	Remove the stash at <INDEX> without applying it.
+
+And <INDEX> is the position of a stash in the list, defaulting to 0 for the
+most recent one.
+
+And <FLAGS> are one of:
+
+`
+
+var (
+	stashFlags = flag.NewFlagSet("stash", flag.ContinueOnError)
+
+	stashAllowConflictsFlag = stashFlags.Bool(
+		"allow-conflicts", false,
+		("if true, then conflicts from 'pop' are left in <PATH> for manual resolution rather than aborting. " +
+			"Once they are resolved, complete the merge with the '--continue' flag of the merge command, and then drop the stash."))
+)
+
+func stashCommand(ctx context.Context, s *storage.LocalFiles, cmd string, args []string) (int, error) {
+	stashFlags.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), stashUsage, cmd)
+		stashFlags.PrintDefaults()
+	}
+	if err := stashFlags.Parse(args); err != nil {
+		return 1, nil
+	}
+	args = stashFlags.Args()
+	if len(args) < 2 || len(args) > 3 {
+		stashFlags.Usage()
+		return 1, nil
+	}
+	subcmd := args[0]
+	abs, err := filepath.Abs(args[1])
+	if err != nil {
+		return 1, fmt.Errorf("failure determining the absolute path of %q: %v", args[1], err)
+	}
+	p := snapshot.Path(abs)
+	index := 0
+	if len(args) > 2 {
+		if subcmd != "pop" && subcmd != "drop" {
+			stashFlags.Usage()
+			return 1, nil
+		}
+		if index, err = strconv.Atoi(args[2]); err != nil {
+			return 1, fmt.Errorf("failure parsing the stash index %q: %v", args[2], err)
+		}
+	}
+	switch subcmd {
+	case "push":
+		progress := newProgressLine()
+		h, err := merge.Stash(ctx, s, p, progress.checkoutOptions())
+		progress.finish()
+		if errors.Is(err, merge.ErrNothingToStash) {
+			fmt.Printf("No local changes to stash for %s\n", abs)
+			return 0, nil
+		} else if err != nil {
+			return 1, fmt.Errorf("failure stashing the changes to %q: %v", abs, err)
+		}
+		fmt.Printf("%s  %s\n", h, abs)
+		return 0, nil
+	case "pop":
+		settings, err := config.Read()
+		if err != nil {
+			return 1, fmt.Errorf("failure reading the config settings: %v", err)
+		}
+		progress := newProgressLine()
+		opts := &merge.Options{
+			Drivers:        settings.Merge,
+			AllowConflicts: *stashAllowConflictsFlag,
+			Checkout:       progress.checkoutOptions(),
+		}
+		result, err := merge.PopStash(ctx, s, p, index, opts)
+		progress.finish()
+		if err != nil {
+			return 1, fmt.Errorf("failure applying stash %d to %q: %v", index, abs, err)
+		}
+		if len(result.Conflicts) > 0 {
+			printConflicts(result.Conflicts)
+			fmt.Printf("Resolve the conflicts above and then run `%s merge --continue %s` followed by `%s stash drop %s %d`\n", cmd, abs, cmd, abs, index)
+			return 1, nil
+		}
+		fmt.Printf("%s  %s\n", result.Hash, abs)
+		return 0, nil
+	case "list":
+		stashes, err := s.Stashes(ctx, p)
+		if err != nil {
+			return 1, fmt.Errorf("failure listing the stashes for %q: %v", abs, err)
+		}
+		for i, h := range stashes {
+			fmt.Printf("%d  %s\n", i, h)
+		}
+		return 0, nil
+	case "drop":
+		if err := merge.DropStash(ctx, s, p, index); err != nil {
+			return 1, fmt.Errorf("failure dropping stash %d for %q: %v", index, abs, err)
+		}
+		return 0, nil
+	}
+	stashFlags.Usage()
+	return 1, nil
+}
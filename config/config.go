@@ -97,6 +97,53 @@ type Identity struct {
 	Mirrors []*Mirror `json:"mirrors,omitempty"`
 }
 
+// MergeDriver defines an external command used to merge individual files.
+type MergeDriver struct {
+	// Name is the name used to refer to the driver in merge rules.
+	Name string `json:"name"`
+
+	// Command is the command to invoke for merging files.
+	//
+	// It is invoked with the given args, followed by the paths of the
+	// source, base, and destination versions of the file, and must
+	// write the merged contents to its standard output.
+	Command string `json:"command"`
+
+	// Args are additional command line arguments to pass to the command.
+	Args []string `json:"args,omitempty"`
+
+	// Timeout is how long the command is allowed to run for a single
+	// file, in the format accepted by `time.ParseDuration`.
+	//
+	// If empty, then a default timeout is used.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// MergeRule selects the merge driver to use for files matching a pattern.
+type MergeRule struct {
+	// Pattern is a glob pattern as supported by `filepath.Match`.
+	//
+	// If the pattern contains a `/`, then it is matched against the
+	// path of the file relative to the root of the merge. Otherwise, it
+	// is matched against the base name of the file.
+	Pattern string `json:"pattern"`
+
+	// Driver is the name of either a built-in merge driver or of one
+	// of the drivers defined in the merge settings.
+	Driver string `json:"driver"`
+}
+
+// MergeSettings defines how individual files are merged.
+type MergeSettings struct {
+	// Drivers are custom merge drivers that can be referenced by rules.
+	Drivers []*MergeDriver `json:"drivers,omitempty"`
+
+	// Rules select the merge driver for files based on their paths.
+	//
+	// If multiple rules match a file, then the last one wins.
+	Rules []*MergeRule `json:"rules,omitempty"`
+}
+
 // Settings defines configuration settings for the rvcs tool.
 type Settings struct {
 	// Identities is a list of configurations for each of the identities we keep track of.
@@ -106,6 +153,9 @@ type Settings struct {
 	// any identities that do not have a matching entry in the
 	// `identities` field.
 	AdditionalMirrors []*Mirror `json:"additionalMirrors,omitempty"`
+
+	// Merge configures how individual files are merged.
+	Merge *MergeSettings `json:"merge,omitempty"`
 }
 
 // Read reads in the configuration saved in the user's config directory.
@@ -162,6 +212,7 @@ func (s *Settings) WithAdditionalMirror(m *Mirror) *Settings {
 	return &Settings{
 		Identities:        s.Identities,
 		AdditionalMirrors: addOrOverwriteMirror(s.AdditionalMirrors, m),
+		Merge:             s.Merge,
 	}
 }
 
@@ -175,6 +226,7 @@ func (s *Settings) WithAdditionalMirror(m *Mirror) *Settings {
 func (s *Settings) WithMirrorForIdentity(idName string, m *Mirror) *Settings {
 	res := &Settings{
 		AdditionalMirrors: s.AdditionalMirrors,
+		Merge:             s.Merge,
 	}
 	for i, existingID := range s.Identities {
 		if existingID.Name != idName {
@@ -202,6 +254,7 @@ func (s *Settings) WithoutAdditionalMirror(u *url.URL) *Settings {
 	return &Settings{
 		Identities:        s.Identities,
 		AdditionalMirrors: removeMirror(s.AdditionalMirrors, u),
+		Merge:             s.Merge,
 	}
 }
 
@@ -212,6 +265,7 @@ func (s *Settings) WithoutAdditionalMirror(u *url.URL) *Settings {
 func (s *Settings) WithoutMirrorForIdentity(idName string, u *url.URL) *Settings {
 	res := &Settings{
 		AdditionalMirrors: s.AdditionalMirrors,
+		Merge:             s.Merge,
 	}
 	for i, existingID := range s.Identities {
 		if existingID.Name != idName {
@@ -62,6 +62,31 @@ func TestParseSettings(t *testing.T) {
 				},
 			},
 		},
+		{
+			Description: "Merge drivers",
+			Serialized:  "{\"merge\": {\"drivers\": [{\"name\": \"json\", \"command\": \"json-merge\", \"args\": [\"--pretty\"]}], \"rules\": [{\"pattern\": \"*.json\", \"driver\": \"json\"}, {\"pattern\": \"go.sum\", \"driver\": \"union\"}]}}",
+			Want: &Settings{
+				Merge: &MergeSettings{
+					Drivers: []*MergeDriver{
+						&MergeDriver{
+							Name:    "json",
+							Command: "json-merge",
+							Args:    []string{"--pretty"},
+						},
+					},
+					Rules: []*MergeRule{
+						&MergeRule{
+							Pattern: "*.json",
+							Driver:  "json",
+						},
+						&MergeRule{
+							Pattern: "go.sum",
+							Driver:  "union",
+						},
+					},
+				},
+			},
+		},
 	}
 	for _, testCase := range testCases {
 		var s Settings
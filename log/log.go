@@ -22,6 +22,7 @@ import (
 	"sort"
 	"syscall"
 
+	"github.com/google/recursive-version-control-system/rename"
 	"github.com/google/recursive-version-control-system/snapshot"
 	"github.com/google/recursive-version-control-system/storage"
 	"golang.org/x/term"
@@ -124,14 +125,29 @@ func insertLine(insertedPath string, insertedHash *snapshot.Hash) string {
 	return fmt.Sprintf("\033[32m%s\033[0m", coreText)
 }
 
-func describeChanged(paths, previousPaths []string, contents, previousContents map[string]*snapshot.Hash) []string {
+func renameLine(previousPath string, previousHash *snapshot.Hash, renamedPath string, renamedHash *snapshot.Hash) string {
+	coreText := fmt.Sprintf("  ~%s(%s) -> %s(%s)", previousPath, previousHash, renamedPath, renamedHash)
+	if !term.IsTerminal(syscall.Stdout) {
+		return coreText
+	}
+	// Add ascii color escape codes if running in a terminal
+	return fmt.Sprintf("\033[33m%s\033[0m", coreText)
+}
+
+func describeChanged(paths, previousPaths []string, contents, previousContents map[string]*snapshot.Hash, renames map[string]string) []string {
+	renamedFrom := make(map[string]bool)
+	for _, previousPath := range renames {
+		renamedFrom[previousPath] = true
+	}
 	changes := []string{}
 	for _, p := range paths {
 		h := contents[p]
 		for len(previousPaths) > 0 && previousPaths[0] < p {
 			deletedPath := previousPaths[0]
 			previousPaths = previousPaths[1:]
-			changes = append(changes, deleteLine(deletedPath, previousContents[deletedPath]))
+			if !renamedFrom[deletedPath] {
+				changes = append(changes, deleteLine(deletedPath, previousContents[deletedPath]))
+			}
 		}
 		var previousHash *snapshot.Hash
 		if len(previousPaths) > 0 && previousPaths[0] == p {
@@ -141,12 +157,19 @@ func describeChanged(paths, previousPaths []string, contents, previousContents m
 		if previousHash.Equal(h) {
 			continue
 		}
+		if previousPath, ok := renames[p]; ok {
+			changes = append(changes, renameLine(previousPath, previousContents[previousPath], p, h))
+			continue
+		}
 		if previousHash != nil {
 			changes = append(changes, deleteLine(p, previousHash))
 		}
 		changes = append(changes, insertLine(p, h))
 	}
 	for _, deletedPath := range previousPaths {
+		if renamedFrom[deletedPath] {
+			continue
+		}
 		previousHash := previousContents[deletedPath]
 		changes = append(changes, deleteLine(deletedPath, previousHash))
 	}
@@ -176,10 +199,21 @@ func SummarizeLog(ctx context.Context, s *storage.LocalFiles, entries []*LogEntr
 			prevContents = contentsMap[*firstParent]
 		}
 		summary := []string{e.Hash.String()}
+		annotations, err := s.Annotations(ctx, e.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("failure reading the annotations for snapshot %q: %v", e.Hash, err)
+		}
+		for _, annotation := range annotations {
+			summary = append(summary, fmt.Sprintf("  (%s)", annotation))
+		}
 		contents, contentsOk := contentsMap[*e.Hash]
 		paths, pathsOk := pathsMap[*e.Hash]
 		if contentsOk && pathsOk {
-			summary = append(summary, describeChanged(paths, prevPaths, contents, prevContents)...)
+			renames, err := rename.DetectBetween(ctx, s, prevContents, contents, rename.DefaultThreshold)
+			if err != nil {
+				return nil, fmt.Errorf("failure detecting renamed files in snapshot %q: %v", e.Hash, err)
+			}
+			summary = append(summary, describeChanged(paths, prevPaths, contents, prevContents, renames)...)
 		}
 		result[*e.Hash] = summary
 	}
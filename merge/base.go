@@ -16,14 +16,260 @@
 package merge
 
 import (
+	"container/heap"
 	"context"
 	"fmt"
 
-	"github.com/google/recursive-version-control-system/log"
 	"github.com/google/recursive-version-control-system/snapshot"
 	"github.com/google/recursive-version-control-system/storage"
 )
 
+// generation returns the generation number of the given snapshot.
+//
+// The nil snapshot has a generation of 0, and every other snapshot has a
+// generation one greater than the maximum generation of its parents. That
+// means a snapshot can only be an ancestor of another if it has a lower
+// generation, which lets us stop ancestry searches early.
+//
+// Generation numbers are cached in storage, so computing them only requires
+// a full traversal of a snapshot's history the first time.
+func generation(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash) (uint64, error) {
+	if h == nil {
+		return 0, nil
+	}
+	if gen, ok := s.CachedGeneration(ctx, h); ok {
+		return gen, nil
+	}
+	gens := make(map[snapshot.Hash]uint64)
+	parents := make(map[snapshot.Hash][]*snapshot.Hash)
+	stack := []*snapshot.Hash{h}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		if _, ok := gens[*top]; ok {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		if gen, ok := s.CachedGeneration(ctx, top); ok {
+			gens[*top] = gen
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		topParents, ok := parents[*top]
+		if !ok {
+			f, err := s.ReadSnapshot(ctx, top)
+			if err != nil {
+				return 0, fmt.Errorf("failure reading the snapshot for %q: %v", top, err)
+			}
+			topParents = f.Parents
+			parents[*top] = topParents
+		}
+		var maxParentGen uint64
+		var pending bool
+		for _, p := range topParents {
+			if gen, ok := gens[*p]; !ok {
+				stack = append(stack, p)
+				pending = true
+			} else if gen > maxParentGen {
+				maxParentGen = gen
+			}
+		}
+		if pending {
+			// Revisit this snapshot once all of its parents are done.
+			continue
+		}
+		gens[*top] = maxParentGen + 1
+		if err := s.CacheGeneration(ctx, top, maxParentGen+1); err != nil {
+			return 0, fmt.Errorf("failure caching the generation of %q: %v", top, err)
+		}
+		stack = stack[:len(stack)-1]
+	}
+	return gens[*h], nil
+}
+
+type queueEntry struct {
+	hash *snapshot.Hash
+	gen  uint64
+}
+
+// generationQueue is a priority queue of snapshots ordered from the
+// highest generation to the lowest.
+type generationQueue []*queueEntry
+
+func (q generationQueue) Len() int           { return len(q) }
+func (q generationQueue) Less(i, j int) bool { return q[i].gen > q[j].gen }
+func (q generationQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *generationQueue) Push(x any) {
+	*q = append(*q, x.(*queueEntry))
+}
+
+func (q *generationQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+func (q *generationQueue) pushHash(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash) error {
+	gen, err := generation(ctx, s, h)
+	if err != nil {
+		return err
+	}
+	heap.Push(q, &queueEntry{hash: h, gen: gen})
+	return nil
+}
+
+// IsAncestor reports whether or not `base` is an ancestor of `h`.
+//
+// See the documentation of the `Base` method for the definition of ancestry.
+func IsAncestor(ctx context.Context, s *storage.LocalFiles, base, h *snapshot.Hash) (bool, error) {
+	// 空快照是所有快照的祖先
+	if base == nil || base.Equal(h) {
+		// The nil snapshot is an ancestor of all other snapshots.
+		return true, nil
+	}
+	if h == nil {
+		return false, nil
+	}
+	baseGen, err := generation(ctx, s, base)
+	if err != nil {
+		return false, fmt.Errorf("failure computing the generation of %q: %v", base, err)
+	}
+	visited := make(map[snapshot.Hash]struct{})
+	queue := []*snapshot.Hash{h}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if _, ok := visited[*next]; ok {
+			continue
+		}
+		visited[*next] = struct{}{}
+		if next.Equal(base) {
+			return true, nil
+		}
+		if gen, err := generation(ctx, s, next); err != nil {
+			return false, fmt.Errorf("failure computing the generation of %q: %v", next, err)
+		} else if gen <= baseGen {
+			// Nothing at or below the generation of the base
+			// can have the base as an ancestor.
+			continue
+		}
+		f, err := s.ReadSnapshot(ctx, next)
+		if err != nil {
+			return false, fmt.Errorf("failure reading the snapshot for %q: %v", next, err)
+		}
+		queue = append(queue, f.Parents...)
+	}
+	return false, nil
+}
+
+const (
+	reachableFromLHS = 1 << iota
+	reachableFromRHS
+	staleAncestor
+
+	reachableFromBoth = reachableFromLHS | reachableFromRHS
+)
+
+// Bases identifies all of the best common ancestors of two snapshots.
+//
+// A common ancestor is "best" if it is not an ancestor of any other common
+// ancestor. For a linear history, there is at most one of these, but for
+// "criss-cross" histories, where each side has merged in the other side
+// independently, there can be several.
+//
+// If the only common ancestor is the nil snapshot, then the returned
+// slice is empty.
+func Bases(ctx context.Context, s *storage.LocalFiles, lhs, rhs *snapshot.Hash) ([]*snapshot.Hash, error) {
+	if lhs.Equal(rhs) {
+		if lhs == nil {
+			return nil, nil
+		}
+		return []*snapshot.Hash{lhs}, nil
+	}
+	if lhs == nil || rhs == nil {
+		return nil, nil
+	}
+
+	// We walk down from both snapshots in order of decreasing generation,
+	// marking each snapshot with which side(s) it is reachable from.
+	//
+	// The first time we reach a snapshot from both sides, it is a
+	// candidate for being a best common ancestor, and everything
+	// reachable from it is marked as stale. We can stop as soon as every
+	// remaining snapshot in the queue is stale.
+	flags := map[snapshot.Hash]int{
+		*lhs: reachableFromLHS,
+		*rhs: reachableFromRHS,
+	}
+	queue := &generationQueue{}
+	if err := queue.pushHash(ctx, s, lhs); err != nil {
+		return nil, fmt.Errorf("failure computing the generation of %q: %v", lhs, err)
+	}
+	if err := queue.pushHash(ctx, s, rhs); err != nil {
+		return nil, fmt.Errorf("failure computing the generation of %q: %v", rhs, err)
+	}
+	var candidates []*snapshot.Hash
+	for queue.hasNonStale(flags) {
+		e := heap.Pop(queue).(*queueEntry)
+		entryFlags := flags[*e.hash]
+		if entryFlags&reachableFromBoth == reachableFromBoth && entryFlags&staleAncestor == 0 {
+			candidates = append(candidates, e.hash)
+			entryFlags |= staleAncestor
+			flags[*e.hash] = entryFlags
+		}
+		f, err := s.ReadSnapshot(ctx, e.hash)
+		if err != nil {
+			return nil, fmt.Errorf("failure reading the snapshot for %q: %v", e.hash, err)
+		}
+		for _, p := range f.Parents {
+			if flags[*p]&entryFlags == entryFlags {
+				// The parent has already been reached this way.
+				continue
+			}
+			flags[*p] |= entryFlags
+			if err := queue.pushHash(ctx, s, p); err != nil {
+				return nil, fmt.Errorf("failure computing the generation of %q: %v", p, err)
+			}
+		}
+	}
+
+	// Some of the candidates might be ancestors of other candidates
+	// that were reached through a different path, so filter those out.
+	var bases []*snapshot.Hash
+	for i, c := range candidates {
+		redundant := false
+		for j, other := range candidates {
+			if i == j {
+				continue
+			}
+			if isAncestor, err := IsAncestor(ctx, s, c, other); err != nil {
+				return nil, err
+			} else if isAncestor {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			bases = append(bases, c)
+		}
+	}
+	return bases, nil
+}
+
+func (q generationQueue) hasNonStale(flags map[snapshot.Hash]int) bool {
+	for _, e := range q {
+		if flags[*e.hash]&staleAncestor == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// virtualBasePath is the path used when reporting on merges of multiple
+// merge bases.
+const virtualBasePath = snapshot.Path("virtual-merge-base")
+
 // Base identifies the "merge base" between two snapshots; the most recent
 // common ancestor of both.
 //
@@ -37,41 +283,36 @@ import (
 // This means there is always a common ancestor for any two given snapshots,
 // because the nil hash/snapshot is considered an ancestor for all snapshots.
 //
+// If there are multiple best common ancestors (see `Bases`), then they are
+// recursively merged together into a single "virtual" merge base, whose
+// parents are those common ancestors. Any conflicts in that merge are left
+// as they were in the most recent of the common ancestors.
+//
 // Regardless, this method can still return an error in cases where the
 // snapshot storage is incomplete and some snapshots are missing.
 func Base(ctx context.Context, s *storage.LocalFiles, lhs, rhs *snapshot.Hash) (*snapshot.Hash, error) {
-	if lhs.Equal(rhs) {
-		return lhs, nil
-	}
-	if lhs == nil || rhs == nil {
-		return nil, nil
-	}
-	lhsLog, err := log.ReadLog(ctx, s, lhs, -1)
+	bases, err := Bases(ctx, s, lhs, rhs)
 	if err != nil {
-		return nil, fmt.Errorf("failure reading the log for %q: %v", lhs, err)
+		return nil, fmt.Errorf("failure identifying the common ancestors of %q and %q: %v", lhs, rhs, err)
 	}
-	lhsAncestors := make(map[snapshot.Hash]struct{})
-	for _, e := range lhsLog {
-		lhsAncestors[*e.Hash] = struct{}{}
-	}
-	rhsLog, err := log.ReadLog(ctx, s, rhs, -1)
-	if err != nil {
-		return nil, fmt.Errorf("failure reading the log for %q: %v", rhs, err)
-	}
-	rhsAncestors := make(map[snapshot.Hash]struct{})
-	for _, e := range rhsLog {
-		rhsAncestors[*e.Hash] = struct{}{}
+	if len(bases) == 0 {
+		// There are no common ancestors other than the nil snapshot
+		return nil, nil
 	}
-	for len(lhsLog) > 0 && len(rhsLog) > 0 {
-		if _, ok := rhsAncestors[*lhsLog[0].Hash]; ok {
-			return lhsLog[0].Hash, nil
+	virtualBase := bases[0]
+	for _, next := range bases[1:] {
+		nestedBase, err := Base(ctx, s, next, virtualBase)
+		if err != nil {
+			return nil, fmt.Errorf("failure determining the merge base for %q and %q: %v", next, virtualBase, err)
 		}
-		if _, ok := lhsAncestors[*rhsLog[0].Hash]; ok {
-			return rhsLog[0].Hash, nil
+		merged, err := mergeWithBase(ctx, s, virtualBasePath, nestedBase, next, virtualBase, &mergeConfig{
+			modeConflict: PreferSourceMode,
+			drivers:      newDrivers(virtualBasePath, nil),
+		})
+		if merged == nil {
+			return nil, fmt.Errorf("failure merging the common ancestors %q and %q: %v", next, virtualBase, err)
 		}
-		lhsLog = lhsLog[1:]
-		rhsLog = rhsLog[1:]
+		virtualBase = merged
 	}
-	// There are no common ancestors other than the nil snapshot
-	return nil, nil
+	return virtualBase, nil
 }
@@ -17,8 +17,10 @@ package merge
 
 import (
 	"context"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/recursive-version-control-system/snapshot"
@@ -143,3 +145,92 @@ func TestMutualParentBase(t *testing.T) {
 		t.Errorf("unexpected mergebase for two sibling snapshots: %v", base)
 	}
 }
+
+func storeTestFile(t *testing.T, s *storage.LocalFiles, contents string, parents ...*snapshot.Hash) *snapshot.Hash {
+	return storeTestSnapshot(t, s, "-rwx------", contents, parents...)
+}
+
+func storeTestSnapshot(t *testing.T, s *storage.LocalFiles, mode, contents string, parents ...*snapshot.Hash) *snapshot.Hash {
+	contentsHash, err := s.StoreObject(context.Background(), int64(len(contents)), strings.NewReader(contents))
+	if err != nil {
+		t.Fatalf("failure storing the file contents %q: %v", contents, err)
+	}
+	f := &snapshot.File{
+		Mode:     mode,
+		Contents: contentsHash,
+		Parents:  parents,
+	}
+	h, err := s.StoreObject(context.Background(), int64(len(f.String())), strings.NewReader(f.String()))
+	if err != nil {
+		t.Fatalf("failure storing the file snapshot %+v: %v", f, err)
+	}
+	return h
+}
+
+func TestCrissCrossBase(t *testing.T) {
+	s := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive")}
+
+	root := storeTestFile(t, s, "a\nb\nc\nd\ne\nf\ng\n")
+	lhs := storeTestFile(t, s, "X\nb\nc\nd\ne\nf\ng\n", root)
+	rhs := storeTestFile(t, s, "a\nb\nc\nd\ne\nf\nY\n", root)
+	lhsMerge := storeTestFile(t, s, "X\nb\nc\nd\ne\nf\nY\n", lhs, rhs)
+	rhsMerge := storeTestFile(t, s, "X\nb\nc\nd\ne\nf\nY\n", rhs, lhs)
+	lhsChild := storeTestFile(t, s, "X\nb\nZ\nd\ne\nf\nY\n", lhsMerge)
+	rhsChild := storeTestFile(t, s, "X\nb\nc\nd\nW\nf\nY\n", rhsMerge)
+
+	bases, err := Bases(context.Background(), s, lhsChild, rhsChild)
+	if err != nil {
+		t.Fatalf("failure computing the common ancestors of a criss-cross merge: %v", err)
+	}
+	if got, want := len(bases), 2; got != want {
+		t.Fatalf("unexpected number of common ancestors for a criss-cross merge: got %d, want %d: %v", got, want, bases)
+	}
+	for _, b := range bases {
+		if !b.Equal(lhs) && !b.Equal(rhs) {
+			t.Errorf("unexpected common ancestor for a criss-cross merge: %q", b)
+		}
+	}
+
+	base, err := Base(context.Background(), s, lhsChild, rhsChild)
+	if err != nil {
+		t.Fatalf("failure computing the mergebase of a criss-cross merge: %v", err)
+	}
+	baseFile, err := s.ReadSnapshot(context.Background(), base)
+	if err != nil {
+		t.Fatalf("failure reading the virtual merge base: %v", err)
+	}
+	if got, want := len(baseFile.Parents), 2; got != want {
+		t.Errorf("unexpected number of parents for the virtual merge base: got %d, want %d", got, want)
+	}
+	r, err := s.ReadObject(context.Background(), baseFile.Contents)
+	if err != nil {
+		t.Fatalf("failure opening the contents of the virtual merge base: %v", err)
+	}
+	defer r.Close()
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failure reading the contents of the virtual merge base: %v", err)
+	}
+	if got, want := string(contents), "X\nb\nc\nd\ne\nf\nY\n"; got != want {
+		t.Errorf("unexpected contents for the virtual merge base: got %q, want %q", got, want)
+	}
+
+	merged, err := mergeWithBase(context.Background(), s, snapshot.Path("example.txt"), base, lhsChild, rhsChild, (*Options)(nil).mergeConfig(snapshot.Path("example.txt")))
+	if err != nil {
+		t.Fatalf("failure merging the two sides of a criss-cross merge: %v", err)
+	}
+	mergedFile, err := s.ReadSnapshot(context.Background(), merged)
+	if err != nil {
+		t.Fatalf("failure reading the merged snapshot: %v", err)
+	}
+	r, err = s.ReadObject(context.Background(), mergedFile.Contents)
+	if err != nil {
+		t.Fatalf("failure opening the contents of the merged snapshot: %v", err)
+	}
+	defer r.Close()
+	if contents, err = io.ReadAll(r); err != nil {
+		t.Fatalf("failure reading the contents of the merged snapshot: %v", err)
+	} else if got, want := string(contents), "X\nb\nZ\nd\nW\nf\nY\n"; got != want {
+		t.Errorf("unexpected contents for the merged snapshot: got %q, want %q", got, want)
+	}
+}
@@ -21,6 +21,9 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/recursive-version-control-system/snapshot"
 	"github.com/google/recursive-version-control-system/storage"
@@ -65,7 +68,7 @@ func ensureDirExistsWithPermissions(ctx context.Context, path string, perm os.Fi
 	return os.Mkdir(path, perm)
 }
 
-func recreateDir(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, f *snapshot.File, p snapshot.Path) error {
+func recreateDir(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, f *snapshot.File, p snapshot.Path, opts *checkoutOptions) error {
 	perm := f.Permissions()
 	if err := ensureDirExistsWithPermissions(ctx, string(p), perm); err != nil {
 		return fmt.Errorf("failure creating the directory %q: %v", p, err)
@@ -75,6 +78,11 @@ func recreateDir(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, f
 	if err != nil {
 		return fmt.Errorf("failure reading the contents of the directory snapshot %q: %v", h, err)
 	}
+	leaveDir, err := opts.enterDir(ctx, s, p)
+	if err != nil {
+		return err
+	}
+	defer leaveDir()
 
 	contents, err := os.Open(string(p))
 	if err != nil {
@@ -109,7 +117,15 @@ func recreateDir(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, f
 			// being updated when checking out a snapshot.
 			continue
 		}
-		if err := Checkout(ctx, s, childHash, childPath); err != nil {
+		if !opts.materialize(childPath) {
+			// The child path is left out of a sparse checkout, so
+			// it should not exist in the local filesystem.
+			if err := os.RemoveAll(string(childPath)); err != nil {
+				return fmt.Errorf("failure removing the unmaterialized file %q: %v", childPath, err)
+			}
+			continue
+		}
+		if err := checkout(ctx, s, childHash, childPath, opts); err != nil {
 			return fmt.Errorf("failure checking out the child path %q: %v", childPath, err)
 		}
 	}
@@ -133,12 +149,16 @@ func ensureFileExistsWithPermissions(ctx context.Context, path string, perm os.F
 	return out, nil
 }
 
-func recreateFile(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, f *snapshot.File, p snapshot.Path) error {
+func recreateFile(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, f *snapshot.File, p snapshot.Path, opts *checkoutOptions) error {
 	if f.IsLink() {
-		return recreateLink(ctx, s, h, f, p)
+		if err := recreateLink(ctx, s, h, f, p); err != nil {
+			return err
+		}
+		opts.written(p, 0)
+		return nil
 	}
 	if f.IsDir() {
-		return recreateDir(ctx, s, h, f, p)
+		return recreateDir(ctx, s, h, f, p, opts)
 	}
 	perm := f.Permissions()
 	contentsReader, err := s.ReadObject(ctx, f.Contents)
@@ -149,12 +169,19 @@ func recreateFile(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash,
 	if err != nil {
 		return fmt.Errorf("failure opening the file %q: %v", p, err)
 	}
-	if _, err := io.Copy(out, contentsReader); err != nil {
+	defer contentsReader.Close()
+	n, err := io.Copy(out, contentsReader)
+	if err != nil {
+		out.Close()
 		return fmt.Errorf("failure writing the contents of %q: %v", p, err)
 	}
 	if err := out.Close(); err != nil {
 		return fmt.Errorf("failure closing the file %q: %v", p, err)
 	}
+	if err := opts.cacheable(p); err != nil {
+		return err
+	}
+	opts.written(p, n)
 	return nil
 }
 
@@ -171,8 +198,219 @@ func recreateFile(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash,
 //
 // If there are any errors during the checkout, then the applied filesystem
 // changes are not rolled back and the local file system can be left in an
-// inconsistent state.
+// inconsistent state. Use `SafeCheckout` to avoid that.
+//
+// If the path is part of a sparse checkout, or contains nested sparse
+// checkouts, then only the nested paths selected by the patterns of the
+// innermost sparse checkout containing them are recreated.
+//
+// Files are written concurrently, using `DefaultCheckoutParallelism`
+// workers. Use `CheckoutWithOptions` to configure this.
 func Checkout(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, p snapshot.Path) error {
+	return CheckoutWithOptions(ctx, s, h, p, nil)
+}
+
+// CheckoutWithOptions checks out the given snapshot the same as `Checkout`,
+// writing files and reporting progress as configured by the given options.
+func CheckoutWithOptions(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, p snapshot.Path, copts *CheckoutOptions) error {
+	opts, err := newCheckoutOptions(ctx, s, p, p, true, copts)
+	if err != nil {
+		return err
+	}
+	opts.keepInfos(copts)
+	if err := opts.wait(checkout(ctx, s, h, p, opts)); err != nil {
+		return err
+	}
+	opts.cacheInfos(ctx, s, p)
+	return nil
+}
+
+// checkoutOptions controls how `checkout` recreates a snapshot. A nil
+// value recreates the entire snapshot without recording it.
+type checkoutOptions struct {
+	// record, if true, records each checked out path as corresponding
+	// to its snapshot.
+	record bool
+
+	// root is the path that the checkout started at.
+	root snapshot.Path
+
+	// target is the path that `root` is being checked out for.
+	target snapshot.Path
+
+	// sparse is the innermost sparse checkout containing the directory
+	// currently being recreated. Directories are recreated one at a
+	// time, so this is updated by `enterDir` as the checkout descends
+	// into nested sparse checkouts, and restored on the way back out.
+	sparse *sparseCheckout
+
+	// workers, if not nil, writes files concurrently. In that case,
+	// `wait` must be called once the checkout has been walked.
+	workers *checkoutWorkers
+
+	// modTime, if not zero, is set as the modification time of every
+	// regular file written, and the resulting file information is kept
+	// in `infos`, keyed by the path relative to `root`, so that it can
+	// be cached once the checkout has been recorded.
+	modTime time.Time
+	infosMu sync.Mutex
+	infos   map[snapshot.Path]os.FileInfo
+}
+
+// sparseCheckout is a sparse checkout containing a path being checked out.
+//
+// The root is the path of the sparse checkout in terms of the checkout
+// target rather than where the snapshot is actually being written.
+type sparseCheckout struct {
+	root     snapshot.Path
+	patterns snapshot.SparsePatterns
+}
+
+// newCheckoutOptions returns the options for checking out a snapshot to
+// `root` on behalf of the path `p`, honouring the sparse checkout patterns
+// for `p`. These paths are different when the checkout is staged
+// somewhere else before being moved into place.
+func newCheckoutOptions(ctx context.Context, s *storage.LocalFiles, p, root snapshot.Path, record bool, copts *CheckoutOptions) (*checkoutOptions, error) {
+	opts := &checkoutOptions{
+		record:  record,
+		root:    root,
+		target:  p,
+		workers: newCheckoutWorkers(copts),
+	}
+	sparseRoot, patterns, err := s.FindSparsePatterns(ctx, p)
+	if err != nil {
+		return nil, fmt.Errorf("failure finding the sparse checkout patterns for %q: %v", p, err)
+	}
+	if len(patterns) > 0 {
+		opts.sparse = &sparseCheckout{root: sparseRoot, patterns: patterns}
+	}
+	return opts, nil
+}
+
+// targetPath returns the path that the given path under `root` is being
+// checked out for.
+func (o *checkoutOptions) targetPath(p snapshot.Path) (snapshot.Path, error) {
+	rel, err := filepath.Rel(string(o.root), string(p))
+	if err != nil {
+		return "", fmt.Errorf("failure resolving %q relative to %q: %v", p, o.root, err)
+	}
+	return o.target.Join(snapshot.Path(rel)), nil
+}
+
+// enterDir switches to the sparse checkout rooted at the given directory,
+// if there is one, for the duration of recreating that directory.
+//
+// The returned function must be called once the directory has been
+// recreated, to switch back to the sparse checkout containing it.
+func (o *checkoutOptions) enterDir(ctx context.Context, s *storage.LocalFiles, dir snapshot.Path) (func(), error) {
+	if o == nil {
+		return func() {}, nil
+	}
+	target, err := o.targetPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	patterns, err := s.SparsePatterns(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the sparse checkout patterns for %q: %v", target, err)
+	}
+	if len(patterns) == 0 {
+		return func() {}, nil
+	}
+	prev := o.sparse
+	o.sparse = &sparseCheckout{root: target, patterns: patterns}
+	return func() { o.sparse = prev }, nil
+}
+
+// materialize reports whether or not the given path should be recreated
+// in the local filesystem.
+func (o *checkoutOptions) materialize(p snapshot.Path) bool {
+	if o == nil || o.sparse == nil {
+		return true
+	}
+	target, err := o.targetPath(p)
+	if err != nil {
+		return true
+	}
+	rel, err := filepath.Rel(string(o.sparse.root), string(target))
+	if err != nil {
+		return true
+	}
+	return o.sparse.patterns.Includes(snapshot.Path(rel))
+}
+
+// keepInfos sets the modification time of the regular files written by
+// the checkout and keeps their file information, so that `cacheInfos` can
+// add them to the stat cache.
+//
+// This must only be used when the checkout is recorded in storage, as the
+// stat cache is only valid for paths that are mapped to their snapshots.
+func (o *checkoutOptions) keepInfos(copts *CheckoutOptions) {
+	o.modTime = copts.modTime(time.Now())
+	o.infos = make(map[snapshot.Path]os.FileInfo)
+}
+
+// cacheable sets the modification time of the regular file just written
+// at the given path, and keeps its file information for `cacheInfos`.
+func (o *checkoutOptions) cacheable(p snapshot.Path) error {
+	if o == nil || o.infos == nil {
+		return nil
+	}
+	if err := os.Chtimes(string(p), o.modTime, o.modTime); err != nil {
+		return fmt.Errorf("failure setting the modification time of %q: %v", p, err)
+	}
+	info, err := os.Lstat(string(p))
+	if err != nil {
+		return fmt.Errorf("failure reading the file metadata for %q: %v", p, err)
+	}
+	rel, err := filepath.Rel(string(o.root), string(p))
+	if err != nil {
+		return fmt.Errorf("failure resolving %q relative to %q: %v", p, o.root, err)
+	}
+	o.infosMu.Lock()
+	defer o.infosMu.Unlock()
+	o.infos[snapshot.Path(rel)] = info
+	return nil
+}
+
+// cacheInfos adds the file information kept by `cacheable` to the stat
+// cache, for the corresponding paths under `dest`.
+//
+// The files keep the same information if they were written somewhere
+// else and then renamed into `dest`.
+//
+// The stat cache is only an optimization, so this is best effort.
+func (o *checkoutOptions) cacheInfos(ctx context.Context, s *storage.LocalFiles, dest snapshot.Path) {
+	for rel, info := range o.infos {
+		s.CachePathInfo(ctx, dest.Join(rel), info)
+	}
+}
+
+// written records that the file at the given path was written.
+func (o *checkoutOptions) written(p snapshot.Path, bytes int64) {
+	if o != nil && o.workers != nil {
+		o.workers.written(p, bytes)
+	}
+}
+
+// wait waits for any files that are still being written, and then returns
+// the given error, or, if that is nil, the first error from writing them.
+func (o *checkoutOptions) wait(err error) error {
+	if o == nil || o.workers == nil {
+		return err
+	}
+	if workersErr := o.workers.wait(); err == nil {
+		return workersErr
+	}
+	return err
+}
+
+// checkout recreates the given snapshot at the given path, and, if
+// `opts.record` is true, records that path as corresponding to the snapshot.
+//
+// If `opts` has workers, then files other than directories are written by
+// them, and may still be in progress when this returns.
+func checkout(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, p snapshot.Path, opts *checkoutOptions) error {
 	f, err := s.ReadSnapshot(ctx, h)
 	if err != nil {
 		return fmt.Errorf("failure reading the file snapshot for %q: %v", h, err)
@@ -186,10 +424,23 @@ func Checkout(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, p sn
 	if err := os.MkdirAll(parent, os.FileMode(0700)); err != nil {
 		return fmt.Errorf("failure ensuring the parent directory of %q exists: %v", p, err)
 	}
+	if opts != nil && opts.workers != nil && !f.IsDir() {
+		opts.workers.run(ctx, func() error {
+			return recreateAndRecord(ctx, s, h, f, p, opts)
+		})
+		return nil
+	}
+	return recreateAndRecord(ctx, s, h, f, p, opts)
+}
+
+func recreateAndRecord(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, f *snapshot.File, p snapshot.Path, opts *checkoutOptions) error {
 	// 重新创建一个文件
-	if err := recreateFile(ctx, s, h, f, p); err != nil {
+	if err := recreateFile(ctx, s, h, f, p, opts); err != nil {
 		return fmt.Errorf("failure checking out the snapshot %q to the path %q: %v", h, p, err)
 	}
+	if opts == nil || !opts.record {
+		return nil
+	}
 
 	// 保存快照
 	if _, err := s.StoreSnapshot(ctx, p, f); err != nil {
@@ -197,3 +448,146 @@ func Checkout(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, p sn
 	}
 	return nil
 }
+
+// recordCheckout records the given path, and every nested path under it, as
+// corresponding to the given snapshot and its nested snapshots.
+func recordCheckout(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, p snapshot.Path) error {
+	f, err := s.ReadSnapshot(ctx, h)
+	if err != nil {
+		return fmt.Errorf("failure reading the file snapshot for %q: %v", h, err)
+	}
+	if _, err := s.StoreSnapshot(ctx, p, f); err != nil {
+		return fmt.Errorf("failure updating the snapshot for %q to %q: %v", p, h, err)
+	}
+	if !f.IsDir() {
+		return nil
+	}
+	tree, err := s.ListDirectorySnapshotContents(ctx, h, f)
+	if err != nil {
+		return fmt.Errorf("failure reading the contents of the directory snapshot %q: %v", h, err)
+	}
+	for child, childHash := range tree {
+		childPath := p.Join(child)
+		if s.Exclude(childPath) {
+			continue
+		}
+		if err := recordCheckout(ctx, s, childHash, childPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// containsArchive reports whether or not the storage archive is nested
+// under (or is) the given path.
+func containsArchive(s *storage.LocalFiles, p snapshot.Path) bool {
+	rel, err := filepath.Rel(string(p), s.ArchiveDir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkUnmodified verifies that the given path still matches the expected
+// snapshot, so that checking out over it will not lose any local changes.
+//
+// The check takes a new snapshot of the path, so any local modifications
+// are also preserved in its history.
+func checkUnmodified(ctx context.Context, s *storage.LocalFiles, p snapshot.Path, expected *snapshot.Hash) error {
+	current, _, err := snapshot.Current(ctx, s, p)
+	if err != nil {
+		return fmt.Errorf("failure snapshotting the current contents of %q: %v", p, err)
+	}
+	if !current.Equal(expected) {
+		return fmt.Errorf("%q has been modified since its snapshot %q was taken; its current contents are saved in the snapshot %q", p, expected, current)
+	}
+	return nil
+}
+
+// renameFile is a handle on `os.Rename` that lets us simulate failures
+// while swapping checkouts into place in unit tests.
+var renameFile func(oldpath, newpath string) error = os.Rename
+
+// SafeCheckout checks out the given snapshot to the given path, replacing
+// the existing contents of that path only if they match the snapshot
+// `expected`, which should be nil if the path is not expected to exist.
+//
+// The snapshot is first checked out into a temporary directory next to the
+// path, and then swapped into place using renames. If any step fails, then
+// the path is left with its previous contents.
+//
+// If the storage archive is nested under the path, then the path cannot be
+// swapped out, so it is instead updated in place as with `Checkout`.
+//
+// Files are written and progress is reported as configured by the given
+// options, which may be nil to use the defaults.
+func SafeCheckout(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, p snapshot.Path, expected *snapshot.Hash, copts *CheckoutOptions) error {
+	parent := filepath.Dir(string(p))
+	if err := os.MkdirAll(parent, os.FileMode(0700)); err != nil {
+		return fmt.Errorf("failure ensuring the parent directory of %q exists: %v", p, err)
+	}
+	if containsArchive(s, p) {
+		if err := checkUnmodified(ctx, s, p, expected); err != nil {
+			return err
+		}
+		return CheckoutWithOptions(ctx, s, h, p, copts)
+	}
+	stagingDir, err := os.MkdirTemp(parent, ".rvcs-checkout-")
+	if err != nil {
+		return fmt.Errorf("failure creating a staging directory for %q: %v", p, err)
+	}
+	// The staging directory is kept if the previous contents could not
+	// be restored, as it then holds the only copy of them.
+	keepStaging := false
+	defer func() {
+		if !keepStaging {
+			os.RemoveAll(stagingDir)
+		}
+	}()
+
+	staged := filepath.Join(stagingDir, "staged")
+	stagingOpts, err := newCheckoutOptions(ctx, s, p, snapshot.Path(staged), false, copts)
+	if err != nil {
+		return err
+	}
+	stagingOpts.keepInfos(copts)
+	if err := stagingOpts.wait(checkout(ctx, s, h, snapshot.Path(staged), stagingOpts)); err != nil {
+		return fmt.Errorf("failure staging the snapshot %q for %q: %v", h, p, err)
+	}
+	// We check for local modifications as late as possible, to keep
+	// the window for them to be overwritten small.
+	if err := checkUnmodified(ctx, s, p, expected); err != nil {
+		return err
+	}
+	previous := filepath.Join(stagingDir, "previous")
+	hadPrevious := true
+	if err := renameFile(string(p), previous); os.IsNotExist(err) {
+		hadPrevious = false
+	} else if err != nil {
+		return fmt.Errorf("failure moving aside the previous contents of %q: %v", p, err)
+	}
+	restore := func(cause error) error {
+		if hadPrevious {
+			os.RemoveAll(string(p))
+			if err := renameFile(previous, string(p)); err != nil {
+				keepStaging = true
+				os.RemoveAll(staged)
+				return fmt.Errorf("%v; additionally failed to restore the previous contents of %q, which have been left in %q: %v", cause, p, previous, err)
+			}
+		}
+		return cause
+	}
+	if _, err := os.Lstat(staged); err == nil {
+		if err := renameFile(staged, string(p)); err != nil {
+			return restore(fmt.Errorf("failure moving the staged snapshot %q into %q: %v", h, p, err))
+		}
+	}
+	if err := recordCheckout(ctx, s, h, p); err != nil {
+		err = restore(fmt.Errorf("failure recording the checkout of %q to %q: %v", h, p, err))
+		if expected != nil {
+			// Best effort attempt to restore the previous path
+			// mappings; they are only a cache of the last snapshot.
+			recordCheckout(ctx, s, expected, p)
+		}
+		return err
+	}
+	stagingOpts.cacheInfos(ctx, s, p)
+	return nil
+}
@@ -17,9 +17,12 @@ package merge
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/recursive-version-control-system/snapshot"
@@ -408,3 +411,399 @@ func TestCheckoutOverwriteTextFileWithDir(t *testing.T) {
 	verifyFilesMatch(t, file2, filepath.Join(cloneDir, "example2.txt"))
 	verifyFilesMatch(t, file3, filepath.Join(cloneDir, "example3.txt"))
 }
+
+func TestSafeCheckoutDir(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	workingDir := filepath.Join(dir, "working-dir")
+	if err := os.Mkdir(workingDir, 0700); err != nil {
+		t.Fatalf("failure creating the working directory for the test: %v", err)
+	}
+	dirPath := snapshot.Path(workingDir)
+	file := filepath.Join(workingDir, "example.txt")
+	if err := os.WriteFile(file, []byte("Hello, World!"), 0700); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	h1, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure creating the initial snapshot for the directory: %v", err)
+	}
+	if err := os.WriteFile(file, []byte("Goodbye, World!"), 0700); err != nil {
+		t.Fatalf("failure updating the example file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(workingDir, "extra.txt"), []byte("Extra"), 0700); err != nil {
+		t.Fatalf("failure creating the extra file: %v", err)
+	}
+	h2, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure creating the updated snapshot for the directory: %v", err)
+	}
+
+	// Local modifications since the expected snapshot block the checkout...
+	if err := os.WriteFile(file, []byte("Unsaved changes"), 0700); err != nil {
+		t.Fatalf("failure modifying the example file: %v", err)
+	}
+	if err := SafeCheckout(context.Background(), s, h1, dirPath, h2, nil); err == nil {
+		t.Fatalf("unexpected success checking out over local modifications")
+	}
+	if contents, err := os.ReadFile(file); err != nil {
+		t.Fatalf("failure reading the example file: %v", err)
+	} else if got, want := string(contents), "Unsaved changes"; got != want {
+		t.Errorf("unexpected contents for the modified file: got %q, want %q", got, want)
+	}
+	h3, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure snapshotting the modified directory: %v", err)
+	}
+
+	// ... and a snapshot that cannot be checked out is rolled back...
+	garbage := "not a snapshot"
+	garbageHash, err := s.StoreObject(context.Background(), int64(len(garbage)), strings.NewReader(garbage))
+	if err != nil {
+		t.Fatalf("failure storing an invalid snapshot: %v", err)
+	}
+	tree := snapshot.Tree{snapshot.Path("broken.txt"): garbageHash}
+	treeHash, err := s.StoreObject(context.Background(), int64(len(tree.String())), strings.NewReader(tree.String()))
+	if err != nil {
+		t.Fatalf("failure storing a broken tree: %v", err)
+	}
+	broken := &snapshot.File{Mode: "drwx------", Contents: treeHash}
+	brokenHash, err := s.StoreObject(context.Background(), int64(len(broken.String())), strings.NewReader(broken.String()))
+	if err != nil {
+		t.Fatalf("failure storing a broken snapshot: %v", err)
+	}
+	if err := SafeCheckout(context.Background(), s, brokenHash, dirPath, h3, nil); err == nil {
+		t.Fatalf("unexpected success checking out a broken snapshot")
+	}
+	if contents, err := os.ReadFile(file); err != nil {
+		t.Fatalf("failure reading the example file: %v", err)
+	} else if got, want := string(contents), "Unsaved changes"; got != want {
+		t.Errorf("unexpected contents after a failed checkout: got %q, want %q", got, want)
+	}
+
+	// ... while an unmodified path is replaced.
+	if err := SafeCheckout(context.Background(), s, h1, dirPath, h3, nil); err != nil {
+		t.Fatalf("failure checking out the directory snapshot %q: %v", h1, err)
+	}
+	if contents, err := os.ReadFile(file); err != nil {
+		t.Fatalf("failure reading the example file: %v", err)
+	} else if got, want := string(contents), "Hello, World!"; got != want {
+		t.Errorf("unexpected contents after the checkout: got %q, want %q", got, want)
+	}
+	if _, err := os.Lstat(filepath.Join(workingDir, "extra.txt")); !os.IsNotExist(err) {
+		t.Errorf("unexpected extra file left after the checkout: %v", err)
+	}
+	if h, _, err := s.FindSnapshot(context.Background(), dirPath); err != nil {
+		t.Errorf("failure finding the snapshot for the checked out directory: %v", err)
+	} else if !h.Equal(h1) {
+		t.Errorf("unexpected snapshot recorded for the checked out directory: got %q, want %q", h, h1)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failure listing the test directory: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".rvcs-checkout-") {
+			t.Errorf("unexpected staging directory left behind: %q", entry.Name())
+		}
+	}
+}
+
+func TestSafeCheckoutFailedRestore(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	workingDir := filepath.Join(dir, "working-dir")
+	if err := os.Mkdir(workingDir, 0700); err != nil {
+		t.Fatalf("failure creating the working directory for the test: %v", err)
+	}
+	dirPath := snapshot.Path(workingDir)
+	file := filepath.Join(workingDir, "example.txt")
+	if err := os.WriteFile(file, []byte("Hello, World!"), 0700); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	h1, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure creating the initial snapshot for the directory: %v", err)
+	}
+	if err := os.WriteFile(file, []byte("Goodbye, World!"), 0700); err != nil {
+		t.Fatalf("failure updating the example file: %v", err)
+	}
+	h2, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure creating the updated snapshot for the directory: %v", err)
+	}
+
+	// Fail every rename into the working directory, so that neither the
+	// staged snapshot nor the previous contents can be moved into place.
+	defer func() { renameFile = os.Rename }()
+	renameFile = func(oldpath, newpath string) error {
+		if newpath == workingDir {
+			return fmt.Errorf("simulated failure renaming %q to %q", oldpath, newpath)
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	err = SafeCheckout(context.Background(), s, h1, dirPath, h2, nil)
+	if err == nil {
+		t.Fatalf("unexpected success checking out with failing renames")
+	}
+	previous, err := filepath.Glob(filepath.Join(dir, ".rvcs-checkout-*", "previous", "example.txt"))
+	if err != nil || len(previous) != 1 {
+		t.Fatalf("the previous contents were not kept after a failed restore: %v, %v", previous, err)
+	}
+	if contents, err := os.ReadFile(previous[0]); err != nil {
+		t.Fatalf("failure reading the kept example file: %v", err)
+	} else if got, want := string(contents), "Goodbye, World!"; got != want {
+		t.Errorf("unexpected contents for the kept example file: got %q, want %q", got, want)
+	}
+}
+
+func TestSparseCheckout(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	workingDir := filepath.Join(dir, "working-dir")
+	for _, nested := range []string{"docs", "src"} {
+		if err := os.MkdirAll(filepath.Join(workingDir, nested), 0700); err != nil {
+			t.Fatalf("failure creating the nested directory %q: %v", nested, err)
+		}
+	}
+	files := map[string]string{
+		"README.md":      "Read me",
+		"docs/guide.txt": "Guide",
+		"src/main.go":    "package main",
+		"src/helper.go":  "package main\n",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(workingDir, name), []byte(contents), 0700); err != nil {
+			t.Fatalf("failure creating the example file %q: %v", name, err)
+		}
+	}
+	h, _, err := snapshot.Current(context.Background(), s, snapshot.Path(workingDir))
+	if err != nil {
+		t.Fatalf("failure creating the snapshot of the directory: %v", err)
+	}
+
+	sparseDir := filepath.Join(dir, "sparse-dir")
+	sparsePath := snapshot.Path(sparseDir)
+	if err := s.UpdateSparsePatterns(context.Background(), sparsePath, snapshot.SparsePatterns{"src/main.go"}); err != nil {
+		t.Fatalf("failure recording the sparse checkout patterns: %v", err)
+	}
+	if err := Checkout(context.Background(), s, h, sparsePath); err != nil {
+		t.Fatalf("failure checking out the snapshot %q: %v", h, err)
+	}
+	verifyFilesMatch(t, filepath.Join(workingDir, "src", "main.go"), filepath.Join(sparseDir, "src", "main.go"))
+	for _, name := range []string{"README.md", "docs", "src/helper.go"} {
+		if _, err := os.Lstat(filepath.Join(sparseDir, name)); !os.IsNotExist(err) {
+			t.Errorf("unexpected materialized path %q: %v", name, err)
+		}
+	}
+	if current, _, err := snapshot.Current(context.Background(), s, sparsePath); err != nil {
+		t.Fatalf("failure snapshotting the sparse checkout: %v", err)
+	} else if !current.Equal(h) {
+		t.Errorf("unexpected snapshot of the unmodified sparse checkout: got %q, want %q", current, h)
+	}
+
+	// Changes to the materialized paths are snapshotted, while the rest are preserved.
+	if err := os.WriteFile(filepath.Join(sparseDir, "src", "main.go"), []byte("package main\n\nfunc main() {}\n"), 0700); err != nil {
+		t.Fatalf("failure updating the materialized file: %v", err)
+	}
+	modified, _, err := snapshot.Current(context.Background(), s, sparsePath)
+	if err != nil {
+		t.Fatalf("failure snapshotting the modified sparse checkout: %v", err)
+	}
+	if _, err := UpdateSparseCheckout(context.Background(), s, sparsePath, nil); err != nil {
+		t.Fatalf("failure disabling the sparse checkout: %v", err)
+	}
+	for _, name := range []string{"README.md", "docs/guide.txt", "src/helper.go"} {
+		verifyFilesMatch(t, filepath.Join(workingDir, name), filepath.Join(sparseDir, name))
+	}
+	if contents, err := os.ReadFile(filepath.Join(sparseDir, "src", "main.go")); err != nil {
+		t.Fatalf("failure reading the modified file: %v", err)
+	} else if got, want := string(contents), "package main\n\nfunc main() {}\n"; got != want {
+		t.Errorf("unexpected contents of the modified file: got %q, want %q", got, want)
+	}
+	if current, _, err := snapshot.Current(context.Background(), s, sparsePath); err != nil {
+		t.Fatalf("failure snapshotting the full checkout: %v", err)
+	} else if !current.Equal(modified) {
+		t.Errorf("unexpected snapshot of the full checkout: got %q, want %q", current, modified)
+	}
+}
+
+func TestNestedSparseCheckout(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	workingDir := filepath.Join(dir, "working-dir")
+	if err := os.MkdirAll(filepath.Join(workingDir, "nested"), 0700); err != nil {
+		t.Fatalf("failure creating the nested directory: %v", err)
+	}
+	files := map[string]string{
+		"README.md":       "Read me",
+		"nested/kept.txt": "Kept",
+		"nested/left.txt": "Left out",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(workingDir, name), []byte(contents), 0700); err != nil {
+			t.Fatalf("failure creating the example file %q: %v", name, err)
+		}
+	}
+	h, _, err := snapshot.Current(context.Background(), s, snapshot.Path(workingDir))
+	if err != nil {
+		t.Fatalf("failure creating the snapshot of the directory: %v", err)
+	}
+
+	// Only a nested directory of the checkout is a sparse checkout.
+	checkoutDir := filepath.Join(dir, "checkout-dir")
+	checkoutPath := snapshot.Path(checkoutDir)
+	if err := s.UpdateSparsePatterns(context.Background(), checkoutPath.Join("nested"), snapshot.SparsePatterns{"kept.txt"}); err != nil {
+		t.Fatalf("failure recording the sparse checkout patterns: %v", err)
+	}
+	if err := Checkout(context.Background(), s, h, checkoutPath); err != nil {
+		t.Fatalf("failure checking out the snapshot %q: %v", h, err)
+	}
+	for _, name := range []string{"README.md", "nested/kept.txt"} {
+		verifyFilesMatch(t, filepath.Join(workingDir, name), filepath.Join(checkoutDir, name))
+	}
+	if _, err := os.Lstat(filepath.Join(checkoutDir, "nested", "left.txt")); !os.IsNotExist(err) {
+		t.Errorf("unexpected materialized path %q: %v", "nested/left.txt", err)
+	}
+	if current, _, err := snapshot.Current(context.Background(), s, checkoutPath); err != nil {
+		t.Fatalf("failure snapshotting the checkout: %v", err)
+	} else if !current.Equal(h) {
+		t.Errorf("unexpected snapshot of the unmodified checkout: got %q, want %q", current, h)
+	}
+
+	// The same applies when checking out over the existing contents.
+	if err := os.Remove(filepath.Join(workingDir, "README.md")); err != nil {
+		t.Fatalf("failure removing the example file: %v", err)
+	}
+	h2, _, err := snapshot.Current(context.Background(), s, snapshot.Path(workingDir))
+	if err != nil {
+		t.Fatalf("failure creating the updated snapshot of the directory: %v", err)
+	}
+	if err := SafeCheckout(context.Background(), s, h2, checkoutPath, h, nil); err != nil {
+		t.Fatalf("failure checking out the updated snapshot %q: %v", h2, err)
+	}
+	if _, err := os.Lstat(filepath.Join(checkoutDir, "nested", "left.txt")); !os.IsNotExist(err) {
+		t.Errorf("unexpected materialized path %q after updating: %v", "nested/left.txt", err)
+	}
+	verifyFilesMatch(t, filepath.Join(workingDir, "nested", "kept.txt"), filepath.Join(checkoutDir, "nested", "kept.txt"))
+}
+
+type recordedProgress struct {
+	files, bytes int64
+	paths        map[snapshot.Path]bool
+}
+
+func (p *recordedProgress) Update(files, bytes int64, current snapshot.Path) {
+	p.files, p.bytes = files, bytes
+	p.paths[current] = true
+}
+
+func TestCheckoutWithProgress(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	workingDir := filepath.Join(dir, "working-dir")
+	var wantBytes int64
+	for i := 0; i < 5; i++ {
+		nestedDir := filepath.Join(workingDir, fmt.Sprintf("dir-%d", i))
+		if err := os.MkdirAll(nestedDir, 0700); err != nil {
+			t.Fatalf("failure creating the nested directory %q: %v", nestedDir, err)
+		}
+		for j := 0; j < 10; j++ {
+			contents := strings.Repeat(fmt.Sprintf("%d-%d\n", i, j), i+j+1)
+			wantBytes += int64(len(contents))
+			if err := os.WriteFile(filepath.Join(nestedDir, fmt.Sprintf("file-%d.txt", j)), []byte(contents), 0700); err != nil {
+				t.Fatalf("failure creating an example file: %v", err)
+			}
+		}
+	}
+	h, _, err := snapshot.Current(context.Background(), s, snapshot.Path(workingDir))
+	if err != nil {
+		t.Fatalf("failure creating the snapshot of the directory: %v", err)
+	}
+
+	cloneDir := filepath.Join(dir, "clone-dir")
+	progress := &recordedProgress{paths: make(map[snapshot.Path]bool)}
+	opts := &CheckoutOptions{Parallelism: 4, Progress: progress}
+	if err := CheckoutWithOptions(context.Background(), s, h, snapshot.Path(cloneDir), opts); err != nil {
+		t.Fatalf("failure checking out the snapshot %q: %v", h, err)
+	}
+	if got, want := progress.files, int64(50); got != want {
+		t.Errorf("unexpected number of files reported: got %d, want %d", got, want)
+	}
+	if got, want := progress.bytes, wantBytes; got != want {
+		t.Errorf("unexpected number of bytes reported: got %d, want %d", got, want)
+	}
+	if got, want := len(progress.paths), 50; got != want {
+		t.Errorf("unexpected number of paths reported: got %d, want %d", got, want)
+	}
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 10; j++ {
+			name := filepath.Join(fmt.Sprintf("dir-%d", i), fmt.Sprintf("file-%d.txt", j))
+			verifyFilesMatch(t, filepath.Join(workingDir, name), filepath.Join(cloneDir, name))
+		}
+	}
+	if current, _, err := snapshot.Current(context.Background(), s, snapshot.Path(cloneDir)); err != nil {
+		t.Fatalf("failure snapshotting the checked out directory: %v", err)
+	} else if !current.Equal(h) {
+		t.Errorf("unexpected snapshot of the checked out directory: got %q, want %q", current, h)
+	}
+}
+
+func TestCheckoutCachesFileInfo(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	workingDir := filepath.Join(dir, "working-dir")
+	if err := os.Mkdir(workingDir, 0700); err != nil {
+		t.Fatalf("failure creating the working directory for the test: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(workingDir, "example.txt"), []byte("Hello, World!"), 0700); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	h, _, err := snapshot.Current(context.Background(), s, snapshot.Path(workingDir))
+	if err != nil {
+		t.Fatalf("failure creating the snapshot of the directory: %v", err)
+	}
+
+	for _, checkoutFunc := range []func(p snapshot.Path) error{
+		func(p snapshot.Path) error { return Checkout(context.Background(), s, h, p) },
+		func(p snapshot.Path) error { return SafeCheckout(context.Background(), s, h, p, nil, nil) },
+	} {
+		cloneDir := filepath.Join(t.TempDir(), "clone-dir")
+		if err := checkoutFunc(snapshot.Path(cloneDir)); err != nil {
+			t.Fatalf("failure checking out the snapshot %q: %v", h, err)
+		}
+		cloneFile := filepath.Join(cloneDir, "example.txt")
+		info, err := os.Lstat(cloneFile)
+		if err != nil {
+			t.Fatalf("failure reading the file metadata for %q: %v", cloneFile, err)
+		}
+		if !s.PathInfoMatchesCache(context.Background(), snapshot.Path(cloneFile), info) {
+			t.Errorf("missing stat cache entry for the checked out file %q", cloneFile)
+		}
+		if !info.ModTime().Before(time.Now().Truncate(time.Second)) {
+			t.Errorf("unexpected modification time for the checked out file %q: %v", cloneFile, info.ModTime())
+		}
+
+		// A modification that keeps the size the same is still detected.
+		if err := os.WriteFile(cloneFile, []byte("Hello, Earth!"), 0700); err != nil {
+			t.Fatalf("failure modifying the checked out file: %v", err)
+		}
+		if current, _, err := snapshot.Current(context.Background(), s, snapshot.Path(cloneDir)); err != nil {
+			t.Fatalf("failure snapshotting the modified directory: %v", err)
+		} else if current.Equal(h) {
+			t.Errorf("modification to %q was not detected", cloneFile)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+// Conflict describes a single path that could not be automatically merged.
+type Conflict struct {
+	// Path is the path of the conflicted file.
+	Path snapshot.Path
+
+	// Base is the snapshot of the file in the merge base, if any.
+	Base *snapshot.Hash
+
+	// Src is the snapshot of the file in the merge source, if any.
+	Src *snapshot.Hash
+
+	// Dest is the snapshot of the file in the merge destination, if any.
+	Dest *snapshot.Hash
+
+	// Merged is the hash of the file contents with conflict markers
+	// around each conflicting region.
+	//
+	// This is nil if the merge helper could not produce such contents,
+	// for example because the file is binary.
+	Merged *snapshot.Hash
+
+	// Reason is a human readable description of the conflict.
+	Reason string
+}
+
+// ConflictError is the error reported when some paths could not be
+// automatically merged.
+type ConflictError struct {
+	Conflicts []*Conflict
+}
+
+// Error implements the `error` interface.
+func (e *ConflictError) Error() string {
+	var reasons []string
+	for _, c := range e.Conflicts {
+		reasons = append(reasons, c.Reason)
+	}
+	return strings.Join(reasons, "\n")
+}
+
+func conflict(p snapshot.Path, base, src, dest *snapshot.Hash, reason string) *ConflictError {
+	return &ConflictError{
+		Conflicts: []*Conflict{
+			{
+				Path:   p,
+				Base:   base,
+				Src:    src,
+				Dest:   dest,
+				Reason: reason,
+			},
+		},
+	}
+}
+
+// writeSideFile checks out one version of a conflicted file next to it,
+// using the given suffix to distinguish it, and returns the path of the
+// side file written, if any.
+//
+// This is done without updating the path mappings in storage, as the side
+// files are only meant to be temporary aids for manually resolving the
+// conflict.
+func writeSideFile(ctx context.Context, s *storage.LocalFiles, c *Conflict, h *snapshot.Hash, suffix string) (snapshot.Path, error) {
+	if h == nil {
+		return "", nil
+	}
+	f, err := s.ReadSnapshot(ctx, h)
+	if err != nil {
+		return "", fmt.Errorf("failure reading the file snapshot for %q: %v", h, err)
+	}
+	if f.IsDir() {
+		// Side files are only useful for individual files.
+		return "", nil
+	}
+	sidePath := snapshot.Path(string(c.Path) + "." + suffix)
+	if err := recreateFile(ctx, s, h, f, sidePath, nil); err != nil {
+		return "", fmt.Errorf("failure writing the %s version of %q: %v", suffix, c.Path, err)
+	}
+	return sidePath, nil
+}
+
+// writeConflict writes the given conflict into the local filesystem.
+//
+// If the conflict has merged contents with conflict markers, then those
+// contents replace the file at the conflicted path. Otherwise, each
+// version of the file is written next to the conflicted path with the
+// suffix `.src`, `.base`, or `.dest`, respectively, and the paths of
+// those side files are returned.
+func writeConflict(ctx context.Context, s *storage.LocalFiles, c *Conflict) ([]snapshot.Path, error) {
+	if c.Merged == nil {
+		var sideFiles []snapshot.Path
+		for _, side := range []struct {
+			h      *snapshot.Hash
+			suffix string
+		}{{c.Src, "src"}, {c.Base, "base"}, {c.Dest, "dest"}} {
+			sidePath, err := writeSideFile(ctx, s, c, side.h, side.suffix)
+			if err != nil {
+				return sideFiles, err
+			}
+			if len(sidePath) > 0 {
+				sideFiles = append(sideFiles, sidePath)
+			}
+		}
+		return sideFiles, nil
+	}
+	modeSource := c.Dest
+	if modeSource == nil {
+		modeSource = c.Src
+	}
+	modeFile, err := s.ReadSnapshot(ctx, modeSource)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the file snapshot for %q: %v", modeSource, err)
+	}
+	markersFile := &snapshot.File{
+		Mode:     modeFile.Mode,
+		Contents: c.Merged,
+	}
+	if err := recreateFile(ctx, s, c.Merged, markersFile, c.Path, nil); err != nil {
+		return nil, fmt.Errorf("failure writing the conflict markers for %q: %v", c.Path, err)
+	}
+	return nil, nil
+}
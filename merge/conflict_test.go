@@ -0,0 +1,324 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/recursive-version-control-system/config"
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+func TestMergeWithConflictsDir(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	workingDir := filepath.Join(dir, "working-dir")
+	if err := os.Mkdir(workingDir, 0700); err != nil {
+		t.Fatalf("failure creating the working directory for the test: %v", err)
+	}
+	dirPath := snapshot.Path(workingDir)
+	conflicted := filepath.Join(workingDir, "conflicted.txt")
+	clean := filepath.Join(workingDir, "clean.txt")
+	if err := os.WriteFile(conflicted, []byte("A\nB\nC\n"), 0700); err != nil {
+		t.Fatalf("failure creating the conflicted example file: %v", err)
+	}
+	if err := os.WriteFile(clean, []byte("Hello, World!"), 0700); err != nil {
+		t.Fatalf("failure creating the clean example file: %v", err)
+	}
+	h1, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure creating the initial snapshot for the directory: %v", err)
+	}
+
+	cloneDir := filepath.Join(dir, "clone-dir")
+	cloneDirPath := snapshot.Path(cloneDir)
+	if err := Checkout(context.Background(), s, h1, cloneDirPath); err != nil {
+		t.Fatalf("failure checking out the directory snapshot %q: %v", h1, err)
+	}
+
+	if err := os.WriteFile(conflicted, []byte("A\nX\nC\n"), 0700); err != nil {
+		t.Fatalf("failure updating the conflicted example file: %v", err)
+	}
+	if err := os.WriteFile(clean, []byte("Goodbye, World!"), 0700); err != nil {
+		t.Fatalf("failure updating the clean example file: %v", err)
+	}
+	h2, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure creating the updated snapshot for the directory: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(cloneDir, "conflicted.txt"), []byte("A\nY\nC\n"), 0700); err != nil {
+		t.Fatalf("failure updating the cloned conflicted example file: %v", err)
+	}
+	h3, _, err := snapshot.Current(context.Background(), s, cloneDirPath)
+	if err != nil {
+		t.Fatalf("failure creating the updated snapshot for the cloned directory: %v", err)
+	}
+
+	if err := Merge(context.Background(), s, h2, cloneDirPath, nil); err == nil {
+		t.Fatalf("unexpected success merging conflicting changes")
+	}
+	conflicts, err := MergeWithConflicts(context.Background(), s, h2, cloneDirPath, nil)
+	if err != nil {
+		t.Fatalf("failure merging with conflicts: %v", err)
+	}
+	if got, want := len(conflicts), 1; got != want {
+		t.Fatalf("unexpected number of conflicts: got %d, want %d: %+v", got, want, conflicts)
+	}
+	if got, want := conflicts[0].Path, cloneDirPath.Join(snapshot.Path("conflicted.txt")); got != want {
+		t.Errorf("unexpected conflict path: got %q, want %q", got, want)
+	}
+	verifyFilesMatch(t, clean, filepath.Join(cloneDir, "clean.txt"))
+	markers, err := os.ReadFile(filepath.Join(cloneDir, "conflicted.txt"))
+	if err != nil {
+		t.Fatalf("failure reading the conflicted file: %v", err)
+	}
+	if !strings.Contains(string(markers), "<<<<<<<") || !strings.Contains(string(markers), ">>>>>>>") {
+		t.Errorf("missing conflict markers in the conflicted file: %q", string(markers))
+	}
+	if _, err := MergeWithConflicts(context.Background(), s, h2, cloneDirPath, nil); err == nil {
+		t.Errorf("unexpected success starting a second merge while one is pending")
+	}
+
+	if err := os.WriteFile(filepath.Join(cloneDir, "conflicted.txt"), []byte("A\nX\nY\nC\n"), 0700); err != nil {
+		t.Fatalf("failure resolving the conflict: %v", err)
+	}
+	h4, err := Continue(context.Background(), s, cloneDirPath)
+	if err != nil {
+		t.Fatalf("failure continuing the merge: %v", err)
+	}
+	f4, err := s.ReadSnapshot(context.Background(), h4)
+	if err != nil {
+		t.Fatalf("failure reading the merged snapshot: %v", err)
+	}
+	if got, want := len(f4.Parents), 2; got != want {
+		t.Fatalf("unexpected number of parents for the merged snapshot: got %d, want %d", got, want)
+	}
+	if !f4.Parents[0].Equal(h2) || !f4.Parents[1].Equal(h3) {
+		t.Errorf("unexpected parents for the merged snapshot: got %v, want [%q %q]", f4.Parents, h2, h3)
+	}
+	if pending, err := s.PendingMerge(context.Background(), cloneDirPath); err != nil {
+		t.Errorf("failure reading the pending merge: %v", err)
+	} else if len(pending) > 0 {
+		t.Errorf("unexpected pending merge after continuing: %v", pending)
+	}
+}
+
+func TestMergeWithBaseResolution(t *testing.T) {
+	s := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive")}
+	p := snapshot.Path("example.txt")
+
+	base := storeTestFile(t, s, "A\n")
+	unchanged := storeTestFile(t, s, "A\n", base)
+	modified := storeTestFile(t, s, "B\n", base)
+	link := storeTestSnapshot(t, s, "Lrwxrwxrwx", "target", base)
+	otherLink := storeTestSnapshot(t, s, "Lrwxrwxrwx", "target", base, unchanged)
+
+	testCases := []struct {
+		Description  string
+		Src          *snapshot.Hash
+		Dest         *snapshot.Hash
+		Policy       DeleteModifyPolicy
+		WantConflict bool
+		WantNil      bool
+		WantContents string
+	}{
+		{
+			Description: "deleted in source and unchanged in destination",
+			Dest:        unchanged,
+			WantNil:     true,
+		},
+		{
+			Description: "unchanged in source and deleted in destination",
+			Src:         unchanged,
+			WantNil:     true,
+		},
+		{
+			Description:  "deleted in source and modified in destination",
+			Dest:         modified,
+			WantConflict: true,
+		},
+		{
+			Description: "deleted in source and modified in destination, preferring deletes",
+			Dest:        modified,
+			Policy:      PreferDelete,
+			WantNil:     true,
+		},
+		{
+			Description:  "modified in source and deleted in destination, preferring to keep",
+			Src:          modified,
+			Policy:       PreferKeep,
+			WantContents: "B\n",
+		},
+		{
+			Description:  "symlink in source and unchanged in destination",
+			Src:          link,
+			Dest:         unchanged,
+			WantContents: "target",
+		},
+		{
+			Description:  "identical symlinks with different histories",
+			Src:          link,
+			Dest:         otherLink,
+			WantContents: "target",
+		},
+		{
+			Description:  "symlink in source and modified in destination",
+			Src:          link,
+			Dest:         modified,
+			WantConflict: true,
+		},
+	}
+	for _, testCase := range testCases {
+		cfg := &mergeConfig{
+			deleteModify: testCase.Policy,
+			drivers:      newDrivers(p, nil),
+		}
+		merged, err := mergeWithBase(context.Background(), s, p, base, testCase.Src, testCase.Dest, cfg)
+		var conflictErr *ConflictError
+		if testCase.WantConflict {
+			if !errors.As(err, &conflictErr) {
+				t.Errorf("unexpected result merging %s: got %v, want a conflict", testCase.Description, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failure merging %s: %v", testCase.Description, err)
+			continue
+		}
+		if testCase.WantNil {
+			if merged != nil {
+				t.Errorf("unexpected result merging %s: got %q, want nil", testCase.Description, merged)
+			}
+			continue
+		}
+		if merged == nil {
+			t.Errorf("unexpected nil result merging %s", testCase.Description)
+			continue
+		}
+		f, err := s.ReadSnapshot(context.Background(), merged)
+		if err != nil {
+			t.Errorf("failure reading the merged snapshot for %s: %v", testCase.Description, err)
+			continue
+		}
+		contents, err := readContents(context.Background(), s, f)
+		if err != nil {
+			t.Errorf("failure reading the merged contents for %s: %v", testCase.Description, err)
+		} else if got, want := string(contents), testCase.WantContents; got != want {
+			t.Errorf("unexpected merged contents for %s: got %q, want %q", testCase.Description, got, want)
+		}
+	}
+}
+
+func TestContinueRemovesSideFiles(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	workingDir := filepath.Join(dir, "working-dir")
+	if err := os.Mkdir(workingDir, 0700); err != nil {
+		t.Fatalf("failure creating the working directory for the test: %v", err)
+	}
+	dirPath := snapshot.Path(workingDir)
+	conflicted := filepath.Join(workingDir, "conflicted.bin")
+	if err := os.WriteFile(conflicted, []byte("A\n"), 0700); err != nil {
+		t.Fatalf("failure creating the conflicted example file: %v", err)
+	}
+	h1, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure creating the initial snapshot for the directory: %v", err)
+	}
+
+	cloneDir := filepath.Join(dir, "clone-dir")
+	cloneDirPath := snapshot.Path(cloneDir)
+	if err := Checkout(context.Background(), s, h1, cloneDirPath); err != nil {
+		t.Fatalf("failure checking out the directory snapshot %q: %v", h1, err)
+	}
+
+	if err := os.WriteFile(conflicted, []byte("B\n"), 0700); err != nil {
+		t.Fatalf("failure updating the conflicted example file: %v", err)
+	}
+	h2, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure creating the updated snapshot for the directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(cloneDir, "conflicted.bin"), []byte("C\n"), 0700); err != nil {
+		t.Fatalf("failure updating the cloned conflicted example file: %v", err)
+	}
+
+	// The binary driver leaves no conflict markers, so each version of
+	// the conflicted file is written next to it instead.
+	opts := &Options{
+		Drivers: &config.MergeSettings{
+			Rules: []*config.MergeRule{
+				&config.MergeRule{Pattern: "*.bin", Driver: BinaryDriver},
+			},
+		},
+	}
+	conflicts, err := MergeWithConflicts(context.Background(), s, h2, cloneDirPath, opts)
+	if err != nil {
+		t.Fatalf("failure merging with conflicts: %v", err)
+	}
+	if got, want := len(conflicts), 1; got != want {
+		t.Fatalf("unexpected number of conflicts: got %d, want %d: %+v", got, want, conflicts)
+	}
+	sideFiles := []string{"conflicted.bin.src", "conflicted.bin.base", "conflicted.bin.dest"}
+	for _, sideFile := range sideFiles {
+		if _, err := os.Stat(filepath.Join(cloneDir, sideFile)); err != nil {
+			t.Errorf("missing the conflict side file %q: %v", sideFile, err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(cloneDir, "conflicted.bin"), []byte("B\nC\n"), 0700); err != nil {
+		t.Fatalf("failure resolving the conflict: %v", err)
+	}
+	h3, err := Continue(context.Background(), s, cloneDirPath)
+	if err != nil {
+		t.Fatalf("failure continuing the merge: %v", err)
+	}
+	for _, sideFile := range sideFiles {
+		if _, err := os.Lstat(filepath.Join(cloneDir, sideFile)); !os.IsNotExist(err) {
+			t.Errorf("unexpected conflict side file %q left after continuing: %v", sideFile, err)
+		}
+	}
+	f3, err := s.ReadSnapshot(context.Background(), h3)
+	if err != nil {
+		t.Fatalf("failure reading the merged snapshot: %v", err)
+	}
+	tree, err := s.ListDirectorySnapshotContents(context.Background(), h3, f3)
+	if err != nil {
+		t.Fatalf("failure listing the merged snapshot: %v", err)
+	}
+	if got, want := len(tree), 1; got != want {
+		t.Errorf("unexpected contents of the merged snapshot: got %v, want only %q", tree, "conflicted.bin")
+	}
+	if _, ok := tree[snapshot.Path("conflicted.bin")]; !ok {
+		t.Errorf("missing the resolved file in the merged snapshot: %v", tree)
+	}
+	if sideFiles, err := s.PendingMergeSideFiles(context.Background(), cloneDirPath); err != nil {
+		t.Errorf("failure reading the pending merge side files: %v", err)
+	} else if len(sideFiles) > 0 {
+		t.Errorf("unexpected pending merge side files after continuing: %v", sideFiles)
+	}
+}
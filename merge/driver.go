@@ -0,0 +1,287 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/recursive-version-control-system/config"
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+const (
+	// AttributesFile is the name of the optional, in-tree file that
+	// selects merge drivers for the files in a directory.
+	//
+	// Each non-empty line that does not start with `#` is of the form
+	// `<PATTERN> <DRIVER>`, where the pattern follows the same rules
+	// as the `Pattern` field of `config.MergeRule`, relative to the
+	// directory holding the attributes file.
+	AttributesFile = ".rvcsattributes"
+
+	// TextDriver merges files line by line without relying on any
+	// external tools. This is the default driver.
+	TextDriver = "text"
+
+	// HelperDriver merges files using the external merge helper
+	// configured by the `RVCS_MERGE_HELPER_COMMAND` and
+	// `RVCS_MERGE_HELPER_ARGS` environment variables, defaulting to
+	// `diff3`. This is the default driver if the former is set.
+	HelperDriver = "helper"
+
+	// OursDriver resolves conflicting changes to a file by keeping
+	// the destination version.
+	OursDriver = "ours"
+
+	// TheirsDriver resolves conflicting changes to a file by taking
+	// the source version.
+	TheirsDriver = "theirs"
+
+	// UnionDriver resolves conflicting changes to a file by keeping
+	// the lines from both versions.
+	UnionDriver = "union"
+
+	// BinaryDriver never attempts to merge the contents of a file,
+	// and instead reports conflicting changes as a conflict.
+	BinaryDriver = "binary"
+)
+
+type driverRule struct {
+	dir     snapshot.Path
+	pattern string
+	driver  string
+}
+
+func (r *driverRule) matches(p snapshot.Path) bool {
+	rel, err := filepath.Rel(string(r.dir), string(p))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	if !strings.Contains(r.pattern, "/") {
+		// Match against the base name of the path itself rather than
+		// of `rel`, as the latter is "." when merging a single file.
+		rel = filepath.Base(string(p))
+	}
+	matched, err := filepath.Match(r.pattern, rel)
+	return err == nil && matched
+}
+
+// drivers selects the merge driver to use for each merged file.
+type drivers struct {
+	custom map[string]*config.MergeDriver
+	rules  []*driverRule
+
+	// helperTimeout, if non-zero, overrides the configured timeouts
+	// for external merge helpers.
+	helperTimeout time.Duration
+}
+
+func newDrivers(root snapshot.Path, settings *config.MergeSettings) *drivers {
+	d := &drivers{
+		custom: make(map[string]*config.MergeDriver),
+	}
+	if settings == nil {
+		return d
+	}
+	for _, driver := range settings.Drivers {
+		d.custom[driver.Name] = driver
+	}
+	for _, rule := range settings.Rules {
+		d.rules = append(d.rules, &driverRule{
+			dir:     root,
+			pattern: rule.Pattern,
+			driver:  rule.Driver,
+		})
+	}
+	return d
+}
+
+func parseAttributes(dir snapshot.Path, contents string) ([]*driverRule, error) {
+	var rules []*driverRule
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed attributes line %q", line)
+		}
+		rules = append(rules, &driverRule{
+			dir:     dir,
+			pattern: fields[0],
+			driver:  fields[1],
+		})
+	}
+	return rules, scanner.Err()
+}
+
+// withAttributes returns the drivers to use for the children of the given
+// directory, taking into account the attributes file in that directory.
+//
+// Rules from the attributes file take precedence over previously defined
+// rules, so nested attributes files override their parent directories
+// and the user's config.
+func (d *drivers) withAttributes(ctx context.Context, s *storage.LocalFiles, dir snapshot.Path, trees ...snapshot.Tree) (*drivers, error) {
+	var attrsHash *snapshot.Hash
+	for _, tree := range trees {
+		if h, ok := tree[snapshot.Path(AttributesFile)]; ok && h != nil {
+			attrsHash = h
+			break
+		}
+	}
+	if attrsHash == nil {
+		return d, nil
+	}
+	attrsFile, err := s.ReadSnapshot(ctx, attrsHash)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the file snapshot for %q: %v", attrsHash, err)
+	}
+	if attrsFile.IsDir() || attrsFile.IsLink() {
+		return d, nil
+	}
+	contents, err := readContents(ctx, s, attrsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the attributes file in %q: %v", dir, err)
+	}
+	rules, err := parseAttributes(dir, string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("failure parsing the attributes file in %q: %v", dir, err)
+	}
+	return &drivers{
+		custom:        d.custom,
+		rules:         append(append([]*driverRule{}, d.rules...), rules...),
+		helperTimeout: d.helperTimeout,
+	}, nil
+}
+
+func (d *drivers) forPath(p snapshot.Path) string {
+	for i := len(d.rules) - 1; i >= 0; i-- {
+		if d.rules[i].matches(p) {
+			return d.rules[i].driver
+		}
+	}
+	return ""
+}
+
+func readContents(ctx context.Context, s *storage.LocalFiles, f *snapshot.File) ([]byte, error) {
+	if f == nil || f.Contents == nil {
+		return nil, nil
+	}
+	r, err := s.ReadObject(ctx, f.Contents)
+	if err != nil {
+		return nil, fmt.Errorf("failure opening the contents %q: %v", f.Contents, err)
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func storeMergedFile(ctx context.Context, s *storage.LocalFiles, mode string, contents []byte, src, dest *snapshot.Hash) (*snapshot.Hash, error) {
+	contentsHash, err := s.StoreObject(ctx, int64(len(contents)), bytes.NewReader(contents))
+	if err != nil {
+		return nil, fmt.Errorf("failure storing the merged contents: %v", err)
+	}
+	return storeMergedSnapshot(ctx, s, mode, contentsHash, src, dest)
+}
+
+func storeMergedSnapshot(ctx context.Context, s *storage.LocalFiles, mode string, contentsHash *snapshot.Hash, src, dest *snapshot.Hash) (*snapshot.Hash, error) {
+	mergedFile := &snapshot.File{
+		Mode:     mode,
+		Contents: contentsHash,
+		Parents:  []*snapshot.Hash{src, dest},
+	}
+	fileBytes := []byte(mergedFile.String())
+	h, err := s.StoreObject(ctx, int64(len(fileBytes)), bytes.NewReader(fileBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failure storing the merged snapshot: %v", err)
+	}
+	return h, nil
+}
+
+// mergeFile merges the contents of two snapshots, at least one of which is
+// not a directory, using the merge driver selected for the given path.
+//
+// The merged file is given the supplied mode, unless the driver takes
+// one side of the merge as a whole.
+//
+// If the path is a directory or symlink on only one side, then only the
+// drivers that take one side as a whole can resolve it, and every other
+// driver reports a conflict rather than merging the encoded contents.
+func (d *drivers) mergeFile(ctx context.Context, s *storage.LocalFiles, p snapshot.Path, mode string, srcFile, destFile *snapshot.File, base, src, dest *snapshot.Hash) (*snapshot.Hash, error) {
+	driver := d.forPath(p)
+	if driver == "" {
+		driver = TextDriver
+		if len(os.Getenv(HelperEnvironmentVariable)) > 0 {
+			driver = HelperDriver
+		}
+	}
+	typeChanged := srcFile.IsDir() || destFile.IsDir() || srcFile.IsLink() || destFile.IsLink()
+	if typeChanged && driver != OursDriver && driver != TheirsDriver {
+		return dest, conflict(p, base, src, dest, fmt.Sprintf("the path %q is a regular file in only one of the source and destination snapshots, so the two snapshots for that path have to be manually merged", p))
+	}
+	if custom, ok := d.custom[driver]; ok {
+		timeout := DefaultHelperTimeout
+		if d.helperTimeout > 0 {
+			timeout = d.helperTimeout
+		} else if len(custom.Timeout) > 0 {
+			var err error
+			if timeout, err = time.ParseDuration(custom.Timeout); err != nil {
+				return nil, fmt.Errorf("failure parsing the timeout %q for the merge driver %q: %v", custom.Timeout, driver, err)
+			}
+		}
+		return runMergeHelper(ctx, s, p, mode, base, src, dest, custom.Command, custom.Args, timeout)
+	}
+	switch driver {
+	case TextDriver:
+		return mergeText(ctx, s, p, mode, srcFile, destFile, base, src, dest, false)
+	case HelperDriver:
+		helperCmd, helperArgs, timeout, err := environmentHelper()
+		if err != nil {
+			return nil, err
+		}
+		if d.helperTimeout > 0 {
+			timeout = d.helperTimeout
+		}
+		return runMergeHelper(ctx, s, p, mode, base, src, dest, helperCmd, helperArgs, timeout)
+	case OursDriver:
+		contents, err := readContents(ctx, s, destFile)
+		if err != nil {
+			return nil, fmt.Errorf("failure reading the destination contents of %q: %v", p, err)
+		}
+		return storeMergedFile(ctx, s, destFile.Mode, contents, src, dest)
+	case TheirsDriver:
+		contents, err := readContents(ctx, s, srcFile)
+		if err != nil {
+			return nil, fmt.Errorf("failure reading the source contents of %q: %v", p, err)
+		}
+		return storeMergedFile(ctx, s, srcFile.Mode, contents, src, dest)
+	case UnionDriver:
+		return mergeText(ctx, s, p, mode, srcFile, destFile, base, src, dest, true)
+	case BinaryDriver:
+		return dest, conflict(p, base, src, dest, fmt.Sprintf("the binary file %q was changed in both the source and destination snapshots, so the two snapshots for that path have to be manually merged", p))
+	}
+	return nil, fmt.Errorf("unknown merge driver %q configured for %q", driver, p)
+}
@@ -0,0 +1,242 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/recursive-version-control-system/config"
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+func TestDriverRules(t *testing.T) {
+	d := newDrivers(snapshot.Path("/root"), &config.MergeSettings{
+		Rules: []*config.MergeRule{
+			&config.MergeRule{Pattern: "*.json", Driver: "json"},
+			&config.MergeRule{Pattern: "vendor/*", Driver: TheirsDriver},
+		},
+	})
+	attrs, err := parseAttributes(snapshot.Path("/root/sub"), "# comment\n\n*.json ours\n")
+	if err != nil {
+		t.Fatalf("failure parsing the attributes: %v", err)
+	}
+	d.rules = append(d.rules, attrs...)
+	testCases := []struct {
+		Path string
+		Want string
+	}{
+		{"/root/example.json", "json"},
+		{"/root/nested/example.json", "json"},
+		{"/root/sub/example.json", OursDriver},
+		{"/root/vendor/lib.go", TheirsDriver},
+		{"/root/nested/vendor/lib.go", ""},
+		{"/root/example.txt", ""},
+		{"/other/example.json", ""},
+		{"/root/..example.json", "json"},
+		{"/root/..vendor/lib.go", ""},
+	}
+	for _, testCase := range testCases {
+		if got, want := d.forPath(snapshot.Path(testCase.Path)), testCase.Want; got != want {
+			t.Errorf("unexpected driver for %q: got %q, want %q", testCase.Path, got, want)
+		}
+	}
+
+	// When merging a single file, the root of the merge is that file.
+	single := newDrivers(snapshot.Path("/root/example.json"), &config.MergeSettings{
+		Rules: []*config.MergeRule{
+			&config.MergeRule{Pattern: "*.json", Driver: "json"},
+		},
+	})
+	if got, want := single.forPath(snapshot.Path("/root/example.json")), "json"; got != want {
+		t.Errorf("unexpected driver for a single file merge: got %q, want %q", got, want)
+	}
+}
+
+func TestMergeWithDrivers(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	workingDir := filepath.Join(dir, "working-dir")
+	if err := os.Mkdir(workingDir, 0700); err != nil {
+		t.Fatalf("failure creating the working directory for the test: %v", err)
+	}
+	dirPath := snapshot.Path(workingDir)
+	files := map[string]string{
+		AttributesFile: "*.list union\n",
+		"ours.txt":     "A\n",
+		"theirs.txt":   "A\n",
+		"items.list":   "A\n",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(workingDir, name), []byte(contents), 0700); err != nil {
+			t.Fatalf("failure creating the example file %q: %v", name, err)
+		}
+	}
+	h1, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure creating the initial snapshot for the directory: %v", err)
+	}
+
+	cloneDir := filepath.Join(dir, "clone-dir")
+	cloneDirPath := snapshot.Path(cloneDir)
+	if err := Checkout(context.Background(), s, h1, cloneDirPath); err != nil {
+		t.Fatalf("failure checking out the directory snapshot %q: %v", h1, err)
+	}
+	for _, name := range []string{"ours.txt", "theirs.txt", "items.list"} {
+		if err := os.WriteFile(filepath.Join(workingDir, name), []byte("A\nB\n"), 0700); err != nil {
+			t.Fatalf("failure updating the example file %q: %v", name, err)
+		}
+		if err := os.WriteFile(filepath.Join(cloneDir, name), []byte("A\nC\n"), 0700); err != nil {
+			t.Fatalf("failure updating the cloned example file %q: %v", name, err)
+		}
+	}
+	h2, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure creating the updated snapshot for the directory: %v", err)
+	}
+
+	opts := &Options{
+		Drivers: &config.MergeSettings{
+			Rules: []*config.MergeRule{
+				&config.MergeRule{Pattern: "ours.txt", Driver: OursDriver},
+				&config.MergeRule{Pattern: "theirs.txt", Driver: TheirsDriver},
+			},
+		},
+	}
+	if err := Merge(context.Background(), s, h2, cloneDirPath, opts); err != nil {
+		t.Fatalf("failure merging with the configured drivers: %v", err)
+	}
+	want := map[string]string{
+		"ours.txt":   "A\nC\n",
+		"theirs.txt": "A\nB\n",
+		"items.list": "A\nC\nB\n",
+	}
+	for name, contents := range want {
+		got, err := os.ReadFile(filepath.Join(cloneDir, name))
+		if err != nil {
+			t.Errorf("failure reading the merged file %q: %v", name, err)
+		} else if string(got) != contents {
+			t.Errorf("unexpected contents for the merged file %q: got %q, want %q", name, string(got), contents)
+		}
+	}
+}
+
+func TestMergeTypeChangeWithDrivers(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	workingDir := filepath.Join(dir, "working-dir")
+	if err := os.Mkdir(workingDir, 0700); err != nil {
+		t.Fatalf("failure creating the working directory for the test: %v", err)
+	}
+	changed := filepath.Join(workingDir, "changed")
+	if err := os.WriteFile(changed, []byte("A\n"), 0700); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	h1, _, err := snapshot.Current(context.Background(), s, snapshot.Path(workingDir))
+	if err != nil {
+		t.Fatalf("failure creating the initial snapshot for the directory: %v", err)
+	}
+
+	// The source replaces the file with a directory...
+	cloneDir := filepath.Join(dir, "clone-dir")
+	if err := Checkout(context.Background(), s, h1, snapshot.Path(cloneDir)); err != nil {
+		t.Fatalf("failure checking out the directory snapshot %q: %v", h1, err)
+	}
+	clonedChanged := filepath.Join(cloneDir, "changed")
+	if err := os.Remove(clonedChanged); err != nil {
+		t.Fatalf("failure removing the cloned example file: %v", err)
+	}
+	if err := os.Mkdir(clonedChanged, 0700); err != nil {
+		t.Fatalf("failure replacing the cloned example file with a directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(clonedChanged, "nested.txt"), []byte("A\n"), 0700); err != nil {
+		t.Fatalf("failure creating the nested example file: %v", err)
+	}
+	src, _, err := snapshot.Current(context.Background(), s, snapshot.Path(cloneDir))
+	if err != nil {
+		t.Fatalf("failure creating the source snapshot: %v", err)
+	}
+
+	// ... while the destination modifies it.
+	if err := os.WriteFile(changed, []byte("A\nB\n"), 0700); err != nil {
+		t.Fatalf("failure updating the example file: %v", err)
+	}
+	dest, _, err := snapshot.Current(context.Background(), s, snapshot.Path(workingDir))
+	if err != nil {
+		t.Fatalf("failure creating the destination snapshot: %v", err)
+	}
+
+	testCases := []struct {
+		driver       string
+		wantConflict bool
+		wantDir      bool
+	}{
+		{driver: TextDriver, wantConflict: true},
+		{driver: UnionDriver, wantConflict: true},
+		{driver: HelperDriver, wantConflict: true},
+		{driver: BinaryDriver, wantConflict: true},
+		{driver: OursDriver},
+		{driver: TheirsDriver, wantDir: true},
+	}
+	for _, tc := range testCases {
+		opts := &Options{
+			AllowConflicts: true,
+			// The nested file has the same contents as the original
+			// file, so it would otherwise be treated as a rename.
+			RenameThreshold: -1,
+			Drivers: &config.MergeSettings{
+				Rules: []*config.MergeRule{
+					&config.MergeRule{Pattern: "changed", Driver: tc.driver},
+				},
+			},
+		}
+		result, err := MergeHashes(context.Background(), s, src, dest, opts)
+		if err != nil {
+			t.Fatalf("failure merging with the %q driver: %v", tc.driver, err)
+		}
+		if got := len(result.Conflicts) > 0; got != tc.wantConflict {
+			t.Errorf("unexpected conflicts merging with the %q driver: got %+v, want conflict %v", tc.driver, result.Conflicts, tc.wantConflict)
+		}
+		if tc.wantConflict {
+			if len(result.Conflicts) != 1 || result.Conflicts[0].Merged != nil {
+				t.Errorf("unexpected conflicts merging with the %q driver: got %+v, want a single conflict without markers", tc.driver, result.Conflicts)
+			}
+			continue
+		}
+		mergedFile, err := s.ReadSnapshot(context.Background(), result.Hash)
+		if err != nil {
+			t.Fatalf("failure reading the merged snapshot %q: %v", result.Hash, err)
+		}
+		tree, err := s.ListDirectorySnapshotContents(context.Background(), result.Hash, mergedFile)
+		if err != nil {
+			t.Fatalf("failure listing the merged snapshot %q: %v", result.Hash, err)
+		}
+		changedFile, err := s.ReadSnapshot(context.Background(), tree["changed"])
+		if err != nil {
+			t.Fatalf("failure reading the merged snapshot of the changed path: %v", err)
+		}
+		if changedFile.IsDir() != tc.wantDir {
+			t.Errorf("unexpected type for the changed path merged with the %q driver: got directory %v, want %v", tc.driver, changedFile.IsDir(), tc.wantDir)
+		}
+	}
+}
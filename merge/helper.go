@@ -19,6 +19,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -30,11 +31,26 @@ import (
 )
 
 const (
-	HelperEnvironmentVariable     = "RVCS_MERGE_HELPER_COMMAND"
-	HelperArgsEnvironmentVariable = "RVCS_MERGE_HELPER_ARGS"
+	HelperEnvironmentVariable        = "RVCS_MERGE_HELPER_COMMAND"
+	HelperArgsEnvironmentVariable    = "RVCS_MERGE_HELPER_ARGS"
+	HelperTimeoutEnvironmentVariable = "RVCS_MERGE_HELPER_TIMEOUT"
+
+	// DefaultHelperTimeout is how long a merge helper is allowed to run
+	// for a single file if no other timeout is configured.
+	DefaultHelperTimeout = time.Minute
 )
 
 func mergeWithHelper(ctx context.Context, s *storage.LocalFiles, p snapshot.Path, mode string, base, src, dest *snapshot.Hash) (*snapshot.Hash, error) {
+	helperCmd, helperArgs, timeout, err := environmentHelper()
+	if err != nil {
+		return nil, err
+	}
+	return runMergeHelper(ctx, s, p, mode, base, src, dest, helperCmd, helperArgs, timeout)
+}
+
+// environmentHelper returns the merge helper command, args, and timeout
+// configured by environment variables.
+func environmentHelper() (string, []string, time.Duration, error) {
 	// 获取帮助命令 (外部的binary 理解)
 	helperCmd := os.Getenv(HelperEnvironmentVariable)
 	// 获取binary的参数
@@ -47,9 +63,27 @@ func mergeWithHelper(ctx context.Context, s *storage.LocalFiles, p snapshot.Path
 	}
 	// 构造入参
 	var args []string
-	if err := json.Unmarshal([]byte(helperArgs), &args); err != nil {
-		return nil, fmt.Errorf("failure parsing the helper args %q: %v", helperArgs, err)
+	err := json.Unmarshal([]byte(helperArgs), &args)
+	if err != nil {
+		return "", nil, 0, fmt.Errorf("failure parsing the helper args %q: %v", helperArgs, err)
+	}
+	timeout := DefaultHelperTimeout
+	if helperTimeout := os.Getenv(HelperTimeoutEnvironmentVariable); len(helperTimeout) > 0 {
+		if timeout, err = time.ParseDuration(helperTimeout); err != nil {
+			return "", nil, 0, fmt.Errorf("failure parsing the helper timeout %q: %v", helperTimeout, err)
+		}
 	}
+	return helperCmd, args, timeout, nil
+}
+
+// runMergeHelper merges a file by invoking the given command with the given
+// args, followed by the paths of the source, base, and destination versions
+// of the file.
+//
+// If the helper does not finish within the given timeout, then it is killed
+// and the merge fails.
+func runMergeHelper(ctx context.Context, s *storage.LocalFiles, p snapshot.Path, mode string, base, src, dest *snapshot.Hash, helperCmd string, helperArgs []string, timeout time.Duration) (*snapshot.Hash, error) {
+	args := append([]string{}, helperArgs...)
 
 	tmpDir, err := os.MkdirTemp("", fmt.Sprintf("rvcs-merge-helper-%q", helperCmd))
 	if err != nil {
@@ -59,7 +93,7 @@ func mergeWithHelper(ctx context.Context, s *storage.LocalFiles, p snapshot.Path
 
 	tmpPath := snapshot.Path(tmpDir)
 	srcPath := tmpPath.Join(snapshot.Path("src")).Join(p)
-	if err := Checkout(ctx, s, src, srcPath); err != nil {
+	if err := checkout(ctx, s, src, srcPath, nil); err != nil {
 		return nil, fmt.Errorf("failure checking out %q to a temporary path for the merge helper: %v", src, err)
 	}
 	basePath := tmpPath.Join(snapshot.Path("base")).Join(p)
@@ -78,35 +112,38 @@ func mergeWithHelper(ctx context.Context, s *storage.LocalFiles, p snapshot.Path
 		if _, err := os.Create(string(basePath)); err != nil {
 			return nil, fmt.Errorf("failure creating an empty temporary file to serve as the merge base for the merge helper: %v", err)
 		}
-	} else if err := Checkout(ctx, s, base, basePath); err != nil {
+	} else if err := checkout(ctx, s, base, basePath, nil); err != nil {
 		return nil, fmt.Errorf("failure checking out %q to a temporary path for the merge helper: %v", base, err)
 	}
 	destPath := tmpPath.Join(snapshot.Path("dest")).Join(p)
-	if err := Checkout(ctx, s, dest, destPath); err != nil {
+	if err := checkout(ctx, s, dest, destPath, nil); err != nil {
 		return nil, fmt.Errorf("failure checking out %q to a temporary path for the merge helper: %v", dest, err)
 	}
 	args = append(args, string(srcPath), string(basePath), string(destPath))
 
-	helperCtx, cancel := context.WithTimeout(ctx, time.Second)
+	helperCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	out, err := exec.CommandContext(helperCtx, helperCmd, args...).Output()
-	if err != nil {
-		return nil, fmt.Errorf("merge helper %q failed: %v", helperCmd, err)
-	}
-	contentsHash, err := s.StoreObject(ctx, int64(len(out)), bytes.NewReader(out))
-	if err != nil {
-		return nil, fmt.Errorf("failure hashing the merged contents: %v", err)
-	}
-	mergedFile := &snapshot.File{
-		Mode:     mode,
-		Contents: contentsHash,
-		Parents:  []*snapshot.Hash{src, dest},
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && helperCtx.Err() == nil {
+		// The helper ran to completion but could not merge the
+		// files, so this is a conflict rather than an internal
+		// failure.
+		c := conflict(p, base, src, dest, fmt.Sprintf("merge helper %q failed: %v", helperCmd, err))
+		if exitErr.ExitCode() == 1 && len(out) > 0 {
+			// By the `diff3` convention, the output includes the
+			// merged contents with conflict markers.
+			markersHash, err := s.StoreObject(ctx, int64(len(out)), bytes.NewReader(out))
+			if err != nil {
+				return nil, fmt.Errorf("failure storing the conflict markers for %q: %v", p, err)
+			}
+			c.Conflicts[0].Merged = markersHash
+		}
+		return dest, c
 	}
-	fileBytes := []byte(mergedFile.String())
-	h, err := s.StoreObject(ctx, int64(len(fileBytes)), bytes.NewReader(fileBytes))
 	if err != nil {
-		return nil, fmt.Errorf("failure storing the merged snapshot: %v", err)
+		return nil, fmt.Errorf("merge helper %q failed: %v", helperCmd, err)
 	}
-	return h, nil
+	return storeMergedFile(ctx, s, mode, out, src, dest)
 }
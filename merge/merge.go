@@ -21,34 +21,192 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/google/recursive-version-control-system/log"
+	"github.com/google/recursive-version-control-system/config"
+	"github.com/google/recursive-version-control-system/rename"
 	"github.com/google/recursive-version-control-system/snapshot"
 	"github.com/google/recursive-version-control-system/storage"
 )
 
-func IsAncestor(ctx context.Context, s *storage.LocalFiles, base, h *snapshot.Hash) (bool, error) {
-	// 空快照是所有快照的祖先
-	if base == nil {
-		// The nil snapshot is an ancestor of all other snapshots.
+// includesBase reports whether or not the history of `h` includes all of
+// the changes from `base`.
+//
+// This is true if `base` is an ancestor of `h`, but also if `base` is a
+// merge of snapshots whose changes are all included in `h`. The latter
+// happens when `base` is a virtual merge base constructed from multiple
+// common ancestors.
+func includesBase(ctx context.Context, s *storage.LocalFiles, base, h *snapshot.Hash) (bool, error) {
+	if isAncestor, err := IsAncestor(ctx, s, base, h); err != nil || isAncestor {
+		return isAncestor, err
+	}
+	baseFile, err := s.ReadSnapshot(ctx, base)
+	if err != nil {
+		return false, fmt.Errorf("failure reading the file snapshot for %q: %v", base, err)
+	}
+	if len(baseFile.Parents) < 2 {
+		return false, nil
+	}
+	for _, parent := range baseFile.Parents {
+		if included, err := includesBase(ctx, s, parent, h); err != nil || !included {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// DeleteModifyPolicy selects how to resolve conflicts where a file was
+// deleted on one side of a merge and modified on the other.
+type DeleteModifyPolicy int
+
+const (
+	// ReportDeleteModify reports such changes as a conflict.
+	ReportDeleteModify DeleteModifyPolicy = iota
+
+	// PreferDelete resolves such changes by deleting the file.
+	PreferDelete
+
+	// PreferKeep resolves such changes by keeping the modified file.
+	PreferKeep
+)
+
+// ModeConflictPolicy selects how to resolve conflicts where the file
+// permissions were changed differently on each side of a merge.
+type ModeConflictPolicy int
+
+const (
+	// ReportModeConflict reports such changes as a conflict.
+	ReportModeConflict ModeConflictPolicy = iota
+
+	// PreferSourceMode resolves such changes by taking the source mode.
+	PreferSourceMode
+
+	// PreferDestinationMode resolves such changes by keeping the
+	// destination mode.
+	PreferDestinationMode
+)
+
+// Strategy selects how the contents of two snapshots are combined.
+type Strategy string
+
+const (
+	// RecursiveStrategy recursively merges every nested path of the
+	// two snapshots. This is the default strategy.
+	RecursiveStrategy Strategy = "recursive"
+
+	// OursStrategy records the source snapshot as merged, but keeps
+	// the contents of the destination unchanged.
+	OursStrategy Strategy = "ours"
+
+	// TheirsStrategy records the source snapshot as merged, and
+	// replaces the contents of the destination with it.
+	TheirsStrategy Strategy = "theirs"
+)
+
+// mergeConfig holds the settings used by `mergeWithBase`.
+type mergeConfig struct {
+	modeConflict ModeConflictPolicy
+	deleteModify DeleteModifyPolicy
+	drivers      *drivers
+
+	// syntheticBase is true if the base is not a common ancestor of
+	// the merged snapshots, such as when applying a single change.
+	syntheticBase bool
+
+	// aliases maps each directory snapshot rewritten by `followRenames`
+	// to the snapshot it was rewritten from.
+	aliases map[snapshot.Hash]*snapshot.Hash
+
+	// renamedFrom maps the snapshot of each file renamed on one side
+	// of the merge to the snapshot of that file in the base.
+	renamedFrom map[snapshot.Hash]*snapshot.Hash
+}
+
+func (c *mergeConfig) withDrivers(d *drivers) *mergeConfig {
+	return &mergeConfig{
+		modeConflict:  c.modeConflict,
+		deleteModify:  c.deleteModify,
+		drivers:       d,
+		syntheticBase: c.syntheticBase,
+		aliases:       c.aliases,
+		renamedFrom:   c.renamedFrom,
+	}
+}
+
+// includesBase reports whether or not the history of `h` includes all of
+// the changes from `base`, which is always assumed for a synthetic base
+// and for files renamed from `base`.
+func (c *mergeConfig) includesBase(ctx context.Context, s *storage.LocalFiles, base, h *snapshot.Hash) (bool, error) {
+	if c.syntheticBase || c.renamed(base, h) {
 		return true, nil
 	}
-	snapshotLog, err := log.ReadLog(ctx, s, h, -1)
-	if err != nil {
-		return false, fmt.Errorf("failure reading the log for %q: %v", h, err)
+	return includesBase(ctx, s, c.original(base), c.original(h))
+}
+
+// mergeMode picks the mode for the result of merging two snapshots of
+// the same type, using the base snapshot as a reference point.
+func (c *mergeConfig) mergeMode(subPath snapshot.Path, base, src, dest *snapshot.Hash, baseFile, srcFile, destFile *snapshot.File) (string, *ConflictError) {
+	if srcFile.Mode == destFile.Mode {
+		return srcFile.Mode, nil
+	}
+	if baseFile != nil && srcFile.Mode == baseFile.Mode {
+		return destFile.Mode, nil
+	}
+	if baseFile != nil && destFile.Mode == baseFile.Mode {
+		return srcFile.Mode, nil
 	}
-	for _, e := range snapshotLog {
-		if e.Hash.Equal(base) {
-			return true, nil
+	switch c.modeConflict {
+	case PreferSourceMode:
+		return srcFile.Mode, nil
+	case PreferDestinationMode:
+		return destFile.Mode, nil
+	}
+	return destFile.Mode, conflict(subPath, base, src, dest, fmt.Sprintf("file permissions for %q do not match between versions; source mode line: %q, destination mode line %q. Manually update the permissions for the source to match what you want for the merge result, or re-run the merge with a policy for resolving mode conflicts", subPath, srcFile.Mode, destFile.Mode))
+}
+
+// sameContents reports whether or not two file snapshots have the same
+// mode and contents, regardless of their histories.
+func sameContents(lhs, rhs *snapshot.File) bool {
+	if lhs == nil || rhs == nil {
+		return lhs == nil && rhs == nil
+	}
+	return lhs.Mode == rhs.Mode && lhs.Contents.Equal(rhs.Contents)
+}
+
+// mergeDeleted merges two snapshots where one of them is nil, meaning
+// the corresponding file was deleted on that side of the merge.
+func mergeDeleted(ctx context.Context, s *storage.LocalFiles, subPath snapshot.Path, base, src, dest *snapshot.Hash, cfg *mergeConfig) (*snapshot.Hash, error) {
+	kept, deletedIn := src, "destination"
+	if src == nil {
+		kept, deletedIn = dest, "source"
+	}
+	if base != nil {
+		// If the kept side has the same contents as the base, then
+		// it was not modified and the deletion wins.
+		baseFile, err := s.ReadSnapshot(ctx, base)
+		if err != nil {
+			return nil, fmt.Errorf("failure reading the file snapshot for %q: %v", base, err)
+		}
+		keptFile, err := s.ReadSnapshot(ctx, kept)
+		if err != nil {
+			return nil, fmt.Errorf("failure reading the file snapshot for %q: %v", kept, err)
+		}
+		if sameContents(baseFile, keptFile) {
+			return nil, nil
 		}
 	}
-	return false, nil
+	switch cfg.deleteModify {
+	case PreferDelete:
+		return nil, nil
+	case PreferKeep:
+		return kept, nil
+	}
+	return kept, conflict(subPath, base, src, dest, fmt.Sprintf("the nested snapshot under the path %q was deleted in the %s snapshot, so the two snapshots have to be manually merged", subPath, deletedIn))
 }
 
 // 合并两个快照，并且有一个基准快照作为参考
-func mergeWithBase(ctx context.Context, s *storage.LocalFiles, subPath snapshot.Path, base, src, dest *snapshot.Hash, forceKeepMode bool) (*snapshot.Hash, error) {
+func mergeWithBase(ctx context.Context, s *storage.LocalFiles, subPath snapshot.Path, base, src, dest *snapshot.Hash, cfg *mergeConfig) (*snapshot.Hash, error) {
 	// First we handle the trivial cases where the merge result should
 	// just be one of the two provided snapshots.
 	if src.Equal(dest) {
@@ -61,15 +219,16 @@ func mergeWithBase(ctx context.Context, s *storage.LocalFiles, subPath snapshot.
 		return src, nil
 	}
 
+	if src == nil || dest == nil {
+		return mergeDeleted(ctx, s, subPath, base, src, dest, cfg)
+	}
+
 	// If either the source or destination do not have the base as an
 	// ancestor, then that means the changes in the base were rolled back
 	// in that version. In that case, we have to ask the user to manually
 	// merge the two versions.
-	if src == nil || dest == nil {
-		return nil, fmt.Errorf("the nested snapshot under the path %q was deleted in either the source or destination snapshot, so the two snapshots have to be manually merged", subPath)
-	}
 	// 分开来判断是不是两个快照的祖先
-	if isAncestor, err := IsAncestor(ctx, s, base, src); err != nil {
+	if isAncestor, err := cfg.includesBase(ctx, s, base, src); err != nil {
 		return nil, err
 	} else if !isAncestor {
 		// The changes from the base snapshot were rolled back in
@@ -77,14 +236,14 @@ func mergeWithBase(ctx context.Context, s *storage.LocalFiles, subPath snapshot.
 		// 缺乏共同的基准：如果 base 不是 src 或 dest 的祖先，说明这两个版本的变更没有一个共同的起点。这样的话，自动合并无法确定哪些变更是独立的，哪些是冲突的。
 		// 变更回滚：如果 src 或 dest 没有 base 作为祖先，可能意味着某些变更在这些版本中被回滚了。自动合并无法判断这些回滚是否是有意的，可能会错误地重新引入这些变更。
 		// 冲突处理：没有共同祖先的情况下，自动合并无法有效地处理冲突。手动合并可以让用户明确地决定如何处理这些冲突，确保合并结果是正确的
-		return nil, fmt.Errorf("nested changes under the path %q were rolled back in the source snapshot, so the two snapshots have to be manually merged", subPath)
+		return dest, conflict(subPath, base, src, dest, fmt.Sprintf("nested changes under the path %q were rolled back in the source snapshot, so the two snapshots have to be manually merged", subPath))
 	}
-	if isAncestor, err := IsAncestor(ctx, s, base, dest); err != nil {
+	if isAncestor, err := cfg.includesBase(ctx, s, base, dest); err != nil {
 		return nil, err
 	} else if !isAncestor {
 		// The changes from the base snapshot were rolled back in
 		// the destination...
-		return nil, fmt.Errorf("nested changes under the path %q were rolled back in the destination snapshot, so the two snapshots have to be manually merged", subPath)
+		return dest, conflict(subPath, base, src, dest, fmt.Sprintf("nested changes under the path %q were rolled back in the destination snapshot, so the two snapshots have to be manually merged", subPath))
 	}
 
 	// For everything else we have to compare the actual snapshots, so
@@ -105,17 +264,44 @@ func mergeWithBase(ctx context.Context, s *storage.LocalFiles, subPath snapshot.
 		}
 	}
 
+	// Snapshots with different histories can still have the same
+	// contents, in which case we do not need to look any further.
+	if sameContents(srcFile, baseFile) {
+		return dest, nil
+	}
+	if sameContents(destFile, baseFile) {
+		return src, nil
+	}
+	if sameContents(srcFile, destFile) {
+		return storeMergedSnapshot(ctx, s, destFile.Mode, destFile.Contents, cfg.original(src), cfg.original(dest))
+	}
+
 	// If either the source or the destination are symbolic links, then
 	// the user has to manually merge them.
 	// 如果是符号连接就需要手动合并
 	// 如果不是目录，就调用mergeHelper函数进行合并
 	if srcFile.IsLink() || destFile.IsLink() {
-		return nil, fmt.Errorf("one or both versions of the snapshot at %q represent a symlink, so the two snapshots for that path have to be manually merged", subPath)
+		return dest, conflict(subPath, base, src, dest, fmt.Sprintf("one or both versions of the snapshot at %q represent a symlink, so the two snapshots for that path have to be manually merged", subPath))
 	}
 
 	// 如果有一个不是文件就使用额外的合并工具来合并
 	if !(srcFile.IsDir() && destFile.IsDir()) {
-		return mergeWithHelper(ctx, s, subPath, destFile.Mode, base, src, dest)
+		if srcFile.IsDir() || destFile.IsDir() || (baseFile != nil && (baseFile.IsDir() || baseFile.IsLink())) {
+			return cfg.drivers.mergeFile(ctx, s, subPath, destFile.Mode, srcFile, destFile, base, src, dest)
+		}
+		mode, modeConflict := cfg.mergeMode(subPath, base, src, dest, baseFile, srcFile, destFile)
+		merged, err := cfg.drivers.mergeFile(ctx, s, subPath, mode, srcFile, destFile, base, src, dest)
+		if modeConflict == nil {
+			return merged, err
+		}
+		var conflictErr *ConflictError
+		if errors.As(err, &conflictErr) {
+			conflictErr.Conflicts = append(conflictErr.Conflicts, modeConflict.Conflicts...)
+			return merged, conflictErr
+		} else if err != nil {
+			return nil, err
+		}
+		return merged, modeConflict
 	}
 
 	// Both source and destination are directories, so we recursively
@@ -140,6 +326,10 @@ func mergeWithBase(ctx context.Context, s *storage.LocalFiles, subPath snapshot.
 		// just be nil
 		baseTree = make(snapshot.Tree)
 	}
+	childDrivers, err := cfg.drivers.withAttributes(ctx, s, subPath, destTree, srcTree)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the merge drivers for %q: %v", subPath, err)
+	}
 
 	mergedTree := make(snapshot.Tree)
 	subpaths := make(map[snapshot.Path]struct{})
@@ -150,14 +340,18 @@ func mergeWithBase(ctx context.Context, s *storage.LocalFiles, subPath snapshot.
 		subpaths[p] = struct{}{}
 	}
 	var nestedErrors []string
+	var conflicts []*Conflict
 	for p, _ := range subpaths {
 		childSubPath := subPath.Join(p)
 		childBase := baseTree[p]
 		childSrc := srcTree[p]
 		childDest := destTree[p]
 		// 递归合并孩子
-		mergedChild, err := mergeWithBase(ctx, s, childSubPath, childBase, childSrc, childDest, forceKeepMode)
-		if err != nil {
+		mergedChild, err := mergeWithBase(ctx, s, childSubPath, childBase, childSrc, childDest, cfg.withDrivers(childDrivers))
+		var conflictErr *ConflictError
+		if errors.As(err, &conflictErr) {
+			conflicts = append(conflicts, conflictErr.Conflicts...)
+		} else if err != nil {
 			nestedErrors = append(nestedErrors, err.Error())
 		}
 		if mergedChild != nil {
@@ -165,11 +359,18 @@ func mergeWithBase(ctx context.Context, s *storage.LocalFiles, subPath snapshot.
 		}
 	}
 	// 权限不匹配的话也会报错
-	if srcFile.Mode != destFile.Mode && !forceKeepMode {
-		nestedErrors = append(nestedErrors, fmt.Sprintf("file permissions for %q do not match between versions; source mode line: %q, destination mode line %q. Manually update the permissions for the source to match what you want for the merge result, and then re-run the merge with the option to force using the source permissions", subPath, srcFile.Mode, destFile.Mode))
+	if !baseFile.IsDir() {
+		baseFile = nil
+	}
+	mode, modeConflict := cfg.mergeMode(subPath, base, src, dest, baseFile, srcFile, destFile)
+	if modeConflict != nil {
+		conflicts = append(conflicts, modeConflict.Conflicts...)
 	}
 	// 子路径报错
 	if len(nestedErrors) > 0 {
+		for _, c := range conflicts {
+			nestedErrors = append(nestedErrors, c.Reason)
+		}
 		return nil, errors.New(strings.Join(nestedErrors, "\n"))
 	}
 
@@ -181,10 +382,10 @@ func mergeWithBase(ctx context.Context, s *storage.LocalFiles, subPath snapshot.
 	}
 	// 合并之后的快照文件
 	mergedFile := &snapshot.File{
-		Mode:     srcFile.Mode,
+		Mode:     mode,
 		Contents: contentsHash,
 		// 双亲节点是两个快照
-		Parents: []*snapshot.Hash{src, dest},
+		Parents: []*snapshot.Hash{cfg.original(src), cfg.original(dest)},
 	}
 	fileBytes := []byte(mergedFile.String())
 	// 把文件存起来
@@ -192,9 +393,120 @@ func mergeWithBase(ctx context.Context, s *storage.LocalFiles, subPath snapshot.
 	if err != nil {
 		return nil, fmt.Errorf("failure storing the merged snapshot: %v", err)
 	}
+	if len(conflicts) > 0 {
+		// The merged snapshot is only partial, with the conflicting
+		// paths left as they were in the destination.
+		return h, &ConflictError{Conflicts: conflicts}
+	}
 	return h, nil
 }
 
+// Options configures how snapshots are merged.
+//
+// A nil `*Options` is equivalent to the zero value, which recursively
+// merges the snapshots using the default merge driver for every file,
+// reports every conflict, and checks out the result.
+type Options struct {
+	// Strategy selects how the snapshots are combined. The empty
+	// value is equivalent to `RecursiveStrategy`.
+	Strategy Strategy
+
+	// Drivers selects the merge drivers used for individual files.
+	//
+	// In addition to these settings, each directory in the merged
+	// snapshots can have an attributes file (see `AttributesFile`)
+	// whose rules take precedence over these.
+	Drivers *config.MergeSettings
+
+	// ModeConflict selects how to resolve files whose permissions were
+	// changed differently on each side of the merge.
+	ModeConflict ModeConflictPolicy
+
+	// DeleteModify selects how to resolve files that were deleted on
+	// one side of the merge and modified on the other.
+	DeleteModify DeleteModifyPolicy
+
+	// HelperTimeout, if non-zero, overrides the timeout for every
+	// external merge helper invoked during the merge.
+	HelperTimeout time.Duration
+
+	// AllowConflicts, if true, leaves conflicts in the destination
+	// for the user to manually resolve. See `MergeWithConflicts`.
+	AllowConflicts bool
+
+	// DryRun, if true, computes the result of the merge without
+	// modifying the destination or recording a pending merge.
+	DryRun bool
+
+	// NoCheckout, if true, stores the merged snapshot without
+	// modifying the destination. This is not compatible with
+	// `AllowConflicts`, as conflicts can only be resolved in the
+	// destination.
+	NoCheckout bool
+
+	// RenameThreshold is the minimum similarity, as a percentage, for
+	// a file deleted and a file added on one side of the merge to be
+	// treated as a rename, so that changes made to the file on the
+	// other side follow it. Zero uses `rename.DefaultThreshold`, and a
+	// negative value disables rename detection.
+	RenameThreshold int
+
+	// Checkout configures how the merged snapshot is written to the
+	// destination, and may be nil to use the defaults.
+	Checkout *CheckoutOptions
+}
+
+func (o *Options) strategy() Strategy {
+	if o == nil || len(o.Strategy) == 0 {
+		return RecursiveStrategy
+	}
+	return o.Strategy
+}
+
+func (o *Options) renameThreshold() int {
+	if o == nil || o.RenameThreshold == 0 {
+		return rename.DefaultThreshold
+	}
+	return o.RenameThreshold
+}
+
+func (o *Options) checkoutOptions() *CheckoutOptions {
+	if o == nil {
+		return nil
+	}
+	return o.Checkout
+}
+
+func (o *Options) dryRun() bool {
+	return o != nil && o.DryRun
+}
+
+func (o *Options) mergeConfig(root snapshot.Path) *mergeConfig {
+	if o == nil {
+		return &mergeConfig{drivers: newDrivers(root, nil)}
+	}
+	d := newDrivers(root, o.Drivers)
+	d.helperTimeout = o.HelperTimeout
+	return &mergeConfig{
+		modeConflict: o.ModeConflict,
+		deleteModify: o.DeleteModify,
+		drivers:      d,
+	}
+}
+
+// Result describes the outcome of merging a snapshot into a destination.
+type Result struct {
+	// Hash is the merged snapshot.
+	//
+	// If there were conflicts, then this only includes the paths that
+	// could be automatically merged, with every conflicting path left
+	// as it was in the destination.
+	Hash *snapshot.Hash
+
+	// Conflicts lists the paths that could not be automatically merged.
+	Conflicts []*Conflict
+}
+
 // Merge attempts to automatically merge the given snapshot into the local
 // filesystem at the specified destination path.
 //
@@ -202,42 +514,252 @@ func mergeWithBase(ctx context.Context, s *storage.LocalFiles, subPath snapshot.
 // filesystem contents, then the `Merge` method retursn an error without
 // modifying the local filesystem.
 //
-// In case there are no conflicts but the local storage is missing some
-// referenced snapshots, then it is possible for this method to both modify
-// the local filesystem contents *and* to also return an error. In that case
-// the previous version of the local filesystem contents will be retrievable
-// using the `rvcs log` command.
-func Merge(ctx context.Context, s *storage.LocalFiles, src *snapshot.Hash, dest snapshot.Path) error {
-	destParent := filepath.Dir(string(dest))
-	if err := os.MkdirAll(destParent, os.FileMode(0700)); err != nil {
-		return fmt.Errorf("failure ensuring the parent directory of %q exists: %v", dest, err)
-	}
-	destPrevHash, _, err := snapshot.Current(ctx, s, dest)
+// The merged snapshot is checked out using `SafeCheckout`, so if the
+// checkout fails, or if the destination is modified while the merge is
+// in progress, then the destination is left with its previous contents.
+func Merge(ctx context.Context, s *storage.LocalFiles, src *snapshot.Hash, dest snapshot.Path, opts *Options) error {
+	_, err := mergeInto(ctx, s, src, dest, opts, false)
+	return err
+}
+
+// MergeWithConflicts merges the given snapshot into the local filesystem
+// at the specified destination path, leaving any conflicts in the local
+// filesystem for the user to manually resolve.
+//
+// Every path that could be automatically merged is checked out. Each
+// conflicting path is either rewritten with conflict markers around the
+// conflicting regions, or, if that is not possible, left as it was with
+// the source, base, and destination versions of the file written next
+// to it using the suffixes `.src`, `.base`, and `.dest`.
+//
+// If there were any conflicts, then they are returned and the merge is
+// recorded as pending in storage. Once the conflicts have been resolved,
+// the merge is completed by calling `Continue`.
+func MergeWithConflicts(ctx context.Context, s *storage.LocalFiles, src *snapshot.Hash, dest snapshot.Path, opts *Options) ([]*Conflict, error) {
+	result, err := mergeInto(ctx, s, src, dest, opts, true)
 	if err != nil {
-		return fmt.Errorf("failure generating snapshot of destination %q prior to merging: %v", dest, err)
+		return nil, err
 	}
-	if destPrevHash == nil {
-		// The destination does not exist; simply check out the source hash there.
-		return Checkout(ctx, s, src, dest)
+	return result.Conflicts, nil
+}
+
+// MergeWithResult merges the given snapshot into the local filesystem at
+// the specified destination path, as configured by the given options, and
+// returns the merged snapshot along with any conflicts.
+//
+// Conflicts are reported as an error unless either `opts.AllowConflicts`
+// or `opts.DryRun` is set.
+func MergeWithResult(ctx context.Context, s *storage.LocalFiles, src *snapshot.Hash, dest snapshot.Path, opts *Options) (*Result, error) {
+	allowConflicts := opts != nil && (opts.AllowConflicts || opts.DryRun)
+	return mergeInto(ctx, s, src, dest, opts, allowConflicts)
+}
+
+// mergeSnapshots merges the source snapshot into the destination snapshot
+// using the strategy selected by the given options.
+func mergeSnapshots(ctx context.Context, s *storage.LocalFiles, p snapshot.Path, base, src, dest *snapshot.Hash, opts *Options) (*snapshot.Hash, error) {
+	strategy := opts.strategy()
+	if strategy == RecursiveStrategy {
+		cfg := opts.mergeConfig(p)
+		base, src, dest, err := cfg.followRenames(ctx, s, base, src, dest, opts.renameThreshold())
+		if err != nil {
+			return nil, err
+		}
+		return mergeWithBase(ctx, s, p, base, src, dest, cfg)
 	}
-	mergeBase, err := Base(ctx, s, src, destPrevHash)
+	kept := dest
+	if strategy == TheirsStrategy {
+		kept = src
+	} else if strategy != OursStrategy {
+		return nil, fmt.Errorf("unknown merge strategy %q", strategy)
+	}
+	keptFile, err := s.ReadSnapshot(ctx, kept)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the file snapshot for %q: %v", kept, err)
+	}
+	return storeMergedSnapshot(ctx, s, keptFile.Mode, keptFile.Contents, src, dest)
+}
+
+// hashesRoot is the path used to report conflicts when merging snapshot
+// hashes that are not tied to any local filesystem path.
+const hashesRoot = snapshot.Path(".")
+
+// MergeHashes merges the source snapshot into the destination snapshot
+// entirely within storage, and returns the merged snapshot along with any
+// conflicts.
+//
+// Unlike `Merge`, this does not read or modify any local filesystem paths,
+// other than temporary directories for external merge helpers. The paths
+// of any conflicts are relative to the root of the merged snapshots, which
+// is reported as ".".
+//
+// Conflicts are reported as an error unless either `opts.AllowConflicts`
+// or `opts.DryRun` is set. In that case the returned snapshot only
+// includes the paths that could be automatically merged.
+func MergeHashes(ctx context.Context, s *storage.LocalFiles, src, dest *snapshot.Hash, opts *Options) (*Result, error) {
+	if dest == nil {
+		return &Result{Hash: src}, nil
+	}
+	allowConflicts := opts != nil && (opts.AllowConflicts || opts.DryRun)
+	return mergeHashes(ctx, s, hashesRoot, src, dest, opts, allowConflicts)
+}
+
+func mergeHashes(ctx context.Context, s *storage.LocalFiles, p snapshot.Path, src, dest *snapshot.Hash, opts *Options, allowConflicts bool) (*Result, error) {
+	mergeBase, err := Base(ctx, s, src, dest)
 	if err != nil {
-		return fmt.Errorf("failure determining the merge base for %q and %q: %v", src, destPrevHash, err)
+		return nil, fmt.Errorf("failure determining the merge base for %q and %q: %v", src, dest, err)
 	}
 	if mergeBase.Equal(src) {
 		// The source has already been merged in
-		return nil
+		return &Result{Hash: dest}, nil
 	}
+	mergedHash, err := mergeSnapshots(ctx, s, p, mergeBase, src, dest, opts)
+	var conflictErr *ConflictError
+	if err != nil && !(allowConflicts && errors.As(err, &conflictErr)) {
+		return nil, fmt.Errorf("unable to automatically merge the two snapshots: %w", err)
+	}
+	result := &Result{Hash: mergedHash}
+	if conflictErr != nil {
+		result.Conflicts = conflictErr.Conflicts
+	}
+	return result, nil
+}
 
-	mergedHash, err := mergeWithBase(ctx, s, dest, mergeBase, src, destPrevHash, false)
+// prepareMerge checks that a merge into the given destination can start,
+// and returns the current snapshot of the destination along with whether
+// or not the merge result should be checked out.
+func prepareMerge(ctx context.Context, s *storage.LocalFiles, dest snapshot.Path, opts *Options, allowConflicts bool) (destPrevHash *snapshot.Hash, checkout bool, err error) {
+	if allowConflicts && opts != nil && opts.NoCheckout && !opts.DryRun {
+		return nil, false, errors.New("conflicts can only be left for manual resolution if the merge result is checked out")
+	}
+	if pending, err := s.PendingMerge(ctx, dest); err != nil {
+		return nil, false, fmt.Errorf("failure checking for a pending merge into %q: %v", dest, err)
+	} else if len(pending) > 0 {
+		return nil, false, fmt.Errorf("a previous merge into %q is waiting on conflicts to be manually resolved; resolve them and then continue that merge first", dest)
+	}
+	destPrevHash, _, err = snapshot.Current(ctx, s, dest)
 	if err != nil {
-		return fmt.Errorf("unable to automatically merge the two snapshots: %v", err)
+		return nil, false, fmt.Errorf("failure generating snapshot of destination %q prior to merging: %v", dest, err)
 	}
+	return destPrevHash, opts == nil || !(opts.DryRun || opts.NoCheckout), nil
+}
 
+// finishMerge checks out the result of a merge into the given destination,
+// leaving any conflicts for the user to resolve.
+//
+// If there are conflicts, then the given parents and annotation are
+// recorded as a pending merge for `Continue` to use.
+func finishMerge(ctx context.Context, s *storage.LocalFiles, dest snapshot.Path, destPrevHash *snapshot.Hash, result *Result, parents []*snapshot.Hash, annotation string, opts *Options) (*Result, error) {
+	if result.Hash.Equal(destPrevHash) {
+		return result, nil
+	}
 	// Update the destination to point to the merged snapshot
-	if err := os.RemoveAll(string(dest)); err != nil {
-		return fmt.Errorf("failure updating %q to point to newer snapshot %q; failure removing old files: %v", dest, mergedHash, err)
+	if err := SafeCheckout(ctx, s, result.Hash, dest, destPrevHash, opts.checkoutOptions()); err != nil {
+		return nil, fmt.Errorf("failure updating %q to point to the merged snapshot %q: %v", dest, result.Hash, err)
+	}
+	if len(result.Conflicts) == 0 {
+		return result, nil
+	}
+	var sideFiles []snapshot.Path
+	for _, c := range result.Conflicts {
+		written, err := writeConflict(ctx, s, c)
+		sideFiles = append(sideFiles, written...)
+		if err != nil {
+			return nil, fmt.Errorf("failure writing the conflict for %q: %v", c.Path, err)
+		}
+	}
+	if err := s.UpdatePendingMerge(ctx, dest, parents); err != nil {
+		return nil, fmt.Errorf("failure recording the pending merge into %q: %v", dest, err)
+	}
+	if err := s.UpdatePendingMergeSideFiles(ctx, dest, sideFiles); err != nil {
+		return nil, fmt.Errorf("failure recording the pending merge into %q: %v", dest, err)
+	}
+	if err := s.UpdatePendingMergeAnnotation(ctx, dest, annotation); err != nil {
+		return nil, fmt.Errorf("failure recording the pending merge into %q: %v", dest, err)
+	}
+	return result, nil
+}
+
+func mergeInto(ctx context.Context, s *storage.LocalFiles, src *snapshot.Hash, dest snapshot.Path, opts *Options, allowConflicts bool) (*Result, error) {
+	destPrevHash, checkout, err := prepareMerge(ctx, s, dest, opts, allowConflicts)
+	if err != nil {
+		return nil, err
+	}
+	if destPrevHash == nil {
+		// The destination does not exist; simply check out the source hash there.
+		if !checkout {
+			return &Result{Hash: src}, nil
+		}
+		return &Result{Hash: src}, SafeCheckout(ctx, s, src, dest, nil, opts.checkoutOptions())
 	}
-	// 设置的checkout？
-	return Checkout(ctx, s, mergedHash, dest)
+	result, err := mergeHashes(ctx, s, dest, src, destPrevHash, opts, allowConflicts)
+	if err != nil || !checkout {
+		return result, err
+	}
+	return finishMerge(ctx, s, dest, destPrevHash, result, []*snapshot.Hash{src, destPrevHash}, "", opts)
+}
+
+// Continue completes a merge into the given destination path that was
+// previously left pending by `MergeWithConflicts`.
+//
+// The current contents of the destination, including any manual conflict
+// resolutions, are snapshotted with both the merge source and the previous
+// destination snapshot as parents.
+//
+// The `.src`, `.base`, and `.dest` side files written next to conflicted
+// files are removed first, so that they are not included in the result.
+//
+// If the pending merge was left by `CherryPick` or `Revert`, then the
+// resulting snapshot is annotated the same way it would have been had
+// there been no conflicts.
+func Continue(ctx context.Context, s *storage.LocalFiles, dest snapshot.Path) (*snapshot.Hash, error) {
+	parents, err := s.PendingMerge(ctx, dest)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the pending merge into %q: %v", dest, err)
+	}
+	if len(parents) == 0 {
+		return nil, fmt.Errorf("there is no pending merge into %q", dest)
+	}
+	annotation, err := s.PendingMergeAnnotation(ctx, dest)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the pending merge into %q: %v", dest, err)
+	}
+	sideFiles, err := s.PendingMergeSideFiles(ctx, dest)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the pending merge into %q: %v", dest, err)
+	}
+	for _, sideFile := range sideFiles {
+		if err := os.Remove(string(sideFile)); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failure removing the conflict side file %q: %v", sideFile, err)
+		}
+	}
+	_, f, err := snapshot.Current(ctx, s, dest)
+	if err != nil {
+		return nil, fmt.Errorf("failure snapshotting the resolved contents of %q: %v", dest, err)
+	} else if f == nil {
+		return nil, fmt.Errorf("the merge destination %q no longer exists", dest)
+	}
+	resolved := &snapshot.File{
+		Mode:     f.Mode,
+		Contents: f.Contents,
+		Parents:  parents,
+	}
+	h, err := s.StoreSnapshot(ctx, dest, resolved)
+	if err != nil {
+		return nil, fmt.Errorf("failure storing the merged snapshot for %q: %v", dest, err)
+	}
+	if len(annotation) > 0 {
+		if err := s.AddAnnotation(ctx, h, annotation); err != nil {
+			return nil, fmt.Errorf("failure annotating the snapshot %q: %v", h, err)
+		}
+	}
+	if err := s.UpdatePendingMerge(ctx, dest, nil); err != nil {
+		return nil, fmt.Errorf("failure clearing the pending merge into %q: %v", dest, err)
+	}
+	if err := s.UpdatePendingMergeAnnotation(ctx, dest, ""); err != nil {
+		return nil, fmt.Errorf("failure clearing the pending merge into %q: %v", dest, err)
+	}
+	if err := s.UpdatePendingMergeSideFiles(ctx, dest, nil); err != nil {
+		return nil, fmt.Errorf("failure clearing the pending merge into %q: %v", dest, err)
+	}
+	return h, nil
 }
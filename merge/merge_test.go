@@ -49,7 +49,7 @@ func TestMergeRegularFile(t *testing.T) {
 	clone := filepath.Join(dir, "clone.txt")
 	clonePath := snapshot.Path(clone)
 
-	if err := Merge(context.Background(), s, h1, clonePath); err != nil {
+	if err := Merge(context.Background(), s, h1, clonePath, nil); err != nil {
 		t.Fatalf("failure checking out the file snapshot %q: %v", h1, err)
 	}
 
@@ -93,7 +93,7 @@ func TestMergeSymlink(t *testing.T) {
 
 	clone := filepath.Join(dir, "clone.txt")
 	clonePath := snapshot.Path(clone)
-	if err := Merge(context.Background(), s, h1, clonePath); err != nil {
+	if err := Merge(context.Background(), s, h1, clonePath, nil); err != nil {
 		t.Fatalf("failure checking out the symlink snapshot %q: %v", h1, err)
 	}
 
@@ -142,7 +142,7 @@ func TestMergeExcludedDir(t *testing.T) {
 		t.Error("unexpectedly included the storage archive in the snapshot")
 	}
 
-	if err := Merge(context.Background(), s, h1, dirPath); err != nil {
+	if err := Merge(context.Background(), s, h1, dirPath, nil); err != nil {
 		t.Fatalf("failure checking out the directory snapshot %q: %v", h1, err)
 	}
 
@@ -189,7 +189,7 @@ func TestMergeDir(t *testing.T) {
 
 	cloneDir := filepath.Join(dir, "clone-dir")
 	cloneDirPath := snapshot.Path(cloneDir)
-	if err := Merge(context.Background(), s, h1, cloneDirPath); err != nil {
+	if err := Merge(context.Background(), s, h1, cloneDirPath, nil); err != nil {
 		t.Fatalf("failure checking out the directory snapshot %q: %v", h1, err)
 	}
 	verifyFilesMatch(t, file1, filepath.Join(cloneDir, "example1.txt"))
@@ -232,7 +232,7 @@ func TestMergeNonConflictingChangesDir(t *testing.T) {
 
 	cloneDir := filepath.Join(dir, "clone-dir")
 	cloneDirPath := snapshot.Path(cloneDir)
-	if err := Merge(context.Background(), s, h1, cloneDirPath); err != nil {
+	if err := Merge(context.Background(), s, h1, cloneDirPath, nil); err != nil {
 		t.Fatalf("failure checking out the directory snapshot %q: %v", h1, err)
 	}
 	verifyFilesMatch(t, file1, filepath.Join(cloneDir, "example1.txt"))
@@ -268,10 +268,194 @@ func TestMergeNonConflictingChangesDir(t *testing.T) {
 	if err := Checkout(context.Background(), s, h2, mergeDirPath); err != nil {
 		t.Fatalf("failure checking out the directory snapshot %q: %v", h2, err)
 	}
-	if err := Merge(context.Background(), s, h3, mergeDirPath); err != nil {
+	if err := Merge(context.Background(), s, h3, mergeDirPath, nil); err != nil {
 		t.Fatalf("failure checking out the directory snapshot %q: %v", h1, err)
 	}
 	verifyFilesMatch(t, file1, filepath.Join(mergeDir, "example1.txt"))
 	verifyFilesMatch(t, filepath.Join(cloneDir, "example2.txt"), filepath.Join(mergeDir, "example2.txt"))
 	verifyFilesMatch(t, file3, filepath.Join(mergeDir, "example3.txt"))
 }
+
+func TestMergeModes(t *testing.T) {
+	s := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive")}
+	p := snapshot.Path("example.txt")
+
+	base := storeTestSnapshot(t, s, "-rw-------", "A\nB\nC\n")
+	srcChanged := storeTestSnapshot(t, s, "-rwx------", "X\nB\nC\n", base)
+	destUnchanged := storeTestSnapshot(t, s, "-rw-------", "A\nB\nY\n", base)
+	destChanged := storeTestSnapshot(t, s, "-rw-r--r--", "A\nB\nY\n", base)
+
+	testCases := []struct {
+		Description  string
+		Dest         *snapshot.Hash
+		Policy       ModeConflictPolicy
+		WantConflict bool
+		WantMode     string
+	}{
+		{
+			Description: "mode only changed in the source",
+			Dest:        destUnchanged,
+			WantMode:    "-rwx------",
+		},
+		{
+			Description:  "mode changed on both sides",
+			Dest:         destChanged,
+			WantConflict: true,
+		},
+		{
+			Description: "mode changed on both sides, preferring the source",
+			Dest:        destChanged,
+			Policy:      PreferSourceMode,
+			WantMode:    "-rwx------",
+		},
+		{
+			Description: "mode changed on both sides, preferring the destination",
+			Dest:        destChanged,
+			Policy:      PreferDestinationMode,
+			WantMode:    "-rw-r--r--",
+		},
+	}
+	for _, testCase := range testCases {
+		opts := &Options{ModeConflict: testCase.Policy}
+		merged, err := mergeWithBase(context.Background(), s, p, base, srcChanged, testCase.Dest, opts.mergeConfig(p))
+		if testCase.WantConflict {
+			if err == nil {
+				t.Errorf("unexpected success merging with the %s", testCase.Description)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failure merging with the %s: %v", testCase.Description, err)
+			continue
+		}
+		f, err := s.ReadSnapshot(context.Background(), merged)
+		if err != nil {
+			t.Errorf("failure reading the merged snapshot with the %s: %v", testCase.Description, err)
+			continue
+		}
+		if got, want := f.Mode, testCase.WantMode; got != want {
+			t.Errorf("unexpected mode for the merge with the %s: got %q, want %q", testCase.Description, got, want)
+		}
+		if contents, err := readContents(context.Background(), s, f); err != nil {
+			t.Errorf("failure reading the merged contents with the %s: %v", testCase.Description, err)
+		} else if got, want := string(contents), "X\nB\nY\n"; got != want {
+			t.Errorf("unexpected contents for the merge with the %s: got %q, want %q", testCase.Description, got, want)
+		}
+	}
+}
+
+func TestMergeOptions(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	original := filepath.Join(dir, "original.txt")
+	if err := os.WriteFile(original, []byte("A\nB\nC\n"), 0700); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	h1, _, err := snapshot.Current(context.Background(), s, snapshot.Path(original))
+	if err != nil {
+		t.Fatalf("failure creating the initial snapshot for the file: %v", err)
+	}
+	clone := filepath.Join(dir, "clone.txt")
+	clonePath := snapshot.Path(clone)
+	if err := Checkout(context.Background(), s, h1, clonePath); err != nil {
+		t.Fatalf("failure checking out the file snapshot %q: %v", h1, err)
+	}
+	if err := os.WriteFile(original, []byte("X\nB\nC\n"), 0700); err != nil {
+		t.Fatalf("failure updating the example file: %v", err)
+	}
+	h2, _, err := snapshot.Current(context.Background(), s, snapshot.Path(original))
+	if err != nil {
+		t.Fatalf("failure creating the updated snapshot for the file: %v", err)
+	}
+	if err := os.WriteFile(clone, []byte("A\nB\nY\n"), 0700); err != nil {
+		t.Fatalf("failure updating the cloned file: %v", err)
+	}
+
+	result, err := MergeWithResult(context.Background(), s, h2, clonePath, &Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("failure running a dry run merge: %v", err)
+	}
+	if contents, err := os.ReadFile(clone); err != nil {
+		t.Fatalf("failure reading the cloned file: %v", err)
+	} else if got, want := string(contents), "A\nB\nY\n"; got != want {
+		t.Errorf("unexpected modification by a dry run merge: got %q, want %q", got, want)
+	}
+	merged, err := s.ReadSnapshot(context.Background(), result.Hash)
+	if err != nil {
+		t.Fatalf("failure reading the merged snapshot: %v", err)
+	}
+	if contents, err := readContents(context.Background(), s, merged); err != nil {
+		t.Fatalf("failure reading the merged contents: %v", err)
+	} else if got, want := string(contents), "X\nB\nY\n"; got != want {
+		t.Errorf("unexpected contents for the dry run merge: got %q, want %q", got, want)
+	}
+
+	if err := Merge(context.Background(), s, h2, clonePath, &Options{Strategy: OursStrategy}); err != nil {
+		t.Fatalf("failure merging with the ours strategy: %v", err)
+	}
+	if contents, err := os.ReadFile(clone); err != nil {
+		t.Fatalf("failure reading the cloned file: %v", err)
+	} else if got, want := string(contents), "A\nB\nY\n"; got != want {
+		t.Errorf("unexpected contents after merging with the ours strategy: got %q, want %q", got, want)
+	}
+	h3, f3, err := snapshot.Current(context.Background(), s, clonePath)
+	if err != nil {
+		t.Fatalf("failure snapshotting the merged file: %v", err)
+	}
+	if got, want := len(f3.Parents), 2; got != want {
+		t.Errorf("unexpected number of parents for %q: got %d, want %d", h3, got, want)
+	}
+	if isAncestor, err := IsAncestor(context.Background(), s, h2, h3); err != nil {
+		t.Errorf("failure checking the ancestry of the merged snapshot: %v", err)
+	} else if !isAncestor {
+		t.Errorf("the merged source %q is not an ancestor of %q", h2, h3)
+	}
+}
+
+func TestMergeHashes(t *testing.T) {
+	s := &storage.LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive")}
+
+	base := storeTestFile(t, s, "A\nB\nC\n")
+	src := storeTestFile(t, s, "X\nB\nC\n", base)
+	dest := storeTestFile(t, s, "A\nB\nY\n", base)
+	conflicting := storeTestFile(t, s, "Z\nB\nC\n", base)
+
+	result, err := MergeHashes(context.Background(), s, src, dest, nil)
+	if err != nil {
+		t.Fatalf("failure merging %q into %q: %v", src, dest, err)
+	}
+	merged, err := s.ReadSnapshot(context.Background(), result.Hash)
+	if err != nil {
+		t.Fatalf("failure reading the merged snapshot: %v", err)
+	}
+	if contents, err := readContents(context.Background(), s, merged); err != nil {
+		t.Fatalf("failure reading the merged contents: %v", err)
+	} else if got, want := string(contents), "X\nB\nY\n"; got != want {
+		t.Errorf("unexpected merged contents: got %q, want %q", got, want)
+	}
+	if got, want := len(merged.Parents), 2; got != want {
+		t.Errorf("unexpected number of parents for the merged snapshot: got %d, want %d", got, want)
+	}
+
+	if result, err := MergeHashes(context.Background(), s, base, dest, nil); err != nil {
+		t.Errorf("failure merging an ancestor into %q: %v", dest, err)
+	} else if !result.Hash.Equal(dest) {
+		t.Errorf("unexpected result merging an ancestor into %q: got %q", dest, result.Hash)
+	}
+
+	if _, err := MergeHashes(context.Background(), s, src, conflicting, nil); err == nil {
+		t.Errorf("unexpected success merging conflicting snapshots")
+	}
+	result, err = MergeHashes(context.Background(), s, src, conflicting, &Options{AllowConflicts: true})
+	if err != nil {
+		t.Fatalf("failure merging conflicting snapshots: %v", err)
+	}
+	if got, want := len(result.Conflicts), 1; got != want {
+		t.Fatalf("unexpected number of conflicts: got %d, want %d", got, want)
+	}
+	if got, want := result.Conflicts[0].Path, snapshot.Path("."); got != want {
+		t.Errorf("unexpected conflict path: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+)
+
+// DefaultCheckoutParallelism is the default maximum number of files that
+// are written concurrently when checking out a snapshot.
+const DefaultCheckoutParallelism = 8
+
+// Progress receives updates as the files of a snapshot are checked out.
+type Progress interface {
+	// Update is called after each file (other than a directory) is
+	// written, with the total number of files and bytes written so far
+	// and the path of the file that was just written.
+	//
+	// Calls to `Update` are never concurrent with each other.
+	Update(files, bytes int64, current snapshot.Path)
+}
+
+// CheckoutOptions configures how snapshots are recreated in the local
+// filesystem.
+type CheckoutOptions struct {
+	// Parallelism is the maximum number of files written concurrently.
+	// Zero uses `DefaultCheckoutParallelism`.
+	Parallelism int
+
+	// Progress, if not nil, is notified as each file is written.
+	Progress Progress
+
+	// ModTime, if not zero, is the modification time given to each
+	// regular file written by a checkout that is recorded in storage.
+	//
+	// By default, these files are given a modification time from just
+	// before the checkout started. Either way, the stat cache is then
+	// updated for them, so that snapshotting them again does not need to
+	// rehash their contents, while any later modification to them will
+	// still be detected.
+	ModTime time.Time
+}
+
+func (o *CheckoutOptions) parallelism() int {
+	if o == nil || o.Parallelism <= 0 {
+		return DefaultCheckoutParallelism
+	}
+	return o.Parallelism
+}
+
+// modTime returns the modification time for files written by a checkout
+// that started at the given time.
+//
+// The default is a whole second before the start of the checkout, as any
+// file modified after this time will get a later modification time even
+// on filesystems that only record them to the second.
+func (o *CheckoutOptions) modTime(start time.Time) time.Time {
+	if o == nil || o.ModTime.IsZero() {
+		return start.Truncate(time.Second).Add(-time.Second)
+	}
+	return o.ModTime
+}
+
+func (o *CheckoutOptions) progress() Progress {
+	if o == nil {
+		return nil
+	}
+	return o.Progress
+}
+
+// checkoutWorkers bounds the number of files written concurrently during a
+// checkout, and collects the first error from writing them.
+//
+// Directories are walked by the caller rather than the workers, so that a
+// worker is never left waiting on another one.
+type checkoutWorkers struct {
+	slots    chan struct{}
+	wg       sync.WaitGroup
+	progress Progress
+
+	mu    sync.Mutex
+	err   error
+	files int64
+	bytes int64
+}
+
+func newCheckoutWorkers(opts *CheckoutOptions) *checkoutWorkers {
+	return &checkoutWorkers{
+		slots:    make(chan struct{}, opts.parallelism()),
+		progress: opts.progress(),
+	}
+}
+
+func (w *checkoutWorkers) failed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err != nil
+}
+
+// run calls the given function on a worker, blocking until one is free.
+//
+// Once any function has failed, or the context has been cancelled, no
+// further functions are called.
+func (w *checkoutWorkers) run(ctx context.Context, fn func() error) {
+	w.slots <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer func() { <-w.slots }()
+		if w.failed() {
+			return
+		}
+		err := ctx.Err()
+		if err == nil {
+			err = fn()
+		}
+		if err != nil {
+			w.mu.Lock()
+			if w.err == nil {
+				w.err = err
+			}
+			w.mu.Unlock()
+		}
+	}()
+}
+
+// wait waits for every function passed to `run` to finish, and returns the
+// first error from any of them.
+func (w *checkoutWorkers) wait() error {
+	w.wg.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// written records that the file at the given path was written.
+func (w *checkoutWorkers) written(p snapshot.Path, bytes int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files++
+	w.bytes += bytes
+	if w.progress != nil {
+		w.progress.Update(w.files, w.bytes, p)
+	}
+}
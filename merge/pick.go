@@ -0,0 +1,136 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+func firstParent(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash) (*snapshot.Hash, error) {
+	f, err := s.ReadSnapshot(ctx, h)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the file snapshot for %q: %v", h, err)
+	}
+	if len(f.Parents) == 0 {
+		return nil, nil
+	}
+	return f.Parents[0], nil
+}
+
+// CherryPick applies the changes made by the given snapshot, relative to
+// its first parent, to the local filesystem at the specified destination
+// path.
+//
+// Unlike `Merge`, the resulting snapshot only has the previous destination
+// snapshot as its parent, since none of the other history of the picked
+// snapshot is included. Instead, the picked snapshot is recorded in an
+// annotation on the resulting snapshot.
+//
+// Conflicts are handled the same as for `MergeWithResult`, and a merge
+// left with conflicts is completed by calling `Continue`, which then
+// records the annotation.
+func CherryPick(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, dest snapshot.Path, opts *Options) (*Result, error) {
+	parent, err := firstParent(ctx, s, h)
+	if err != nil {
+		return nil, err
+	}
+	return applyChange(ctx, s, parent, h, dest, opts, fmt.Sprintf("cherry-picked from %s", h))
+}
+
+// Revert applies the inverse of the changes made by the given snapshot,
+// relative to its first parent, to the local filesystem at the specified
+// destination path.
+//
+// The resulting snapshot is recorded the same way as for `CherryPick`.
+func Revert(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, dest snapshot.Path, opts *Options) (*Result, error) {
+	parent, err := firstParent(ctx, s, h)
+	if err != nil {
+		return nil, err
+	}
+	return applyChange(ctx, s, h, parent, dest, opts, fmt.Sprintf("reverted %s", h))
+}
+
+// applyChange applies the changes from `before` to `after` to the given
+// destination path, using `before` as a synthetic merge base.
+//
+// If the given annotation is empty, then no annotation is recorded.
+func applyChange(ctx context.Context, s *storage.LocalFiles, before, after *snapshot.Hash, dest snapshot.Path, opts *Options, annotation string) (*Result, error) {
+	allowConflicts := opts != nil && (opts.AllowConflicts || opts.DryRun)
+	destPrevHash, checkout, err := prepareMerge(ctx, s, dest, opts, allowConflicts)
+	if err != nil {
+		return nil, err
+	}
+	if destPrevHash == nil {
+		return nil, fmt.Errorf("the destination %q does not exist", dest)
+	}
+	cfg := opts.mergeConfig(dest)
+	cfg.syntheticBase = true
+	before, after, destCurrent, err := cfg.followRenames(ctx, s, before, after, destPrevHash, opts.renameThreshold())
+	if err != nil {
+		return nil, err
+	}
+	merged, err := mergeWithBase(ctx, s, dest, before, after, destCurrent, cfg)
+	var conflictErr *ConflictError
+	if err != nil && !(allowConflicts && errors.As(err, &conflictErr)) {
+		return nil, fmt.Errorf("unable to automatically apply the changes: %w", err)
+	}
+	if merged == nil {
+		return nil, fmt.Errorf("applying the changes would delete %q", dest)
+	}
+	mergedFile, err := s.ReadSnapshot(ctx, merged)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the file snapshot for %q: %v", merged, err)
+	}
+	destPrevFile, err := s.ReadSnapshot(ctx, destPrevHash)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the file snapshot for %q: %v", destPrevHash, err)
+	}
+	result := &Result{Hash: destPrevHash}
+	if conflictErr != nil {
+		result.Conflicts = conflictErr.Conflicts
+	}
+	if sameContents(mergedFile, destPrevFile) && len(result.Conflicts) == 0 {
+		// The changes have already been applied.
+		return result, nil
+	}
+	appliedFile := &snapshot.File{
+		Mode:     mergedFile.Mode,
+		Contents: mergedFile.Contents,
+		Parents:  []*snapshot.Hash{destPrevHash},
+	}
+	fileBytes := []byte(appliedFile.String())
+	result.Hash, err = s.StoreObject(ctx, int64(len(fileBytes)), bytes.NewReader(fileBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failure storing the snapshot with the applied changes: %v", err)
+	}
+	if checkout {
+		if result, err = finishMerge(ctx, s, dest, destPrevHash, result, []*snapshot.Hash{destPrevHash}, annotation, opts); err != nil {
+			return nil, err
+		}
+	}
+	if len(result.Conflicts) == 0 && !opts.dryRun() && len(annotation) > 0 {
+		if err := s.AddAnnotation(ctx, result.Hash, annotation); err != nil {
+			return nil, fmt.Errorf("failure annotating the snapshot %q: %v", result.Hash, err)
+		}
+	}
+	return result, nil
+}
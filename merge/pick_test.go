@@ -0,0 +1,161 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+func TestCherryPickAndRevert(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	original := filepath.Join(dir, "original.txt")
+	originalPath := snapshot.Path(original)
+	if err := os.WriteFile(original, []byte("A\nB\nC\nD\nE\n"), 0700); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	h1, _, err := snapshot.Current(context.Background(), s, originalPath)
+	if err != nil {
+		t.Fatalf("failure creating the initial snapshot for the file: %v", err)
+	}
+	clone := filepath.Join(dir, "clone.txt")
+	clonePath := snapshot.Path(clone)
+	if err := Checkout(context.Background(), s, h1, clonePath); err != nil {
+		t.Fatalf("failure checking out the file snapshot %q: %v", h1, err)
+	}
+
+	// Two changes are made to the original, and only the second is picked.
+	if err := os.WriteFile(original, []byte("X\nB\nC\nD\nE\n"), 0700); err != nil {
+		t.Fatalf("failure updating the example file: %v", err)
+	}
+	if _, _, err := snapshot.Current(context.Background(), s, originalPath); err != nil {
+		t.Fatalf("failure snapshotting the first change: %v", err)
+	}
+	if err := os.WriteFile(original, []byte("X\nB\nC\nD\nY\n"), 0700); err != nil {
+		t.Fatalf("failure updating the example file: %v", err)
+	}
+	h3, _, err := snapshot.Current(context.Background(), s, originalPath)
+	if err != nil {
+		t.Fatalf("failure snapshotting the second change: %v", err)
+	}
+	if err := os.WriteFile(clone, []byte("A\nB\nZ\nD\nE\n"), 0700); err != nil {
+		t.Fatalf("failure updating the cloned file: %v", err)
+	}
+
+	result, err := CherryPick(context.Background(), s, h3, clonePath, nil)
+	if err != nil {
+		t.Fatalf("failure cherry-picking %q: %v", h3, err)
+	}
+	if contents, err := os.ReadFile(clone); err != nil {
+		t.Fatalf("failure reading the cloned file: %v", err)
+	} else if got, want := string(contents), "A\nB\nZ\nD\nY\n"; got != want {
+		t.Errorf("unexpected contents after cherry-picking: got %q, want %q", got, want)
+	}
+	picked, err := s.ReadSnapshot(context.Background(), result.Hash)
+	if err != nil {
+		t.Fatalf("failure reading the cherry-picked snapshot: %v", err)
+	}
+	if got, want := len(picked.Parents), 1; got != want {
+		t.Errorf("unexpected number of parents for the cherry-picked snapshot: got %d, want %d", got, want)
+	}
+	if annotations, err := s.Annotations(context.Background(), result.Hash); err != nil {
+		t.Errorf("failure reading the annotations for the cherry-picked snapshot: %v", err)
+	} else if got, want := len(annotations), 1; got != want {
+		t.Errorf("unexpected annotations for the cherry-picked snapshot: %v", annotations)
+	}
+
+	if _, err := Revert(context.Background(), s, result.Hash, clonePath, nil); err != nil {
+		t.Fatalf("failure reverting %q: %v", result.Hash, err)
+	}
+	if contents, err := os.ReadFile(clone); err != nil {
+		t.Fatalf("failure reading the cloned file: %v", err)
+	} else if got, want := string(contents), "A\nB\nZ\nD\nE\n"; got != want {
+		t.Errorf("unexpected contents after reverting: got %q, want %q", got, want)
+	}
+}
+
+func TestCherryPickWithConflicts(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	original := filepath.Join(dir, "original.txt")
+	originalPath := snapshot.Path(original)
+	if err := os.WriteFile(original, []byte("A\nB\nC\n"), 0700); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	h1, _, err := snapshot.Current(context.Background(), s, originalPath)
+	if err != nil {
+		t.Fatalf("failure creating the initial snapshot for the file: %v", err)
+	}
+	clone := filepath.Join(dir, "clone.txt")
+	clonePath := snapshot.Path(clone)
+	if err := Checkout(context.Background(), s, h1, clonePath); err != nil {
+		t.Fatalf("failure checking out the file snapshot %q: %v", h1, err)
+	}
+
+	// The same line is changed differently in the original and the clone.
+	if err := os.WriteFile(original, []byte("A\nX\nC\n"), 0700); err != nil {
+		t.Fatalf("failure updating the example file: %v", err)
+	}
+	h2, _, err := snapshot.Current(context.Background(), s, originalPath)
+	if err != nil {
+		t.Fatalf("failure snapshotting the change: %v", err)
+	}
+	if err := os.WriteFile(clone, []byte("A\nY\nC\n"), 0700); err != nil {
+		t.Fatalf("failure updating the cloned file: %v", err)
+	}
+
+	result, err := CherryPick(context.Background(), s, h2, clonePath, &Options{AllowConflicts: true})
+	if err != nil {
+		t.Fatalf("failure cherry-picking %q: %v", h2, err)
+	}
+	if got, want := len(result.Conflicts), 1; got != want {
+		t.Fatalf("unexpected conflicts cherry-picking %q: got %+v, want %d conflict", h2, result.Conflicts, want)
+	}
+	if err := os.WriteFile(clone, []byte("A\nX\nY\nC\n"), 0700); err != nil {
+		t.Fatalf("failure resolving the conflict: %v", err)
+	}
+	h3, err := Continue(context.Background(), s, clonePath)
+	if err != nil {
+		t.Fatalf("failure continuing the cherry-pick: %v", err)
+	}
+	picked, err := s.ReadSnapshot(context.Background(), h3)
+	if err != nil {
+		t.Fatalf("failure reading the cherry-picked snapshot: %v", err)
+	}
+	if got, want := len(picked.Parents), 1; got != want {
+		t.Errorf("unexpected number of parents for the cherry-picked snapshot: got %d, want %d", got, want)
+	}
+	if annotations, err := s.Annotations(context.Background(), h3); err != nil {
+		t.Errorf("failure reading the annotations for the cherry-picked snapshot: %v", err)
+	} else if want := "cherry-picked from " + h2.String(); len(annotations) != 1 || annotations[0] != want {
+		t.Errorf("unexpected annotations for the cherry-picked snapshot: got %v, want [%q]", annotations, want)
+	}
+	if annotation, err := s.PendingMergeAnnotation(context.Background(), clonePath); err != nil {
+		t.Errorf("failure reading the pending merge annotation: %v", err)
+	} else if len(annotation) > 0 {
+		t.Errorf("unexpected pending merge annotation after continuing: %q", annotation)
+	}
+}
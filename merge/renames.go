@@ -0,0 +1,327 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/recursive-version-control-system/rename"
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+// defaultDirMode is the mode used for directories that have to be created
+// in order to follow a rename, if no other mode is known for them.
+const defaultDirMode = "drwx------"
+
+// flattenTree adds every nested, non-directory snapshot under the given
+// directory snapshot to the given map, keyed by its path relative to the
+// root of the flattening.
+func flattenTree(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, prefix string, result map[string]*snapshot.Hash) error {
+	f, err := s.ReadSnapshot(ctx, h)
+	if err != nil {
+		return fmt.Errorf("failure reading the file snapshot for %q: %v", h, err)
+	}
+	if !f.IsDir() {
+		result[prefix] = h
+		return nil
+	}
+	tree, err := s.ListDirectorySnapshotContents(ctx, h, f)
+	if err != nil {
+		return fmt.Errorf("failure reading the tree for the snapshot %q: %v", h, err)
+	}
+	for child, childHash := range tree {
+		if err := flattenTree(ctx, s, childHash, filepath.Join(prefix, string(child)), result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addsOrDeletes reports whether or not any nested paths were added to or
+// deleted from the snapshot `before` to get the snapshot `after`.
+//
+// Only the subdirectories that differ between the two are read, so this is
+// much cheaper than flattening both snapshots when few files were changed.
+// Since a rename is always both a deletion and an addition, there is no
+// need to look for renames if this returns false.
+func addsOrDeletes(ctx context.Context, s *storage.LocalFiles, before, after *snapshot.Hash) (bool, error) {
+	if before.Equal(after) {
+		return false, nil
+	}
+	beforeFile, err := s.ReadSnapshot(ctx, before)
+	if err != nil {
+		return false, fmt.Errorf("failure reading the file snapshot for %q: %v", before, err)
+	}
+	afterFile, err := s.ReadSnapshot(ctx, after)
+	if err != nil {
+		return false, fmt.Errorf("failure reading the file snapshot for %q: %v", after, err)
+	}
+	if !beforeFile.IsDir() || !afterFile.IsDir() {
+		return beforeFile.IsDir() != afterFile.IsDir(), nil
+	}
+	beforeTree, err := s.ListDirectorySnapshotContents(ctx, before, beforeFile)
+	if err != nil {
+		return false, fmt.Errorf("failure reading the tree for the snapshot %q: %v", before, err)
+	}
+	afterTree, err := s.ListDirectorySnapshotContents(ctx, after, afterFile)
+	if err != nil {
+		return false, fmt.Errorf("failure reading the tree for the snapshot %q: %v", after, err)
+	}
+	if len(beforeTree) != len(afterTree) {
+		return true, nil
+	}
+	for child, childHash := range beforeTree {
+		afterChild, ok := afterTree[child]
+		if !ok {
+			return true, nil
+		}
+		if changed, err := addsOrDeletes(ctx, s, childHash, afterChild); changed || err != nil {
+			return changed, err
+		}
+	}
+	return false, nil
+}
+
+// rewriteTree returns a snapshot of the given directory with the given
+// nested paths replaced, where a nil hash removes the corresponding path.
+//
+// Any directories that have to be created take their mode from the
+// corresponding directory in one of the given templates, if there is one.
+//
+// The rewritten directories have the same history as the originals, and
+// are recorded in `aliases` so that the originals can be used in their
+// place when checking ancestry or recording parents.
+func rewriteTree(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, templates []*snapshot.Hash, changes map[string]*snapshot.Hash, aliases map[snapshot.Hash]*snapshot.Hash) (*snapshot.Hash, error) {
+	tree := make(snapshot.Tree)
+	mode := ""
+	var parents []*snapshot.Hash
+	if h != nil {
+		f, err := s.ReadSnapshot(ctx, h)
+		if err != nil {
+			return nil, fmt.Errorf("failure reading the file snapshot for %q: %v", h, err)
+		}
+		if !f.IsDir() {
+			return nil, fmt.Errorf("the snapshot %q is not a directory", h)
+		}
+		existing, err := s.ListDirectorySnapshotContents(ctx, h, f)
+		if err != nil {
+			return nil, fmt.Errorf("failure reading the tree for the snapshot %q: %v", h, err)
+		}
+		for child, childHash := range existing {
+			tree[child] = childHash
+		}
+		mode = f.Mode
+		parents = f.Parents
+	}
+	templateTrees := make([]snapshot.Tree, len(templates))
+	for i, template := range templates {
+		if template == nil {
+			continue
+		}
+		f, err := s.ReadSnapshot(ctx, template)
+		if err != nil {
+			return nil, fmt.Errorf("failure reading the file snapshot for %q: %v", template, err)
+		}
+		if !f.IsDir() {
+			continue
+		}
+		if len(mode) == 0 {
+			mode = f.Mode
+		}
+		if templateTrees[i], err = s.ListDirectorySnapshotContents(ctx, template, f); err != nil {
+			return nil, fmt.Errorf("failure reading the tree for the snapshot %q: %v", template, err)
+		}
+	}
+	if len(mode) == 0 {
+		mode = defaultDirMode
+	}
+
+	nested := make(map[snapshot.Path]map[string]*snapshot.Hash)
+	for p, changed := range changes {
+		parts := strings.SplitN(p, string(filepath.Separator), 2)
+		child := snapshot.Path(parts[0])
+		if len(parts) == 1 {
+			if changed == nil {
+				delete(tree, child)
+			} else {
+				tree[child] = changed
+			}
+			continue
+		}
+		if nested[child] == nil {
+			nested[child] = make(map[string]*snapshot.Hash)
+		}
+		nested[child][parts[1]] = changed
+	}
+	for child, childChanges := range nested {
+		var childTemplates []*snapshot.Hash
+		for _, templateTree := range templateTrees {
+			childTemplates = append(childTemplates, templateTree[child])
+		}
+		rewritten, err := rewriteTree(ctx, s, tree[child], childTemplates, childChanges, aliases)
+		if err != nil {
+			return nil, err
+		}
+		tree[child] = rewritten
+	}
+
+	contentsBytes := []byte(tree.String())
+	contentsHash, err := s.StoreObject(ctx, int64(len(contentsBytes)), bytes.NewReader(contentsBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failure storing the contents of a rewritten tree: %v", err)
+	}
+	rewrittenFile := &snapshot.File{
+		Mode:     mode,
+		Contents: contentsHash,
+		Parents:  parents,
+	}
+	fileBytes := []byte(rewrittenFile.String())
+	rewritten, err := s.StoreObject(ctx, int64(len(fileBytes)), bytes.NewReader(fileBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failure storing a rewritten tree: %v", err)
+	}
+	aliases[*rewritten] = h
+	return rewritten, nil
+}
+
+// followRenames detects files that were renamed on one side of a merge, and
+// rewrites the other side and the base to use the same names, so that any
+// changes made to those files on the other side follow them.
+//
+// Renames are only followed for files that were not also renamed or deleted
+// on the other side.
+func (c *mergeConfig) followRenames(ctx context.Context, s *storage.LocalFiles, base, src, dest *snapshot.Hash, threshold int) (*snapshot.Hash, *snapshot.Hash, *snapshot.Hash, error) {
+	if threshold <= 0 || base == nil || src == nil || dest == nil {
+		return base, src, dest, nil
+	}
+	for _, h := range []*snapshot.Hash{base, src, dest} {
+		f, err := s.ReadSnapshot(ctx, h)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failure reading the file snapshot for %q: %v", h, err)
+		}
+		if !f.IsDir() {
+			return base, src, dest, nil
+		}
+	}
+	srcChanged, err := addsOrDeletes(ctx, s, base, src)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failure comparing %q to the merge base %q: %v", src, base, err)
+	}
+	destChanged, err := addsOrDeletes(ctx, s, base, dest)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failure comparing %q to the merge base %q: %v", dest, base, err)
+	}
+	if !srcChanged && !destChanged {
+		// Nothing was renamed, so there is no need to list every file.
+		return base, src, dest, nil
+	}
+	baseFiles := make(map[string]*snapshot.Hash)
+	srcFiles := make(map[string]*snapshot.Hash)
+	destFiles := make(map[string]*snapshot.Hash)
+	for _, flattened := range []struct {
+		h     *snapshot.Hash
+		files map[string]*snapshot.Hash
+	}{{base, baseFiles}, {src, srcFiles}, {dest, destFiles}} {
+		if err := flattenTree(ctx, s, flattened.h, "", flattened.files); err != nil {
+			return nil, nil, nil, fmt.Errorf("failure listing the files of %q: %v", flattened.h, err)
+		}
+	}
+	srcRenames, err := rename.DetectBetween(ctx, s, baseFiles, srcFiles, threshold)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failure detecting renames in %q: %v", src, err)
+	}
+	destRenames, err := rename.DetectBetween(ctx, s, baseFiles, destFiles, threshold)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failure detecting renames in %q: %v", dest, err)
+	}
+
+	baseChanges := make(map[string]*snapshot.Hash)
+	srcChanges := make(map[string]*snapshot.Hash)
+	destChanges := make(map[string]*snapshot.Hash)
+	if c.aliases == nil {
+		c.aliases = make(map[snapshot.Hash]*snapshot.Hash)
+	}
+	if c.renamedFrom == nil {
+		c.renamedFrom = make(map[snapshot.Hash]*snapshot.Hash)
+	}
+	follow := func(renames map[string]string, files, otherFiles, otherChanges map[string]*snapshot.Hash) {
+		for renamed, previous := range renames {
+			if _, ok := otherFiles[previous]; !ok {
+				// Renamed or deleted on the other side too.
+				continue
+			}
+			if _, ok := otherFiles[renamed]; ok {
+				continue
+			}
+			baseChanges[previous] = nil
+			baseChanges[renamed] = baseFiles[previous]
+			otherChanges[previous] = nil
+			otherChanges[renamed] = otherFiles[previous]
+			c.renamedFrom[*files[renamed]] = baseFiles[previous]
+		}
+	}
+	follow(srcRenames, srcFiles, destFiles, destChanges)
+	follow(destRenames, destFiles, srcFiles, srcChanges)
+	if len(baseChanges) == 0 {
+		return base, src, dest, nil
+	}
+
+	newBase, err := rewriteTree(ctx, s, base, []*snapshot.Hash{src, dest}, baseChanges, c.aliases)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failure following renames in the merge base %q: %v", base, err)
+	}
+	newSrc, newDest := src, dest
+	if len(srcChanges) > 0 {
+		if newSrc, err = rewriteTree(ctx, s, src, []*snapshot.Hash{dest}, srcChanges, c.aliases); err != nil {
+			return nil, nil, nil, fmt.Errorf("failure following renames in the source %q: %v", src, err)
+		}
+	}
+	if len(destChanges) > 0 {
+		if newDest, err = rewriteTree(ctx, s, dest, []*snapshot.Hash{src}, destChanges, c.aliases); err != nil {
+			return nil, nil, nil, fmt.Errorf("failure following renames in the destination %q: %v", dest, err)
+		}
+	}
+	return newBase, newSrc, newDest, nil
+}
+
+// renamed reports whether or not `h` is the snapshot of a file that was
+// renamed from `base` by one side of the merge.
+//
+// The renamed file has a new history, so this is used in place of checking
+// that its history includes the base.
+func (c *mergeConfig) renamed(base, h *snapshot.Hash) bool {
+	if base == nil || h == nil || c.renamedFrom == nil {
+		return false
+	}
+	return base.Equal(c.renamedFrom[*h])
+}
+
+// original returns the snapshot that the given one was rewritten from by
+// `followRenames`, or the given snapshot if it was not rewritten.
+func (c *mergeConfig) original(h *snapshot.Hash) *snapshot.Hash {
+	if h == nil || c.aliases == nil {
+		return h
+	}
+	if original, ok := c.aliases[*h]; ok {
+		return original
+	}
+	return h
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+func TestMergeFollowsRenames(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	workingDir := filepath.Join(dir, "working-dir")
+	if err := os.MkdirAll(filepath.Join(workingDir, "a"), 0700); err != nil {
+		t.Fatalf("failure creating the working directory for the test: %v", err)
+	}
+	dirPath := snapshot.Path(workingDir)
+	if err := os.WriteFile(filepath.Join(workingDir, "a", "x.txt"), []byte("A\nB\nC\nD\nE\n"), 0700); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(workingDir, "other.txt"), []byte("Hello, World!"), 0700); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	h1, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure creating the initial snapshot for the directory: %v", err)
+	}
+	cloneDir := filepath.Join(dir, "clone-dir")
+	cloneDirPath := snapshot.Path(cloneDir)
+	if err := Checkout(context.Background(), s, h1, cloneDirPath); err != nil {
+		t.Fatalf("failure checking out the directory snapshot %q: %v", h1, err)
+	}
+
+	// The file is moved and slightly edited in the source...
+	if err := os.RemoveAll(filepath.Join(workingDir, "a")); err != nil {
+		t.Fatalf("failure removing the original directory: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(workingDir, "b"), 0700); err != nil {
+		t.Fatalf("failure creating the new directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(workingDir, "b", "x.txt"), []byte("A\nB\nC\nD\nE\nF\n"), 0700); err != nil {
+		t.Fatalf("failure moving the example file: %v", err)
+	}
+	h2, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure snapshotting the moved file: %v", err)
+	}
+
+	// ... and edited in place in the destination.
+	if err := os.WriteFile(filepath.Join(cloneDir, "a", "x.txt"), []byte("Z\nB\nC\nD\nE\n"), 0700); err != nil {
+		t.Fatalf("failure updating the cloned file: %v", err)
+	}
+
+	h3, _, err := snapshot.Current(context.Background(), s, cloneDirPath)
+	if err != nil {
+		t.Fatalf("failure snapshotting the edited file: %v", err)
+	}
+	// Only the source adds or deletes any files, so only it is listed in
+	// full to look for renames.
+	for _, tc := range []struct {
+		h    *snapshot.Hash
+		want bool
+	}{{h2, true}, {h3, false}} {
+		if got, err := addsOrDeletes(context.Background(), s, h1, tc.h); err != nil {
+			t.Errorf("failure comparing %q to %q: %v", tc.h, h1, err)
+		} else if got != tc.want {
+			t.Errorf("unexpected result for whether %q adds or deletes files: got %v, want %v", tc.h, got, tc.want)
+		}
+	}
+	if _, err := MergeHashes(context.Background(), s, h2, h3, &Options{RenameThreshold: -1}); err == nil {
+		t.Errorf("unexpected success merging a moved file without rename detection")
+	}
+
+	if err := Merge(context.Background(), s, h2, cloneDirPath, nil); err != nil {
+		t.Fatalf("failure merging %q into %q: %v", h2, cloneDir, err)
+	}
+	if contents, err := os.ReadFile(filepath.Join(cloneDir, "b", "x.txt")); err != nil {
+		t.Fatalf("failure reading the moved file: %v", err)
+	} else if got, want := string(contents), "Z\nB\nC\nD\nE\nF\n"; got != want {
+		t.Errorf("unexpected contents of the moved file: got %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(cloneDir, "a", "x.txt")); !os.IsNotExist(err) {
+		t.Errorf("unexpected file left at the original path: %v", err)
+	}
+	verifyFilesMatch(t, filepath.Join(workingDir, "other.txt"), filepath.Join(cloneDir, "other.txt"))
+
+	merged, _, err := snapshot.Current(context.Background(), s, cloneDirPath)
+	if err != nil {
+		t.Fatalf("failure snapshotting the merged directory: %v", err)
+	}
+	if isAncestor, err := IsAncestor(context.Background(), s, h2, merged); err != nil {
+		t.Fatalf("failure checking the merged history: %v", err)
+	} else if !isAncestor {
+		t.Errorf("the source %q is not an ancestor of the merge result %q", h2, merged)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+// nestedSnapshot returns the snapshot nested under the given snapshot at
+// the given relative path, or nil if there is no such nested snapshot.
+func nestedSnapshot(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, rel snapshot.Path) (*snapshot.Hash, error) {
+	cleaned := filepath.Clean(string(rel))
+	if cleaned == "." {
+		return h, nil
+	}
+	for _, elem := range strings.Split(cleaned, string(filepath.Separator)) {
+		if h == nil {
+			return nil, nil
+		}
+		f, err := s.ReadSnapshot(ctx, h)
+		if err != nil {
+			return nil, fmt.Errorf("failure reading the file snapshot for %q: %v", h, err)
+		}
+		if !f.IsDir() {
+			return nil, nil
+		}
+		tree, err := s.ListDirectorySnapshotContents(ctx, h, f)
+		if err != nil {
+			return nil, fmt.Errorf("failure reading the contents of the directory snapshot %q: %v", h, err)
+		}
+		h = tree[snapshot.Path(elem)]
+	}
+	return h, nil
+}
+
+// checkRestoredParents reports an error if any of the existing parent
+// directories of the given nested path under `p` is a symbolic link, as
+// restoring through it would modify files outside of `p`.
+func checkRestoredParents(p, subpath snapshot.Path) error {
+	elems := strings.Split(filepath.Clean(string(subpath)), string(filepath.Separator))
+	dir := p
+	for _, elem := range elems[:len(elems)-1] {
+		dir = dir.Join(snapshot.Path(elem))
+		info, err := os.Lstat(string(dir))
+		if os.IsNotExist(err) {
+			// The remaining parents are created by the restore.
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failure reading the file metadata for %q: %v", dir, err)
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("the path %q to restore is under the symbolic link %q", subpath, dir)
+		}
+	}
+	return nil
+}
+
+// Restore replaces the given nested paths of the local path `p` with their
+// versions from the snapshot `h`, leaving the rest of `p` unchanged.
+//
+// The nested paths are relative to `p`, and any of them that do not exist
+// in `h` are removed. Paths under a symbolic link in `p` are refused
+// rather than followed, and a symbolic link at a restored path is
+// replaced rather than written through.
+//
+// The current contents of `p` are snapshotted before anything is restored,
+// so that any local modifications are kept in its history. The returned
+// value is the new snapshot of `p` with the restored paths.
+func Restore(ctx context.Context, s *storage.LocalFiles, h *snapshot.Hash, p snapshot.Path, subpaths []snapshot.Path) (*snapshot.Hash, error) {
+	for _, subpath := range subpaths {
+		cleaned := filepath.Clean(string(subpath))
+		if filepath.IsAbs(cleaned) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("the path %q to restore must be nested under %q", subpath, p)
+		}
+		if err := checkRestoredParents(p, subpath); err != nil {
+			return nil, err
+		}
+	}
+	if _, _, err := snapshot.Current(ctx, s, p); err != nil {
+		return nil, fmt.Errorf("failure snapshotting the current contents of %q: %v", p, err)
+	}
+	for _, subpath := range subpaths {
+		nested, err := nestedSnapshot(ctx, s, h, subpath)
+		if err != nil {
+			return nil, fmt.Errorf("failure finding %q in the snapshot %q: %v", subpath, h, err)
+		}
+		target := p.Join(subpath)
+		if nested == nil {
+			if err := os.RemoveAll(string(target)); err != nil {
+				return nil, fmt.Errorf("failure removing %q, which does not exist in the snapshot %q: %v", target, h, err)
+			}
+			continue
+		}
+		if info, err := os.Lstat(string(target)); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			if err := os.Remove(string(target)); err != nil {
+				return nil, fmt.Errorf("failure removing the symbolic link %q: %v", target, err)
+			}
+		}
+		// The restored paths are not recorded as corresponding to the
+		// restored snapshots, so that the new snapshots of them are
+		// descendants of their current snapshots.
+		opts, err := newCheckoutOptions(ctx, s, target, target, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := opts.wait(checkout(ctx, s, nested, target, opts)); err != nil {
+			return nil, fmt.Errorf("failure restoring %q from the snapshot %q: %v", target, nested, err)
+		}
+	}
+	restored, _, err := snapshot.Current(ctx, s, p)
+	if err != nil {
+		return nil, fmt.Errorf("failure snapshotting the restored contents of %q: %v", p, err)
+	}
+	return restored, nil
+}
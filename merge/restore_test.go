@@ -0,0 +1,157 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	workingDir := filepath.Join(dir, "working-dir")
+	if err := os.MkdirAll(filepath.Join(workingDir, "nested"), 0700); err != nil {
+		t.Fatalf("failure creating the working directory for the test: %v", err)
+	}
+	dirPath := snapshot.Path(workingDir)
+	restoredFile := filepath.Join(workingDir, "nested", "restored.txt")
+	keptFile := filepath.Join(workingDir, "kept.txt")
+	if err := os.WriteFile(restoredFile, []byte("Original"), 0700); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	if err := os.WriteFile(keptFile, []byte("Original"), 0700); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	h1, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure creating the initial snapshot for the directory: %v", err)
+	}
+
+	for _, file := range []string{restoredFile, keptFile} {
+		if err := os.WriteFile(file, []byte("Modified"), 0700); err != nil {
+			t.Fatalf("failure modifying the example file %q: %v", file, err)
+		}
+	}
+	addedFile := filepath.Join(workingDir, "added.txt")
+	if err := os.WriteFile(addedFile, []byte("Added"), 0700); err != nil {
+		t.Fatalf("failure creating the added file: %v", err)
+	}
+	modified, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure snapshotting the modified directory: %v", err)
+	}
+
+	restored, err := Restore(context.Background(), s, h1, dirPath, []snapshot.Path{"nested/restored.txt", "added.txt"})
+	if err != nil {
+		t.Fatalf("failure restoring from %q: %v", h1, err)
+	}
+	if contents, err := os.ReadFile(restoredFile); err != nil {
+		t.Fatalf("failure reading the restored file: %v", err)
+	} else if got, want := string(contents), "Original"; got != want {
+		t.Errorf("unexpected contents of the restored file: got %q, want %q", got, want)
+	}
+	if contents, err := os.ReadFile(keptFile); err != nil {
+		t.Fatalf("failure reading the kept file: %v", err)
+	} else if got, want := string(contents), "Modified"; got != want {
+		t.Errorf("unexpected contents of the file that was not restored: got %q, want %q", got, want)
+	}
+	if _, err := os.Lstat(addedFile); !os.IsNotExist(err) {
+		t.Errorf("unexpected file left after restoring a path missing from the snapshot: %v", err)
+	}
+	if isAncestor, err := IsAncestor(context.Background(), s, modified, restored); err != nil {
+		t.Fatalf("failure checking the history of the restored snapshot: %v", err)
+	} else if !isAncestor {
+		t.Errorf("the modified snapshot %q is not an ancestor of the restored snapshot %q", modified, restored)
+	}
+
+	if _, err := Restore(context.Background(), s, h1, dirPath, []snapshot.Path{"../escaped.txt"}); err == nil {
+		t.Errorf("unexpected success restoring a path outside of %q", dirPath)
+	}
+}
+
+func TestRestoreThroughSymlink(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	workingDir := filepath.Join(dir, "working-dir")
+	if err := os.MkdirAll(filepath.Join(workingDir, "nested"), 0700); err != nil {
+		t.Fatalf("failure creating the working directory for the test: %v", err)
+	}
+	dirPath := snapshot.Path(workingDir)
+	if err := os.WriteFile(filepath.Join(workingDir, "nested", "restored.txt"), []byte("Original"), 0700); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(workingDir, "linked.txt"), []byte("Original"), 0700); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	h1, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure creating the initial snapshot for the directory: %v", err)
+	}
+
+	// Replace the nested directory and the file with symbolic links to
+	// paths outside of the working directory.
+	outsideDir := filepath.Join(dir, "outside-dir")
+	if err := os.Mkdir(outsideDir, 0700); err != nil {
+		t.Fatalf("failure creating the outside directory: %v", err)
+	}
+	outsideFile := filepath.Join(dir, "outside.txt")
+	if err := os.WriteFile(outsideFile, []byte("Outside"), 0700); err != nil {
+		t.Fatalf("failure creating the outside file: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(workingDir, "nested")); err != nil {
+		t.Fatalf("failure removing the nested directory: %v", err)
+	}
+	if err := os.Symlink(outsideDir, filepath.Join(workingDir, "nested")); err != nil {
+		t.Fatalf("failure linking the nested directory: %v", err)
+	}
+	if err := os.Remove(filepath.Join(workingDir, "linked.txt")); err != nil {
+		t.Fatalf("failure removing the example file: %v", err)
+	}
+	if err := os.Symlink(outsideFile, filepath.Join(workingDir, "linked.txt")); err != nil {
+		t.Fatalf("failure linking the example file: %v", err)
+	}
+
+	if _, err := Restore(context.Background(), s, h1, dirPath, []snapshot.Path{"nested/restored.txt"}); err == nil {
+		t.Errorf("unexpected success restoring a path under a symbolic link")
+	}
+	if _, err := os.Lstat(filepath.Join(outsideDir, "restored.txt")); !os.IsNotExist(err) {
+		t.Errorf("unexpected file restored outside of %q: %v", dirPath, err)
+	}
+
+	if _, err := Restore(context.Background(), s, h1, dirPath, []snapshot.Path{"linked.txt"}); err != nil {
+		t.Fatalf("failure restoring a symbolic link: %v", err)
+	}
+	if contents, err := os.ReadFile(outsideFile); err != nil {
+		t.Fatalf("failure reading the outside file: %v", err)
+	} else if got, want := string(contents), "Outside"; got != want {
+		t.Errorf("unexpected contents of the outside file: got %q, want %q", got, want)
+	}
+	if info, err := os.Lstat(filepath.Join(workingDir, "linked.txt")); err != nil {
+		t.Fatalf("failure reading the restored file metadata: %v", err)
+	} else if !info.Mode().IsRegular() {
+		t.Errorf("unexpected mode of the restored file: %v", info.Mode())
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+// UpdateSparseCheckout changes the sparse checkout patterns for the given
+// path, and then checks out its latest snapshot again so that exactly the
+// nested paths selected by the new patterns are materialized.
+//
+// Passing an empty list of patterns turns the path back into a full
+// checkout.
+//
+// Nested paths that are no longer selected are removed from the local
+// filesystem, but they remain in the snapshot of the path, as do any
+// local modifications that were made to them.
+//
+// The returned value is the snapshot of the path that was checked out.
+func UpdateSparseCheckout(ctx context.Context, s *storage.LocalFiles, p snapshot.Path, patterns snapshot.SparsePatterns) (*snapshot.Hash, error) {
+	if err := patterns.Validate(); err != nil {
+		return nil, err
+	}
+	previousPatterns, err := s.SparsePatterns(ctx, p)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the sparse checkout patterns for %q: %v", p, err)
+	}
+	// Snapshot the path using the previous patterns, so that nothing is
+	// lost when the new patterns are applied.
+	current, _, err := snapshot.Current(ctx, s, p)
+	if err != nil {
+		return nil, fmt.Errorf("failure snapshotting the current contents of %q: %v", p, err)
+	}
+	if err := s.UpdateSparsePatterns(ctx, p, patterns); err != nil {
+		return nil, fmt.Errorf("failure updating the sparse checkout patterns for %q: %v", p, err)
+	}
+	if current == nil {
+		return nil, nil
+	}
+	// The path was just snapshotted, so there are no local changes for
+	// `SafeCheckout` to protect, and its check would treat any newly
+	// selected paths as deleted.
+	if err := Checkout(ctx, s, current, p); err != nil {
+		// Best effort attempt to go back to the previous patterns,
+		// which still describe the snapshot of the path.
+		s.UpdateSparsePatterns(ctx, p, previousPatterns)
+		return nil, fmt.Errorf("failure checking out %q with the updated sparse checkout patterns: %v", p, err)
+	}
+	return current, nil
+}
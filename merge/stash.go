@@ -0,0 +1,131 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+// ErrNothingToStash is returned by `Stash` when the given path has no
+// changes since its last recorded snapshot.
+var ErrNothingToStash = errors.New("there are no local changes to stash")
+
+// Stash sets aside the local changes made to the given path since its last
+// recorded snapshot, and then checks that snapshot back out.
+//
+// The changes are recorded in a new snapshot whose first parent is the
+// previously recorded one. That snapshot is detached from the path mapping,
+// and is instead kept at the top of the list of stashes for the path.
+func Stash(ctx context.Context, s *storage.LocalFiles, p snapshot.Path, copts *CheckoutOptions) (*snapshot.Hash, error) {
+	if pending, err := s.PendingMerge(ctx, p); err != nil {
+		return nil, fmt.Errorf("failure checking for a pending merge into %q: %v", p, err)
+	} else if len(pending) > 0 {
+		return nil, fmt.Errorf("a previous merge into %q is waiting on conflicts to be manually resolved; resolve them and then continue that merge first", p)
+	}
+	base, _, err := s.FindSnapshot(ctx, p)
+	if err != nil {
+		return nil, fmt.Errorf("failure looking up the last snapshot of %q: %v", p, err)
+	}
+	if base == nil {
+		return nil, fmt.Errorf("%q has not been previously snapshotted", p)
+	}
+	h, _, err := snapshot.Current(ctx, s, p)
+	if err != nil {
+		return nil, fmt.Errorf("failure snapshotting the current contents of %q: %v", p, err)
+	}
+	if h.Equal(base) {
+		return nil, ErrNothingToStash
+	}
+	stashes, err := s.Stashes(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.UpdateStashes(ctx, p, append([]*snapshot.Hash{h}, stashes...)); err != nil {
+		return nil, err
+	}
+	if err := SafeCheckout(ctx, s, base, p, h, copts); err != nil {
+		if restoreErr := s.UpdateStashes(ctx, p, stashes); restoreErr != nil {
+			return nil, fmt.Errorf("failure restoring the stashes for %q: %v, after failing to check out %q: %v", p, restoreErr, base, err)
+		}
+		return nil, fmt.Errorf("failure checking out %q to %q: %v", base, p, err)
+	}
+	return h, nil
+}
+
+// stashEntry returns the stash at the given index in the list of stashes
+// for the given path, along with the full list.
+func stashEntry(ctx context.Context, s *storage.LocalFiles, p snapshot.Path, index int) (*snapshot.Hash, []*snapshot.Hash, error) {
+	stashes, err := s.Stashes(ctx, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(stashes) == 0 {
+		return nil, nil, fmt.Errorf("there are no stashes for %q", p)
+	}
+	if index < 0 || index >= len(stashes) {
+		return nil, nil, fmt.Errorf("there is no stash %d for %q; it only has %d", index, p, len(stashes))
+	}
+	return stashes[index], stashes, nil
+}
+
+// PopStash applies the changes recorded in the stash at the given index
+// back to the given path, and then drops that stash.
+//
+// The changes are applied with a three-way merge against the snapshot that
+// was current when they were stashed, so the path may have been updated
+// in the meantime. The resulting snapshot is recorded the same way as for
+// `CherryPick`, except that it is not annotated.
+//
+// If the merge is left with conflicts, or is only a dry run, then the stash
+// is kept and has to be dropped separately.
+func PopStash(ctx context.Context, s *storage.LocalFiles, p snapshot.Path, index int, opts *Options) (*Result, error) {
+	h, _, err := stashEntry(ctx, s, p, index)
+	if err != nil {
+		return nil, err
+	}
+	base, err := firstParent(ctx, s, h)
+	if err != nil {
+		return nil, err
+	}
+	result, err := applyChange(ctx, s, base, h, p, opts, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Conflicts) > 0 || opts.dryRun() {
+		return result, nil
+	}
+	if err := DropStash(ctx, s, p, index); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DropStash removes the stash at the given index from the list of stashes
+// for the given path.
+func DropStash(ctx context.Context, s *storage.LocalFiles, p snapshot.Path, index int) error {
+	_, stashes, err := stashEntry(ctx, s, p, index)
+	if err != nil {
+		return err
+	}
+	remaining := append([]*snapshot.Hash{}, stashes[:index]...)
+	remaining = append(remaining, stashes[index+1:]...)
+	return s.UpdateStashes(ctx, p, remaining)
+}
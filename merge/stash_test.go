@@ -0,0 +1,108 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+func TestStash(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	s := &storage.LocalFiles{ArchiveDir: archive}
+
+	workingDir := filepath.Join(dir, "working-dir")
+	if err := os.MkdirAll(workingDir, 0700); err != nil {
+		t.Fatalf("failure creating the working directory for the test: %v", err)
+	}
+	dirPath := snapshot.Path(workingDir)
+	stashedFile := filepath.Join(workingDir, "stashed.txt")
+	updatedFile := filepath.Join(workingDir, "updated.txt")
+	for _, file := range []string{stashedFile, updatedFile} {
+		if err := os.WriteFile(file, []byte("Original"), 0700); err != nil {
+			t.Fatalf("failure creating the example file %q: %v", file, err)
+		}
+	}
+	h1, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure creating the initial snapshot for the directory: %v", err)
+	}
+	if _, err := Stash(context.Background(), s, dirPath, nil); !errors.Is(err, ErrNothingToStash) {
+		t.Errorf("unexpected result stashing an unmodified directory: got %v, want %v", err, ErrNothingToStash)
+	}
+
+	if err := os.WriteFile(stashedFile, []byte("Stashed"), 0700); err != nil {
+		t.Fatalf("failure modifying the example file: %v", err)
+	}
+	stashed, err := Stash(context.Background(), s, dirPath, nil)
+	if err != nil {
+		t.Fatalf("failure stashing the local changes: %v", err)
+	}
+	if contents, err := os.ReadFile(stashedFile); err != nil {
+		t.Fatalf("failure reading the stashed file: %v", err)
+	} else if got, want := string(contents), "Original"; got != want {
+		t.Errorf("unexpected contents of the stashed file after stashing: got %q, want %q", got, want)
+	}
+	if got, _, err := s.FindSnapshot(context.Background(), dirPath); err != nil {
+		t.Fatalf("failure looking up the snapshot of the directory: %v", err)
+	} else if !got.Equal(h1) {
+		t.Errorf("unexpected snapshot of the directory after stashing: got %q, want %q", got, h1)
+	}
+	if stashes, err := s.Stashes(context.Background(), dirPath); err != nil {
+		t.Fatalf("failure listing the stashes: %v", err)
+	} else if len(stashes) != 1 || !stashes[0].Equal(stashed) {
+		t.Errorf("unexpected stashes: got %v, want [%q]", stashes, stashed)
+	}
+
+	if err := os.WriteFile(updatedFile, []byte("Updated"), 0700); err != nil {
+		t.Fatalf("failure modifying the example file: %v", err)
+	}
+	h2, _, err := snapshot.Current(context.Background(), s, dirPath)
+	if err != nil {
+		t.Fatalf("failure snapshotting the updated directory: %v", err)
+	}
+	result, err := PopStash(context.Background(), s, dirPath, 0, nil)
+	if err != nil {
+		t.Fatalf("failure popping the stash: %v", err)
+	}
+	for file, want := range map[string]string{stashedFile: "Stashed", updatedFile: "Updated"} {
+		if contents, err := os.ReadFile(file); err != nil {
+			t.Fatalf("failure reading the file %q: %v", file, err)
+		} else if got := string(contents); got != want {
+			t.Errorf("unexpected contents of %q after popping the stash: got %q, want %q", file, got, want)
+		}
+	}
+	if isAncestor, err := IsAncestor(context.Background(), s, h2, result.Hash); err != nil {
+		t.Fatalf("failure checking the history of the result: %v", err)
+	} else if !isAncestor {
+		t.Errorf("the updated snapshot %q is not an ancestor of the result %q", h2, result.Hash)
+	}
+	if stashes, err := s.Stashes(context.Background(), dirPath); err != nil {
+		t.Fatalf("failure listing the stashes: %v", err)
+	} else if len(stashes) != 0 {
+		t.Errorf("unexpected stashes left after popping: %v", stashes)
+	}
+	if err := DropStash(context.Background(), s, dirPath, 0); err == nil {
+		t.Errorf("unexpected success dropping a stash that does not exist")
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+const (
+	srcMarker  = "<<<<<<< src\n"
+	baseMarker = "||||||| base\n"
+	sepMarker  = "=======\n"
+	destMarker = ">>>>>>> dest\n"
+
+	// binaryCheckSize is how much of a file we look at to decide if it is binary.
+	binaryCheckSize = 8000
+
+	// maxTextMergeSize is the largest file that is merged line by line.
+	maxTextMergeSize = 8 * 1024 * 1024
+
+	// maxLineEdits roughly limits the number of lines that the source or
+	// destination can differ from the base by for their lines to be
+	// matched up, since the time that takes grows with both the size of
+	// the files and the number of differences between them.
+	maxLineEdits = 8192
+)
+
+// errTooManyChanges reports that the changes made to a file are too
+// extensive for its lines to be merged automatically.
+var errTooManyChanges = errors.New("too many lines were changed")
+
+// errTooLarge reports that a file is larger than `maxTextMergeSize`.
+var errTooLarge = errors.New("the file is too large to merge line by line")
+
+// readTextContents reads the contents of the given file snapshot, unless
+// they are larger than `maxTextMergeSize`.
+func readTextContents(ctx context.Context, s *storage.LocalFiles, f *snapshot.File) ([]byte, error) {
+	if f == nil || f.Contents == nil {
+		return nil, nil
+	}
+	r, err := s.ReadObject(ctx, f.Contents)
+	if err != nil {
+		return nil, fmt.Errorf("failure opening the contents %q: %v", f.Contents, err)
+	}
+	defer r.Close()
+	contents, err := io.ReadAll(io.LimitReader(r, maxTextMergeSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) > maxTextMergeSize {
+		return nil, errTooLarge
+	}
+	return contents, nil
+}
+
+// isBinary reports whether or not the given contents look like a binary file.
+//
+// This uses the same heuristic as many other tools; the contents are
+// considered binary if they contain a NUL byte near the start.
+func isBinary(contents []byte) bool {
+	if len(contents) > binaryCheckSize {
+		contents = contents[:binaryCheckSize]
+	}
+	return bytes.IndexByte(contents, 0) >= 0
+}
+
+// splitLines splits the given contents into lines, with each line
+// retaining its trailing newline (if any).
+func splitLines(contents []byte) [][]byte {
+	var lines [][]byte
+	for len(contents) > 0 {
+		i := bytes.IndexByte(contents, '\n')
+		if i < 0 {
+			lines = append(lines, contents)
+			break
+		}
+		lines = append(lines, contents[:i+1])
+		contents = contents[i+1:]
+	}
+	return lines
+}
+
+// matchLines computes a longest common subsequence of the two sequences
+// using Myers' diff algorithm.
+//
+// The returned slice has one entry for each element of `a`, holding the
+// index of the matching element in `b`, or -1 if the element is unmatched.
+//
+// If the sequences differ by more than roughly `maxLineEdits` elements,
+// then the search is abandoned and the returned bool is false.
+func matchLines(a, b []int) ([]int, bool) {
+	match := make([]int, len(a))
+	for i := range match {
+		match[i] = -1
+	}
+	if !matchRange(a, b, 0, 0, match) {
+		return nil, false
+	}
+	return match, true
+}
+
+// matchRange fills in `match` for the elements of the given subsequences,
+// which start at the given offsets in the sequences passed to `matchLines`.
+//
+// This uses the linear space refinement of Myers' algorithm; the middle of
+// an optimal edit path is found by searching from both ends at once, and
+// then the parts before and after it are matched recursively. That keeps
+// the memory used proportional to the lengths of the sequences, rather
+// than to the square of the number of differences between them.
+//
+// The returned bool is false if the search was abandoned.
+func matchRange(a, b []int, aOffset, bOffset int, match []int) bool {
+	// Matching the common prefix and suffix directly keeps the search
+	// below small for the common case of localized changes.
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		match[aOffset] = bOffset
+		a, b = a[1:], b[1:]
+		aOffset++
+		bOffset++
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		match[aOffset+len(a)-1] = bOffset + len(b) - 1
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	x, y, ok := middleSnake(a, b)
+	if !ok {
+		// Either the two subsequences have nothing in common, or
+		// they differ by too much to keep searching.
+		return len(a)+len(b) <= maxLineEdits
+	}
+	return matchRange(a[:x], b[:y], aOffset, bOffset, match) && matchRange(a[x:], b[y:], aOffset+x, bOffset+y, match)
+}
+
+// middleSnake finds a point on an optimal edit path between the two
+// sequences where the forward and reverse searches meet.
+//
+// The returned bool is false if the sequences have nothing in common, or if
+// no such point is found within `maxLineEdits` differences.
+func middleSnake(a, b []int) (int, int, bool) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	limit := maxD
+	if limit > maxLineEdits/2+1 {
+		limit = maxLineEdits/2 + 1
+	}
+	forward := make([]int, 2*maxD+2)
+	reverse := make([]int, 2*maxD+2)
+	for i := range forward {
+		forward[i] = -1
+		reverse[i] = -1
+	}
+	forward[offset+1] = 0
+	reverse[offset+1] = 0
+	delta := n - m
+	// If the difference in lengths is odd, then the forward search is
+	// the one that reaches the overlap first.
+	front := delta%2 != 0
+	// These trim the diagonals that have run off the edge of the grid.
+	var fStart, fEnd, rStart, rEnd int
+	for d := 0; d < limit; d++ {
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			if x > n {
+				fEnd += 2
+			} else if y > m {
+				fStart += 2
+			} else if front {
+				if rk := offset + delta - k; rk >= 0 && rk < len(reverse) && reverse[rk] != -1 && x >= n-reverse[rk] {
+					return x, y, true
+				}
+			}
+		}
+		for k := -d + rStart; k <= d-rEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && reverse[offset+k-1] < reverse[offset+k+1]) {
+				x = reverse[offset+k+1]
+			} else {
+				x = reverse[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			reverse[offset+k] = x
+			if x > n {
+				rEnd += 2
+			} else if y > m {
+				rStart += 2
+			} else if !front {
+				if fk := offset + delta - k; fk >= 0 && fk < len(forward) && forward[fk] != -1 {
+					if fx := forward[fk]; fx >= n-x {
+						return fx, fx - (fk - offset), true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func equalLines(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func writeLines(out *bytes.Buffer, lines [][]byte, terminate bool) {
+	for _, line := range lines {
+		out.Write(line)
+	}
+	if terminate && out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteByte('\n')
+	}
+}
+
+// mergeLines performs a three-way merge of the lines of `src` and `dest`,
+// using `base` as their common ancestor.
+//
+// Regions that only changed on one side take that side's changes. If both
+// sides changed the same region differently, then that is a conflict. When
+// `union` is true, conflicts are resolved by keeping the destination lines
+// followed by the source lines. Otherwise, the conflicting region is written
+// with `diff3`-style conflict markers, and the returned bool is false.
+//
+// If either side changed too much of the base for their lines to be matched
+// up, then `errTooManyChanges` is returned.
+func mergeLines(base, src, dest []byte, union bool) ([]byte, bool, error) {
+	ids := make(map[string]int)
+	intern := func(lines [][]byte) []int {
+		result := make([]int, len(lines))
+		for i, line := range lines {
+			id, ok := ids[string(line)]
+			if !ok {
+				id = len(ids)
+				ids[string(line)] = id
+			}
+			result[i] = id
+		}
+		return result
+	}
+	baseLines, srcLines, destLines := splitLines(base), splitLines(src), splitLines(dest)
+	baseIDs := intern(baseLines)
+	srcMatch, srcOK := matchLines(baseIDs, intern(srcLines))
+	destMatch, destOK := matchLines(baseIDs, intern(destLines))
+	if !srcOK || !destOK {
+		return nil, false, errTooManyChanges
+	}
+
+	var out bytes.Buffer
+	clean := true
+	var i, s, d int
+	for {
+		// Find the next base line that is unchanged on both sides...
+		nextI := i
+		for nextI < len(baseLines) && (srcMatch[nextI] < 0 || destMatch[nextI] < 0) {
+			nextI++
+		}
+		nextS, nextD := len(srcLines), len(destLines)
+		if nextI < len(baseLines) {
+			nextS, nextD = srcMatch[nextI], destMatch[nextI]
+		}
+		// ... and then merge the changed region before it.
+		baseChunk, srcChunk, destChunk := baseLines[i:nextI], srcLines[s:nextS], destLines[d:nextD]
+		switch {
+		case equalLines(srcChunk, baseChunk):
+			writeLines(&out, destChunk, false)
+		case equalLines(destChunk, baseChunk), equalLines(srcChunk, destChunk):
+			writeLines(&out, srcChunk, false)
+		case union:
+			writeLines(&out, destChunk, true)
+			writeLines(&out, srcChunk, false)
+		default:
+			clean = false
+			writeLines(&out, nil, true)
+			out.WriteString(srcMarker)
+			writeLines(&out, srcChunk, true)
+			out.WriteString(baseMarker)
+			writeLines(&out, baseChunk, true)
+			out.WriteString(sepMarker)
+			writeLines(&out, destChunk, true)
+			out.WriteString(destMarker)
+		}
+		if nextI >= len(baseLines) {
+			return out.Bytes(), clean, nil
+		}
+		out.Write(baseLines[nextI])
+		i, s, d = nextI+1, nextS+1, nextD+1
+	}
+}
+
+func tooLargeConflict(p snapshot.Path, base, src, dest *snapshot.Hash) error {
+	return conflict(p, base, src, dest, fmt.Sprintf("the file %q is too large to merge line by line, so the two snapshots for that path have to be manually merged", p))
+}
+
+// mergeText merges the contents of two files line by line, without
+// relying on any external tools.
+//
+// Files larger than `maxTextMergeSize`, or whose lines differ too much
+// from the base to be matched up, are reported as conflicts without any
+// conflict markers.
+func mergeText(ctx context.Context, s *storage.LocalFiles, p snapshot.Path, mode string, srcFile, destFile *snapshot.File, base, src, dest *snapshot.Hash, union bool) (*snapshot.Hash, error) {
+	if srcFile.IsDir() || destFile.IsDir() || srcFile.IsLink() || destFile.IsLink() {
+		return nil, fmt.Errorf("internal error: the path %q is not a regular file in both the source and destination snapshots", p)
+	}
+	var baseContents []byte
+	if base != nil {
+		baseFile, err := s.ReadSnapshot(ctx, base)
+		if err != nil {
+			return nil, fmt.Errorf("failure reading the file snapshot for %q: %v", base, err)
+		}
+		if !baseFile.IsDir() {
+			if baseContents, err = readTextContents(ctx, s, baseFile); errors.Is(err, errTooLarge) {
+				return dest, tooLargeConflict(p, base, src, dest)
+			} else if err != nil {
+				return nil, fmt.Errorf("failure reading the base contents of %q: %v", p, err)
+			}
+		}
+	}
+	srcContents, err := readTextContents(ctx, s, srcFile)
+	if errors.Is(err, errTooLarge) {
+		return dest, tooLargeConflict(p, base, src, dest)
+	} else if err != nil {
+		return nil, fmt.Errorf("failure reading the source contents of %q: %v", p, err)
+	}
+	destContents, err := readTextContents(ctx, s, destFile)
+	if errors.Is(err, errTooLarge) {
+		return dest, tooLargeConflict(p, base, src, dest)
+	} else if err != nil {
+		return nil, fmt.Errorf("failure reading the destination contents of %q: %v", p, err)
+	}
+	if isBinary(baseContents) || isBinary(srcContents) || isBinary(destContents) {
+		return dest, conflict(p, base, src, dest, fmt.Sprintf("the binary file %q was changed in both the source and destination snapshots, so the two snapshots for that path have to be manually merged", p))
+	}
+	merged, clean, err := mergeLines(baseContents, srcContents, destContents, union)
+	if errors.Is(err, errTooManyChanges) {
+		return dest, conflict(p, base, src, dest, fmt.Sprintf("the file %q was changed too extensively in the source or destination snapshot to be merged line by line, so the two snapshots for that path have to be manually merged", p))
+	}
+	if clean {
+		return storeMergedFile(ctx, s, mode, merged, src, dest)
+	}
+	markersHash, err := s.StoreObject(ctx, int64(len(merged)), bytes.NewReader(merged))
+	if err != nil {
+		return nil, fmt.Errorf("failure storing the conflict markers for %q: %v", p, err)
+	}
+	c := conflict(p, base, src, dest, fmt.Sprintf("the file %q has conflicting changes in the source and destination snapshots, so the two snapshots for that path have to be manually merged", p))
+	c.Conflicts[0].Merged = markersHash
+	return dest, c
+}
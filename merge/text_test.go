@@ -0,0 +1,175 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package merge defines methods for merging two snapshots together.
+package merge
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func lcsLength(a, b []int) int {
+	table := make([][]int, len(a)+1)
+	for i := range table {
+		table[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				table[i][j] = table[i+1][j+1] + 1
+			} else if table[i+1][j] > table[i][j+1] {
+				table[i][j] = table[i+1][j]
+			} else {
+				table[i][j] = table[i][j+1]
+			}
+		}
+	}
+	return table[0][0]
+}
+
+func TestMatchLines(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for iteration := 0; iteration < 200; iteration++ {
+		a := make([]int, r.Intn(20))
+		for i := range a {
+			a[i] = r.Intn(4)
+		}
+		b := make([]int, r.Intn(20))
+		for i := range b {
+			b[i] = r.Intn(4)
+		}
+		match, ok := matchLines(a, b)
+		if !ok {
+			t.Fatalf("abandoned matching %v and %v", a, b)
+		}
+		var matched int
+		prev := -1
+		for i, j := range match {
+			if j < 0 {
+				continue
+			}
+			if j <= prev {
+				t.Fatalf("non-monotonic match for %v and %v: %v", a, b, match)
+			}
+			if a[i] != b[j] {
+				t.Fatalf("mismatched lines matched for %v and %v: %v", a, b, match)
+			}
+			prev = j
+			matched++
+		}
+		if got, want := matched, lcsLength(a, b); got != want {
+			t.Errorf("unexpected number of matched lines for %v and %v: got %d, want %d", a, b, got, want)
+		}
+	}
+}
+
+func TestMergeLines(t *testing.T) {
+	testCases := []struct {
+		Description string
+		Base        string
+		Src         string
+		Dest        string
+		Union       bool
+		Want        string
+		WantClean   bool
+	}{
+		{
+			Description: "non-conflicting insertions",
+			Base:        "A\nB\nC\nD\nE\n",
+			Src:         "A\nX\nB\nY\nC\nD\nE\n",
+			Dest:        "A\nB\nC\nZ\nD\nE\n",
+			Want:        "A\nX\nB\nY\nC\nZ\nD\nE\n",
+			WantClean:   true,
+		},
+		{
+			Description: "non-conflicting deletions",
+			Base:        "A\nB\nC\nD\nE\n",
+			Src:         "B\nC\nD\nE\n",
+			Dest:        "A\nB\nC\nD\n",
+			Want:        "B\nC\nD\n",
+			WantClean:   true,
+		},
+		{
+			Description: "identical changes",
+			Base:        "A\nB\nC\n",
+			Src:         "A\nX\nC\n",
+			Dest:        "A\nX\nC\n",
+			Want:        "A\nX\nC\n",
+			WantClean:   true,
+		},
+		{
+			Description: "conflicting changes",
+			Base:        "A\nB\nC\n",
+			Src:         "A\nX\nC\n",
+			Dest:        "A\nY\nC\n",
+			Want:        "A\n<<<<<<< src\nX\n||||||| base\nB\n=======\nY\n>>>>>>> dest\nC\n",
+			WantClean:   false,
+		},
+		{
+			Description: "conflicting changes without trailing newlines",
+			Base:        "A\nB",
+			Src:         "A\nX",
+			Dest:        "A\nY",
+			Want:        "A\n<<<<<<< src\nX\n||||||| base\nB\n=======\nY\n>>>>>>> dest\n",
+			WantClean:   false,
+		},
+		{
+			Description: "unrelated files",
+			Base:        "",
+			Src:         "A\n",
+			Dest:        "B\n",
+			Want:        "<<<<<<< src\nA\n||||||| base\n=======\nB\n>>>>>>> dest\n",
+			WantClean:   false,
+		},
+		{
+			Description: "union of conflicting changes",
+			Base:        "A\nB\nC\n",
+			Src:         "A\nX\nC\n",
+			Dest:        "A\nY\nC\n",
+			Union:       true,
+			Want:        "A\nY\nX\nC\n",
+			WantClean:   true,
+		},
+	}
+	for _, testCase := range testCases {
+		got, gotClean, err := mergeLines([]byte(testCase.Base), []byte(testCase.Src), []byte(testCase.Dest), testCase.Union)
+		if err != nil {
+			t.Errorf("failure merging %s: %v", testCase.Description, err)
+			continue
+		}
+		if string(got) != testCase.Want {
+			t.Errorf("unexpected result merging %s: got %q, want %q", testCase.Description, string(got), testCase.Want)
+		}
+		if gotClean != testCase.WantClean {
+			t.Errorf("unexpected clean result merging %s: got %v, want %v", testCase.Description, gotClean, testCase.WantClean)
+		}
+	}
+}
+
+func TestMergeLinesTooManyChanges(t *testing.T) {
+	var base, src, dest strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&base, "line %d\n", i)
+		fmt.Fprintf(&src, "rewritten line %d\n", i)
+		fmt.Fprintf(&dest, "line %d\n", i)
+	}
+	dest.WriteString("appended line\n")
+	if _, _, err := mergeLines([]byte(base.String()), []byte(src.String()), []byte(dest.String()), false); !errors.Is(err, errTooManyChanges) {
+		t.Errorf("unexpected result merging a rewritten file: got %v, want %v", err, errTooManyChanges)
+	}
+}
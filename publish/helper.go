@@ -18,6 +18,7 @@ package publish
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 
@@ -34,6 +35,12 @@ import (
 // of a snapshot, then this method returns that hash. Otherwise, this returns
 // an error.
 func runHelper(ctx context.Context, cmd, namespace string, args []string) (*snapshot.Hash, error) {
+	return runHelperWithOutput(ctx, os.Stdout, cmd, namespace, args)
+}
+
+// runHelperWithOutput runs the specified helper, forwarding its standard
+// output to the given writer.
+func runHelperWithOutput(ctx context.Context, stdout io.Writer, cmd, namespace string, args []string) (*snapshot.Hash, error) {
 	helperCommand := fmt.Sprintf("rvcs-%s-%s", cmd, namespace)
 	outFile, err := os.CreateTemp("", helperCommand+"*")
 	if err != nil {
@@ -44,7 +51,7 @@ func runHelper(ctx context.Context, cmd, namespace string, args []string) (*snap
 	args = append(args, outFile.Name())
 	helper := exec.CommandContext(ctx, helperCommand, args...)
 	helper.Stdin = os.Stdin
-	helper.Stdout = os.Stdout
+	helper.Stdout = stdout
 	helper.Stderr = os.Stderr
 	if err := helper.Run(); err != nil {
 		return nil, fmt.Errorf("failure running the helper command %q: %v", helperCommand, err)
@@ -19,6 +19,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
 
 	"github.com/google/recursive-version-control-system/snapshot"
 	"github.com/google/recursive-version-control-system/storage"
@@ -42,3 +43,28 @@ func Sign(ctx context.Context, s *storage.LocalFiles, id *snapshot.Identity, h *
 	}
 	return h, nil
 }
+
+// SignDetached signs the given hash as the given identity without recording
+// the resulting signature as the latest one for that identity.
+//
+// This is used for signatures that are distributed along with the signed
+// data, such as the signatures of bundles. The output of the sign helper is
+// redirected to standard error so that it cannot interleave with any data
+// being written to standard output.
+func SignDetached(ctx context.Context, id *snapshot.Identity, h *snapshot.Hash) (*snapshot.Hash, error) {
+	if id == nil {
+		return nil, errors.New("identity must not be nil")
+	}
+	if h == nil {
+		return nil, errors.New("hash must not be nil")
+	}
+	args := []string{id.String(), h.String(), ""}
+	sig, err := runHelperWithOutput(ctx, os.Stderr, "sign", id.Algorithm(), args)
+	if err != nil {
+		return nil, fmt.Errorf("failure invoking the sign helper for %q: %v", id.Algorithm(), err)
+	}
+	if sig == nil {
+		return nil, fmt.Errorf("the sign helper for %q did not produce a signature", id.Algorithm())
+	}
+	return sig, nil
+}
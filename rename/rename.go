@@ -0,0 +1,255 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rename defines methods for detecting files that were moved.
+package rename
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+const (
+	// DefaultThreshold is the default minimum similarity, as a
+	// percentage, for a deleted and an added file to be considered
+	// a rename.
+	DefaultThreshold = 50
+
+	// maxCandidates limits how many deleted or added files are compared
+	// by content similarity, since every pair has to be compared.
+	maxCandidates = 1000
+
+	// maxSize limits the size of files that are compared by content
+	// similarity.
+	maxSize = 1 << 20
+)
+
+type candidate struct {
+	path  string
+	file  *snapshot.File
+	lines map[string]int
+	count int
+}
+
+func readCandidates(ctx context.Context, s *storage.LocalFiles, paths map[string]*snapshot.Hash) ([]*candidate, error) {
+	var result []*candidate
+	for p, h := range paths {
+		if h == nil {
+			continue
+		}
+		f, err := s.ReadSnapshot(ctx, h)
+		if err != nil {
+			return nil, fmt.Errorf("failure reading the file snapshot for %q: %v", h, err)
+		}
+		if f.IsDir() {
+			continue
+		}
+		result = append(result, &candidate{path: p, file: f})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].path < result[j].path
+	})
+	return result, nil
+}
+
+// sameType reports whether or not the two files are of the same type, e.g.
+// both regular files or both symbolic links.
+func sameType(lhs, rhs *snapshot.File) bool {
+	return lhs.IsLink() == rhs.IsLink()
+}
+
+func (c *candidate) readLines(ctx context.Context, s *storage.LocalFiles) (bool, error) {
+	if c.lines != nil {
+		return true, nil
+	}
+	if c.file.IsLink() || c.file.Contents == nil {
+		return false, nil
+	}
+	r, err := s.ReadObject(ctx, c.file.Contents)
+	if err != nil {
+		return false, fmt.Errorf("failure opening the contents of %q: %v", c.path, err)
+	}
+	defer r.Close()
+	contents, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return false, fmt.Errorf("failure reading the contents of %q: %v", c.path, err)
+	}
+	if len(contents) > maxSize {
+		return false, nil
+	}
+	c.lines = make(map[string]int)
+	for len(contents) > 0 {
+		line := contents
+		if i := bytes.IndexByte(contents, '\n'); i >= 0 {
+			line = contents[:i+1]
+		}
+		c.lines[string(line)]++
+		c.count++
+		contents = contents[len(line):]
+	}
+	return true, nil
+}
+
+// similarity returns the percentage of lines shared by the two files.
+func similarity(lhs, rhs *candidate) int {
+	if lhs.count+rhs.count == 0 {
+		return 100
+	}
+	var common int
+	for line, count := range lhs.lines {
+		if other := rhs.lines[line]; other < count {
+			common += other
+		} else {
+			common += count
+		}
+	}
+	return 200 * common / (lhs.count + rhs.count)
+}
+
+type match struct {
+	deleted, added *candidate
+	score          int
+	sameName       bool
+}
+
+// Detect pairs up deleted files with added files that are likely to be the
+// same file after it was moved.
+//
+// Files with identical contents are paired first, preferring files with the
+// same base name. The remaining files are then paired by the percentage of
+// lines they have in common, if that is at least the given threshold. A
+// threshold greater than 100 only detects renames of identical files.
+//
+// Directories are ignored, and the returned map is from each renamed added
+// path to the corresponding deleted path.
+func Detect(ctx context.Context, s *storage.LocalFiles, deleted, added map[string]*snapshot.Hash, threshold int) (map[string]string, error) {
+	renames := make(map[string]string)
+	if len(deleted) == 0 || len(added) == 0 {
+		return renames, nil
+	}
+	deletedCandidates, err := readCandidates(ctx, s, deleted)
+	if err != nil {
+		return nil, err
+	}
+	addedCandidates, err := readCandidates(ctx, s, added)
+	if err != nil {
+		return nil, err
+	}
+
+	byContents := make(map[string][]*candidate)
+	for _, c := range deletedCandidates {
+		key := c.file.Contents.String()
+		byContents[key] = append(byContents[key], c)
+	}
+	matched := make(map[*candidate]bool)
+	var remaining []*candidate
+	for _, a := range addedCandidates {
+		var best *candidate
+		for _, d := range byContents[a.file.Contents.String()] {
+			if matched[d] || !sameType(a.file, d.file) {
+				continue
+			}
+			if best == nil || (filepath.Base(d.path) == filepath.Base(a.path) && filepath.Base(best.path) != filepath.Base(a.path)) {
+				best = d
+			}
+		}
+		if best == nil {
+			remaining = append(remaining, a)
+			continue
+		}
+		matched[best] = true
+		renames[a.path] = best.path
+	}
+
+	if threshold > 100 || len(remaining) == 0 {
+		return renames, nil
+	}
+	var remainingDeleted []*candidate
+	for _, d := range deletedCandidates {
+		if !matched[d] {
+			remainingDeleted = append(remainingDeleted, d)
+		}
+	}
+	if len(remainingDeleted) == 0 || len(remainingDeleted) > maxCandidates || len(remaining) > maxCandidates {
+		return renames, nil
+	}
+	var matches []*match
+	for _, a := range remaining {
+		if ok, err := a.readLines(ctx, s); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		for _, d := range remainingDeleted {
+			if ok, err := d.readLines(ctx, s); err != nil {
+				return nil, err
+			} else if !ok {
+				continue
+			}
+			if score := similarity(d, a); score >= threshold {
+				matches = append(matches, &match{
+					deleted:  d,
+					added:    a,
+					score:    score,
+					sameName: filepath.Base(d.path) == filepath.Base(a.path),
+				})
+			}
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].sameName && !matches[j].sameName
+	})
+	for _, m := range matches {
+		if matched[m.deleted] {
+			continue
+		}
+		if _, ok := renames[m.added.path]; ok {
+			continue
+		}
+		matched[m.deleted] = true
+		renames[m.added.path] = m.deleted.path
+	}
+	return renames, nil
+}
+
+// DetectBetween detects the files that were renamed between two listings of
+// the same directory, each of which maps nested paths to file snapshots.
+//
+// Paths that are only in `before` are treated as deleted, and paths that
+// are only in `after` as added, before pairing them up as for `Detect`.
+func DetectBetween(ctx context.Context, s *storage.LocalFiles, before, after map[string]*snapshot.Hash, threshold int) (map[string]string, error) {
+	deleted := make(map[string]*snapshot.Hash)
+	for p, h := range before {
+		if _, ok := after[p]; !ok {
+			deleted[p] = h
+		}
+	}
+	added := make(map[string]*snapshot.Hash)
+	for p, h := range after {
+		if _, ok := before[p]; !ok {
+			added[p] = h
+		}
+	}
+	return Detect(ctx, s, deleted, added, threshold)
+}
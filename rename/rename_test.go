@@ -0,0 +1,101 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rename defines methods for detecting files that were moved.
+package rename
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+	"github.com/google/recursive-version-control-system/storage"
+)
+
+func TestDetect(t *testing.T) {
+	dir := t.TempDir()
+	s := &storage.LocalFiles{ArchiveDir: filepath.Join(dir, "archive")}
+	ctx := context.Background()
+	snapshotFile := func(name, contents string) *snapshot.Hash {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(contents), 0700); err != nil {
+			t.Fatalf("failure creating the example file %q: %v", name, err)
+		}
+		h, _, err := snapshot.Current(ctx, s, snapshot.Path(p))
+		if err != nil {
+			t.Fatalf("failure snapshotting the example file %q: %v", name, err)
+		}
+		return h
+	}
+	deleted := map[string]*snapshot.Hash{
+		"a/same.txt":    snapshotFile("deleted-same.txt", "Hello, World!\n"),
+		"a/similar.txt": snapshotFile("deleted-similar.txt", "A\nB\nC\nD\nE\n"),
+		"a/gone.txt":    snapshotFile("deleted-gone.txt", "1\n2\n3\n"),
+	}
+	added := map[string]*snapshot.Hash{
+		"b/same.txt":   snapshotFile("added-same.txt", "Hello, World!\n"),
+		"b/edited.txt": snapshotFile("added-edited.txt", "A\nB\nC\nD\nX\n"),
+		"b/unrelated":  snapshotFile("added-unrelated.txt", "X\nY\nZ\n"),
+	}
+
+	renames, err := Detect(ctx, s, deleted, added, DefaultThreshold)
+	if err != nil {
+		t.Fatalf("failure detecting renames: %v", err)
+	}
+	want := map[string]string{
+		"b/same.txt":   "a/same.txt",
+		"b/edited.txt": "a/similar.txt",
+	}
+	if len(renames) != len(want) {
+		t.Errorf("unexpected renames: got %+v, want %+v", renames, want)
+	}
+	for p, previous := range want {
+		if got := renames[p]; got != previous {
+			t.Errorf("unexpected rename source for %q: got %q, want %q", p, got, previous)
+		}
+	}
+
+	exactOnly, err := Detect(ctx, s, deleted, added, 101)
+	if err != nil {
+		t.Fatalf("failure detecting exact renames: %v", err)
+	}
+	if len(exactOnly) != 1 || exactOnly["b/same.txt"] != "a/same.txt" {
+		t.Errorf("unexpected exact renames: %+v", exactOnly)
+	}
+
+	// Paths in both listings are neither deleted nor added.
+	unchanged := snapshotFile("unchanged.txt", "Hello, World!\n")
+	before := map[string]*snapshot.Hash{"c/unchanged.txt": unchanged}
+	after := map[string]*snapshot.Hash{"c/unchanged.txt": unchanged}
+	for p, h := range deleted {
+		before[p] = h
+	}
+	for p, h := range added {
+		after[p] = h
+	}
+	between, err := DetectBetween(ctx, s, before, after, DefaultThreshold)
+	if err != nil {
+		t.Fatalf("failure detecting renames between the listings: %v", err)
+	}
+	if len(between) != len(want) {
+		t.Errorf("unexpected renames between the listings: got %+v, want %+v", between, want)
+	}
+	for p, previous := range want {
+		if got := between[p]; got != previous {
+			t.Errorf("unexpected rename source between the listings for %q: got %q, want %q", p, got, previous)
+		}
+	}
+}
@@ -30,6 +30,19 @@ var (
 	}
 )
 
+// DefaultHashFunction returns the name of the hash function used for newly
+// created hashes.
+func DefaultHashFunction() string {
+	return defaultHashFunction
+}
+
+// IsSupportedHashFunction reports whether or not hashes using the named
+// hash function can be parsed.
+func IsSupportedHashFunction(name string) bool {
+	_, ok := supportedHashFunctions[name]
+	return ok
+}
+
 // Hash represents a hash/fingerprint of a blob.
 type Hash struct {
 	// function is the name of the hash function used (e.g. `sha256`, etc).
@@ -55,6 +55,32 @@ type Storage interface {
 	PathInfoMatchesCache(context.Context, Path, os.FileInfo) bool
 }
 
+// SparseStorage is implemented by storage that supports sparse checkouts.
+//
+// This is optional, and storage that does not implement it is treated as
+// having no sparse checkouts.
+type SparseStorage interface {
+	Storage
+
+	// SparsePatterns returns the patterns of the sparse checkout rooted
+	// at the given path, which are empty if the path is not the root of
+	// a sparse checkout.
+	SparsePatterns(context.Context, Path) (SparsePatterns, error)
+
+	// FindSparsePatterns returns the root and the patterns of the
+	// innermost sparse checkout containing the given path, which are
+	// empty if the path is not part of a sparse checkout.
+	FindSparsePatterns(context.Context, Path) (Path, SparsePatterns, error)
+
+	// Unmaterialized returns the snapshots of any children of the given
+	// directory that were intentionally left out of the local filesystem
+	// by the sparse checkout with the given root and patterns.
+	//
+	// These children are kept in new snapshots of the directory rather
+	// than being treated as deleted.
+	Unmaterialized(ctx context.Context, p, root Path, patterns SparsePatterns) (Tree, error)
+}
+
 func snapshotFileMetadata(ctx context.Context, s Storage, p Path, info os.FileInfo, contentsHash *Hash) (*Hash, *File, error) {
 	modeLine := info.Mode().String()
 	// 这里是寻找这个文件之前的Hash
@@ -129,7 +155,7 @@ func snapshotRegularFile(ctx context.Context, s Storage, p Path, info os.FileInf
 	return snapshotFileMetadata(ctx, s, p, info, h)
 }
 
-func snapshotDirectory(ctx context.Context, s Storage, p Path, info os.FileInfo, contents *os.File) (*Hash, *File, error) {
+func snapshotDirectory(ctx context.Context, s Storage, p Path, info os.FileInfo, contents *os.File, sparse *sparseCheckout) (*Hash, *File, error) {
 	entries, err := contents.ReadDir(0)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failure reading the filesystem contents of the directory %q: %v", p, err)
@@ -137,7 +163,13 @@ func snapshotDirectory(ctx context.Context, s Storage, p Path, info os.FileInfo,
 	childHashes := make(Tree)
 	for _, entry := range entries {
 		childPath := Path(filepath.Join(string(p), entry.Name()))
-		childHash, _, err := Current(ctx, s, childPath)
+		childSparse := sparse
+		if entry.IsDir() {
+			if childSparse, err = sparse.forDir(ctx, s, childPath); err != nil {
+				return nil, nil, err
+			}
+		}
+		childHash, _, err := current(ctx, s, childPath, childSparse)
 		if err != nil {
 			return nil, nil, fmt.Errorf("failure hashing the child dir %q: %v", childPath, err)
 		}
@@ -145,6 +177,17 @@ func snapshotDirectory(ctx context.Context, s Storage, p Path, info os.FileInfo,
 			childHashes[Path(entry.Name())] = childHash
 		}
 	}
+	if ss, ok := s.(SparseStorage); ok {
+		unmaterialized, err := ss.Unmaterialized(ctx, p, sparse.root, sparse.patterns)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failure reading the unmaterialized contents of the directory %q: %v", p, err)
+		}
+		for child, childHash := range unmaterialized {
+			if _, ok := childHashes[child]; !ok {
+				childHashes[child] = childHash
+			}
+		}
+	}
 	contentsJson := []byte(childHashes.String())
 	contentsHash, err := s.StoreObject(ctx, int64(len(contentsJson)), bytes.NewReader(contentsJson))
 	return snapshotFileMetadata(ctx, s, p, info, contentsHash)
@@ -169,6 +212,23 @@ func snapshotLink(ctx context.Context, s Storage, p Path, info os.FileInfo) (*Ha
 //
 // The returned value is the hash of the generated `snapshot.File` object.
 func Current(ctx context.Context, s Storage, p Path) (*Hash, *File, error) {
+	if s.Exclude(p) {
+		return nil, nil, nil
+	}
+	// The sparse checkout containing the path is looked up once, and
+	// then only nested sparse checkouts are checked for.
+	sparse := &sparseCheckout{}
+	if ss, ok := s.(SparseStorage); ok {
+		root, patterns, err := ss.FindSparsePatterns(ctx, p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failure finding the sparse checkout containing %q: %v", p, err)
+		}
+		sparse = &sparseCheckout{root: root, patterns: patterns}
+	}
+	return current(ctx, s, p, sparse)
+}
+
+func current(ctx context.Context, s Storage, p Path, sparse *sparseCheckout) (*Hash, *File, error) {
 	if s.Exclude(p) {
 		// 我们不应该为给定路径存储快照，所以假装它不存在。
 		// 本地文件系统实现的Storage解决的是不跟 ~/.rvcs/archive冲突
@@ -207,7 +267,7 @@ func Current(ctx context.Context, s Storage, p Path) (*Hash, *File, error) {
 		return nil, nil, fmt.Errorf("failure reading the filesystem metadata for %q: %v", p, err)
 	}
 	if info.IsDir() {
-		return snapshotDirectory(ctx, s, p, info, contents)
+		return snapshotDirectory(ctx, s, p, info, contents, sparse)
 	} else {
 		return snapshotRegularFile(ctx, s, p, info, contents)
 	}
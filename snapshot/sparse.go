@@ -0,0 +1,115 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SparsePatterns selects which nested paths of a directory are materialized
+// on the local filesystem by a sparse checkout.
+//
+// Each pattern is a slash-separated path relative to the directory, and
+// each element of the pattern may use the syntax of `path.Match`. A nested
+// path is materialized if it, or one of its parent directories, matches a
+// pattern, or if it is a parent directory of a path that does.
+//
+// An empty set of patterns materializes every nested path.
+type SparsePatterns []string
+
+// Validate reports an error if any of the patterns are malformed.
+func (ps SparsePatterns) Validate() error {
+	for _, pattern := range ps {
+		if len(pattern) == 0 || path.IsAbs(pattern) {
+			return fmt.Errorf("sparse patterns must be non-empty relative paths: %q", pattern)
+		}
+		for _, elem := range strings.Split(path.Clean(pattern), "/") {
+			if elem == ".." {
+				return fmt.Errorf("sparse patterns cannot refer to parent directories: %q", pattern)
+			}
+			if _, err := path.Match(elem, ""); err != nil {
+				return fmt.Errorf("malformed sparse pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Includes reports whether or not the given path, relative to the root of
+// the sparse checkout, should be materialized.
+func (ps SparsePatterns) Includes(rel Path) bool {
+	if len(ps) == 0 {
+		return true
+	}
+	cleaned := filepath.ToSlash(filepath.Clean(string(rel)))
+	if cleaned == "." {
+		return true
+	}
+	elems := strings.Split(cleaned, "/")
+	for _, pattern := range ps {
+		pattern = path.Clean(pattern)
+		if pattern == "." {
+			return true
+		}
+		if matchElements(strings.Split(pattern, "/"), elems) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchElements reports whether or not the leading elements of the given
+// pattern and path match each other, meaning that the path either matches
+// the pattern, is nested under a match, or is a parent of a match.
+func matchElements(patternElems, elems []string) bool {
+	for i := 0; i < len(patternElems) && i < len(elems); i++ {
+		if matched, err := path.Match(patternElems[i], elems[i]); err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// sparseCheckout is the innermost sparse checkout containing a path that
+// is being snapshotted.
+//
+// The root and patterns are empty if the path is not part of a sparse
+// checkout.
+type sparseCheckout struct {
+	root     Path
+	patterns SparsePatterns
+}
+
+// forDir returns the innermost sparse checkout containing the given
+// nested directory, which is either the directory itself or the sparse
+// checkout containing its parent.
+func (sc *sparseCheckout) forDir(ctx context.Context, s Storage, dir Path) (*sparseCheckout, error) {
+	ss, ok := s.(SparseStorage)
+	if !ok {
+		return sc, nil
+	}
+	patterns, err := ss.SparsePatterns(ctx, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the sparse checkout patterns for %q: %v", dir, err)
+	}
+	if len(patterns) == 0 {
+		return sc, nil
+	}
+	return &sparseCheckout{root: dir, patterns: patterns}, nil
+}
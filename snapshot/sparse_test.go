@@ -0,0 +1,53 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"testing"
+)
+
+func TestSparsePatterns(t *testing.T) {
+	patterns := SparsePatterns{"docs", "src/*/main.go"}
+	testCases := []struct {
+		Path Path
+		Want bool
+	}{
+		{".", true},
+		{"docs", true},
+		{"docs/nested/file.txt", true},
+		{"src", true},
+		{"src/cmd", true},
+		{"src/cmd/main.go", true},
+		{"src/cmd/other.go", false},
+		{"README.md", false},
+		{"documents", false},
+	}
+	for _, tc := range testCases {
+		if got, want := patterns.Includes(tc.Path), tc.Want; got != want {
+			t.Errorf("unexpected result for %q: got %v, want %v", tc.Path, got, want)
+		}
+	}
+	if !(SparsePatterns{}).Includes("anything") {
+		t.Errorf("empty sparse patterns should include every path")
+	}
+	if err := patterns.Validate(); err != nil {
+		t.Errorf("unexpected error validating %+v: %v", patterns, err)
+	}
+	for _, invalid := range []SparsePatterns{{""}, {"/abs"}, {"../parent"}, {"bad["}} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("unexpected success validating %+v", invalid)
+		}
+	}
+}
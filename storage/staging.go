@@ -0,0 +1,243 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storage defines the persistent storage of snapshots.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/recursive-version-control-system/snapshot"
+)
+
+const stagingDir = "staging"
+
+// Staging is an area of the archive that holds objects until they are
+// published into the archive all together.
+//
+// Staged objects are stored the same way as the objects of the archive,
+// including encrypting large objects with the archive's identity, but they
+// cannot be read until they are published.
+type Staging struct {
+	s    *LocalFiles
+	name string
+}
+
+// Staging returns the staging area with the given name, creating it if it
+// does not already exist.
+//
+// An existing staging area may still hold objects from an earlier use that
+// was interrupted before they were published.
+func (s *LocalFiles) Staging(name string) (*Staging, error) {
+	if len(name) == 0 || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid staging area name %q", name)
+	}
+	st := &Staging{s: s, name: name}
+	if err := os.MkdirAll(st.Dir(), os.FileMode(0700)); err != nil {
+		return nil, fmt.Errorf("failure creating the staging area %q: %v", name, err)
+	}
+	return st, nil
+}
+
+// NewStaging creates a new staging area with a unique name starting with
+// the given prefix.
+func (s *LocalFiles) NewStaging(prefix string) (*Staging, error) {
+	parent := filepath.Join(s.ArchiveDir, stagingDir)
+	if err := os.MkdirAll(parent, os.FileMode(0700)); err != nil {
+		return nil, fmt.Errorf("failure creating the staging dir: %v", err)
+	}
+	dir, err := os.MkdirTemp(parent, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failure creating a staging area: %v", err)
+	}
+	return &Staging{s: s, name: filepath.Base(dir)}, nil
+}
+
+func (st *Staging) subpath() string {
+	return filepath.Join(stagingDir, st.name)
+}
+
+// Dir returns the directory of the staging area.
+//
+// Callers may keep their own files in this directory, as long as they are
+// not named after the subdirectories used for objects.
+func (st *Staging) Dir() string {
+	return filepath.Join(st.s.ArchiveDir, st.subpath())
+}
+
+// StoreObject stores the given object in the staging area.
+func (st *Staging) StoreObject(ctx context.Context, size int64, reader io.Reader) (*snapshot.Hash, error) {
+	return st.s.storeObject(ctx, st.subpath(), size, reader)
+}
+
+// objectPaths returns the paths where the given object may be staged.
+func (st *Staging) objectPaths(h *snapshot.Hash) []string {
+	var paths []string
+	for _, sub := range []struct {
+		dir       string
+		encrypted bool
+	}{{smallObjectStorageDir, false}, {largeObjectStorageDir, true}} {
+		objPath, objName := objectName(h, filepath.Join(st.Dir(), sub.dir), sub.encrypted)
+		paths = append(paths, filepath.Join(objPath, objName))
+	}
+	return paths
+}
+
+// HasObject reports whether or not the given object is staged.
+func (st *Staging) HasObject(ctx context.Context, h *snapshot.Hash) bool {
+	for _, p := range st.objectPaths(h) {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyObject reports whether or not the given object is staged with
+// contents that match its hash.
+//
+// Staged objects are not synced to disk, so this is used to check objects
+// staged before an interruption. An object that does not match is removed
+// so that it can be staged again.
+func (st *Staging) VerifyObject(ctx context.Context, h *snapshot.Hash) bool {
+	if !st.HasObject(ctx, h) {
+		return false
+	}
+	rc, err := st.s.readObject(ctx, st.subpath(), h)
+	if err == nil {
+		got, hashErr := snapshot.NewHash(rc)
+		rc.Close()
+		if hashErr == nil && got.Equal(h) {
+			return true
+		}
+	}
+	st.RemoveObject(ctx, h)
+	return false
+}
+
+// RemoveObject removes the given object from the staging area, if it is
+// staged.
+func (st *Staging) RemoveObject(ctx context.Context, h *snapshot.Hash) error {
+	for _, p := range st.objectPaths(h) {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failure removing the staged object %q: %v", h, err)
+		}
+	}
+	return nil
+}
+
+// Publish moves every staged object into the archive.
+//
+// Each object is moved atomically, so if publishing is interrupted then it
+// can be safely retried.
+func (st *Staging) Publish(ctx context.Context) error {
+	for _, sub := range []string{smallObjectStorageDir, largeObjectStorageDir} {
+		root := filepath.Join(st.Dir(), sub)
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) && p == root {
+				// Nothing of this size was staged.
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if d.Name() == tmpFileDir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			dest := filepath.Join(st.s.ArchiveDir, sub, rel)
+			if err := os.MkdirAll(filepath.Dir(dest), os.FileMode(0700)); err != nil {
+				return err
+			}
+			return os.Rename(p, dest)
+		})
+		if err != nil {
+			return fmt.Errorf("failure publishing the staged objects in %q: %v", root, err)
+		}
+	}
+	return nil
+}
+
+// PublishObjects moves the given staged objects into the archive ahead of
+// the rest of the staging area, so that they can be read by external tools
+// such as the verify helpers for signatures.
+//
+// The returned function moves the objects back into the staging area, and
+// must be called once they no longer need to be read. Objects that are not
+// staged, or that are already in the archive, are left as they are.
+func (st *Staging) PublishObjects(ctx context.Context, hashes []*snapshot.Hash) (withdraw func() error, err error) {
+	type move struct {
+		staged, published string
+	}
+	var moves []move
+	withdraw = func() error {
+		var errs []string
+		for _, m := range moves {
+			if err := os.Rename(m.published, m.staged); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		moves = nil
+		if len(errs) > 0 {
+			return fmt.Errorf("failure withdrawing the published objects: %s", strings.Join(errs, "; "))
+		}
+		return nil
+	}
+	for _, h := range hashes {
+		for _, sub := range []struct {
+			dir       string
+			encrypted bool
+		}{{smallObjectStorageDir, false}, {largeObjectStorageDir, true}} {
+			stagedPath, stagedName := objectName(h, filepath.Join(st.Dir(), sub.dir), sub.encrypted)
+			publishedPath, publishedName := objectName(h, filepath.Join(st.s.ArchiveDir, sub.dir), sub.encrypted)
+			m := move{
+				staged:    filepath.Join(stagedPath, stagedName),
+				published: filepath.Join(publishedPath, publishedName),
+			}
+			if _, err := os.Stat(m.staged); err != nil {
+				continue
+			}
+			if _, err := os.Stat(m.published); err == nil {
+				continue
+			}
+			if err := os.MkdirAll(publishedPath, os.FileMode(0700)); err != nil {
+				withdraw()
+				return nil, fmt.Errorf("failure creating the object dir for %q: %v", h, err)
+			}
+			if err := os.Rename(m.staged, m.published); err != nil {
+				withdraw()
+				return nil, fmt.Errorf("failure publishing the staged object %q: %v", h, err)
+			}
+			moves = append(moves, m)
+		}
+	}
+	return withdraw, nil
+}
+
+// Remove removes the staging area along with anything left in it.
+func (st *Staging) Remove() error {
+	return os.RemoveAll(st.Dir())
+}
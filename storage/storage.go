@@ -23,6 +23,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -36,6 +37,7 @@ const (
 	smallObjectStorageDir = "objects"
 	largeObjectStorageDir = "largeObjects"
 	localIdentityFile     = "x25519Identity"
+	tmpFileDir            = "staging-dir"
 )
 
 // LocalFiles implementes the `snapshot.Storage` interface using the local file system.
@@ -87,8 +89,25 @@ func (s *LocalFiles) recipient() (*age.X25519Recipient, error) {
 	return identity.Recipient(), nil
 }
 
+// Recipient returns the age recipient for the local identity of the archive.
+//
+// Data encrypted to this recipient can only be decrypted using this archive.
+func (s *LocalFiles) Recipient() (*age.X25519Recipient, error) {
+	return s.recipient()
+}
+
+// Decrypt returns a reader for the plaintext of the given age-encrypted
+// reader, using the local identity of the archive.
+func (s *LocalFiles) Decrypt(reader io.Reader) (io.Reader, error) {
+	identity, err := s.identity()
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the local identity: %w", err)
+	}
+	return age.Decrypt(reader, identity)
+}
+
 func (s *LocalFiles) tmpFile(ctx context.Context, subpath string) (*os.File, error) {
-	tmpDir := filepath.Join(s.ArchiveDir, subpath, "staging-dir")
+	tmpDir := filepath.Join(s.ArchiveDir, subpath, tmpFileDir)
 	if err := os.MkdirAll(tmpDir, os.FileMode(0700)); err != nil {
 		return nil, fmt.Errorf("failure creating the tmp dir: %v", err)
 	}
@@ -104,11 +123,17 @@ func (s *LocalFiles) objectStoragePath(ctx context.Context, objectsSubDir string
 }
 
 func (s *LocalFiles) StoreObject(ctx context.Context, size int64, reader io.Reader) (h *snapshot.Hash, err error) {
+	return s.storeObject(ctx, "", size, reader)
+}
+
+// storeObject stores an object under the given subpath of the archive
+// directory, which is empty for objects stored directly in the archive.
+func (s *LocalFiles) storeObject(ctx context.Context, subpath string, size int64, reader io.Reader) (h *snapshot.Hash, err error) {
 	var tmp *os.File
 	var encrypted bool
-	objectsSubDir := smallObjectStorageDir
+	objectsSubDir := filepath.Join(subpath, smallObjectStorageDir)
 	if size > 1024*1024 {
-		objectsSubDir = largeObjectStorageDir
+		objectsSubDir = filepath.Join(subpath, largeObjectStorageDir)
 		encrypted = true
 	}
 	tmp, err = s.tmpFile(ctx, objectsSubDir)
@@ -196,17 +221,23 @@ func (s *LocalFiles) decryptingReader(reader io.ReadCloser) (io.ReadCloser, erro
 }
 
 func (s *LocalFiles) ReadObject(ctx context.Context, h *snapshot.Hash) (io.ReadCloser, error) {
+	return s.readObject(ctx, "", h)
+}
+
+// readObject reads an object stored under the given subpath of the archive
+// directory, which is empty for objects stored directly in the archive.
+func (s *LocalFiles) readObject(ctx context.Context, subpath string, h *snapshot.Hash) (io.ReadCloser, error) {
 	if h == nil {
 		return nil, errors.New("there is no object associated with the nil hash")
 	}
-	objPath, objName := objectName(h, filepath.Join(s.ArchiveDir, smallObjectStorageDir), false)
+	objPath, objName := objectName(h, filepath.Join(s.ArchiveDir, subpath, smallObjectStorageDir), false)
 	if r, err := os.Open(filepath.Join(objPath, objName)); err == nil {
 		return r, nil
 	} else if !os.IsNotExist(err) {
 		return nil, fmt.Errorf("failure opening the object storage location: %w", err)
 	}
 	// The object was not found in the small object storage; look in the large object storage instead...
-	objPath, objName = objectName(h, filepath.Join(s.ArchiveDir, largeObjectStorageDir), true)
+	objPath, objName = objectName(h, filepath.Join(s.ArchiveDir, subpath, largeObjectStorageDir), true)
 	reader, err := os.Open(filepath.Join(objPath, objName))
 	if err != nil {
 		return nil, err
@@ -413,7 +444,7 @@ func (s *LocalFiles) CachePathInfo(ctx context.Context, p snapshot.Path, info os
 	if err := os.MkdirAll(cacheDir, 0700); err != nil {
 		return fmt.Errorf("failure creating the cache dir for %q: %v", p, err)
 	}
-	if err := os.Remove(cachePath); !os.IsNotExist(err) {
+	if err := os.Remove(cachePath); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failure removing the old cache entry for %q: %v", p, err)
 	}
 
@@ -504,3 +535,448 @@ func (s *LocalFiles) UpdateSignatureForIdentity(ctx context.Context, id *snapsho
 	}
 	return os.WriteFile(idPath, []byte(h.String()), 0700)
 }
+
+// pathKeyedFile returns the location of a file under the given subdirectory
+// of the archive that holds data keyed by the given path.
+func (s *LocalFiles) pathKeyedFile(p snapshot.Path, subdir string) (dir string, name string, err error) {
+	pathHash, err := snapshot.NewHash(strings.NewReader(string(p)))
+	if err != nil {
+		return "", "", fmt.Errorf("failure hashing the path name %q: %v", p, err)
+	}
+	if pathHash == nil {
+		return "", "", fmt.Errorf("unexpected nil hash for the path %q", p)
+	}
+	dir, name = objectName(pathHash, filepath.Join(s.ArchiveDir, subdir), false)
+	return dir, name, nil
+}
+
+func (s *LocalFiles) pendingMergeFile(p snapshot.Path) (dir string, name string, err error) {
+	return s.pathKeyedFile(p, "pendingMerges")
+}
+
+// readHashList reads a file containing one snapshot hash per line.
+//
+// If the file does not exist, then the returned slice is empty.
+func readHashList(path string) ([]*snapshot.Hash, error) {
+	bs, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var hashes []*snapshot.Hash
+	for _, line := range strings.Split(string(bs), "\n") {
+		h, err := snapshot.ParseHash(line)
+		if err != nil {
+			return nil, fmt.Errorf("failure parsing the hash %q: %v", line, err)
+		}
+		if h != nil {
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes, nil
+}
+
+// writeHashList writes the given snapshot hashes to a file, one per line.
+//
+// If the list is empty, then the file is removed.
+func writeHashList(dir, name string, hashes []*snapshot.Hash) error {
+	path := filepath.Join(dir, name)
+	if len(hashes) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var lines []string
+	for _, h := range hashes {
+		lines = append(lines, h.String())
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600)
+}
+
+// PendingMerge returns the parents recorded for a merge into the given path
+// that is still waiting on conflicts to be manually resolved.
+//
+// If there is no such merge, then the returned slice is empty.
+func (s *LocalFiles) PendingMerge(ctx context.Context, p snapshot.Path) ([]*snapshot.Hash, error) {
+	mergeDir, mergeFile, err := s.pendingMergeFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("failure constructing the pending merge path for %q: %v", p, err)
+	}
+	parents, err := readHashList(filepath.Join(mergeDir, mergeFile))
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the pending merge for %q: %v", p, err)
+	}
+	return parents, nil
+}
+
+// UpdatePendingMerge records the parents of a merge into the given path
+// that is waiting on conflicts to be manually resolved.
+//
+// Passing an empty list of parents clears any pending merge for the path.
+func (s *LocalFiles) UpdatePendingMerge(ctx context.Context, p snapshot.Path, parents []*snapshot.Hash) error {
+	mergeDir, mergeFile, err := s.pendingMergeFile(p)
+	if err != nil {
+		return fmt.Errorf("failure constructing the pending merge path for %q: %v", p, err)
+	}
+	if err := writeHashList(mergeDir, mergeFile, parents); err != nil {
+		return fmt.Errorf("failure updating the pending merge for %q: %v", p, err)
+	}
+	return nil
+}
+
+func (s *LocalFiles) pendingMergeAnnotationFile(p snapshot.Path) (dir string, name string, err error) {
+	return s.pathKeyedFile(p, "pendingMergeAnnotations")
+}
+
+// PendingMergeAnnotation returns the annotation to record on the result
+// of a merge into the given path once its conflicts have been manually
+// resolved.
+//
+// If there is no such annotation, then the returned string is empty.
+func (s *LocalFiles) PendingMergeAnnotation(ctx context.Context, p snapshot.Path) (string, error) {
+	annotationDir, annotationFile, err := s.pendingMergeAnnotationFile(p)
+	if err != nil {
+		return "", fmt.Errorf("failure constructing the pending merge annotation path for %q: %v", p, err)
+	}
+	bs, err := os.ReadFile(filepath.Join(annotationDir, annotationFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failure reading the pending merge annotation for %q: %v", p, err)
+	}
+	return string(bs), nil
+}
+
+// UpdatePendingMergeAnnotation records the annotation to add to the result
+// of a merge into the given path that is waiting on conflicts to be
+// manually resolved.
+//
+// Passing an empty annotation clears any pending annotation for the path.
+func (s *LocalFiles) UpdatePendingMergeAnnotation(ctx context.Context, p snapshot.Path, annotation string) error {
+	annotationDir, annotationFile, err := s.pendingMergeAnnotationFile(p)
+	if err != nil {
+		return fmt.Errorf("failure constructing the pending merge annotation path for %q: %v", p, err)
+	}
+	path := filepath.Join(annotationDir, annotationFile)
+	if len(annotation) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failure clearing the pending merge annotation for %q: %v", p, err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(annotationDir, 0700); err != nil {
+		return fmt.Errorf("failure creating the pending merge annotations dir for %q: %v", p, err)
+	}
+	if err := os.WriteFile(path, []byte(annotation), 0600); err != nil {
+		return fmt.Errorf("failure updating the pending merge annotation for %q: %v", p, err)
+	}
+	return nil
+}
+
+func (s *LocalFiles) pendingMergeSideFilesFile(p snapshot.Path) (dir string, name string, err error) {
+	return s.pathKeyedFile(p, "pendingMergeSideFiles")
+}
+
+// PendingMergeSideFiles returns the paths of the side files that were
+// written next to conflicted files during a merge into the given path
+// that is still waiting on conflicts to be manually resolved.
+//
+// If there are no such side files, then the returned slice is empty.
+func (s *LocalFiles) PendingMergeSideFiles(ctx context.Context, p snapshot.Path) ([]snapshot.Path, error) {
+	sideFilesDir, sideFilesFile, err := s.pendingMergeSideFilesFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("failure constructing the pending merge side files path for %q: %v", p, err)
+	}
+	bs, err := os.ReadFile(filepath.Join(sideFilesDir, sideFilesFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the pending merge side files for %q: %v", p, err)
+	}
+	var sideFiles []snapshot.Path
+	for _, line := range strings.Split(string(bs), "\n") {
+		if len(line) > 0 {
+			sideFiles = append(sideFiles, snapshot.Path(line))
+		}
+	}
+	return sideFiles, nil
+}
+
+// UpdatePendingMergeSideFiles records the paths of the side files written
+// next to conflicted files during a merge into the given path.
+//
+// Passing an empty list of paths clears any pending side files for the path.
+func (s *LocalFiles) UpdatePendingMergeSideFiles(ctx context.Context, p snapshot.Path, sideFiles []snapshot.Path) error {
+	sideFilesDir, sideFilesFile, err := s.pendingMergeSideFilesFile(p)
+	if err != nil {
+		return fmt.Errorf("failure constructing the pending merge side files path for %q: %v", p, err)
+	}
+	path := filepath.Join(sideFilesDir, sideFilesFile)
+	if len(sideFiles) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failure clearing the pending merge side files for %q: %v", p, err)
+		}
+		return nil
+	}
+	var lines []string
+	for _, sideFile := range sideFiles {
+		lines = append(lines, string(sideFile))
+	}
+	if err := os.MkdirAll(sideFilesDir, 0700); err != nil {
+		return fmt.Errorf("failure creating the pending merge side files dir for %q: %v", p, err)
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		return fmt.Errorf("failure updating the pending merge side files for %q: %v", p, err)
+	}
+	return nil
+}
+
+func (s *LocalFiles) stashesFile(p snapshot.Path) (dir string, name string, err error) {
+	return s.pathKeyedFile(p, "stashes")
+}
+
+// Stashes returns the snapshots of the local changes that were stashed
+// away from the given path, starting with the most recent.
+func (s *LocalFiles) Stashes(ctx context.Context, p snapshot.Path) ([]*snapshot.Hash, error) {
+	stashesDir, stashesFile, err := s.stashesFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("failure constructing the stashes path for %q: %v", p, err)
+	}
+	stashes, err := readHashList(filepath.Join(stashesDir, stashesFile))
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the stashes for %q: %v", p, err)
+	}
+	return stashes, nil
+}
+
+// UpdateStashes records the snapshots of the local changes that were
+// stashed away from the given path, starting with the most recent.
+func (s *LocalFiles) UpdateStashes(ctx context.Context, p snapshot.Path, stashes []*snapshot.Hash) error {
+	stashesDir, stashesFile, err := s.stashesFile(p)
+	if err != nil {
+		return fmt.Errorf("failure constructing the stashes path for %q: %v", p, err)
+	}
+	if err := writeHashList(stashesDir, stashesFile, stashes); err != nil {
+		return fmt.Errorf("failure updating the stashes for %q: %v", p, err)
+	}
+	return nil
+}
+
+func (s *LocalFiles) generationFile(h *snapshot.Hash) (dir string, name string) {
+	return objectName(h, filepath.Join(s.ArchiveDir, "generations"), false)
+}
+
+// CachedGeneration returns the previously cached generation number for the
+// given snapshot, if there is one.
+//
+// Since snapshots are immutable, so are their generation numbers, and
+// thus the cached values never have to be invalidated.
+func (s *LocalFiles) CachedGeneration(ctx context.Context, h *snapshot.Hash) (uint64, bool) {
+	genDir, genFile := s.generationFile(h)
+	bs, err := os.ReadFile(filepath.Join(genDir, genFile))
+	if err != nil {
+		return 0, false
+	}
+	gen, err := strconv.ParseUint(string(bs), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return gen, true
+}
+
+// CacheGeneration caches the generation number for the given snapshot.
+func (s *LocalFiles) CacheGeneration(ctx context.Context, h *snapshot.Hash, gen uint64) error {
+	genDir, genFile := s.generationFile(h)
+	if err := os.MkdirAll(genDir, 0700); err != nil {
+		return fmt.Errorf("failure creating the generations dir for %q: %v", h, err)
+	}
+	return os.WriteFile(filepath.Join(genDir, genFile), []byte(strconv.FormatUint(gen, 10)), 0600)
+}
+
+func (s *LocalFiles) annotationsFile(h *snapshot.Hash) (dir string, name string) {
+	return objectName(h, filepath.Join(s.ArchiveDir, "annotations"), false)
+}
+
+// Annotations returns the annotations recorded for the given snapshot.
+//
+// Annotations are free-form, single-line notes about a snapshot, such as
+// where its changes were copied from. They are stored alongside, rather
+// than inside, the snapshot, so they do not affect its hash.
+func (s *LocalFiles) Annotations(ctx context.Context, h *snapshot.Hash) ([]string, error) {
+	annotationsDir, annotationsFile := s.annotationsFile(h)
+	bs, err := os.ReadFile(filepath.Join(annotationsDir, annotationsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the annotations for %q: %v", h, err)
+	}
+	var annotations []string
+	for _, line := range strings.Split(string(bs), "\n") {
+		if len(line) > 0 {
+			annotations = append(annotations, line)
+		}
+	}
+	return annotations, nil
+}
+
+// AddAnnotation records an annotation for the given snapshot.
+//
+// Newlines in the annotation are replaced with spaces.
+func (s *LocalFiles) AddAnnotation(ctx context.Context, h *snapshot.Hash, annotation string) error {
+	annotationsDir, annotationsFile := s.annotationsFile(h)
+	if err := os.MkdirAll(annotationsDir, 0700); err != nil {
+		return fmt.Errorf("failure creating the annotations dir for %q: %v", h, err)
+	}
+	out, err := os.OpenFile(filepath.Join(annotationsDir, annotationsFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failure opening the annotations for %q: %v", h, err)
+	}
+	line := strings.ReplaceAll(annotation, "\n", " ") + "\n"
+	if _, err := out.WriteString(line); err != nil {
+		out.Close()
+		return fmt.Errorf("failure writing the annotation for %q: %v", h, err)
+	}
+	return out.Close()
+}
+
+const sparseCheckoutsDir = "sparseCheckouts"
+
+// LocalFiles supports sparse checkouts, which snapshotting only detects
+// with a type assertion, so make sure that it keeps doing so.
+var _ snapshot.SparseStorage = (*LocalFiles)(nil)
+
+func (s *LocalFiles) sparsePatternsFile(p snapshot.Path) (dir string, name string, err error) {
+	return s.pathKeyedFile(p, sparseCheckoutsDir)
+}
+
+// hasSparseCheckouts reports whether or not sparse checkout patterns have
+// ever been recorded in the archive, so that looking them up can be
+// skipped in archives that never used sparse checkouts.
+func (s *LocalFiles) hasSparseCheckouts() bool {
+	_, err := os.Stat(filepath.Join(s.ArchiveDir, sparseCheckoutsDir))
+	return err == nil
+}
+
+// SparsePatterns returns the sparse checkout patterns recorded for the
+// given path.
+//
+// If the path is not the root of a sparse checkout, then the returned
+// patterns are empty.
+func (s *LocalFiles) SparsePatterns(ctx context.Context, p snapshot.Path) (snapshot.SparsePatterns, error) {
+	if !s.hasSparseCheckouts() {
+		return nil, nil
+	}
+	sparseDir, sparseFile, err := s.sparsePatternsFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("failure constructing the sparse patterns path for %q: %v", p, err)
+	}
+	bs, err := os.ReadFile(filepath.Join(sparseDir, sparseFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failure reading the sparse patterns for %q: %v", p, err)
+	}
+	var patterns snapshot.SparsePatterns
+	for _, line := range strings.Split(string(bs), "\n") {
+		if len(line) > 0 {
+			patterns = append(patterns, line)
+		}
+	}
+	return patterns, nil
+}
+
+// UpdateSparsePatterns records the sparse checkout patterns for the given
+// path.
+//
+// Passing an empty list of patterns makes the path a full checkout again.
+func (s *LocalFiles) UpdateSparsePatterns(ctx context.Context, p snapshot.Path, patterns snapshot.SparsePatterns) error {
+	if err := patterns.Validate(); err != nil {
+		return err
+	}
+	sparseDir, sparseFile, err := s.sparsePatternsFile(p)
+	if err != nil {
+		return fmt.Errorf("failure constructing the sparse patterns path for %q: %v", p, err)
+	}
+	sparsePath := filepath.Join(sparseDir, sparseFile)
+	if len(patterns) == 0 {
+		if err := os.Remove(sparsePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failure removing the sparse patterns for %q: %v", p, err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(sparseDir, 0700); err != nil {
+		return fmt.Errorf("failure creating the sparse patterns dir for %q: %v", p, err)
+	}
+	return os.WriteFile(sparsePath, []byte(strings.Join(patterns, "\n")), 0600)
+}
+
+// FindSparsePatterns returns the root and the patterns of the innermost
+// sparse checkout containing the given path.
+//
+// If the path is not part of a sparse checkout, then the returned
+// patterns are empty.
+func (s *LocalFiles) FindSparsePatterns(ctx context.Context, p snapshot.Path) (snapshot.Path, snapshot.SparsePatterns, error) {
+	if !s.hasSparseCheckouts() {
+		return "", nil, nil
+	}
+	for root := p; ; {
+		patterns, err := s.SparsePatterns(ctx, root)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(patterns) > 0 {
+			return root, patterns, nil
+		}
+		parent := snapshot.Path(filepath.Dir(string(root)))
+		if parent == root {
+			return "", nil, nil
+		}
+		root = parent
+	}
+}
+
+// Unmaterialized returns the snapshots of any children of the given
+// directory that were intentionally left out of the local filesystem
+// by the sparse checkout with the given root and patterns.
+//
+// These are the children of the latest snapshot of the directory that are
+// not selected by the patterns of the sparse checkout containing it.
+func (s *LocalFiles) Unmaterialized(ctx context.Context, p, root snapshot.Path, patterns snapshot.SparsePatterns) (snapshot.Tree, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	h, f, err := s.FindSnapshot(ctx, p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failure looking up the previous snapshot of %q: %v", p, err)
+	}
+	if !f.IsDir() {
+		return nil, nil
+	}
+	tree, err := s.ListDirectorySnapshotContents(ctx, h, f)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(string(root), string(p))
+	if err != nil {
+		return nil, fmt.Errorf("failure resolving %q relative to the sparse checkout %q: %v", p, root, err)
+	}
+	unmaterialized := make(snapshot.Tree)
+	for child, childHash := range tree {
+		if !patterns.Includes(snapshot.Path(rel).Join(child)) {
+			unmaterialized[child] = childHash
+		}
+	}
+	return unmaterialized, nil
+}
@@ -18,6 +18,7 @@ package storage
 import (
 	"bytes"
 	"context"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -364,3 +365,121 @@ func TestDirSnapshot(t *testing.T) {
 		t.Errorf("unexpected hash and/or snapshot for a removed file: hash %q, snapshot %+v", file2Hash3, file2Snapshot3)
 	}
 }
+
+func TestCachePathInfo(t *testing.T) {
+	dir := t.TempDir()
+	s := &LocalFiles{ArchiveDir: filepath.Join(dir, "archive")}
+	file := filepath.Join(dir, "example.txt")
+	p := snapshot.Path(file)
+	if err := os.WriteFile(file, []byte("Hello, World!"), 0700); err != nil {
+		t.Fatalf("failure creating the example file: %v", err)
+	}
+	info, err := os.Lstat(file)
+	if err != nil {
+		t.Fatalf("failure reading the file metadata for %q: %v", file, err)
+	}
+	// Caching the same path repeatedly replaces the previous entry.
+	for i := 0; i < 2; i++ {
+		if err := s.CachePathInfo(context.Background(), p, info); err != nil {
+			t.Fatalf("failure caching the file information for %q: %v", file, err)
+		}
+		if !s.PathInfoMatchesCache(context.Background(), p, info) {
+			t.Errorf("missing cache entry for %q after caching it %d times", file, i+1)
+		}
+	}
+	if err := os.WriteFile(file, []byte("Goodbye, World!"), 0700); err != nil {
+		t.Fatalf("failure updating the example file: %v", err)
+	}
+	updated, err := os.Lstat(file)
+	if err != nil {
+		t.Fatalf("failure reading the file metadata for %q: %v", file, err)
+	}
+	if s.PathInfoMatchesCache(context.Background(), p, updated) {
+		t.Errorf("unexpected cache match for the updated file %q", file)
+	}
+}
+
+func TestStaging(t *testing.T) {
+	ctx := context.Background()
+	s := &LocalFiles{ArchiveDir: filepath.Join(t.TempDir(), "archive")}
+	st, err := s.Staging("example")
+	if err != nil {
+		t.Fatalf("failure creating the staging area: %v", err)
+	}
+	small := []byte("Hello, World!")
+	large := bytes.Repeat([]byte("0123456789abcdef"), 128*1024)
+	var staged []*snapshot.Hash
+	for _, contents := range [][]byte{small, large} {
+		h, err := st.StoreObject(ctx, int64(len(contents)), bytes.NewReader(contents))
+		if err != nil {
+			t.Fatalf("failure staging an object: %v", err)
+		}
+		if !st.HasObject(ctx, h) {
+			t.Errorf("missing the staged object %q", h)
+		}
+		if _, err := s.ReadObject(ctx, h); err == nil {
+			t.Errorf("unexpected access to the object %q before it was published", h)
+		}
+		staged = append(staged, h)
+	}
+	if _, err := s.Staging("../escape"); err == nil {
+		t.Error("unexpected success creating a staging area outside of the staging dir")
+	}
+
+	// Reopening the staging area keeps the previously staged objects.
+	st, err = s.Staging("example")
+	if err != nil {
+		t.Fatalf("failure reopening the staging area: %v", err)
+	}
+
+	// Objects can be published temporarily and then withdrawn.
+	withdraw, err := st.PublishObjects(ctx, staged)
+	if err != nil {
+		t.Fatalf("failure temporarily publishing the staged objects: %v", err)
+	}
+	for _, h := range staged {
+		r, err := s.ReadObject(ctx, h)
+		if err != nil {
+			t.Errorf("failure reading the temporarily published object %q: %v", h, err)
+			continue
+		}
+		r.Close()
+	}
+	if err := withdraw(); err != nil {
+		t.Fatalf("failure withdrawing the temporarily published objects: %v", err)
+	}
+	for _, h := range staged {
+		if _, err := s.ReadObject(ctx, h); err == nil {
+			t.Errorf("unexpected access to the withdrawn object %q", h)
+		}
+		if !st.HasObject(ctx, h) {
+			t.Errorf("the withdrawn object %q is no longer staged", h)
+		}
+	}
+	if err := st.Publish(ctx); err != nil {
+		t.Fatalf("failure publishing the staged objects: %v", err)
+	}
+	for i, contents := range [][]byte{small, large} {
+		r, err := s.ReadObject(ctx, staged[i])
+		if err != nil {
+			t.Fatalf("failure reading the published object %q: %v", staged[i], err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("failure reading the published object %q: %v", staged[i], err)
+		}
+		if !bytes.Equal(got, contents) {
+			t.Errorf("unexpected contents for the published object %q", staged[i])
+		}
+		if st.HasObject(ctx, staged[i]) {
+			t.Errorf("the published object %q is still staged", staged[i])
+		}
+	}
+	if err := st.Remove(); err != nil {
+		t.Fatalf("failure removing the staging area: %v", err)
+	}
+	if _, err := os.Stat(st.Dir()); !os.IsNotExist(err) {
+		t.Errorf("the staging area %q was not removed: %v", st.Dir(), err)
+	}
+}